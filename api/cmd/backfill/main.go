@@ -0,0 +1,102 @@
+// Backfill loads a CSV or NDJSON file of historical events into postgres, bypassing the API. Run it again with the
+// same file to resume an interrupted backfill.
+//
+//	go run ./api/cmd/backfill -file events.csv
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/dustin/go-humanize"
+	"github.com/penthious/catchall/business/adapters"
+	"github.com/penthious/catchall/business/core/backfill"
+	"github.com/penthious/catchall/foundation/database"
+	"github.com/rs/zerolog"
+)
+
+func main() {
+	log := zerolog.New(os.Stdout).With().Timestamp().Logger()
+
+	if err := run(log); err != nil {
+		log.Error().Err(err).Msg("backfill failed")
+		os.Exit(1)
+	}
+}
+
+func run(log zerolog.Logger) error {
+	file := flag.String("file", "", "the CSV (.csv) or NDJSON (.ndjson, .jsonl) event file")
+	format := flag.String("format", "", "csv or ndjson, taken from the extension of the file by default")
+	source := flag.String("source", "", "the name the checkpoint of the file is kept under, its absolute path by default")
+	batch := flag.Int("batch", 100_000, "the number of domains loaded per batch")
+	host := flag.String("host", "localhost:5434", "the host of the postgres primary")
+	user := flag.String("user", "postgres", "the postgres user")
+	password := flag.String("password", "example", "the postgres password")
+	name := flag.String("db", "postgres", "the postgres database")
+	tlsMode := flag.String("tls-mode", "disable", "disable, require, verify-ca or verify-full")
+	rootCA := flag.String("root-ca", "", "the PEM bundle of the CAs the postgres certificate is verified against")
+	flag.Parse()
+
+	if *file == "" {
+		flag.Usage()
+		return errors.New("-file is required")
+	}
+
+	db, err := database.Open(database.Config{
+		User:         *user,
+		Password:     *password,
+		Host:         *host,
+		Name:         *name,
+		TLSMode:      database.TLSMode(*tlsMode),
+		RootCAFile:   *rootCA,
+		MaxOpenConns: 2,
+		MaxIdleConns: 1,
+		MaxIdleTime:  time.Minute,
+	})
+	if err != nil {
+		return fmt.Errorf("opening database: %w", err)
+	}
+	defer db.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := database.StatusCheck(ctx, db); err != nil {
+		return fmt.Errorf("database not ready: %w", err)
+	}
+
+	// An interrupt stops the backfill after loading what was read so far, the next run resumes from there.
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	progress, err := backfill.Run(ctx, adapters.NewPostgresBackfill(db), *file, backfill.Config{
+		Source:       *source,
+		Format:       backfill.Format(*format),
+		BatchDomains: *batch,
+		Progress: func(p backfill.Progress) {
+			log.Info().
+				Str("progress", fmt.Sprintf("%.1f%%", p.Percent())).
+				Int64("offset", p.Offset).
+				Int64("events", p.Events).
+				Int64("skipped", p.Skipped).
+				Int("batches", p.Batches).
+				Str("rate", humanize.Bytes(uint64(p.Rate()))+"/s").
+				Msg("backfilling")
+		},
+	})
+	if err != nil {
+		return err
+	}
+
+	log.Info().
+		Int64("events", progress.Events).
+		Int64("skipped", progress.Skipped).
+		Dur("took", progress.Elapsed).
+		Msg("backfill done")
+	return nil
+}
@@ -20,8 +20,8 @@ func main() {
 	fmt.Println("About to send", humanize.Comma(int64(eventLimit)), "events")
 	start := time.Now()
 	for i := 0; i < eventLimit; i++ {
+		wg.Add(1)
 		go func() {
-			wg.Add(1)
 			e := bus.GetEvent()
 			req, err := http.NewRequest(http.MethodPut, fmt.Sprintf("http://localhost:7000/v1/events/%s/%s", e.Domain, e.Type), nil)
 			if err != nil {
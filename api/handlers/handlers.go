@@ -2,6 +2,7 @@ package handlers
 
 import (
 	v1 "github.com/penthious/catchall/api/handlers/v1"
+	"github.com/penthious/catchall/business/core/stream"
 	"github.com/penthious/catchall/business/ports"
 	"github.com/penthious/catchall/foundation/web"
 	"github.com/penthious/catchall/foundation/web/middleware"
@@ -14,8 +15,16 @@ import (
 type APIMuxConfig struct {
 	Log         *zerolog.Logger
 	DB          ports.DB
+	Webhooks    ports.WebhookStore
+	Broker      *stream.Broker
+	AuditLog    ports.AuditLog
+	APIKeys     map[string]string
+	ClientCerts map[string]string
 	ServiceName string
 	Shutdown    chan os.Signal
+
+	// AuditEventSample records one in every AuditEventSample ingested events in the audit log, every event when 0.
+	AuditEventSample int
 }
 
 // APIMux constructs a http.Handler with all application routes defined.
@@ -28,6 +37,7 @@ func APIMux(cfg APIMuxConfig) http.Handler {
 		cfg.Log,
 		middleware.LogRequest(),
 		middleware.Errors(), // after this point any errors will be lost
+		middleware.Authenticate(cfg.APIKeys, cfg.ClientCerts),
 		// Any extra middleware can be added here:
 		// cors
 		// ratelimiter
@@ -38,7 +48,12 @@ func APIMux(cfg APIMuxConfig) http.Handler {
 	v1.Routes(
 		app,
 		v1.Options{
-			DB: cfg.DB,
+			DB:       cfg.DB,
+			Webhooks: cfg.Webhooks,
+			Broker:   cfg.Broker,
+			AuditLog: cfg.AuditLog,
+
+			AuditEventSample: cfg.AuditEventSample,
 		},
 	)
 
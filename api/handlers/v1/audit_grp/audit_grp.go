@@ -0,0 +1,80 @@
+// Package audit_grp maintains the group of handlers for the audit log.
+package audit_grp
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/penthious/catchall/business/models"
+	"github.com/penthious/catchall/business/ports"
+	"github.com/penthious/catchall/foundation/web"
+	webErr "github.com/penthious/catchall/foundation/web/errors"
+)
+
+const (
+	// defaultLimit is the number of entries returned when the client doesn't ask for a limit.
+	defaultLimit = 100
+	// maxLimit caps the number of entries returned at once.
+	maxLimit = 1_000
+)
+
+// Handlers manages the set of audit endpoints.
+type Handlers struct {
+	Log ports.AuditLog
+}
+
+// Query returns the audit entries, oldest first. The query parameters are
+//   - from: RFC 3339 time, only entries at or after it
+//   - to: RFC 3339 time, only entries before it
+//   - action: only entries for this action, for example domain.override.set
+//   - target: only entries for this target, a domain name or webhook id
+//   - limit: the number of entries, 100 by default and at most 1000
+func (h Handlers) Query(ctx echo.Context) error {
+	q := models.AuditQuery{
+		Action: ctx.QueryParam("action"),
+		Target: ctx.QueryParam("target"),
+		Limit:  defaultLimit,
+	}
+
+	var err error
+	if q.From, err = parseTime(ctx, "from"); err != nil {
+		return webErr.NewRequestError(err, http.StatusBadRequest)
+	}
+	if q.To, err = parseTime(ctx, "to"); err != nil {
+		return webErr.NewRequestError(err, http.StatusBadRequest)
+	}
+	if !q.From.IsZero() && !q.To.IsZero() && !q.From.Before(q.To) {
+		return webErr.NewRequestError(fmt.Errorf("from must be before to"), http.StatusBadRequest)
+	}
+
+	if v := ctx.QueryParam("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > maxLimit {
+			return webErr.NewRequestError(fmt.Errorf("limit must be between 1 and %d", maxLimit), http.StatusBadRequest)
+		}
+		q.Limit = n
+	}
+
+	entries, err := h.Log.Query(q)
+	if err != nil {
+		return fmt.Errorf("error querying audit log: %w", err)
+	}
+
+	return web.Respond(ctx, http.StatusOK, entries)
+}
+
+func parseTime(ctx echo.Context, name string) (time.Time, error) {
+	v := ctx.QueryParam(name)
+	if v == "" {
+		return time.Time{}, nil
+	}
+
+	t, err := time.Parse(time.RFC3339, v)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("%s must be an RFC 3339 time", name)
+	}
+	return t, nil
+}
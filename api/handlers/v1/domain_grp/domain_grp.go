@@ -2,9 +2,18 @@
 package domain_grp
 
 import (
+	"encoding/json"
+	"errors"
 	"fmt"
+	"github.com/penthious/catchall/business/core/audit"
+	"github.com/penthious/catchall/business/models"
 	"github.com/penthious/catchall/business/ports"
+	webErr "github.com/penthious/catchall/foundation/web/errors"
+	"io"
 	"net/http"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/labstack/echo/v4"
 	"github.com/mailgun/catchall"
@@ -13,53 +22,495 @@ import (
 
 // Handlers manages the set of user endpoints.
 type Handlers struct {
-	DB ports.DB
+	DB    ports.DB
+	Audit *audit.Recorder
 }
 
-// Get queries the database for a domain and returns the different types of catchall events.
+// Get queries the database for a domain and returns the different types of catchall events. A domain that has never
+// been seen is unknown like one without enough events yet, the X-Catchall-Seen header tells the two apart.
 func (h Handlers) Get(ctx echo.Context) error {
 	domainName := ctx.Param("domain_name")
 
+	seen := true
 	domain, err := h.DB.Query(domainName)
+	if errors.Is(err, ports.ErrNotFound) {
+		seen, err = false, nil
+	}
 	if err != nil {
 		return fmt.Errorf("error getting domain: %w", err)
 	}
 
-	if domain.Bounced > 0 {
-		return web.Respond(ctx, http.StatusOK, "not catch-all")
-	}
-
-	if domain.Delivered >= 1_000 {
-		return web.Respond(ctx, http.StatusOK, "catch-all")
+	// The body stays a bare status for existing clients, whether the domain was seen and an active override are
+	// surfaced in the headers.
+	ctx.Response().Header().Set("X-Catchall-Seen", strconv.FormatBool(seen))
+	now := web.GetNow(ctx)
+	if domain.Override.Active(now) {
+		ctx.Response().Header().Set("X-Catchall-Override-Reason", domain.Override.Reason)
+		ctx.Response().Header().Set("X-Catchall-Override-Expires", domain.Override.ExpiresAt.Format(time.RFC3339))
 	}
 
-	return web.Respond(ctx, http.StatusOK, "unknown")
+	return web.Respond(ctx, http.StatusOK, domain.StatusAt(now))
 }
 
-// PutDelivered updates the delivered count for a domain.
+// PutDelivered updates the delivered count for a domain. It answers 202 Accepted instead of 204 when the event was
+// queued to be counted in the background, or spooled to be counted once the database is back. An event ID can be given
+// as the event_id query parameter or the Idempotency-Key header, an event whose ID was already counted is answered
+// with a 204 and X-Catchall-Duplicate: true without being counted again.
 func (h Handlers) PutDelivered(ctx echo.Context) error {
 	event := catchall.Event{
 		Type:   catchall.TypeDelivered,
 		Domain: ctx.Param("domain_name"),
 	}
 
-	if err := h.DB.Insert(event); err != nil {
+	err := h.insert(ctx, event)
+	if errors.Is(err, ports.ErrDuplicate) {
+		return duplicate(ctx)
+	}
+	if accepted(err) {
+		return web.Respond(ctx, http.StatusAccepted, nil)
+	}
+	if err != nil {
 		return fmt.Errorf("error saving delivered: %w", err)
 	}
 
 	return web.Respond(ctx, http.StatusNoContent, nil)
 }
 
-// PutBounced updates the bounced count for a domain.
+// PutBounced updates the bounced count for a domain, or answers 202 Accepted when the event was queued or spooled.
+// Events with an ID are counted once like in PutDelivered.
 func (h Handlers) PutBounced(ctx echo.Context) error {
 	event := catchall.Event{
 		Type:   catchall.TypeBounced,
 		Domain: ctx.Param("domain_name"),
 	}
 
-	if err := h.DB.Insert(event); err != nil {
+	err := h.insert(ctx, event)
+	if errors.Is(err, ports.ErrDuplicate) {
+		return duplicate(ctx)
+	}
+	if accepted(err) {
+		return web.Respond(ctx, http.StatusAccepted, nil)
+	}
+	if err != nil {
 		return fmt.Errorf("error saving bounced: %w", err)
 	}
 
 	return web.Respond(ctx, http.StatusNoContent, nil)
 }
+
+// insert inserts the event at most once when the request carries an event ID and the DB is a ports.IdempotentDB. The
+// events that are counted, now or later, are recorded in the audit log at its event sampling rate.
+func (h Handlers) insert(ctx echo.Context, event catchall.Event) error {
+	id := ctx.QueryParam("event_id")
+	if id == "" {
+		id = ctx.Request().Header.Get("Idempotency-Key")
+	}
+
+	var err error
+	if db, ok := h.DB.(ports.IdempotentDB); ok && id != "" {
+		err = db.InsertOnce(id, event)
+	} else {
+		err = h.DB.Insert(event)
+	}
+
+	if err == nil || accepted(err) {
+		h.Audit.RecordEvent(web.GetActor(ctx), web.GetTraceID(ctx), event.Domain, event.Type, id)
+	}
+	return err
+}
+
+// duplicate acknowledges an event that was already counted.
+func duplicate(ctx echo.Context) error {
+	ctx.Response().Header().Set("X-Catchall-Duplicate", "true")
+	return web.Respond(ctx, http.StatusNoContent, nil)
+}
+
+// accepted reports whether the error of an Insert means the event is counted later.
+func accepted(err error) bool {
+	return errors.Is(err, ports.ErrQueued) || errors.Is(err, ports.ErrSpooled)
+}
+
+const (
+	// defaultListLimit is the page size when the client doesn't ask for one.
+	defaultListLimit = 100
+	// maxListLimit caps the page size of a listing.
+	maxListLimit = 1_000
+	// maxLookupDomains caps the number of domains in a single lookup request.
+	maxLookupDomains = 100_000
+	// maxLookupBytes caps the size of a lookup request body.
+	maxLookupBytes = 32 << 20
+	// lookupBatchSize is the number of domains looked up per query while streaming the response.
+	lookupBatchSize = 1_000
+)
+
+// Classification is the classification of a single domain, Seen is false for a domain no event was ever recorded for.
+type Classification struct {
+	Domain string        `json:"domain"`
+	Status models.Status `json:"status"`
+	Seen   bool          `json:"seen"`
+}
+
+// Lookup classifies every domain in the request body, either a JSON array of domain names or NDJSON with one domain
+// name per line (Content-Type: application/x-ndjson). The classifications are streamed back in request order, in the
+// same format as the request, looking the domains up in batches.
+func (h Handlers) Lookup(ctx echo.Context) error {
+	ndjson := strings.HasPrefix(ctx.Request().Header.Get(echo.HeaderContentType), "application/x-ndjson")
+
+	domains, err := decodeDomains(io.LimitReader(ctx.Request().Body, maxLookupBytes), ndjson)
+	if err != nil {
+		return webErr.NewRequestError(err, http.StatusBadRequest)
+	}
+
+	// Look the first batch up before anything is written, so a database that is down still ends in a proper error.
+	batch := domains[:batchEnd(0, len(domains))]
+	found, err := h.DB.QueryMany(batch)
+	if err != nil {
+		return fmt.Errorf("error looking up domains: %w", err)
+	}
+
+	w := ctx.Response()
+	if ndjson {
+		w.Header().Set(echo.HeaderContentType, "application/x-ndjson")
+	} else {
+		w.Header().Set(echo.HeaderContentType, echo.MIMEApplicationJSONCharsetUTF8)
+	}
+	web.SetStatusCode(ctx, http.StatusOK)
+	w.WriteHeader(http.StatusOK)
+
+	enc := json.NewEncoder(w)
+	if !ndjson {
+		_, _ = w.Write([]byte("["))
+	}
+
+	now := web.GetNow(ctx)
+	for start := 0; ; {
+		for i, domain := range batch {
+			if !ndjson && start+i > 0 {
+				_, _ = w.Write([]byte(","))
+			}
+			d, seen := found[domain]
+			if err := enc.Encode(Classification{Domain: domain, Status: d.StatusAt(now), Seen: seen}); err != nil {
+				return nil
+			}
+		}
+		w.Flush()
+
+		start += len(batch)
+		if start >= len(domains) {
+			break
+		}
+
+		batch = domains[start:batchEnd(start, len(domains))]
+		if found, err = h.DB.QueryMany(batch); err != nil {
+			// The status has already been sent, abort the response so the client can't mistake it for a complete one.
+			log, _ := web.GetLogger(ctx)
+			log.Error().Err(err).Interface("uuid", web.GetTraceID(ctx)).Msg("error looking up domains")
+			panic(http.ErrAbortHandler)
+		}
+	}
+
+	if !ndjson {
+		_, _ = w.Write([]byte("]\n"))
+	}
+
+	return nil
+}
+
+// batchEnd returns the end of the lookup batch starting at start.
+func batchEnd(start int, total int) int {
+	if end := start + lookupBatchSize; end < total {
+		return end
+	}
+	return total
+}
+
+// decodeDomains reads the domain names out of a JSON array or NDJSON body.
+func decodeDomains(r io.Reader, ndjson bool) ([]string, error) {
+	dec := json.NewDecoder(r)
+	if !ndjson {
+		if tok, err := dec.Token(); err != nil || tok != json.Delim('[') {
+			return nil, errors.New("body must be a JSON array of domain names")
+		}
+	}
+
+	domains := make([]string, 0)
+	for ndjson || dec.More() {
+		var domain string
+		if err := dec.Decode(&domain); err != nil {
+			if ndjson && errors.Is(err, io.EOF) {
+				break
+			}
+			return nil, fmt.Errorf("invalid domain at index %d: %w", len(domains), err)
+		}
+		if domain == "" {
+			return nil, fmt.Errorf("empty domain at index %d", len(domains))
+		}
+
+		domains = append(domains, domain)
+		if len(domains) > maxLookupDomains {
+			return nil, fmt.Errorf("too many domains, at most %d can be looked up at once", maxLookupDomains)
+		}
+	}
+
+	if len(domains) == 0 {
+		return nil, errors.New("no domains to look up")
+	}
+
+	return domains, nil
+}
+
+// DomainInfo is everything known about a single domain, the override is left out when none is active.
+type DomainInfo struct {
+	Domain    string        `json:"domain"`
+	Status    models.Status `json:"status"`
+	Bounced   int           `json:"bounced"`
+	Delivered int           `json:"delivered"`
+	LastSeen  time.Time     `json:"last_seen"`
+	Override  *Override     `json:"override,omitempty"`
+}
+
+// Override pins the classification of a domain until it expires.
+type Override struct {
+	Status    models.Status `json:"status"`
+	Reason    string        `json:"reason"`
+	ExpiresAt time.Time     `json:"expires_at"`
+}
+
+// DomainPage is a page of a listing, next_cursor is left out on the last page.
+type DomainPage struct {
+	Domains    []DomainInfo `json:"domains"`
+	NextCursor string       `json:"next_cursor,omitempty"`
+}
+
+// List returns a page of the domains the service knows about. The query parameters are
+//   - status: only list domains with this classification
+//   - min_delivered: only list domains with at least this many deliveries
+//   - has_bounces: true or false, only list domains with or without bounces
+//   - suffix: only list the domain and its subdomains, example.com matches mail.example.com but not ample.com
+//   - sort: id (default), last_seen, delivered or bounced
+//   - order: asc or desc, defaults to asc for id and desc for everything else
+//   - limit: the page size, 100 by default and at most 1000
+//   - cursor: the next_cursor of the previous page
+func (h Handlers) List(ctx echo.Context) error {
+	q, err := parseDomainQuery(ctx)
+	if err != nil {
+		return webErr.NewRequestError(err, http.StatusBadRequest)
+	}
+
+	domains, next, err := h.DB.List(q)
+	if err != nil {
+		return fmt.Errorf("error listing domains: %w", err)
+	}
+
+	page := DomainPage{
+		Domains: make([]DomainInfo, len(domains)),
+	}
+	for i, d := range domains {
+		page.Domains[i] = toDomainInfo(d, q.Filter.Now)
+	}
+	if next != nil {
+		page.NextCursor = next.Encode()
+	}
+
+	return web.Respond(ctx, http.StatusOK, page)
+}
+
+// parseDomainQuery builds the listing query out of the query parameters.
+func parseDomainQuery(ctx echo.Context) (models.DomainQuery, error) {
+	q := models.DomainQuery{
+		Sort:  models.SortID,
+		Limit: defaultListLimit,
+	}
+
+	switch status := models.Status(ctx.QueryParam("status")); status {
+	case "", models.StatusUnknown, models.StatusCatchAll, models.StatusNotCatchAll:
+		q.Filter.Status = status
+	default:
+		return q, fmt.Errorf("unknown status: %s", status)
+	}
+
+	if v := ctx.QueryParam("min_delivered"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			return q, errors.New("min_delivered must be a positive number")
+		}
+		q.Filter.MinDelivered = n
+	}
+
+	if v := ctx.QueryParam("has_bounces"); v != "" {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return q, errors.New("has_bounces must be true or false")
+		}
+		q.Filter.HasBounces = &b
+	}
+
+	q.Filter.Suffix = strings.TrimPrefix(strings.ToLower(ctx.QueryParam("suffix")), ".")
+	q.Filter.Now = web.GetNow(ctx)
+
+	switch sort := models.DomainSort(ctx.QueryParam("sort")); sort {
+	case "", models.SortID:
+	case models.SortLastSeen, models.SortDelivered, models.SortBounced:
+		q.Sort = sort
+		q.Desc = true
+	default:
+		return q, fmt.Errorf("unknown sort: %s", sort)
+	}
+
+	switch order := ctx.QueryParam("order"); order {
+	case "":
+	case "asc":
+		q.Desc = false
+	case "desc":
+		q.Desc = true
+	default:
+		return q, fmt.Errorf("unknown order: %s", order)
+	}
+
+	if v := ctx.QueryParam("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > maxListLimit {
+			return q, fmt.Errorf("limit must be between 1 and %d", maxListLimit)
+		}
+		q.Limit = n
+	}
+
+	if v := ctx.QueryParam("cursor"); v != "" {
+		after, err := q.DecodeCursor(v)
+		if err != nil {
+			return q, err
+		}
+		q.After = after
+	}
+
+	return q, nil
+}
+
+// Delete removes every trace of a domain, for instance after a customer migrated their MX.
+func (h Handlers) Delete(ctx echo.Context) error {
+	domainName := ctx.Param("domain_name")
+
+	before, err := h.domainInfo(ctx, domainName)
+	if err != nil {
+		return err
+	}
+
+	if err := h.DB.Delete(domainName); err != nil {
+		return fmt.Errorf("error deleting domain: %w", err)
+	}
+
+	h.Audit.Record(web.GetActor(ctx), web.GetTraceID(ctx), "domain.delete", domainName, before, nil)
+
+	return web.Respond(ctx, http.StatusNoContent, nil)
+}
+
+// Reset wipes the bounced and delivered counts of a domain, its override is kept.
+func (h Handlers) Reset(ctx echo.Context) error {
+	domainName := ctx.Param("domain_name")
+
+	return h.mutate(ctx, "domain.reset", domainName, func() error {
+		if err := h.DB.Reset(domainName); err != nil {
+			return fmt.Errorf("error resetting domain: %w", err)
+		}
+		return nil
+	})
+}
+
+// SetOverride pins the classification of a domain regardless of its counts until the override expires.
+func (h Handlers) SetOverride(ctx echo.Context) error {
+	domainName := ctx.Param("domain_name")
+
+	var o Override
+	if err := ctx.Bind(&o); err != nil {
+		return webErr.NewRequestError(fmt.Errorf("unable to decode payload: %w", err), http.StatusBadRequest)
+	}
+
+	switch o.Status {
+	case models.StatusUnknown, models.StatusCatchAll, models.StatusNotCatchAll:
+	default:
+		return webErr.NewRequestError(fmt.Errorf("unknown status: %s", o.Status), http.StatusBadRequest)
+	}
+	if strings.TrimSpace(o.Reason) == "" {
+		return webErr.NewRequestError(errors.New("reason is required"), http.StatusBadRequest)
+	}
+	if !o.ExpiresAt.After(web.GetNow(ctx)) {
+		return webErr.NewRequestError(errors.New("expires_at must be in the future"), http.StatusBadRequest)
+	}
+
+	override := models.Override{
+		Status:    o.Status,
+		Reason:    o.Reason,
+		ExpiresAt: o.ExpiresAt.UTC(),
+	}
+
+	return h.mutate(ctx, "domain.override.set", domainName, func() error {
+		if err := h.DB.SetOverride(domainName, override); err != nil {
+			return fmt.Errorf("error setting override: %w", err)
+		}
+		return nil
+	})
+}
+
+// ClearOverride removes the override of a domain so it is classified by its counts again.
+func (h Handlers) ClearOverride(ctx echo.Context) error {
+	domainName := ctx.Param("domain_name")
+
+	return h.mutate(ctx, "domain.override.clear", domainName, func() error {
+		if err := h.DB.ClearOverride(domainName); err != nil {
+			return fmt.Errorf("error clearing override: %w", err)
+		}
+		return nil
+	})
+}
+
+// mutate runs the admin action on the domain, records it in the audit log and responds with the new state of the
+// domain.
+func (h Handlers) mutate(ctx echo.Context, action string, domainName string, fn func() error) error {
+	before, err := h.domainInfo(ctx, domainName)
+	if err != nil {
+		return err
+	}
+
+	if err := fn(); err != nil {
+		return err
+	}
+
+	after, err := h.domainInfo(ctx, domainName)
+	if err != nil {
+		return err
+	}
+
+	h.Audit.Record(web.GetActor(ctx), web.GetTraceID(ctx), action, domainName, before, after)
+
+	return web.Respond(ctx, http.StatusOK, after)
+}
+
+// domainInfo returns the current state of the domain. It is read from the primary, the state after an admin operation
+// is read right after the write.
+func (h Handlers) domainInfo(ctx echo.Context, domainName string) (DomainInfo, error) {
+	domain, err := ports.QueryPrimary(h.DB, domainName)
+	if err != nil && !errors.Is(err, ports.ErrNotFound) {
+		return DomainInfo{}, fmt.Errorf("error getting domain: %w", err)
+	}
+	domain.Domain = domainName
+
+	return toDomainInfo(domain, web.GetNow(ctx)), nil
+}
+
+func toDomainInfo(d models.Domain, now time.Time) DomainInfo {
+	info := DomainInfo{
+		Domain:    d.Domain,
+		Status:    d.StatusAt(now),
+		Bounced:   d.Bounced,
+		Delivered: d.Delivered,
+		LastSeen:  d.LastSeen,
+	}
+	if d.Override.Active(now) {
+		info.Override = &Override{
+			Status:    d.Override.Status,
+			Reason:    d.Override.Reason,
+			ExpiresAt: d.Override.ExpiresAt,
+		}
+	}
+	return info
+}
@@ -1,13 +1,25 @@
 package domain_grp
 
 import (
+	"bufio"
+	"encoding/json"
+	"fmt"
 	"net/http"
 	"net/http/httptest"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/labstack/echo/v4"
+	"github.com/mailgun/catchall"
 	"github.com/penthious/catchall/business/adapters"
+	"github.com/penthious/catchall/business/core/audit"
+	"github.com/penthious/catchall/business/core/dedup"
 	"github.com/penthious/catchall/business/models"
+	"github.com/penthious/catchall/business/ports"
+	"github.com/penthious/catchall/foundation/web"
+	webErr "github.com/penthious/catchall/foundation/web/errors"
+	"github.com/rs/zerolog"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -51,7 +63,7 @@ func TestGet(t *testing.T) {
 		}
 
 		want := "not catchall"
-		setEchoPath(c, "/events/:domain_name/delivered", "domain_name", "test")
+		c, rec = newGetContext(e, "test")
 		if err := handler.Get(c); err != nil {
 			t.Fatal(err)
 		}
@@ -68,12 +80,27 @@ func TestGet(t *testing.T) {
 		}
 
 		want := "unknown"
-		setEchoPath(c, "/events/:domain_name/delivered", "domain_name", "test")
+		c, rec = newGetContext(e, "test")
 		if err := handler.Get(c); err != nil {
 			t.Fatal(err)
 		}
 		assert.NotEqual(t, want, rec.Body.String())
 	})
+	t.Run("never seen", func(t *testing.T) {
+		c, rec := newGetContext(e, "never-seen.com")
+		if err := handler.Get(c); err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, http.StatusOK, rec.Code)
+		assert.Contains(t, rec.Body.String(), "unknown")
+		assert.Equal(t, "false", rec.Header().Get("X-Catchall-Seen"))
+
+		c, rec = newGetContext(e, "test")
+		if err := handler.Get(c); err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, "true", rec.Header().Get("X-Catchall-Seen"))
+	})
 }
 
 func TestPutBounced(t *testing.T) {
@@ -91,13 +118,12 @@ func TestPutBounced(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	want := map[string]models.Domain{
-		"test": {
-			Bounced: 1,
-		},
-	}
-
-	assert.Equal(t, want, db.Storage)
+	assert.Len(t, db.Storage, 1)
+	got := db.Storage["test"]
+	assert.Equal(t, "test", got.Domain)
+	assert.Equal(t, 1, got.Bounced)
+	assert.Equal(t, 0, got.Delivered)
+	assert.False(t, got.LastSeen.IsZero())
 
 }
 
@@ -116,13 +142,421 @@ func TestPutDelivered(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	want := map[string]models.Domain{
-		"test": {
-			Delivered: 1,
-		},
+	assert.Len(t, db.Storage, 1)
+	got := db.Storage["test"]
+	assert.Equal(t, "test", got.Domain)
+	assert.Equal(t, 0, got.Bounced)
+	assert.Equal(t, 1, got.Delivered)
+	assert.False(t, got.LastSeen.IsZero())
+}
+
+// acceptingDB counts no event right away, every Insert fails with err.
+type acceptingDB struct {
+	adapters.MemoryRepo
+	err error
+}
+
+func (db acceptingDB) Insert(catchall.Event) error {
+	return db.err
+}
+
+func TestPutAccepted(t *testing.T) {
+	e := echo.New()
+
+	for _, err := range []error{ports.ErrSpooled, ports.ErrQueued} {
+		handler := Handlers{
+			DB: acceptingDB{MemoryRepo: adapters.NewMemoryRepo(), err: err},
+		}
+
+		for path, put := range map[string]echo.HandlerFunc{"delivered": handler.PutDelivered, "bounced": handler.PutBounced} {
+			req := httptest.NewRequest(http.MethodPut, "/events/test/"+path, nil)
+			rec := httptest.NewRecorder()
+			c := e.NewContext(req, rec)
+			setEchoPath(c, "/events/:domain_name/"+path, "domain_name", "test")
+
+			if err := put(c); err != nil {
+				t.Fatal(err)
+			}
+			assert.Equal(t, http.StatusAccepted, rec.Code, path)
+		}
+	}
+}
+
+func TestPutDuplicate(t *testing.T) {
+	e := echo.New()
+	db := adapters.NewMemoryRepo()
+	handler := Handlers{
+		DB: dedup.NewRepo(db, adapters.NewMemoryDedup(adapters.DedupConfig{}), dedup.Config{}),
+	}
+
+	put := func(url string, header string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPut, url, nil)
+		if header != "" {
+			req.Header.Set("Idempotency-Key", header)
+		}
+		rec := httptest.NewRecorder()
+		c := e.NewContext(req, rec)
+		setEchoPath(c, "/events/:domain_name/delivered", "domain_name", "test")
+		if err := handler.PutDelivered(c); err != nil {
+			t.Fatal(err)
+		}
+		return rec
+	}
+
+	rec := put("/events/test/delivered?event_id=1", "")
+	assert.Equal(t, http.StatusNoContent, rec.Code)
+	assert.Empty(t, rec.Header().Get("X-Catchall-Duplicate"))
+
+	rec = put("/events/test/delivered?event_id=1", "")
+	assert.Equal(t, http.StatusNoContent, rec.Code)
+	assert.Equal(t, "true", rec.Header().Get("X-Catchall-Duplicate"))
+
+	rec = put("/events/test/delivered", "1")
+	assert.Equal(t, "true", rec.Header().Get("X-Catchall-Duplicate"), "the header carries the same ID")
+
+	put("/events/test/delivered", "2")
+	put("/events/test/delivered", "")
+	put("/events/test/delivered", "")
+
+	assert.Equal(t, 4, db.Storage["test"].Delivered, "events without an ID are always counted")
+}
+
+func TestPutAudited(t *testing.T) {
+	e := echo.New()
+	auditLog, err := adapters.NewFileAuditLog(t.TempDir(), 1<<20, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer auditLog.Close()
+	log := zerolog.Nop()
+	handler := Handlers{
+		DB:    adapters.NewMemoryRepo(),
+		Audit: audit.NewRecorder(auditLog, &log, audit.Config{EventSample: 2}),
+	}
+
+	for i := 0; i < 5; i++ {
+		req := httptest.NewRequest(http.MethodPut, fmt.Sprintf("/events/test/delivered?event_id=%d", i), nil)
+		c := e.NewContext(req, httptest.NewRecorder())
+		setEchoPath(c, "/events/:domain_name/delivered", "domain_name", "test")
+		if err := handler.PutDelivered(c); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	entries, err := auditLog.Query(models.AuditQuery{Action: "event.delivered"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if assert.Len(t, entries, 3, "one in every 2 events is recorded") {
+		assert.Equal(t, "test", entries[0].Target)
+		assert.Equal(t, "anonymous", entries[0].Actor)
+		assert.JSONEq(t, `{"type":"delivered","id":"0","sample":2}`, string(entries[0].After))
+		assert.JSONEq(t, `{"type":"delivered","id":"2","sample":2}`, string(entries[1].After))
+	}
+}
+
+func TestLookup(t *testing.T) {
+	e := echo.New()
+	db := adapters.NewMemoryRepo()
+	handler := Handlers{
+		DB: db,
+	}
+	for i := 0; i < models.CatchAllThreshold; i++ {
+		if err := db.Insert(catchall.Event{Type: catchall.TypeDelivered, Domain: "catchall.com"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.Insert(catchall.Event{Type: catchall.TypeBounced, Domain: "bounced.com"}); err != nil {
+		t.Fatal(err)
 	}
 
-	assert.Equal(t, want, db.Storage)
+	t.Run("json", func(t *testing.T) {
+		body := `["bounced.com", "never-seen.com", "catchall.com"]`
+		req := httptest.NewRequest(http.MethodPost, "/domains:lookup", strings.NewReader(body))
+		req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+		rec := httptest.NewRecorder()
+
+		if err := handler.Lookup(e.NewContext(req, rec)); err != nil {
+			t.Fatal(err)
+		}
+
+		var got []Classification
+		if err := json.Unmarshal(rec.Body.Bytes(), &got); err != nil {
+			t.Fatal(err)
+		}
+		want := []Classification{
+			{Domain: "bounced.com", Status: models.StatusNotCatchAll, Seen: true},
+			{Domain: "never-seen.com", Status: models.StatusUnknown, Seen: false},
+			{Domain: "catchall.com", Status: models.StatusCatchAll, Seen: true},
+		}
+		assert.Equal(t, want, got)
+	})
+	t.Run("overrides are classified at the time of the request", func(t *testing.T) {
+		expires := time.Now().Add(time.Hour)
+		override := models.Override{Status: models.StatusCatchAll, Reason: "migration", ExpiresAt: expires}
+		if err := db.SetOverride("bounced.com", override); err != nil {
+			t.Fatal(err)
+		}
+		defer db.ClearOverride("bounced.com")
+
+		for now, want := range map[time.Time]models.Status{
+			expires.Add(-time.Minute): models.StatusCatchAll,
+			expires.Add(time.Minute):  models.StatusNotCatchAll,
+		} {
+			req := httptest.NewRequest(http.MethodPost, "/domains:lookup", strings.NewReader(`["bounced.com"]`))
+			rec := httptest.NewRecorder()
+			c := e.NewContext(req, rec)
+			web.SetValues(c, &web.Values{Now: now})
+
+			if err := handler.Lookup(c); err != nil {
+				t.Fatal(err)
+			}
+			var got []Classification
+			if err := json.Unmarshal(rec.Body.Bytes(), &got); err != nil {
+				t.Fatal(err)
+			}
+			if assert.Len(t, got, 1) {
+				assert.Equal(t, want, got[0].Status)
+			}
+		}
+	})
+	t.Run("ndjson across batches", func(t *testing.T) {
+		var body strings.Builder
+		total := lookupBatchSize*2 + 1
+		for i := 0; i < total-1; i++ {
+			fmt.Fprintf(&body, "\"%d.example.com\"\n", i)
+		}
+		body.WriteString(`"bounced.com"`)
+
+		req := httptest.NewRequest(http.MethodPost, "/domains:lookup", strings.NewReader(body.String()))
+		req.Header.Set(echo.HeaderContentType, "application/x-ndjson")
+		rec := httptest.NewRecorder()
+
+		if err := handler.Lookup(e.NewContext(req, rec)); err != nil {
+			t.Fatal(err)
+		}
+
+		assert.Equal(t, "application/x-ndjson", rec.Header().Get(echo.HeaderContentType))
+		var got []Classification
+		scanner := bufio.NewScanner(rec.Body)
+		for scanner.Scan() {
+			var c Classification
+			if err := json.Unmarshal(scanner.Bytes(), &c); err != nil {
+				t.Fatal(err)
+			}
+			got = append(got, c)
+		}
+		if !assert.Len(t, got, total) {
+			t.FailNow()
+		}
+		assert.Equal(t, Classification{Domain: "0.example.com", Status: models.StatusUnknown}, got[0])
+		assert.Equal(t, Classification{Domain: "bounced.com", Status: models.StatusNotCatchAll, Seen: true}, got[total-1])
+	})
+	t.Run("bad request", func(t *testing.T) {
+		for _, body := range []string{`{"domain": "a.com"}`, `[]`, `["a.com", 1]`, `[""]`} {
+			req := httptest.NewRequest(http.MethodPost, "/domains:lookup", strings.NewReader(body))
+			rec := httptest.NewRecorder()
+
+			err := handler.Lookup(e.NewContext(req, rec))
+			reqErr := webErr.GetRequestError(err)
+			if assert.NotNil(t, reqErr, body) {
+				assert.Equal(t, http.StatusBadRequest, reqErr.Status, body)
+			}
+		}
+	})
+}
+
+func TestList(t *testing.T) {
+	e := echo.New()
+	db := adapters.NewMemoryRepo()
+	handler := Handlers{
+		DB: db,
+	}
+	for i := 1; i <= 5; i++ {
+		for j := 0; j < i; j++ {
+			if err := db.Insert(catchall.Event{Type: catchall.TypeDelivered, Domain: fmt.Sprintf("%d.example.com", i)}); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if err := db.Insert(catchall.Event{Type: catchall.TypeBounced, Domain: "bounced.org"}); err != nil {
+		t.Fatal(err)
+	}
+	for _, domain := range []string{"example.org", "mail.example.org", "badexample.org"} {
+		if err := db.Insert(catchall.Event{Type: catchall.TypeDelivered, Domain: domain}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	list := func(t *testing.T, query string) DomainPage {
+		req := httptest.NewRequest(http.MethodGet, "/domains?"+query, nil)
+		rec := httptest.NewRecorder()
+		if err := handler.List(e.NewContext(req, rec)); err != nil {
+			t.Fatal(err)
+		}
+
+		var page DomainPage
+		if err := json.Unmarshal(rec.Body.Bytes(), &page); err != nil {
+			t.Fatal(err)
+		}
+		return page
+	}
+	names := func(page DomainPage) []string {
+		var names []string
+		for _, d := range page.Domains {
+			names = append(names, d.Domain)
+		}
+		return names
+	}
+
+	t.Run("paginate", func(t *testing.T) {
+		var got []string
+		cursor := ""
+		for pages := 0; pages < 10; pages++ {
+			page := list(t, "sort=delivered&suffix=.com&limit=2&cursor="+cursor)
+			got = append(got, names(page)...)
+			if page.NextCursor == "" {
+				break
+			}
+			cursor = page.NextCursor
+		}
+		assert.Equal(t, []string{"5.example.com", "4.example.com", "3.example.com", "2.example.com", "1.example.com"}, got)
+	})
+	t.Run("filter", func(t *testing.T) {
+		assert.Equal(t, []string{"bounced.org"}, names(list(t, "has_bounces=true")))
+		assert.Equal(t, []string{"bounced.org"}, names(list(t, "status=not+catch-all")))
+		assert.Equal(t, []string{"3.example.com", "4.example.com", "5.example.com"}, names(list(t, "min_delivered=3")))
+		assert.Empty(t, list(t, "status=catch-all").Domains)
+	})
+	t.Run("suffix on a label boundary", func(t *testing.T) {
+		assert.ElementsMatch(t, []string{"example.org", "mail.example.org"}, names(list(t, "suffix=example.org")))
+		assert.ElementsMatch(t, []string{"example.org", "mail.example.org"}, names(list(t, "suffix=.Example.org")))
+	})
+	t.Run("bad request", func(t *testing.T) {
+		cursor := list(t, "sort=delivered&limit=1").NextCursor
+		for _, query := range []string{"sort=name", "limit=0", "status=maybe", "has_bounces=sometimes", "cursor=nope", "sort=bounced&cursor=" + cursor} {
+			req := httptest.NewRequest(http.MethodGet, "/domains?"+query, nil)
+			rec := httptest.NewRecorder()
+
+			err := handler.List(e.NewContext(req, rec))
+			reqErr := webErr.GetRequestError(err)
+			if assert.NotNil(t, reqErr, query) {
+				assert.Equal(t, http.StatusBadRequest, reqErr.Status, query)
+			}
+		}
+	})
+}
+
+func TestAdmin(t *testing.T) {
+	e := echo.New()
+	db := adapters.NewMemoryRepo()
+	auditLog, err := adapters.NewFileAuditLog(t.TempDir(), 1<<20, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer auditLog.Close()
+	log := zerolog.Nop()
+	handler := Handlers{
+		DB:    db,
+		Audit: audit.NewRecorder(auditLog, &log, audit.Config{}),
+	}
+	if err := db.Insert(catchall.Event{Type: catchall.TypeBounced, Domain: "test"}); err != nil {
+		t.Fatal(err)
+	}
+
+	call := func(t *testing.T, fn echo.HandlerFunc, method string, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, "/domain/test", strings.NewReader(body))
+		req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+		rec := httptest.NewRecorder()
+		c := e.NewContext(req, rec)
+		setEchoPath(c, "/domain/:domain_name", "domain_name", "test")
+		if err := fn(c); err != nil {
+			t.Fatal(err)
+		}
+		return rec
+	}
+
+	t.Run("override", func(t *testing.T) {
+		expires := time.Now().Add(time.Hour).UTC().Truncate(time.Second)
+		body := fmt.Sprintf(`{"status": "catch-all", "reason": "customer confirmed", "expires_at": %q}`, expires.Format(time.RFC3339))
+		rec := call(t, handler.SetOverride, http.MethodPut, body)
+
+		var info DomainInfo
+		if err := json.Unmarshal(rec.Body.Bytes(), &info); err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, models.StatusCatchAll, info.Status)
+		assert.Equal(t, 1, info.Bounced)
+		if assert.NotNil(t, info.Override) {
+			assert.Equal(t, "customer confirmed", info.Override.Reason)
+			assert.Equal(t, expires, info.Override.ExpiresAt)
+		}
+
+		rec = call(t, handler.Get, http.MethodGet, "")
+		assert.Contains(t, rec.Body.String(), `"catch-all"`)
+		assert.Equal(t, "customer confirmed", rec.Header().Get("X-Catchall-Override-Reason"))
+	})
+	t.Run("reset keeps override", func(t *testing.T) {
+		call(t, handler.Reset, http.MethodPost, "")
+		assert.Equal(t, 0, db.Storage["test"].Bounced)
+		assert.Equal(t, models.StatusCatchAll, db.Storage["test"].Status())
+	})
+	t.Run("clear override", func(t *testing.T) {
+		rec := call(t, handler.ClearOverride, http.MethodDelete, "")
+		assert.Contains(t, rec.Body.String(), `"status":"unknown"`)
+		assert.NotContains(t, rec.Body.String(), `"override"`)
+	})
+	t.Run("delete", func(t *testing.T) {
+		call(t, handler.Delete, http.MethodDelete, "")
+		assert.Empty(t, db.Storage)
+	})
+	t.Run("audited", func(t *testing.T) {
+		entries, err := auditLog.Query(models.AuditQuery{Target: "test"})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var actions []string
+		for _, entry := range entries {
+			actions = append(actions, entry.Action)
+			assert.Equal(t, "anonymous", entry.Actor)
+		}
+		assert.Equal(t, []string{"domain.override.set", "domain.reset", "domain.override.clear", "domain.delete"}, actions)
+		if assert.Len(t, entries, 4) {
+			assert.Contains(t, string(entries[0].Before), `"status":"not catch-all"`)
+			assert.Contains(t, string(entries[0].After), `"status":"catch-all"`)
+			assert.Nil(t, entries[3].After)
+		}
+	})
+	t.Run("bad override", func(t *testing.T) {
+		past := time.Now().Add(-time.Hour).Format(time.RFC3339)
+		future := time.Now().Add(time.Hour).Format(time.RFC3339)
+		for _, body := range []string{
+			fmt.Sprintf(`{"status": "maybe", "reason": "r", "expires_at": %q}`, future),
+			fmt.Sprintf(`{"status": "catch-all", "reason": "", "expires_at": %q}`, future),
+			fmt.Sprintf(`{"status": "catch-all", "reason": "r", "expires_at": %q}`, past),
+			`{"status": "catch-all", "reason": "r"}`,
+		} {
+			req := httptest.NewRequest(http.MethodPut, "/domain/test/override", strings.NewReader(body))
+			req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+			c := e.NewContext(req, httptest.NewRecorder())
+			setEchoPath(c, "/domain/:domain_name/override", "domain_name", "test")
+
+			reqErr := webErr.GetRequestError(handler.SetOverride(c))
+			if assert.NotNil(t, reqErr, body) {
+				assert.Equal(t, http.StatusBadRequest, reqErr.Status, body)
+			}
+		}
+	})
+}
+
+// newGetContext returns a fresh context for the get handler, the response of a context can only be written once.
+func newGetContext(e *echo.Echo, domain string) (echo.Context, *httptest.ResponseRecorder) {
+	req := httptest.NewRequest(http.MethodGet, "/domain/"+domain, nil)
+	rec := httptest.NewRecorder()
+	c := e.NewContext(req, rec)
+	setEchoPath(c, "/domain/:domain_name", "domain_name", domain)
+	return c, rec
 }
 
 // this happens by default in the echo framework, but we need to do it manually for testing
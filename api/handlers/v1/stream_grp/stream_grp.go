@@ -0,0 +1,89 @@
+// Package stream_grp maintains the group of handlers for live streams.
+package stream_grp
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/penthious/catchall/business/core/stream"
+	"github.com/penthious/catchall/foundation/web"
+)
+
+// Handlers manages the set of stream endpoints.
+type Handlers struct {
+	Broker *stream.Broker
+
+	// Heartbeat is how often a comment is sent on an idle stream, so proxies keep the connection open and dead
+	// clients are noticed.
+	Heartbeat time.Duration
+	// WriteTimeout bounds every single write to the client. It replaces the server wide write timeout, which
+	// would otherwise kill the stream.
+	WriteTimeout time.Duration
+}
+
+// Classifications streams every classification change as a server sent event, optionally filtered by the `suffix`
+// query parameter.
+func (h Handlers) Classifications(ctx echo.Context) error {
+	client := h.Broker.Subscribe(ctx.QueryParam("suffix"))
+	defer h.Broker.Unsubscribe(client)
+
+	w := ctx.Response()
+	rc := http.NewResponseController(w.Writer)
+
+	w.Header().Set(echo.HeaderContentType, "text/event-stream")
+	w.Header().Set(echo.HeaderCacheControl, "no-cache")
+	w.Header().Set(echo.HeaderConnection, "keep-alive")
+	w.Header().Set("X-Accel-Buffering", "no")
+
+	web.SetStatusCode(ctx, http.StatusOK)
+	if err := h.write(rc, w, ": connected\n\n"); err != nil {
+		return nil
+	}
+
+	heartbeat := time.NewTicker(h.Heartbeat)
+	defer heartbeat.Stop()
+
+	for id := 1; ; id++ {
+		select {
+		case <-ctx.Request().Context().Done():
+			return nil
+
+		case <-heartbeat.C:
+			if err := h.write(rc, w, ": ping\n\n"); err != nil {
+				return nil
+			}
+
+		case t, ok := <-client.Events():
+			if !ok {
+				// Tell the client why it was disconnected so it can tell a slow connection from a shutdown.
+				_ = h.write(rc, w, fmt.Sprintf("event: close\ndata: %s\n\n", client.Err()))
+				return nil
+			}
+
+			data, err := json.Marshal(t)
+			if err != nil {
+				return fmt.Errorf("error marshalling transition: %w", err)
+			}
+			if err := h.write(rc, w, fmt.Sprintf("id: %d\nevent: classification\ndata: %s\n\n", id, data)); err != nil {
+				return nil
+			}
+		}
+	}
+}
+
+// write sends msg to the client and flushes it. Every write gets its own deadline, a client that stops reading
+// fails the write instead of holding the handler forever.
+func (h Handlers) write(rc *http.ResponseController, w *echo.Response, msg string) error {
+	if err := rc.SetWriteDeadline(time.Now().Add(h.WriteTimeout)); err != nil && !errors.Is(err, http.ErrNotSupported) {
+		return err
+	}
+	if _, err := w.Write([]byte(msg)); err != nil {
+		return err
+	}
+	w.Flush()
+	return nil
+}
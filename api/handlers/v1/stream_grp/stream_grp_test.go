@@ -0,0 +1,70 @@
+package stream_grp
+
+import (
+	"bufio"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/penthious/catchall/business/core/stream"
+	"github.com/penthious/catchall/business/models"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestClassifications(t *testing.T) {
+	broker := stream.NewBroker(10)
+	handler := Handlers{
+		Broker:       broker,
+		Heartbeat:    time.Hour,
+		WriteTimeout: time.Second,
+	}
+
+	e := echo.New()
+	e.GET("/stream/classifications", handler.Classifications)
+	srv := httptest.NewServer(e)
+	defer srv.Close()
+
+	resp, err := http.Get(srv.URL + "/stream/classifications?suffix=.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "text/event-stream", resp.Header.Get("Content-Type"))
+
+	r := bufio.NewReader(resp.Body)
+	assert.Equal(t, ": connected", readEvent(t, r))
+
+	// the client subscribes before the preamble is written
+	assert.Equal(t, 1, broker.Clients())
+
+	broker.Notify(models.Transition{Domain: "example.org", From: models.StatusUnknown, To: models.StatusCatchAll})
+	broker.Notify(models.Transition{Domain: "example.com", From: models.StatusUnknown, To: models.StatusCatchAll})
+
+	ev := readEvent(t, r)
+	assert.Contains(t, ev, "id: 1\nevent: classification\n")
+	assert.Contains(t, ev, `"domain":"example.com"`)
+
+	broker.Close()
+	assert.Equal(t, "event: close\ndata: broker closed", readEvent(t, r))
+}
+
+// readEvent reads a single event from the stream, without the blank line that terminates it.
+func readEvent(t *testing.T, r *bufio.Reader) string {
+	var lines []string
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		line = strings.TrimSuffix(line, "\n")
+		if line == "" {
+			return strings.Join(lines, "\n")
+		}
+		lines = append(lines, line)
+	}
+}
@@ -1,24 +1,76 @@
 package v1
 
 import (
+	"github.com/penthious/catchall/api/handlers/v1/audit_grp"
 	"github.com/penthious/catchall/api/handlers/v1/domain_grp"
+	"github.com/penthious/catchall/api/handlers/v1/stream_grp"
+	"github.com/penthious/catchall/api/handlers/v1/webhook_grp"
+	"github.com/penthious/catchall/business/core/audit"
+	"github.com/penthious/catchall/business/core/stream"
 	"github.com/penthious/catchall/business/ports"
 	"github.com/penthious/catchall/foundation/web"
+	"github.com/penthious/catchall/foundation/web/middleware"
 	"net/http"
+	"time"
 )
 
 const v1 = "v1"
 
 type Options struct {
-	DB ports.DB
+	DB       ports.DB
+	Webhooks ports.WebhookStore
+	Broker   *stream.Broker
+	AuditLog ports.AuditLog
+	// AuditEventSample records one in every AuditEventSample ingested events in the audit log, every event when 0.
+	AuditEventSample int
 }
 
-// Routes binds all the version 1 routes.
+// Routes binds all the version 1 routes. The admin routes, the audit log and the webhooks require an authenticated
+// caller, so they are refused when no credentials are configured.
 func Routes(app *web.App, cfg Options) {
+	admin := middleware.RequireActor()
+
+	var recorder *audit.Recorder
+	if cfg.AuditLog != nil {
+		recorder = audit.NewRecorder(cfg.AuditLog, app.Log(), audit.Config{EventSample: cfg.AuditEventSample})
+
+		agrp := audit_grp.Handlers{
+			Log: cfg.AuditLog,
+		}
+		app.Handle(http.MethodGet, v1, "/audit", agrp.Query, admin)
+	}
+
 	dgrp := domain_grp.Handlers{
-		DB: cfg.DB,
+		DB:    cfg.DB,
+		Audit: recorder,
 	}
 	app.Handle(http.MethodGet, v1, "/domain/:domain_name", dgrp.Get)
+	app.Handle(http.MethodDelete, v1, "/domain/:domain_name", dgrp.Delete, admin)
+	app.Handle(http.MethodPost, v1, "/domain/:domain_name/reset", dgrp.Reset, admin)
+	app.Handle(http.MethodPut, v1, "/domain/:domain_name/override", dgrp.SetOverride, admin)
+	app.Handle(http.MethodDelete, v1, "/domain/:domain_name/override", dgrp.ClearOverride, admin)
+	app.Handle(http.MethodGet, v1, "/domains", dgrp.List)
+	app.Handle(http.MethodPost, v1, "/domains\\:lookup", dgrp.Lookup)
 	app.Handle(http.MethodPut, v1, "/events/:domain_name/bounced", dgrp.PutBounced)
 	app.Handle(http.MethodPut, v1, "/events/:domain_name/delivered", dgrp.PutDelivered)
+
+	if cfg.Webhooks != nil {
+		wgrp := webhook_grp.Handlers{
+			Store: cfg.Webhooks,
+			Audit: recorder,
+		}
+		app.Handle(http.MethodPost, v1, "/webhooks", wgrp.Create, admin)
+		app.Handle(http.MethodGet, v1, "/webhooks", wgrp.List, admin)
+		app.Handle(http.MethodDelete, v1, "/webhooks/:id", wgrp.Delete, admin)
+		app.Handle(http.MethodGet, v1, "/webhooks/deadletters", wgrp.DeadLetters, admin)
+	}
+
+	if cfg.Broker != nil {
+		sgrp := stream_grp.Handlers{
+			Broker:       cfg.Broker,
+			Heartbeat:    15 * time.Second,
+			WriteTimeout: 10 * time.Second,
+		}
+		app.Handle(http.MethodGet, v1, "/stream/classifications", sgrp.Classifications)
+	}
 }
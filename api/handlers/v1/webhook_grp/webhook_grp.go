@@ -0,0 +1,156 @@
+// Package webhook_grp maintains the group of handlers for webhook subscriptions.
+package webhook_grp
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/labstack/echo/v4"
+	"github.com/penthious/catchall/business/core/audit"
+	"github.com/penthious/catchall/business/models"
+	"github.com/penthious/catchall/business/ports"
+	"github.com/penthious/catchall/foundation/web"
+	webErr "github.com/penthious/catchall/foundation/web/errors"
+)
+
+// Handlers manages the set of webhook endpoints.
+type Handlers struct {
+	Store ports.WebhookStore
+	Audit *audit.Recorder
+}
+
+// NewSubscription is what we require from clients when registering a webhook. The secret is generated when it is left
+// empty.
+type NewSubscription struct {
+	URL    string `json:"url"`
+	Secret string `json:"secret"`
+}
+
+// Subscription is the subscription returned to clients, the secret is only ever returned when it is created.
+type Subscription struct {
+	ID        string    `json:"id"`
+	URL       string    `json:"url"`
+	Secret    string    `json:"secret,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// DeadLetter is a delivery that ran out of attempts.
+type DeadLetter struct {
+	ID             string          `json:"id"`
+	SubscriptionID string          `json:"subscription_id"`
+	Payload        json.RawMessage `json:"payload"`
+	Attempts       int             `json:"attempts"`
+	LastError      string          `json:"last_error"`
+	CreatedAt      time.Time       `json:"created_at"`
+}
+
+// Create registers a new webhook subscription.
+func (h Handlers) Create(ctx echo.Context) error {
+	var ns NewSubscription
+	if err := ctx.Bind(&ns); err != nil {
+		return webErr.NewRequestError(fmt.Errorf("unable to decode payload: %w", err), http.StatusBadRequest)
+	}
+
+	u, err := url.Parse(ns.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return webErr.NewRequestError(errors.New("url must be an absolute http or https url"), http.StatusBadRequest)
+	}
+
+	if ns.Secret == "" {
+		b := make([]byte, 32)
+		if _, err := rand.Read(b); err != nil {
+			return fmt.Errorf("error generating secret: %w", err)
+		}
+		ns.Secret = hex.EncodeToString(b)
+	}
+
+	sub := models.Subscription{
+		ID:        uuid.NewString(),
+		URL:       u.String(),
+		Secret:    ns.Secret,
+		CreatedAt: web.GetNow(ctx),
+	}
+	if err := h.Store.CreateSubscription(sub); err != nil {
+		return fmt.Errorf("error creating subscription: %w", err)
+	}
+
+	resp := toSubscription(sub)
+	h.Audit.Record(web.GetActor(ctx), web.GetTraceID(ctx), "webhook.create", sub.ID, nil, resp)
+
+	resp.Secret = sub.Secret
+	return web.Respond(ctx, http.StatusCreated, resp)
+}
+
+// List returns every webhook subscription.
+func (h Handlers) List(ctx echo.Context) error {
+	subs, err := h.Store.Subscriptions()
+	if err != nil {
+		return fmt.Errorf("error listing subscriptions: %w", err)
+	}
+
+	resp := make([]Subscription, len(subs))
+	for i, sub := range subs {
+		resp[i] = toSubscription(sub)
+	}
+	return web.Respond(ctx, http.StatusOK, resp)
+}
+
+// Delete removes a webhook subscription, anything still queued for it is dead lettered.
+func (h Handlers) Delete(ctx echo.Context) error {
+	id := ctx.Param("id")
+
+	sub, err := h.Store.Subscription(id)
+	if err != nil {
+		if errors.Is(err, ports.ErrSubscriptionNotFound) {
+			return webErr.NewRequestError(err, http.StatusNotFound)
+		}
+		return fmt.Errorf("error getting subscription: %w", err)
+	}
+
+	if err := h.Store.DeleteSubscription(id); err != nil {
+		if errors.Is(err, ports.ErrSubscriptionNotFound) {
+			return webErr.NewRequestError(err, http.StatusNotFound)
+		}
+		return fmt.Errorf("error deleting subscription: %w", err)
+	}
+
+	h.Audit.Record(web.GetActor(ctx), web.GetTraceID(ctx), "webhook.delete", id, toSubscription(sub), nil)
+
+	return web.Respond(ctx, http.StatusNoContent, nil)
+}
+
+// DeadLetters returns the deliveries that could not be delivered.
+func (h Handlers) DeadLetters(ctx echo.Context) error {
+	dead, err := h.Store.DeadLetters()
+	if err != nil {
+		return fmt.Errorf("error listing dead letters: %w", err)
+	}
+
+	resp := make([]DeadLetter, len(dead))
+	for i, d := range dead {
+		resp[i] = DeadLetter{
+			ID:             d.ID,
+			SubscriptionID: d.SubscriptionID,
+			Payload:        d.Payload,
+			Attempts:       d.Attempts,
+			LastError:      d.LastError,
+			CreatedAt:      d.CreatedAt,
+		}
+	}
+	return web.Respond(ctx, http.StatusOK, resp)
+}
+
+func toSubscription(sub models.Subscription) Subscription {
+	return Subscription{
+		ID:        sub.ID,
+		URL:       sub.URL,
+		CreatedAt: sub.CreatedAt,
+	}
+}
@@ -2,11 +2,29 @@ package main
 
 import (
 	"context"
+	"errors"
+	"expvar"
+	"flag"
 	"fmt"
 	"github.com/penthious/catchall/api/handlers"
 	"github.com/penthious/catchall/business/adapters"
+	"github.com/penthious/catchall/business/core/cache"
+	"github.com/penthious/catchall/business/core/consumer"
+	"github.com/penthious/catchall/business/core/dedup"
+	"github.com/penthious/catchall/business/core/ingest"
+	"github.com/penthious/catchall/business/core/resilience"
+	"github.com/penthious/catchall/business/core/spool"
+	"github.com/penthious/catchall/business/core/stream"
+	"github.com/penthious/catchall/business/core/transition"
+	"github.com/penthious/catchall/business/core/webhook"
+	"github.com/penthious/catchall/business/core/writebehind"
 	"github.com/penthious/catchall/business/ports"
 	"github.com/penthious/catchall/foundation/database"
+	"github.com/penthious/catchall/foundation/kv"
+	"github.com/penthious/catchall/foundation/nats"
+	"github.com/penthious/catchall/foundation/redis"
+	"github.com/penthious/catchall/foundation/wal"
+	"github.com/penthious/catchall/foundation/web"
 	"net/http"
 	"os"
 	"os/signal"
@@ -21,17 +39,22 @@ import (
 // Entry point to the server
 func main() {
 	appName := "catchall"
+	asyncIngest := flag.Bool("async-ingest", false, "answer the events with 202 Accepted once they are queued in memory")
+	brokerAddr := flag.String("broker-addr", "", "host:port of a NATS server to also consume the events from")
+	flag.Parse()
+
 	log := initLogger(loggerConf{})
 
 	log.Info().Msg("Application starting")
 
-	if err := server(appName, log); err != nil {
+	if err := server(appName, log, *asyncIngest, *brokerAddr); err != nil {
 		log.Error().Err(err).Msg("startup")
 	}
 }
 
-// server creates the http.Server and runs it
-func server(appName string, log *zerolog.Logger) error {
+// server creates the http.Server and runs it, asyncIngest puts the events in an in-memory queue before writing them
+// and a brokerAddr also consumes them from NATS.
+func server(appName string, log *zerolog.Logger, asyncIngest bool, brokerAddr string) error {
 	// Get maxprocs
 	opt := maxprocs.Logger(log.Printf)
 
@@ -49,7 +72,8 @@ func server(appName string, log *zerolog.Logger) error {
 	signal.Notify(shutdown, syscall.SIGINT, syscall.SIGTERM, syscall.SIGQUIT)
 
 	// @TODO: I would use viper or something similar to manage config
-	// change this value to `memory` to use the in-memory database.
+	// change this value to `memory` to use the in-memory database, `redis` to store the domains in redis, or `embedded`
+	// to keep them in a local data directory.
 	adapter := "postgres"
 
 	// used to stop the execution of connecting to the databases if the time limit is reached
@@ -57,43 +81,371 @@ func server(appName string, log *zerolog.Logger) error {
 	defer cancel()
 
 	var db ports.DB
+	// webhooks holds the subscriptions and the queue of deliveries. Only postgres persists them, the other adapters
+	// keep them in memory so the subscriptions and the deliveries not yet made are lost on a restart.
+	var webhooks ports.WebhookStore
+	var auditLog ports.AuditLog
+	// eventIDs remembers the IDs of the events that were counted, in memory unless the adapter shares them between the
+	// instances.
+	var eventIDs ports.Dedup
+
+	// drains are run on shutdown after the server stopped serving requests, to write out anything still buffered.
+	var drains []func(ctx context.Context) error
+
+	// startInvalidations is set by the adapters that can tell which domains other instances changed, to evict them
+	// from the cache of this one.
+	var startInvalidations func(cache ports.Invalidator)
+
+	// flush is set by the adapters that buffer their writes, to write out what is buffered. The events consumed from
+	// the broker are flushed before they are acked.
+	var flush func() error
+
+	// Serve repeated lookups of the same domains from memory. Every write through the cache invalidates the domain, so
+	// it never serves a count older than the last write it saw. An adapter that buffers its writes sets cached to a
+	// cache below the buffer, the cache is put around db otherwise. The hit/miss counters are published as an expvar.
+	var cached *cache.Repo
+	cacheConfig := cache.Config{Size: 100_000, TTL: time.Minute}
+
 	switch adapter {
 	case "postgres":
-		psql, err := database.Open(database.Config{
-			User:         "postgres",
-			Password:     "example",
-			Host:         "localhost:5434",
-			Name:         "postgres",
-			DisableTLS:   true,
-			MaxOpenConns: 50,
-			MaxIdleConns: 2,
-			MaxIdleTime:  time.Minute,
-		})
+		// Add the hosts of read replicas to Replicas to move lookups and listings off the primary. A replica only
+		// serves reads while it passes its health check and is less than MaxReplicaLag behind.
+		// Outside of local development set TLSMode to database.TLSVerifyFull instead of DisableTLS, with RootCAFile
+		// when the server certificate isn't issued by a public CA, and ClientCertFile and ClientKeyFile to
+		// authenticate with a certificate.
+		cluster, err := database.OpenCluster(database.Config{
+			User:          "postgres",
+			Password:      "example",
+			Host:          "localhost:5434",
+			Name:          "postgres",
+			DisableTLS:    true,
+			MaxOpenConns:  50,
+			MaxIdleConns:  2,
+			MaxIdleTime:   time.Minute,
+			Replicas:      []string{},
+			MaxReplicaLag: 5 * time.Second,
+		}, log)
 		if err != nil {
 			return fmt.Errorf("opening database: %w", err)
 		}
+		defer cluster.Close()
+		psql := cluster.Primary
 
 		if err := database.StatusCheck(ctx, psql); err != nil {
 			return fmt.Errorf("database not ready: %w", err)
 		}
+		cluster.CheckReplicas(ctx)
+		cluster.Start()
+
+		// Record the latency of every query per operation and log the ones over SlowQuery, and sample the stats of
+		// every pool. Both are published as the `db` expvar on the debug server.
+		monitor := database.NewMonitor(database.MonitorConfig{
+			Log:           log,
+			SlowQuery:     200 * time.Millisecond,
+			StatsInterval: 10 * time.Second,
+		})
+		monitor.Watch("primary", psql)
+		for _, replica := range cluster.Replicas {
+			monitor.Watch(replica.Host, replica.DB)
+		}
+		monitor.Start()
+		defer monitor.Close()
+		expvar.Publish("db", monitor)
+
+		// Retry the calls that fail because postgres blipped, and once it is down stop calling it for a while so
+		// requests fail fast with a 503 and a Retry-After instead of piling up.
+		repo := resilience.NewRepo(adapters.NewReplicatedPostgresRepo(cluster), resilience.Config{
+			Log:              log,
+			Transient:        adapters.IsTransientPostgresError,
+			Unapplied:        adapters.IsUnappliedPostgresError,
+			Attempts:         3,
+			FailureThreshold: 5,
+			OpenTimeout:      10 * time.Second,
+		})
+
+		// While postgres is down keep the increments in a spool on the local disk rather than failing them, the events
+		// are answered with 202 Accepted and written once postgres is back. Past MaxBytes the events fail with a 503
+		// again. The counts of the spool are published as an expvar.
+		fileSpool, err := adapters.NewFileSpool(adapters.SpoolConfig{
+			Dir:      "data/spool",
+			Sync:     wal.SyncAlways,
+			MaxBytes: 1 << 30,
+			Log:      log,
+		})
+		if err != nil {
+			return fmt.Errorf("opening spool: %w", err)
+		}
+		defer fileSpool.Close()
+		spooled := spool.NewRepo(repo, fileSpool, spool.Config{
+			Log: log,
+			Unavailable: func(err error) bool {
+				return errors.Is(err, ports.ErrUnavailable) || adapters.IsTransientPostgresError(err)
+			},
+			ReplayInterval: time.Second,
+		})
+		// The postgres repo writes batches, so the spool does too.
+		replayer := spooled.(*spool.DeltaRepo)
+		replayer.Start()
+		expvar.Publish("spool", expvar.Func(func() interface{} { return replayer.Stats() }))
+
+		// The cache goes below the buffer, the buffer serves the increments that are pending and the cache what was
+		// written, so the transition check before every event doesn't read postgres. A flush invalidates the domains
+		// it writes.
+		below := cache.NewDeltaRepo(replayer, cacheConfig)
+		cached = below.Repo
+
+		// Coalesce the increments of hot domains in memory and write them in batched upserts, rather than a round
+		// trip per event. The buffer is drained once the server has stopped accepting events, into the spool when
+		// postgres is down.
+		buffer := writebehind.NewBuffer(below, writebehind.Config{
+			Log:           log,
+			MaxDomains:    1000,
+			FlushInterval: 500 * time.Millisecond,
+		})
+		buffer.Start()
+		drains = append(drains, buffer.Shutdown, replayer.Shutdown)
+		flush = buffer.Flush
+		db = buffer
+		webhooks = adapters.NewPostgresWebhookStore(psql)
+		auditLog = adapters.NewPostgresAuditLog(psql)
+		eventIDs = adapters.NewPostgresDedup(psql, 24*time.Hour)
+
+		// Every status change is notified on the primary, and evicted from the caches of all the instances. Reads
+		// from a lagging replica can cache the old domain again, so with replicas the domains are evicted a second
+		// time once the replicas caught up.
+		startInvalidations = func(cache ports.Invalidator) {
+			var reevict time.Duration
+			if len(cluster.Replicas) > 0 {
+				reevict = 5 * time.Second
+			}
+			listener := adapters.NewPostgresInvalidationListener(psql, cache, adapters.InvalidationConfig{
+				Log:     log,
+				Reevict: reevict,
+			})
+			listener.Start()
+			drains = append(drains, func(ctx context.Context) error { return listener.Close() })
+		}
+	case "redis":
+		client, err := redis.Open(redis.Config{
+			Addr:     "localhost:6379",
+			PoolSize: 50,
+		})
+		if err != nil {
+			return fmt.Errorf("opening redis: %w", err)
+		}
+		defer client.Close()
 
-		db = adapters.NewPostgresRepo(psql)
+		db = adapters.NewRedisRepo(client)
+		// not persisted, see webhooks above
+		webhooks = adapters.NewMemoryWebhookStore()
+
+		fileLog, err := adapters.NewFileAuditLog("audit", 64<<20, 16)
+		if err != nil {
+			return fmt.Errorf("opening audit log: %w", err)
+		}
+		defer fileLog.Close()
+		auditLog = fileLog
 	case "mongo":
 		// this is where I would add mongo or any other database
+	case "embedded":
+		// The domains are kept in an embedded key-value store in the directory, for single node deployments that can't
+		// run postgres. Every write is logged before it is applied, so a crash loses at most the last second of events.
+		repo, err := adapters.NewEmbeddedRepo("data/embedded", kv.Options{Sync: wal.SyncInterval})
+		if err != nil {
+			return fmt.Errorf("opening embedded repo: %w", err)
+		}
+		defer func() {
+			if err := repo.Close(); err != nil {
+				log.Error().Err(err).Msg("closing embedded repo")
+			}
+		}()
+		db = repo
+		// not persisted, see webhooks above
+		webhooks = adapters.NewMemoryWebhookStore()
+
+		fileLog, err := adapters.NewFileAuditLog("audit", 64<<20, 16)
+		if err != nil {
+			return fmt.Errorf("opening audit log: %w", err)
+		}
+		defer fileLog.Close()
+		auditLog = fileLog
 	case "memory":
-		db = adapters.NewMemoryRepo()
+		// Set memoryDir to keep the domains across restarts, every change is written to a WAL in the directory and
+		// compacted into a snapshot every few minutes. Left empty the domains only live as long as the process.
+		memoryDir := ""
+		if memoryDir == "" {
+			db = adapters.NewShardedMemoryRepo(adapters.DefaultShards)
+		} else {
+			repo, err := adapters.NewDurableMemoryRepo(adapters.DurableConfig{
+				Dir:  memoryDir,
+				Sync: wal.SyncInterval,
+				Log:  log,
+			})
+			if err != nil {
+				return fmt.Errorf("opening memory repo: %w", err)
+			}
+			defer func() {
+				if err := repo.Close(); err != nil {
+					log.Error().Err(err).Msg("closing memory repo")
+				}
+			}()
+			db = repo
+		}
+		// not persisted, see webhooks above
+		webhooks = adapters.NewMemoryWebhookStore()
+
+		// The audit log has to outlive the process even when the domains don't, so it goes to disk.
+		fileLog, err := adapters.NewFileAuditLog("audit", 64<<20, 16)
+		if err != nil {
+			return fmt.Errorf("opening audit log: %w", err)
+		}
+		defer fileLog.Close()
+		auditLog = fileLog
 	default:
 		return fmt.Errorf("unknown adapter: %s", adapter)
 	}
 
+	if cached == nil {
+		// The adapters that write batches in one call keep doing so through the cache.
+		if w, ok := db.(interface {
+			ports.DB
+			ports.DeltaWriter
+		}); ok {
+			below := cache.NewDeltaRepo(w, cacheConfig)
+			cached, db = below.Repo, below
+		} else {
+			cached = cache.NewRepo(db, cacheConfig)
+			db = cached
+		}
+	}
+	expvar.Publish("cache", expvar.Func(func() interface{} { return cached.Stats() }))
+	if startInvalidations != nil {
+		startInvalidations(cached)
+	}
+
+	// Deliver classification transitions to the registered webhooks. The dispatcher works through the persisted queue
+	// in the background so a slow subscriber never holds up an event.
+	var notifiers []ports.Notifier
+	if webhooks != nil {
+		dispatcher := webhook.NewDispatcher(webhook.Config{
+			Log:   log,
+			Store: webhooks,
+		})
+		dispatcher.Start()
+		defer func() {
+			ctx, cancel := context.WithTimeout(context.Background(), time.Second*20)
+			defer cancel()
+			if err := dispatcher.Shutdown(ctx); err != nil {
+				log.Error().Err(err).Msg("webhook shutdown")
+			}
+		}()
+		notifiers = append(notifiers, dispatcher)
+	}
+
+	// Fan classification transitions out to the live SSE streams, every client can buffer 64 transitions before it
+	// is considered too slow and disconnected.
+	broker := stream.NewBroker(64)
+	notifiers = append(notifiers, broker)
+
+	db = transition.NewRepo(db, notifiers...)
+
+	// written is the DB below the ingest queue, whose inserts aren't queued. They may still be buffered until flush.
+	written := db
+
+	// Run with -async-ingest to answer the events with 202 Accepted once they are in an in-memory queue, a pool of
+	// workers writes them in the background in batches of up to 100 events summed per domain, through the transition
+	// detection and the cache. A batch that fails is written again with backoff, so while the database fails the queue
+	// fills up and a full queue is answered with a 503 and a Retry-After. The queue writes through everything else so
+	// it is drained first on shutdown, but the events still in it are lost on a crash. The depth of the queue and how
+	// long the events waited in it are published as the `ingest` expvar.
+	if asyncIngest {
+		queue := ingest.NewQueue(db, ingest.Config{
+			Log:        log,
+			Size:       10_000,
+			Workers:    4,
+			BatchSize:  100,
+			MinBackoff: 100 * time.Millisecond,
+			MaxBackoff: 10 * time.Second,
+		})
+		queue.Start()
+		expvar.Publish("ingest", expvar.Func(func() interface{} { return queue.Stats() }))
+		drains = append([]func(ctx context.Context) error{queue.Shutdown}, drains...)
+		db = queue
+	}
+
+	// Count the events carrying an ID at most once in 24 hours, since the webhooks of the ESPs are delivered at least
+	// once. The duplicates are answered without being counted, and are published as the `dedup` expvar.
+	if eventIDs == nil {
+		eventIDs = adapters.NewMemoryDedup(adapters.DedupConfig{
+			TTL:      24 * time.Hour,
+			Capacity: 1_000_000,
+		})
+	}
+	idempotent := dedup.NewRepo(db, eventIDs, dedup.Config{Log: log})
+	expvar.Publish("dedup", expvar.Func(func() interface{} { return idempotent.Stats() }))
+	db = idempotent
+
+	// Run with -broker-addr to also consume the events published on the catchall.events NATS subject, as JSON like
+	// {"id":"...","domain":"...","type":"delivered"}. Subscribe to the deliver subject of a JetStream push consumer
+	// with explicit acks to have the events acked once written and redelivered when they aren't. The consumer writes
+	// below the ingest queue and flushes the write-behind buffer before every ack, so an event is only acked once it
+	// is in the database or the spool. It shares the event IDs with the API so an event posted both ways is counted
+	// once. The consumer stops before anything else drains on shutdown, its counts are published as the `consumer`
+	// expvar.
+	if brokerAddr != "" {
+		source, err := adapters.NewNatsSource(adapters.NatsSourceConfig{
+			Conn:    nats.Config{Addr: brokerAddr, Name: appName},
+			Subject: "catchall.events",
+			Queue:   appName,
+		})
+		if err != nil {
+			return fmt.Errorf("connecting to nats: %w", err)
+		}
+		events := consumer.NewConsumer(dedup.NewRepo(written, eventIDs, dedup.Config{Log: log}), source, consumer.Config{
+			Log:        log,
+			BatchSize:  100,
+			RetryDelay: time.Second,
+			Flush:      flush,
+		})
+		events.Start()
+		expvar.Publish("consumer", expvar.Func(func() interface{} { return events.Stats() }))
+		drains = append([]func(ctx context.Context) error{events.Shutdown}, drains...)
+	}
+
 	apiMux := handlers.APIMux(handlers.APIMuxConfig{
 		Log:         log,
 		ServiceName: appName,
 		Shutdown:    shutdown,
 		DB:          db,
+		Webhooks:    webhooks,
+		Broker:      broker,
+		AuditLog:    auditLog,
+		// Every admin operation is audited, but only one in every 1000 ingested events so that the audit log doesn't
+		// take a write per event. Set it to 1 to audit every event.
+		AuditEventSample: 1000,
+		// API key -> key ID, the key ID is recorded as the actor in the audit log. Leave empty to disable
+		// authentication, every request is then made by "anonymous" and the admin, audit and webhook routes are
+		// refused with a 403.
+		APIKeys: map[string]string{},
+		// Subject common name of a verified client certificate -> identity, recorded as the actor like a key ID.
+		// Client certificates are only asked for when ClientCAFile is set below.
+		ClientCerts: map[string]string{},
 	})
 
-	// TODO: We should create a background service hosted on a different port to expose debug endpoints
+	// The debug endpoints are served on their own port, which should never be exposed outside of the host.
+	debug := http.Server{
+		Addr:        "localhost:4000",
+		Handler:     handlers.DebugMux(),
+		ReadTimeout: time.Second * 5,
+	}
+	go func() {
+		log.Info().Str("host", debug.Addr).Msg("Debug server starting")
+		if err := debug.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Error().Err(err).Msg("debug server")
+		}
+	}()
+	defer debug.Close()
+
 	// Construct a server to service the requests against the mux.
 	api := http.Server{
 		Addr:         "localhost:7000",
@@ -103,15 +455,54 @@ func server(appName string, log *zerolog.Logger) error {
 		IdleTimeout:  time.Minute * 2,
 	}
 
+	// Streams never go idle, so they need to be ended for the server to shut down gracefully.
+	api.RegisterOnShutdown(broker.Close)
+
 	// Make a channel to listen for errors coming from the listener. Use a
 	// buffered channel so the goroutine can exit if we don't collect this errors.
 	serverErrors := make(chan error, 1)
 
+	// Set CertFile and KeyFile to serve over TLS, and h2 along with it. Set ClientCAFile to verify client certificates
+	// against the bundle, required of every client with RequireClientCert or else used to authenticate those that
+	// present one. The files are read again on SIGHUP, the connections already established are kept.
+	tlsCfg := web.TLSConfig{
+		CertFile:          "",
+		KeyFile:           "",
+		ClientCAFile:      "",
+		RequireClientCert: false,
+	}
+	if tlsCfg.Enabled() {
+		certs, err := web.NewCertReloader(tlsCfg)
+		if err != nil {
+			return fmt.Errorf("loading TLS files: %w", err)
+		}
+		api.TLSConfig = certs.Config()
+
+		reload := make(chan os.Signal, 1)
+		signal.Notify(reload, syscall.SIGHUP)
+		defer signal.Stop(reload)
+		go func() {
+			for range reload {
+				if err := certs.Reload(); err != nil {
+					log.Error().Err(err).Msg("reloading TLS files, still serving the previous ones")
+					continue
+				}
+				log.Info().Msg("reloaded TLS files")
+			}
+		}()
+	}
+
 	// Start the service listening for api requests.
 	go func() {
 		log.Info().
 			Str("host", api.Addr).
+			Bool("tls", tlsCfg.Enabled()).
 			Msg("Application starting")
+		if tlsCfg.Enabled() {
+			// the files come from the TLSConfig of the server
+			serverErrors <- api.ListenAndServeTLS("", "")
+			return
+		}
 		serverErrors <- api.ListenAndServe()
 	}()
 
@@ -119,7 +510,7 @@ func server(appName string, log *zerolog.Logger) error {
 	// Shutdown
 
 	// Blocking main and waiting for shutdown.
-	if err := waitForSignalShutdown(shutdown, serverErrors, &api, log); err != nil {
+	if err := waitForSignalShutdown(shutdown, serverErrors, &api, log, drains...); err != nil {
 		log.Error().
 			Err(err).
 			Msg("server shutdown")
@@ -159,10 +550,15 @@ func initLogger(c loggerConf) *zerolog.Logger {
 
 // waitForSignalShutdown *** THIS IS A BLOCKING CALL *** run a select statement that listens for either server errors
 // or shutdown signals, it'll terminate the running http.Server
-func waitForSignalShutdown(shutdown chan os.Signal, serverErrors chan error, api *http.Server, logger *zerolog.Logger) error {
+func waitForSignalShutdown(shutdown chan os.Signal, serverErrors chan error, api *http.Server, logger *zerolog.Logger, drains ...func(ctx context.Context) error) error {
 
 	select {
 	case err := <-serverErrors:
+		// Nothing is being served anymore, but whatever was accepted before the server failed is still written out.
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second*20)
+		defer cancel()
+		drain(ctx, drains, logger)
+
 		return fmt.Errorf("server errors: %w", err)
 
 	case sig := <-shutdown:
@@ -176,9 +572,21 @@ func waitForSignalShutdown(shutdown chan os.Signal, serverErrors chan error, api
 		// Asking listener to shut down and shed load.
 		if err := api.Shutdown(ctx); err != nil {
 			_ = api.Close()
+			drain(ctx, drains, logger)
 			return fmt.Errorf("could not stop server gracefully: %w", err)
 		}
+
+		drain(ctx, drains, logger)
 	}
 
 	return nil
 }
+
+// drain runs every drain, logging the ones that fail so the rest still get their chance.
+func drain(ctx context.Context, drains []func(ctx context.Context) error, logger *zerolog.Logger) {
+	for _, fn := range drains {
+		if err := fn(ctx); err != nil {
+			logger.Error().Err(err).Msg("shutdown drain")
+		}
+	}
+}
@@ -0,0 +1,57 @@
+package adapters
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/penthious/catchall/business/ports"
+	"github.com/penthious/catchall/business/ports/portstest"
+	"github.com/penthious/catchall/foundation/kv"
+	"github.com/penthious/catchall/foundation/wal"
+)
+
+func TestConformance(t *testing.T) {
+	adapters := []struct {
+		name  string
+		newDB func(t *testing.T) ports.DB
+	}{
+		{"memory", func(t *testing.T) ports.DB { return NewMemoryRepo() }},
+		{"sharded memory", func(t *testing.T) ports.DB { return NewShardedMemoryRepo(4) }},
+		{"durable memory", func(t *testing.T) ports.DB {
+			mr, err := NewDurableMemoryRepo(DurableConfig{Dir: t.TempDir(), Sync: wal.SyncNever, SnapshotInterval: time.Hour})
+			if err != nil {
+				t.Fatal(err)
+			}
+			t.Cleanup(func() { mr.Close() })
+			return mr
+		}},
+		{"redis", func(t *testing.T) ports.DB { return newRedisRepo(t) }},
+		{"embedded", func(t *testing.T) ports.DB {
+			e, err := NewEmbeddedRepo(t.TempDir(), kv.Options{Sync: wal.SyncNever})
+			if err != nil {
+				t.Fatal(err)
+			}
+			t.Cleanup(func() { e.Close() })
+			return e
+		}},
+		{"postgres", newPostgresRepo},
+	}
+
+	for _, a := range adapters {
+		t.Run(a.name, func(t *testing.T) {
+			portstest.Run(t, a.newDB)
+		})
+	}
+}
+
+// newPostgresRepo returns a repo over an emptied domains table, the test is skipped unless
+// portstest.PostgresDSNEnv is set.
+func newPostgresRepo(t *testing.T) ports.DB {
+	db := portstest.Postgres(t)
+	repo := NewPostgresRepo(db)
+	if _, err := db.ExecContext(context.Background(), `TRUNCATE domains RESTART IDENTITY`); err != nil {
+		t.Fatal(err)
+	}
+	return repo
+}
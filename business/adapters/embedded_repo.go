@@ -0,0 +1,221 @@
+package adapters
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/mailgun/catchall"
+	"github.com/penthious/catchall/business/models"
+	"github.com/penthious/catchall/business/ports"
+	"github.com/penthious/catchall/foundation/kv"
+)
+
+var _ ports.DB = EmbeddedRepo{}
+var _ ports.DeltaWriter = EmbeddedRepo{}
+
+// The keys of the embedded repo, every domain is stored under the prefix followed by its name.
+const (
+	embeddedDomainPrefix = "domain/"
+	embeddedIDCounter    = "seq/domain_id"
+)
+
+// embeddedDomain is how a domain is encoded in the store.
+type embeddedDomain struct {
+	ID        int64           `json:"id"`
+	Bounced   int             `json:"bounced,omitempty"`
+	Delivered int             `json:"delivered,omitempty"`
+	LastSeen  time.Time       `json:"last_seen"`
+	Override  models.Override `json:"override"`
+}
+
+// NewEmbeddedRepo opens the embedded store in the directory, Close it on shutdown.
+func NewEmbeddedRepo(dir string, opts kv.Options) (EmbeddedRepo, error) {
+	store, err := kv.Open(dir, opts)
+	if err != nil {
+		return EmbeddedRepo{}, fmt.Errorf("error opening embedded store: %w", err)
+	}
+	return EmbeddedRepo{store: store}, nil
+}
+
+// EmbeddedRepo keeps the domains in an embedded key-value store on the local disk, for deployments that can't run
+// postgres. Every write is a transaction of the store, so increments are atomic and survive a crash.
+type EmbeddedRepo struct{ store *kv.Store }
+
+// Close closes the store.
+func (e EmbeddedRepo) Close() error {
+	return e.store.Close()
+}
+
+func decodeDomain(name string, value []byte) (models.Domain, error) {
+	var ed embeddedDomain
+	if err := json.Unmarshal(value, &ed); err != nil {
+		return models.Domain{}, fmt.Errorf("error decoding domain %s: %w", name, err)
+	}
+	return models.Domain{
+		ID:        ed.ID,
+		Domain:    name,
+		Bounced:   ed.Bounced,
+		Delivered: ed.Delivered,
+		LastSeen:  ed.LastSeen,
+		Override:  ed.Override,
+	}, nil
+}
+
+// get reads the domain in the transaction, or returns a new domain with the next id when it isn't stored yet.
+func (e EmbeddedRepo) get(tx *kv.Tx, name string) (models.Domain, error) {
+	if value, ok := tx.Get(embeddedDomainPrefix + name); ok {
+		return decodeDomain(name, value)
+	}
+
+	id, err := tx.IncrBy(embeddedIDCounter, 1)
+	if err != nil {
+		return models.Domain{}, err
+	}
+	return models.Domain{ID: id, Domain: name, LastSeen: time.Now().UTC()}, nil
+}
+
+func (e EmbeddedRepo) put(tx *kv.Tx, d models.Domain) error {
+	value, err := json.Marshal(embeddedDomain{
+		ID:        d.ID,
+		Bounced:   d.Bounced,
+		Delivered: d.Delivered,
+		LastSeen:  d.LastSeen,
+		Override:  d.Override,
+	})
+	if err != nil {
+		return fmt.Errorf("error encoding domain %s: %w", d.Domain, err)
+	}
+	tx.Put(embeddedDomainPrefix+d.Domain, value)
+	return nil
+}
+
+// Query returns the domain, or ports.ErrNotFound when it is unknown.
+func (e EmbeddedRepo) Query(domain string) (models.Domain, error) {
+	value, ok := e.store.Get(embeddedDomainPrefix + domain)
+	if !ok {
+		return models.Domain{}, ports.ErrNotFound
+	}
+	return decodeDomain(domain, value)
+}
+
+// QueryMany reads every domain from memory.
+func (e EmbeddedRepo) QueryMany(domains []string) (map[string]models.Domain, error) {
+	found := make(map[string]models.Domain, len(domains))
+	for _, domain := range domains {
+		value, ok := e.store.Get(embeddedDomainPrefix + domain)
+		if !ok {
+			continue
+		}
+		d, err := decodeDomain(domain, value)
+		if err != nil {
+			return nil, err
+		}
+		found[domain] = d
+	}
+	return found, nil
+}
+
+// Insert increments the count of the event type in a single transaction.
+func (e EmbeddedRepo) Insert(event catchall.Event) error {
+	dl, err := ports.EventDelta(event, time.Now())
+	if err != nil {
+		return err
+	}
+	return e.ApplyDeltas([]models.Delta{dl})
+}
+
+// ApplyDeltas adds the deltas to their domains in a single transaction, creating the domains that don't exist yet.
+func (e EmbeddedRepo) ApplyDeltas(deltas []models.Delta) error {
+	err := e.store.Update(func(tx *kv.Tx) error {
+		for _, dl := range deltas {
+			d, err := e.get(tx, dl.Domain)
+			if err != nil {
+				return err
+			}
+			if err := e.put(tx, dl.Apply(d)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("error applying deltas: %w", err)
+	}
+	return nil
+}
+
+// Delete removes the domain.
+func (e EmbeddedRepo) Delete(domain string) error {
+	err := e.store.Update(func(tx *kv.Tx) error {
+		tx.Delete(embeddedDomainPrefix + domain)
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("error deleting domain: %w", err)
+	}
+	return nil
+}
+
+// Reset zeroes the counts of the domain if it exists.
+func (e EmbeddedRepo) Reset(domain string) error {
+	return e.update(domain, false, func(d *models.Domain) {
+		d.Bounced, d.Delivered = 0, 0
+	})
+}
+
+// SetOverride sets the override of the domain, creating the domain if it is unknown.
+func (e EmbeddedRepo) SetOverride(domain string, override models.Override) error {
+	return e.update(domain, true, func(d *models.Domain) {
+		d.Override = override
+	})
+}
+
+// ClearOverride removes the override of the domain if it exists.
+func (e EmbeddedRepo) ClearOverride(domain string) error {
+	return e.update(domain, false, func(d *models.Domain) {
+		d.Override = models.Override{}
+	})
+}
+
+// update applies fn to the domain in a transaction, an unknown domain is only created when create is set.
+func (e EmbeddedRepo) update(domain string, create bool, fn func(d *models.Domain)) error {
+	err := e.store.Update(func(tx *kv.Tx) error {
+		if _, ok := tx.Get(embeddedDomainPrefix + domain); !ok && !create {
+			return nil
+		}
+		d, err := e.get(tx, domain)
+		if err != nil {
+			return err
+		}
+		fn(&d)
+		return e.put(tx, d)
+	})
+	if err != nil {
+		return fmt.Errorf("error updating domain: %w", err)
+	}
+	return nil
+}
+
+// List scans the domains in the store and returns the page after the cursor.
+func (e EmbeddedRepo) List(q models.DomainQuery) ([]models.Domain, *models.Cursor, error) {
+	filter := q.Filter.At(time.Now())
+	matched := make([]models.Domain, 0)
+	var err error
+	e.store.Scan(embeddedDomainPrefix, "", func(key string, value []byte) bool {
+		var d models.Domain
+		if d, err = decodeDomain(key[len(embeddedDomainPrefix):], value); err != nil {
+			return false
+		}
+		if filter.Matches(d) {
+			matched = append(matched, d)
+		}
+		return true
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	page, next := paginate(matched, q)
+	return page, next, nil
+}
@@ -0,0 +1,162 @@
+package adapters
+
+import (
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/mailgun/catchall"
+	"github.com/penthious/catchall/business/models"
+	"github.com/penthious/catchall/foundation/kv"
+	"github.com/penthious/catchall/foundation/wal"
+	"github.com/stretchr/testify/assert"
+)
+
+func openEmbedded(t *testing.T, dir string, opts kv.Options) EmbeddedRepo {
+	t.Helper()
+	opts.Sync = wal.SyncAlways
+	e, err := NewEmbeddedRepo(dir, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return e
+}
+
+func TestEmbeddedRepo(t *testing.T) {
+	e := openEmbedded(t, t.TempDir(), kv.Options{})
+	t.Cleanup(func() { e.Close() })
+
+	testDeltaRepo(t, e)
+}
+
+func TestEmbeddedRepoReopen(t *testing.T) {
+	dir := t.TempDir()
+	override := models.Override{Status: models.StatusCatchAll, Reason: "pinned", ExpiresAt: time.Now().Add(time.Hour).UTC()}
+
+	e := openEmbedded(t, dir, kv.Options{})
+	for i := 0; i < 3; i++ {
+		if err := e.Insert(catchall.Event{Domain: "a.com", Type: catchall.TypeDelivered}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, err := range []error{
+		e.Insert(catchall.Event{Domain: "b.com", Type: catchall.TypeBounced}),
+		e.Insert(catchall.Event{Domain: "c.com", Type: catchall.TypeDelivered}),
+		e.SetOverride("d.com", override),
+		e.Delete("c.com"),
+	} {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	want, _, err := e.List(models.DomainQuery{Sort: models.SortID, Limit: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := e.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	e = openEmbedded(t, dir, kv.Options{})
+	defer e.Close()
+	got, _, err := e.List(models.DomainQuery{Sort: models.SortID, Limit: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, want, got)
+
+	// a domain created after the restart must not reuse an id
+	if err := e.Insert(catchall.Event{Domain: "f.com", Type: catchall.TypeDelivered}); err != nil {
+		t.Fatal(err)
+	}
+	f, _ := e.Query("f.com")
+	assert.Equal(t, int64(5), f.ID)
+}
+
+func TestEmbeddedRepoTornRecord(t *testing.T) {
+	dir := t.TempDir()
+
+	e := openEmbedded(t, dir, kv.Options{})
+	for i := 0; i < 5; i++ {
+		if err := e.Insert(catchall.Event{Domain: "a.com", Type: catchall.TypeDelivered}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := e.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Simulate a crash halfway through the next commit, a header promising more payload than made it to disk.
+	logs, _ := filepath.Glob(filepath.Join(dir, "wal-*.log"))
+	if len(logs) != 1 {
+		t.Fatalf("expected a single log, got %v", logs)
+	}
+	f, err := os.OpenFile(logs[0], os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	torn := make([]byte, 8, 20)
+	binary.LittleEndian.PutUint32(torn[0:4], 100)
+	torn = append(torn, []byte("\x01\x0adomain/a")...)
+	if _, err := f.Write(torn); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	e = openEmbedded(t, dir, kv.Options{})
+	a, _ := e.Query("a.com")
+	assert.Equal(t, 5, a.Delivered, "every complete transaction is recovered")
+
+	// transactions committed after the recovery must be readable on the next boot
+	if err := e.Insert(catchall.Event{Domain: "a.com", Type: catchall.TypeBounced}); err != nil {
+		t.Fatal(err)
+	}
+	if err := e.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	e = openEmbedded(t, dir, kv.Options{})
+	defer e.Close()
+	a, _ = e.Query("a.com")
+	assert.Equal(t, 5, a.Delivered)
+	assert.Equal(t, 1, a.Bounced)
+}
+
+func TestEmbeddedRepoCompaction(t *testing.T) {
+	dir := t.TempDir()
+	opts := kv.Options{CompactSize: 4 << 10}
+
+	e := openEmbedded(t, dir, opts)
+	for i := 0; i < 500; i++ {
+		if err := e.Insert(catchall.Event{Domain: "a.com", Type: catchall.TypeDelivered}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := e.Delete("a.com"); err != nil {
+		t.Fatal(err)
+	}
+	if err := e.Insert(catchall.Event{Domain: "b.com", Type: catchall.TypeBounced}); err != nil {
+		t.Fatal(err)
+	}
+	if err := e.store.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	if err := e.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	tables, _ := filepath.Glob(filepath.Join(dir, "table-*.kv"))
+	logs, _ := filepath.Glob(filepath.Join(dir, "wal-*.log"))
+	assert.Len(t, tables, 1, "older tables are removed")
+	assert.Len(t, logs, 1, "the logs covered by the table are removed")
+
+	e = openEmbedded(t, dir, opts)
+	defer e.Close()
+	a, _ := e.Query("a.com")
+	assert.Zero(t, a.ID)
+	b, _ := e.Query("b.com")
+	assert.Equal(t, int64(2), b.ID)
+	assert.Equal(t, 1, b.Bounced)
+}
@@ -0,0 +1,263 @@
+package adapters
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/penthious/catchall/business/models"
+	"github.com/penthious/catchall/business/ports"
+)
+
+var _ ports.AuditLog = (*FileAuditLog)(nil)
+
+const (
+	auditFilePrefix = "audit-"
+	auditFileSuffix = ".jsonl"
+	// auditFileTime is the layout of the time a file was started in its name, it sorts in time order.
+	auditFileTime = "20060102T150405.000000000Z"
+)
+
+// NewFileAuditLog returns a FileAuditLog writing into dir. It keeps appending to the newest file in dir when there is
+// room left in it, after cutting off a line that was torn by a crash in the middle of an append.
+func NewFileAuditLog(dir string, maxBytes int64, maxFiles int) (*FileAuditLog, error) {
+	if err := os.MkdirAll(dir, 0o750); err != nil {
+		return nil, fmt.Errorf("error creating audit dir: %w", err)
+	}
+
+	fl := FileAuditLog{
+		dir:      dir,
+		maxBytes: maxBytes,
+		maxFiles: maxFiles,
+	}
+
+	files, err := fl.files()
+	if err != nil {
+		return nil, err
+	}
+	if len(files) > 0 {
+		newest := files[len(files)-1]
+		f, err := os.OpenFile(newest, os.O_RDWR|os.O_APPEND, 0o640)
+		if err != nil {
+			return nil, fmt.Errorf("error opening audit file: %w", err)
+		}
+		size, err := truncateTorn(f)
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+		fl.file, fl.size = f, size
+	}
+
+	return &fl, nil
+}
+
+// FileAuditLog appends the audit log as JSON lines to a file, rotating to a new file once the current one reaches
+// maxBytes and removing the oldest files beyond maxFiles.
+type FileAuditLog struct {
+	dir      string
+	maxBytes int64
+	maxFiles int
+
+	mu   sync.Mutex
+	file *os.File
+	size int64
+}
+
+// Append writes the entry to the current file and syncs it to disk.
+func (fl *FileAuditLog) Append(entry models.AuditEntry) error {
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return fmt.Errorf("error marshalling audit entry: %w", err)
+	}
+	line = append(line, '\n')
+
+	fl.mu.Lock()
+	defer fl.mu.Unlock()
+
+	if fl.file == nil || (fl.size > 0 && fl.size+int64(len(line)) > fl.maxBytes) {
+		if err := fl.rotate(); err != nil {
+			return err
+		}
+	}
+
+	n, err := fl.file.Write(line)
+	fl.size += int64(n)
+	if err != nil {
+		return fmt.Errorf("error writing audit entry: %w", err)
+	}
+	if err := fl.file.Sync(); err != nil {
+		return fmt.Errorf("error syncing audit file: %w", err)
+	}
+
+	return nil
+}
+
+// Query scans the files for the entries selected by the query, oldest first. Files that were rotated out before the
+// start of the range are skipped. It doesn't hold the lock, so appends go on during a scan, an entry that is being
+// appended is left out and a file that is pruned in the meantime is skipped.
+func (fl *FileAuditLog) Query(q models.AuditQuery) ([]models.AuditEntry, error) {
+	files, err := fl.files()
+	if err != nil {
+		return nil, err
+	}
+
+	entries := make([]models.AuditEntry, 0)
+	for i, name := range files {
+		// Every entry in a file was written before the next file was started.
+		if !q.From.IsZero() && i+1 < len(files) && !startedAt(files[i+1]).After(q.From) {
+			continue
+		}
+
+		entries, err = scanAuditFile(name, q, entries)
+		if err != nil {
+			return nil, err
+		}
+		if q.Limit > 0 && len(entries) >= q.Limit {
+			return entries[:q.Limit], nil
+		}
+	}
+
+	return entries, nil
+}
+
+// Close closes the current file.
+func (fl *FileAuditLog) Close() error {
+	fl.mu.Lock()
+	defer fl.mu.Unlock()
+	if fl.file == nil {
+		return nil
+	}
+	err := fl.file.Close()
+	fl.file = nil
+	return err
+}
+
+// rotate starts a new file and prunes the oldest ones, the caller must hold the lock.
+func (fl *FileAuditLog) rotate() error {
+	if fl.file != nil {
+		if err := fl.file.Close(); err != nil {
+			return fmt.Errorf("error closing audit file: %w", err)
+		}
+		fl.file = nil
+	}
+
+	name := filepath.Join(fl.dir, auditFilePrefix+time.Now().UTC().Format(auditFileTime)+auditFileSuffix)
+	f, err := os.OpenFile(name, os.O_WRONLY|os.O_APPEND|os.O_CREATE|os.O_EXCL, 0o640)
+	if err != nil {
+		return fmt.Errorf("error creating audit file: %w", err)
+	}
+	fl.file, fl.size = f, 0
+
+	files, err := fl.files()
+	if err != nil {
+		return err
+	}
+	for fl.maxFiles > 0 && len(files) > fl.maxFiles {
+		if err := os.Remove(files[0]); err != nil {
+			return fmt.Errorf("error removing audit file: %w", err)
+		}
+		files = files[1:]
+	}
+
+	return nil
+}
+
+// files returns the audit files in dir, oldest first.
+func (fl *FileAuditLog) files() ([]string, error) {
+	files, err := filepath.Glob(filepath.Join(fl.dir, auditFilePrefix+"*"+auditFileSuffix))
+	if err != nil {
+		return nil, fmt.Errorf("error listing audit files: %w", err)
+	}
+	sort.Strings(files)
+	return files, nil
+}
+
+// startedAt returns the time the file was started from its name.
+func startedAt(name string) time.Time {
+	base := strings.TrimSuffix(strings.TrimPrefix(filepath.Base(name), auditFilePrefix), auditFileSuffix)
+	t, _ := time.Parse(auditFileTime, base)
+	return t
+}
+
+// truncateTorn cuts the file back to its last complete line and returns the size left. Every entry is written with
+// its newline in one go, so anything after the last newline is what a crash left of an append.
+func truncateTorn(f *os.File) (int64, error) {
+	info, err := f.Stat()
+	if err != nil {
+		return 0, fmt.Errorf("error reading audit file: %w", err)
+	}
+
+	size := info.Size()
+	buf := make([]byte, 64*1024)
+	for end := size; end > 0; {
+		start := end - int64(len(buf))
+		if start < 0 {
+			start = 0
+		}
+		n, err := f.ReadAt(buf[:end-start], start)
+		if err != nil && !errors.Is(err, io.EOF) {
+			return 0, fmt.Errorf("error reading audit file: %w", err)
+		}
+		if i := bytes.LastIndexByte(buf[:n], '\n'); i >= 0 {
+			return cutAt(f, size, start+int64(i)+1)
+		}
+		end = start
+	}
+	return cutAt(f, size, 0)
+}
+
+// cutAt truncates the file to n bytes unless it is that size already.
+func cutAt(f *os.File, size, n int64) (int64, error) {
+	if n == size {
+		return size, nil
+	}
+	if err := f.Truncate(n); err != nil {
+		return 0, fmt.Errorf("error truncating torn audit entry: %w", err)
+	}
+	return n, nil
+}
+
+// scanAuditFile appends the entries in the file selected by the query to entries. A last line that doesn't decode is
+// an append still in progress and is left out, a file that no longer exists was pruned and has nothing to add.
+func scanAuditFile(name string, q models.AuditQuery, entries []models.AuditEntry) ([]models.AuditEntry, error) {
+	f, err := os.Open(name)
+	if errors.Is(err, os.ErrNotExist) {
+		return entries, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error opening audit file: %w", err)
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 16<<20)
+	var torn error
+	for scanner.Scan() {
+		if torn != nil {
+			return nil, torn
+		}
+		var e models.AuditEntry
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			torn = fmt.Errorf("error decoding audit entry in %s: %w", name, err)
+			continue
+		}
+		if q.Matches(e) {
+			entries = append(entries, e)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("error reading audit file: %w", err)
+	}
+
+	return entries, nil
+}
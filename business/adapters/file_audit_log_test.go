@@ -0,0 +1,132 @@
+package adapters
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/penthious/catchall/business/models"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFileAuditLog(t *testing.T) {
+	dir := t.TempDir()
+	fl, err := NewFileAuditLog(dir, 512, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// entries are always appended after the time they record
+	start := time.Now().UTC().Add(-time.Hour)
+	for i := 0; i < 20; i++ {
+		entry := models.AuditEntry{
+			At:     start.Add(time.Duration(i) * time.Second),
+			Actor:  "key-1",
+			Action: "domain.reset",
+			Target: fmt.Sprintf("%d.example.com", i),
+			After:  []byte(`{"status":"unknown"}`),
+		}
+		if err := fl.Append(entry); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	files, _ := filepath.Glob(filepath.Join(dir, "audit-*.jsonl"))
+	assert.Len(t, files, 3, "rotated files beyond the limit are removed")
+
+	entries, err := fl.Query(models.AuditQuery{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !assert.NotEmpty(t, entries) {
+		t.FailNow()
+	}
+	assert.Equal(t, "19.example.com", entries[len(entries)-1].Target)
+	assert.JSONEq(t, `{"status":"unknown"}`, string(entries[0].After))
+
+	entries, err = fl.Query(models.AuditQuery{
+		From:  start.Add(17 * time.Second),
+		To:    start.Add(19 * time.Second),
+		Limit: 10,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if assert.Len(t, entries, 2) {
+		assert.Equal(t, "17.example.com", entries[0].Target)
+		assert.Equal(t, "18.example.com", entries[1].Target)
+	}
+
+	// reopening keeps appending to the newest file
+	if err := fl.Close(); err != nil {
+		t.Fatal(err)
+	}
+	fl, err = NewFileAuditLog(dir, 512, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fl.Close()
+	if err := fl.Append(models.AuditEntry{At: start.Add(time.Minute), Target: "last"}); err != nil {
+		t.Fatal(err)
+	}
+	entries, err = fl.Query(models.AuditQuery{Target: "last"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Len(t, entries, 1)
+}
+
+func TestFileAuditLogTornLine(t *testing.T) {
+	dir := t.TempDir()
+	fl, err := NewFileAuditLog(dir, 1<<20, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, target := range []string{"a", "b"} {
+		if err := fl.Append(models.AuditEntry{At: time.Now().UTC(), Target: target}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	files, _ := filepath.Glob(filepath.Join(dir, "audit-*.jsonl"))
+	if !assert.Len(t, files, 1) {
+		t.FailNow()
+	}
+	targets := func(fl *FileAuditLog) []string {
+		entries, err := fl.Query(models.AuditQuery{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		var targets []string
+		for _, e := range entries {
+			targets = append(targets, e.Target)
+		}
+		return targets
+	}
+
+	// what a crash halfway through an append leaves behind
+	f, err := os.OpenFile(files[0], os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.WriteString(`{"actor":"key-1","tar`); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	assert.Equal(t, []string{"a", "b"}, targets(fl), "an append in progress is left out")
+	if err := fl.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	fl, err = NewFileAuditLog(dir, 1<<20, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fl.Close()
+	if err := fl.Append(models.AuditEntry{At: time.Now().UTC(), Target: "c"}); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, []string{"a", "b", "c"}, targets(fl), "the torn line was cut off when the file was opened")
+}
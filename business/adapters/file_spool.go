@@ -0,0 +1,370 @@
+package adapters
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+
+	"github.com/penthious/catchall/business/models"
+	"github.com/penthious/catchall/business/ports"
+	"github.com/penthious/catchall/foundation/wal"
+	"github.com/rs/zerolog"
+)
+
+var _ ports.Spool = (*FileSpool)(nil)
+
+const spoolCursorFile = "cursor.json"
+
+// walHeaderSize is the framing the WAL adds in front of every record, counted in the size of the spool.
+const walHeaderSize = 8
+
+// SpoolConfig configures a FileSpool, zero values are replaced with the defaults.
+type SpoolConfig struct {
+	// Dir holds the segments of the spool and its cursor, it is created if needed.
+	Dir string
+	// Sync decides when appended batches are fsynced, wal.SyncAlways when left zero so a batch is on disk once Append
+	// returned.
+	Sync wal.SyncPolicy
+	// MaxBytes caps the size of the spool on disk, appends fail with ports.ErrSpoolFull beyond it. 1GiB by default.
+	MaxBytes int64
+	// SegmentBytes is the size a segment grows to before the next one is started, 16MiB by default. The spool shrinks a
+	// segment at a time as the batches are acked.
+	SegmentBytes int64
+	// Log receives the torn records dropped on open, it is optional.
+	Log *zerolog.Logger
+}
+
+// spoolSegment is a WAL file of the spool.
+type spoolSegment struct {
+	n       int
+	batches int
+	bytes   int64
+}
+
+// spoolCursor is how far into the oldest segment the batches were acked.
+type spoolCursor struct {
+	Segment int `json:"segment"`
+	Acked   int `json:"acked"`
+}
+
+// FileSpool is a ports.Spool that appends every batch as a record to numbered WAL segments in a directory. The batches
+// of the oldest segment are read into memory when they are peeked, and the segment is removed once they are all acked.
+// The acked position within it is kept in a cursor file, so a restart doesn't hand out the acked batches again.
+type FileSpool struct {
+	cfg SpoolConfig
+
+	mu       sync.Mutex
+	segments []spoolSegment
+	active   *wal.Log
+	cursor   spoolCursor
+	// head are the batches of segments[0] that weren't acked yet, nil until they are peeked. The segment is sealed once
+	// they were read, nothing is appended to it anymore.
+	head    [][]models.Delta
+	batches int
+	bytes   int64
+}
+
+// NewFileSpool opens the spool in the directory, counting the batches left in it by an earlier process. A batch torn by
+// a crash at the end of a segment is dropped.
+func NewFileSpool(cfg SpoolConfig) (*FileSpool, error) {
+	if cfg.MaxBytes <= 0 {
+		cfg.MaxBytes = 1 << 30
+	}
+	if cfg.SegmentBytes <= 0 {
+		cfg.SegmentBytes = 16 << 20
+	}
+	if cfg.Log == nil {
+		nop := zerolog.Nop()
+		cfg.Log = &nop
+	}
+
+	if err := os.MkdirAll(cfg.Dir, 0o750); err != nil {
+		return nil, fmt.Errorf("error creating spool directory: %w", err)
+	}
+
+	s := FileSpool{cfg: cfg}
+	if err := s.restore(); err != nil {
+		return nil, err
+	}
+	return &s, nil
+}
+
+// restore reads the cursor, counts the batches of every segment and opens the last one for appending.
+func (s *FileSpool) restore() error {
+	if err := readJSONFile(filepath.Join(s.cfg.Dir, spoolCursorFile), &s.cursor); err != nil {
+		return err
+	}
+
+	paths, err := filepath.Glob(filepath.Join(s.cfg.Dir, "spool-*.log"))
+	if err != nil {
+		return err
+	}
+	numbers := make([]int, 0, len(paths))
+	for _, path := range paths {
+		var n int
+		if _, err := fmt.Sscanf(filepath.Base(path), "spool-%d.log", &n); err != nil {
+			continue
+		}
+		numbers = append(numbers, n)
+	}
+	sort.Ints(numbers)
+
+	for _, n := range numbers {
+		// Left behind by a crash between moving the cursor past the segment and removing it.
+		if n < s.cursor.Segment {
+			if err := os.Remove(s.path(n)); err != nil {
+				return fmt.Errorf("error removing spool segment: %w", err)
+			}
+			continue
+		}
+
+		seg, err := s.count(n)
+		if err != nil {
+			return err
+		}
+		s.segments = append(s.segments, seg)
+		s.batches += seg.batches
+		s.bytes += seg.bytes
+	}
+
+	if len(s.segments) == 0 {
+		n := s.cursor.Segment
+		if n == 0 {
+			n = 1
+		}
+		s.segments = []spoolSegment{{n: n}}
+	}
+	if s.segments[0].n != s.cursor.Segment {
+		s.cursor = spoolCursor{Segment: s.segments[0].n}
+	}
+	if s.cursor.Acked > s.segments[0].batches {
+		s.cursor.Acked = s.segments[0].batches
+	}
+	s.batches -= s.cursor.Acked
+
+	active, err := wal.Open(s.path(s.last().n), s.cfg.Sync)
+	if err != nil {
+		return err
+	}
+	s.active = active
+
+	return nil
+}
+
+// count returns the number of batches and bytes of the segment.
+func (s *FileSpool) count(n int) (spoolSegment, error) {
+	seg := spoolSegment{n: n}
+	_, err := s.replay(n, func(payload []byte) error {
+		seg.batches++
+		seg.bytes += walHeaderSize + int64(len(payload))
+		return nil
+	})
+	return seg, err
+}
+
+func (s *FileSpool) replay(n int, fn func(payload []byte) error) (int64, error) {
+	path := s.path(n)
+	log, err := wal.Open(path, wal.SyncNever)
+	if err != nil {
+		return 0, err
+	}
+	defer log.Close()
+
+	torn, err := log.Replay(fn)
+	if err != nil {
+		return 0, fmt.Errorf("error reading %s: %w", path, err)
+	}
+	if torn > 0 {
+		s.cfg.Log.Warn().Str("segment", path).Int64("bytes", torn).Msg("dropped torn spool record")
+	}
+	return torn, nil
+}
+
+func (s *FileSpool) path(n int) string {
+	return filepath.Join(s.cfg.Dir, fmt.Sprintf("spool-%08d.log", n))
+}
+
+func (s *FileSpool) last() *spoolSegment {
+	return &s.segments[len(s.segments)-1]
+}
+
+// Append writes the deltas as a single record to the newest segment, starting a new one once it is full.
+func (s *FileSpool) Append(deltas []models.Delta) error {
+	payload, err := json.Marshal(deltas)
+	if err != nil {
+		return fmt.Errorf("error encoding spool batch: %w", err)
+	}
+	size := walHeaderSize + int64(len(payload))
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.bytes+size > s.cfg.MaxBytes {
+		return ports.ErrSpoolFull
+	}
+	if s.last().bytes > 0 && s.last().bytes+size > s.cfg.SegmentBytes {
+		if err := s.rotate(); err != nil {
+			return err
+		}
+	}
+
+	if err := s.active.Append(payload); err != nil {
+		return err
+	}
+	s.last().batches++
+	s.last().bytes += size
+	s.batches++
+	s.bytes += size
+
+	return nil
+}
+
+// rotate seals the newest segment and starts appending to the next one, the caller must hold the lock.
+func (s *FileSpool) rotate() error {
+	n := s.last().n + 1
+	next, err := wal.Open(s.path(n), s.cfg.Sync)
+	if err != nil {
+		return err
+	}
+	if err := s.active.Close(); err != nil {
+		next.Close()
+		return err
+	}
+	s.active = next
+	s.segments = append(s.segments, spoolSegment{n: n})
+	return nil
+}
+
+// Peek returns up to n of the oldest batches. They are read from the oldest segment, which is sealed first when
+// appends still go to it.
+func (s *FileSpool) Peek(n int) ([][]models.Delta, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for len(s.head) == 0 {
+		if s.batches == 0 {
+			return nil, nil
+		}
+		if s.head != nil {
+			// every batch of the sealed segment was acked
+			if err := s.drop(); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		if err := s.load(); err != nil {
+			return nil, err
+		}
+	}
+
+	if n > len(s.head) {
+		n = len(s.head)
+	}
+	return s.head[:n:n], nil
+}
+
+// load reads the batches of the oldest segment past the cursor into head, the caller must hold the lock.
+func (s *FileSpool) load() error {
+	if len(s.segments) == 1 {
+		if err := s.rotate(); err != nil {
+			return err
+		}
+	}
+
+	head := make([][]models.Delta, 0, s.segments[0].batches)
+	skip := s.cursor.Acked
+	_, err := s.replay(s.segments[0].n, func(payload []byte) error {
+		if skip > 0 {
+			skip--
+			return nil
+		}
+		var deltas []models.Delta
+		if err := json.Unmarshal(payload, &deltas); err != nil {
+			return fmt.Errorf("error decoding spool batch: %w", err)
+		}
+		head = append(head, deltas)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	s.head = head
+	return nil
+}
+
+// Ack removes the n oldest batches, and the oldest segment once all of its batches were acked.
+func (s *FileSpool) Ack(n int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if n <= 0 {
+		return nil
+	}
+	if n > len(s.head) {
+		return fmt.Errorf("acking %d spool batches, only %d were peeked", n, len(s.head))
+	}
+
+	s.head = s.head[n:]
+	s.cursor.Acked += n
+	s.batches -= n
+
+	if len(s.head) == 0 {
+		return s.drop()
+	}
+	return writeJSONFile(s.cfg.Dir, spoolCursorFile, s.cursor)
+}
+
+// drop moves the cursor to the next segment and removes the oldest one, the caller must hold the lock. The cursor is
+// moved first, a segment left behind by a crash in between is removed on open.
+func (s *FileSpool) drop() error {
+	oldest := s.segments[0]
+	cursor := spoolCursor{Segment: s.segments[1].n}
+	if err := writeJSONFile(s.cfg.Dir, spoolCursorFile, cursor); err != nil {
+		return err
+	}
+
+	s.cursor = cursor
+	s.segments = s.segments[1:]
+	s.head = nil
+	s.bytes -= oldest.bytes
+
+	if err := os.Remove(s.path(oldest.n)); err != nil {
+		return fmt.Errorf("error removing spool segment: %w", err)
+	}
+	return nil
+}
+
+// Size returns the number of batches left and the bytes of the segments, which include the acked batches of the
+// oldest segment until it is removed.
+func (s *FileSpool) Size() (int, int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.batches, s.bytes
+}
+
+// Close closes the newest segment, the batches left in the spool are read again by the next NewFileSpool.
+func (s *FileSpool) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.active.Close()
+}
+
+// readJSONFile decodes the file into v, leaving v untouched when the file doesn't exist.
+func readJSONFile(path string, v interface{}) error {
+	b, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("error reading %s: %w", filepath.Base(path), err)
+	}
+	if err := json.Unmarshal(b, v); err != nil {
+		return fmt.Errorf("error decoding %s: %w", filepath.Base(path), err)
+	}
+	return nil
+}
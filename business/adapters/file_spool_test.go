@@ -0,0 +1,147 @@
+package adapters
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/penthious/catchall/business/models"
+	"github.com/penthious/catchall/business/ports"
+	"github.com/stretchr/testify/assert"
+)
+
+func spoolBatch(domain string, bounced int) []models.Delta {
+	return []models.Delta{{Domain: domain, Bounced: bounced, LastSeen: time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)}}
+}
+
+func openSpool(t *testing.T, cfg SpoolConfig) *FileSpool {
+	t.Helper()
+	s, err := NewFileSpool(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func appendBatches(t *testing.T, s *FileSpool, batches ...[]models.Delta) {
+	t.Helper()
+	for _, b := range batches {
+		if err := s.Append(b); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// drain peeks and acks until the spool is empty, and returns every batch in the order they were peeked.
+func drain(t *testing.T, s *FileSpool) [][]models.Delta {
+	t.Helper()
+	var all [][]models.Delta
+	for {
+		got, err := s.Peek(10)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(got) == 0 {
+			return all
+		}
+		all = append(all, got...)
+		if err := s.Ack(len(got)); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestFileSpool(t *testing.T) {
+	dir := t.TempDir()
+	s := openSpool(t, SpoolConfig{Dir: dir, SegmentBytes: 200})
+	defer s.Close()
+
+	got, err := s.Peek(10)
+	assert.NoError(t, err)
+	assert.Empty(t, got)
+
+	for i := 1; i <= 5; i++ {
+		appendBatches(t, s, spoolBatch("a.com", i))
+	}
+	batches, bytes := s.Size()
+	assert.Equal(t, 5, batches)
+	assert.Greater(t, bytes, int64(0))
+
+	got, err = s.Peek(2)
+	assert.NoError(t, err)
+	assert.Equal(t, [][]models.Delta{spoolBatch("a.com", 1), spoolBatch("a.com", 2)}, got)
+
+	again, err := s.Peek(2)
+	assert.NoError(t, err)
+	assert.Equal(t, got, again, "peeking again returns the same batches")
+
+	if err := s.Ack(2); err != nil {
+		t.Fatal(err)
+	}
+	got, err = s.Peek(1)
+	assert.NoError(t, err)
+	assert.Equal(t, [][]models.Delta{spoolBatch("a.com", 3)}, got)
+	assert.Error(t, s.Ack(100), "there aren't that many batches")
+
+	t.Run("appends after a peek are kept in order", func(t *testing.T) {
+		appendBatches(t, s, spoolBatch("b.com", 6))
+
+		want := [][]models.Delta{
+			spoolBatch("a.com", 3), spoolBatch("a.com", 4), spoolBatch("a.com", 5), spoolBatch("b.com", 6),
+		}
+		assert.Equal(t, want, drain(t, s))
+
+		batches, bytes := s.Size()
+		assert.Zero(t, batches)
+		assert.Zero(t, bytes)
+
+		segments, _ := filepath.Glob(filepath.Join(dir, "spool-*.log"))
+		assert.Len(t, segments, 1, "the acked segments are removed")
+	})
+}
+
+func TestFileSpoolRestart(t *testing.T) {
+	dir := t.TempDir()
+	s := openSpool(t, SpoolConfig{Dir: dir})
+	appendBatches(t, s, spoolBatch("a.com", 1), spoolBatch("a.com", 2), spoolBatch("a.com", 3))
+	if _, err := s.Peek(1); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Ack(1); err != nil {
+		t.Fatal(err)
+	}
+	appendBatches(t, s, spoolBatch("a.com", 4))
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// a batch torn by a crash
+	segments, _ := filepath.Glob(filepath.Join(dir, "spool-*.log"))
+	f, err := os.OpenFile(segments[len(segments)-1], os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Write([]byte{42, 0, 0, 0, 1}); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	s = openSpool(t, SpoolConfig{Dir: dir})
+	defer s.Close()
+
+	batches, _ := s.Size()
+	assert.Equal(t, 3, batches, "the acked batch isn't handed out again")
+	assert.Equal(t, [][]models.Delta{spoolBatch("a.com", 2), spoolBatch("a.com", 3), spoolBatch("a.com", 4)}, drain(t, s))
+}
+
+func TestFileSpoolFull(t *testing.T) {
+	s := openSpool(t, SpoolConfig{Dir: t.TempDir(), MaxBytes: 100})
+	defer s.Close()
+
+	appendBatches(t, s, spoolBatch("a.com", 1))
+	assert.ErrorIs(t, s.Append(spoolBatch("a.com", 2)), ports.ErrSpoolFull)
+
+	drain(t, s)
+	assert.NoError(t, s.Append(spoolBatch("a.com", 2)), "acking makes room")
+}
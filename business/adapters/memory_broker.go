@@ -0,0 +1,132 @@
+package adapters
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"sync"
+
+	"github.com/mailgun/catchall"
+	"github.com/penthious/catchall/business/models"
+	"github.com/penthious/catchall/business/ports"
+)
+
+var _ ports.Source = (*MemoryBrokerSource)(nil)
+
+// MemoryBroker is an in-process broker with the semantics of a partitioned log, for tests and local development.
+// Every topic is a log of events, and every consumer group commits the offset it read the topic up to.
+type MemoryBroker struct {
+	mu     sync.Mutex
+	topics map[string][]catchall.Event
+	// committed is the offset of the next event to read per group and topic.
+	committed map[string]int64
+	// published is closed and replaced on every publish, to wake the sources waiting for events.
+	published chan struct{}
+}
+
+// NewMemoryBroker returns an empty broker.
+func NewMemoryBroker() *MemoryBroker {
+	return &MemoryBroker{
+		topics:    make(map[string][]catchall.Event),
+		committed: make(map[string]int64),
+		published: make(chan struct{}),
+	}
+}
+
+// Publish appends the events to the topic.
+func (b *MemoryBroker) Publish(topic string, events ...catchall.Event) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.topics[topic] = append(b.topics[topic], events...)
+	close(b.published)
+	b.published = make(chan struct{})
+}
+
+// Committed returns the offset the group committed the topic up to.
+func (b *MemoryBroker) Committed(topic, group string) int64 {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.committed[group+"/"+topic]
+}
+
+// Source returns a Source reading the topic for the group from its committed offset. The events that were read but
+// not committed by an earlier Source of the group are delivered again, like after a rebalance.
+func (b *MemoryBroker) Source(topic, group string) *MemoryBrokerSource {
+	return &MemoryBrokerSource{
+		broker: b,
+		topic:  topic,
+		group:  group,
+		next:   b.Committed(topic, group),
+	}
+}
+
+// MemoryBrokerSource reads a topic of a MemoryBroker for a consumer group. The ID of a message is its topic and offset.
+type MemoryBrokerSource struct {
+	broker *MemoryBroker
+	topic  string
+	group  string
+
+	mu   sync.Mutex
+	next int64
+}
+
+// Fetch waits for events past the ones already fetched, and returns up to max of them.
+func (s *MemoryBrokerSource) Fetch(ctx context.Context, max int) ([]models.Message, error) {
+	for {
+		s.mu.Lock()
+		s.broker.mu.Lock()
+		log := s.broker.topics[s.topic]
+		published := s.broker.published
+		s.broker.mu.Unlock()
+
+		if int64(len(log)) > s.next {
+			end := s.next + int64(max)
+			if end > int64(len(log)) {
+				end = int64(len(log))
+			}
+
+			msgs := make([]models.Message, 0, end-s.next)
+			for offset := s.next; offset < end; offset++ {
+				msgs = append(msgs, models.Message{
+					ID:    fmt.Sprintf("%s/%d", s.topic, offset),
+					Event: log[offset],
+					Ack:   strconv.FormatInt(offset, 10),
+				})
+			}
+			s.next = end
+			s.mu.Unlock()
+			return msgs, nil
+		}
+		s.mu.Unlock()
+
+		select {
+		case <-published:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// Commit moves the committed offset of the group past the messages.
+func (s *MemoryBrokerSource) Commit(_ context.Context, msgs []models.Message) error {
+	s.broker.mu.Lock()
+	defer s.broker.mu.Unlock()
+
+	key := s.group + "/" + s.topic
+	for _, msg := range msgs {
+		offset, err := strconv.ParseInt(msg.Ack, 10, 64)
+		if err != nil {
+			return fmt.Errorf("error committing message %s: %w", msg.ID, err)
+		}
+		if offset+1 > s.broker.committed[key] {
+			s.broker.committed[key] = offset + 1
+		}
+	}
+	return nil
+}
+
+// Close does nothing, the events that weren't committed are delivered to the next Source of the group.
+func (s *MemoryBrokerSource) Close() error {
+	return nil
+}
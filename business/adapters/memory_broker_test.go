@@ -0,0 +1,65 @@
+package adapters
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/mailgun/catchall"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMemoryBroker(t *testing.T) {
+	broker := NewMemoryBroker()
+	for _, domain := range []string{"a.com", "b.com", "c.com"} {
+		broker.Publish("events", catchall.Event{Domain: domain, Type: catchall.TypeDelivered})
+	}
+
+	ctx := context.Background()
+	source := broker.Source("events", "catchall")
+	msgs, err := source.Fetch(ctx, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if assert.Len(t, msgs, 2) {
+		assert.Equal(t, "events/0", msgs[0].ID)
+		assert.Equal(t, "b.com", msgs[1].Event.Domain)
+	}
+	assert.NoError(t, source.Commit(ctx, msgs[:1]))
+	assert.Equal(t, int64(1), broker.Committed("events", "catchall"))
+	assert.Zero(t, broker.Committed("events", "other"), "every group has its own offset")
+
+	t.Run("uncommitted events are delivered again to the next source", func(t *testing.T) {
+		msgs, err := broker.Source("events", "catchall").Fetch(ctx, 10)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if assert.Len(t, msgs, 2) {
+			assert.Equal(t, "events/1", msgs[0].ID)
+		}
+	})
+
+	t.Run("fetch waits for events", func(t *testing.T) {
+		msgs, err := source.Fetch(ctx, 10)
+		if err != nil || len(msgs) != 1 {
+			t.Fatalf("expected the last event, got %v %v", msgs, err)
+		}
+
+		go func() {
+			time.Sleep(10 * time.Millisecond)
+			broker.Publish("events", catchall.Event{Domain: "d.com", Type: catchall.TypeBounced})
+		}()
+		msgs, err = source.Fetch(ctx, 10)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if assert.Len(t, msgs, 1) {
+			assert.Equal(t, "events/3", msgs[0].ID)
+		}
+
+		ctx, cancel := context.WithTimeout(ctx, 10*time.Millisecond)
+		defer cancel()
+		_, err = source.Fetch(ctx, 10)
+		assert.ErrorIs(t, err, context.DeadlineExceeded)
+	})
+}
@@ -0,0 +1,160 @@
+package adapters
+
+import (
+	"container/list"
+	"hash/fnv"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/penthious/catchall/business/ports"
+)
+
+var _ ports.Dedup = (*MemoryDedup)(nil)
+
+// DedupConfig configures a MemoryDedup, zero values are replaced with the defaults.
+type DedupConfig struct {
+	// TTL is how long an ID is remembered, 24h by default.
+	TTL time.Duration
+	// Capacity is the most IDs remembered, the least recently seen ones are forgotten first. 1,000,000 by default.
+	Capacity int
+	// FalsePositiveRate is the rate at which the bloom filter sends a new ID to the LRU, 1% by default.
+	FalsePositiveRate float64
+}
+
+// MemoryDedup remembers the IDs in a bloom filter in front of an exact LRU. Most new IDs are told apart by the bloom
+// filter alone, the IDs it may have seen are looked up in the LRU, so a false positive of the filter never drops an
+// event. The filter is made of two generations swapped every TTL so that it forgets the old IDs too.
+type MemoryDedup struct {
+	cfg DedupConfig
+	now func() time.Time
+
+	mu       sync.Mutex
+	current  *bloom
+	previous *bloom
+	rotated  time.Time
+
+	lru     *list.List
+	entries map[string]*list.Element
+}
+
+// dedupEntry is an ID in the LRU.
+type dedupEntry struct {
+	id      string
+	expires time.Time
+}
+
+// NewMemoryDedup returns an empty MemoryDedup.
+func NewMemoryDedup(cfg DedupConfig) *MemoryDedup {
+	if cfg.TTL <= 0 {
+		cfg.TTL = 24 * time.Hour
+	}
+	if cfg.Capacity <= 0 {
+		cfg.Capacity = 1_000_000
+	}
+	if cfg.FalsePositiveRate <= 0 || cfg.FalsePositiveRate >= 1 {
+		cfg.FalsePositiveRate = 0.01
+	}
+
+	d := &MemoryDedup{
+		cfg:     cfg,
+		now:     time.Now,
+		lru:     list.New(),
+		entries: make(map[string]*list.Element),
+	}
+	d.current = newBloom(cfg.Capacity, cfg.FalsePositiveRate)
+	d.previous = newBloom(cfg.Capacity, cfg.FalsePositiveRate)
+	d.rotated = d.now()
+	return d
+}
+
+// Claim records the ID, and returns false when it was recorded less than TTL ago.
+func (d *MemoryDedup) Claim(id string) (bool, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	now := d.now()
+	if now.Sub(d.rotated) >= d.cfg.TTL {
+		d.previous, d.current = d.current, newBloom(d.cfg.Capacity, d.cfg.FalsePositiveRate)
+		d.rotated = now
+	}
+
+	h1, h2 := bloomHash(id)
+	if d.current.has(h1, h2) || d.previous.has(h1, h2) {
+		if el, ok := d.entries[id]; ok {
+			if now.Before(el.Value.(*dedupEntry).expires) {
+				d.lru.MoveToFront(el)
+				return false, nil
+			}
+			d.lru.Remove(el)
+			delete(d.entries, id)
+		}
+	}
+
+	d.current.add(h1, h2)
+	d.entries[id] = d.lru.PushFront(&dedupEntry{id: id, expires: now.Add(d.cfg.TTL)})
+	for d.lru.Len() > d.cfg.Capacity {
+		oldest := d.lru.Back()
+		d.lru.Remove(oldest)
+		delete(d.entries, oldest.Value.(*dedupEntry).id)
+	}
+	return true, nil
+}
+
+// Release forgets the ID. It stays in the bloom filter, which only costs a lookup in the LRU when it is claimed again.
+func (d *MemoryDedup) Release(id string) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if el, ok := d.entries[id]; ok {
+		d.lru.Remove(el)
+		delete(d.entries, id)
+	}
+	return nil
+}
+
+// Len returns the number of IDs in the LRU, expired ones included until they are evicted.
+func (d *MemoryDedup) Len() int {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.lru.Len()
+}
+
+// bloom is a bloom filter sized for n items at the false positive rate p.
+type bloom struct {
+	bits []uint64
+	m    uint64
+	k    uint64
+}
+
+func newBloom(n int, p float64) *bloom {
+	m := uint64(math.Ceil(-float64(n) * math.Log(p) / (math.Ln2 * math.Ln2)))
+	k := uint64(math.Max(1, math.Round(float64(m)/float64(n)*math.Ln2)))
+	return &bloom{bits: make([]uint64, (m+63)/64), m: m, k: k}
+}
+
+// bloomHash returns the two hashes of the ID the k positions are derived from, by double hashing.
+func bloomHash(id string) (uint64, uint64) {
+	h := fnv.New64a()
+	h.Write([]byte(id))
+	h1 := h.Sum64()
+	// the second hash must be odd so the positions don't cycle early
+	return h1, (h1>>33 | h1<<31) | 1
+}
+
+func (b *bloom) add(h1, h2 uint64) {
+	for i := uint64(0); i < b.k; i++ {
+		pos := (h1 + i*h2) % b.m
+		b.bits[pos/64] |= 1 << (pos % 64)
+	}
+}
+
+func (b *bloom) has(h1, h2 uint64) bool {
+	for i := uint64(0); i < b.k; i++ {
+		pos := (h1 + i*h2) % b.m
+		if b.bits[pos/64]&(1<<(pos%64)) == 0 {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,70 @@
+package adapters
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// claim claims the ID and fails the test on error.
+func claim(t *testing.T, d interface{ Claim(string) (bool, error) }, id string) bool {
+	t.Helper()
+	first, err := d.Claim(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return first
+}
+
+func TestMemoryDedup(t *testing.T) {
+	now := time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)
+	d := NewMemoryDedup(DedupConfig{TTL: time.Hour, Capacity: 100})
+	d.now = func() time.Time { return now }
+
+	assert.True(t, claim(t, d, "a"))
+	assert.False(t, claim(t, d, "a"))
+	assert.True(t, claim(t, d, "b"))
+
+	assert.NoError(t, d.Release("a"))
+	assert.True(t, claim(t, d, "a"), "a released ID is claimed again")
+
+	now = now.Add(59 * time.Minute)
+	assert.False(t, claim(t, d, "b"))
+
+	now = now.Add(2 * time.Minute)
+	assert.True(t, claim(t, d, "b"), "the ID expired")
+	assert.False(t, claim(t, d, "b"))
+
+	now = now.Add(3 * time.Hour)
+	assert.True(t, claim(t, d, "b"), "the ID expired after the bloom filters rotated")
+}
+
+func TestMemoryDedupCapacity(t *testing.T) {
+	d := NewMemoryDedup(DedupConfig{Capacity: 10})
+
+	for i := 0; i < 20; i++ {
+		assert.True(t, claim(t, d, fmt.Sprint(i)))
+	}
+	assert.Equal(t, 10, d.Len())
+
+	assert.False(t, claim(t, d, "19"))
+	assert.True(t, claim(t, d, "0"), "the least recently seen IDs are forgotten")
+}
+
+func TestBloom(t *testing.T) {
+	b := newBloom(10_000, 0.01)
+	for i := 0; i < 10_000; i++ {
+		b.add(bloomHash(fmt.Sprint("in", i)))
+	}
+
+	falsePositives := 0
+	for i := 0; i < 10_000; i++ {
+		assert.True(t, b.has(bloomHash(fmt.Sprint("in", i))))
+		if b.has(bloomHash(fmt.Sprint("out", i))) {
+			falsePositives++
+		}
+	}
+	assert.Less(t, falsePositives, 300, "the false positive rate stays close to 1%")
+}
@@ -5,68 +5,199 @@ import (
 	"github.com/mailgun/catchall"
 	"github.com/penthious/catchall/business/models"
 	"github.com/penthious/catchall/business/ports"
+	"sort"
 	"sync"
+	"time"
 )
 
 var _ ports.DB = MemoryRepo{}
-var mut sync.RWMutex
 
 // NewMemoryRepo returns a new MemoryRepo.
 // We create a new map to act as the DB for the application, we also create a mutex
 // to handle concurrent access to the map. Without it we would have a race condition on the map.
-// I do not want to put the mutex on the MemoryRepo struct because I dont want to have to use pointer semantics, nor
-// do I want to change the function signature to return a pointer.
+// The mutex lives behind a pointer so the MemoryRepo keeps its value semantics, while every copy of a repo still
+// shares its lock and no two repos share one.
 func NewMemoryRepo() MemoryRepo {
 	d := make(map[string]models.Domain)
-	mut = sync.RWMutex{}
 	return MemoryRepo{
 		Storage: d,
+		state:   &memoryState{},
 	}
 }
 
+// memoryState is shared by the copies of a MemoryRepo.
+type memoryState struct {
+	mu sync.RWMutex
+
+	// lastID hands out the ids of new domains, like the autoincrement column in postgres. It is guarded by mu.
+	lastID int64
+}
+
+// MemoryRepo keeps every domain in a single map behind a single lock, see ShardedMemoryRepo for a repo that scales
+// with the number of cores.
 type MemoryRepo struct {
 	Storage map[string]models.Domain
+	state   *memoryState
+
+	// wal persists every mutation when the repo was opened with NewDurableMemoryRepo, it is nil otherwise.
+	wal *memoryWAL
 }
 
-// Query searches the map for the domain and returns the domain if found.
+// Query searches the map for the domain and returns the domain if found, ports.ErrNotFound otherwise.
 func (mr MemoryRepo) Query(domain string) (models.Domain, error) {
-	mut.RLock()
-	defer mut.RUnlock()
-	return mr.Storage[domain], nil
+	mr.state.mu.RLock()
+	defer mr.state.mu.RUnlock()
+	d, ok := mr.Storage[domain]
+	if !ok {
+		return models.Domain{}, ports.ErrNotFound
+	}
+	return d, nil
+}
+
+// QueryMany looks up every domain under a single read lock.
+func (mr MemoryRepo) QueryMany(domains []string) (map[string]models.Domain, error) {
+	mr.state.mu.RLock()
+	defer mr.state.mu.RUnlock()
+	found := make(map[string]models.Domain, len(domains))
+	for _, domain := range domains {
+		if d, ok := mr.Storage[domain]; ok {
+			found[domain] = d
+		}
+	}
+	return found, nil
 }
 
 // Insert adds the domain to the map and increments the count based on the event type.
 func (mr MemoryRepo) Insert(event catchall.Event) error {
-	mut.Lock()
-	defer mut.Unlock()
-	if _, ok := mr.Storage[event.Domain]; !ok {
-		mr.Storage[event.Domain] = models.Domain{}
+	if err := ports.ValidateEvent(event); err != nil {
+		return err
+	}
+
+	mr.state.mu.Lock()
+	defer mr.state.mu.Unlock()
+	return mr.apply(memoryOp{Op: opInsert, Domain: event.Domain, Type: event.Type, At: time.Now().UTC()})
+}
+
+// Delete removes the domain from the map.
+func (mr MemoryRepo) Delete(domain string) error {
+	mr.state.mu.Lock()
+	defer mr.state.mu.Unlock()
+	return mr.apply(memoryOp{Op: opDelete, Domain: domain})
+}
+
+// Reset zeroes the counts of the domain if it is in the map.
+func (mr MemoryRepo) Reset(domain string) error {
+	mr.state.mu.Lock()
+	defer mr.state.mu.Unlock()
+	if _, ok := mr.Storage[domain]; !ok {
+		return nil
+	}
+	return mr.apply(memoryOp{Op: opReset, Domain: domain})
+}
+
+// SetOverride sets the override of the domain, adding the domain to the map if needed.
+func (mr MemoryRepo) SetOverride(domain string, override models.Override) error {
+	mr.state.mu.Lock()
+	defer mr.state.mu.Unlock()
+	return mr.apply(memoryOp{Op: opSetOverride, Domain: domain, Override: override, At: time.Now().UTC()})
+}
+
+// ClearOverride removes the override of the domain if it is in the map.
+func (mr MemoryRepo) ClearOverride(domain string) error {
+	mr.state.mu.Lock()
+	defer mr.state.mu.Unlock()
+	if _, ok := mr.Storage[domain]; !ok {
+		return nil
 	}
+	return mr.apply(memoryOp{Op: opClearOverride, Domain: domain})
+}
 
-	domain, err := increment(mr, event)
-	if err != nil {
-		return fmt.Errorf("error incrementing domain: %w", err)
+// apply writes the operation to the WAL when the repo is durable and then applies it to the map, so nothing is
+// acknowledged that would be lost on a restart. The caller must hold the write lock.
+func (mr MemoryRepo) apply(op memoryOp) error {
+	if _, ok := mr.Storage[op.Domain]; !ok && (op.Op == opInsert || op.Op == opSetOverride) {
+		mr.state.lastID++
+		op.ID = mr.state.lastID
 	}
 
-	mr.Storage[event.Domain] = domain
+	if mr.wal != nil {
+		if err := mr.wal.append(op); err != nil {
+			return fmt.Errorf("error logging %s of %s: %w", op.Op, op.Domain, err)
+		}
+	}
 
+	mr.mutate(op)
 	return nil
 }
 
-func increment(mr MemoryRepo, event catchall.Event) (models.Domain, error) {
-	switch event.Type {
-	case catchall.TypeBounced:
-		return models.Domain{
-			Bounced:   mr.Storage[event.Domain].Bounced + 1,
-			Delivered: mr.Storage[event.Domain].Delivered,
-		}, nil
-	case catchall.TypeDelivered:
-		return models.Domain{
-			Bounced:   mr.Storage[event.Domain].Bounced,
-			Delivered: mr.Storage[event.Domain].Delivered + 1,
-		}, nil
-
-	default:
-		return models.Domain{}, fmt.Errorf("unknown status: %s", event.Type)
+// mutate applies the operation to the map. It is shared by apply and the replay of the WAL, so it must not depend
+// on anything but the operation and the map.
+func (mr MemoryRepo) mutate(op memoryOp) {
+	d, ok := mr.Storage[op.Domain]
+	if !ok && op.ID != 0 {
+		d = models.Domain{ID: op.ID, Domain: op.Domain, LastSeen: op.At}
+		if op.ID > mr.state.lastID {
+			mr.state.lastID = op.ID
+		}
 	}
+
+	switch op.Op {
+	case opInsert:
+		switch op.Type {
+		case catchall.TypeBounced:
+			d.Bounced++
+		case catchall.TypeDelivered:
+			d.Delivered++
+		}
+		d.LastSeen = op.At
+	case opDelete:
+		delete(mr.Storage, op.Domain)
+		return
+	case opReset:
+		if !ok {
+			return
+		}
+		d.Bounced, d.Delivered = 0, 0
+	case opSetOverride:
+		d.Override = op.Override
+	case opClearOverride:
+		if !ok {
+			return
+		}
+		d.Override = models.Override{}
+	}
+
+	mr.Storage[op.Domain] = d
+}
+
+// List filters and sorts the whole map and returns the page after the cursor.
+func (mr MemoryRepo) List(q models.DomainQuery) ([]models.Domain, *models.Cursor, error) {
+	filter := q.Filter.At(time.Now())
+	mr.state.mu.RLock()
+	matched := make([]models.Domain, 0)
+	for _, d := range mr.Storage {
+		if filter.Matches(d) {
+			matched = append(matched, d)
+		}
+	}
+	mr.state.mu.RUnlock()
+
+	page, next := paginate(matched, q)
+	return page, next, nil
+}
+
+// paginate sorts the domains in the order of the query and returns the page following the cursor along with the
+// cursor of the next page, which is nil on the last page. Used by adapters that can't page natively.
+func paginate(domains []models.Domain, q models.DomainQuery) ([]models.Domain, *models.Cursor) {
+	sort.Slice(domains, func(i, j int) bool { return q.Less(domains[i], domains[j]) })
+
+	start := sort.Search(len(domains), func(i int) bool { return q.AfterCursor(domains[i]) })
+
+	page := domains[start:]
+	if len(page) <= q.Limit {
+		return page, nil
+	}
+
+	page = page[:q.Limit]
+	return page, q.CursorFor(page[len(page)-1])
 }
@@ -0,0 +1,414 @@
+package adapters
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/penthious/catchall/business/models"
+	"github.com/penthious/catchall/foundation/wal"
+	"github.com/rs/zerolog"
+)
+
+// The operations written to the WAL of a durable MemoryRepo.
+const (
+	opInsert        = "insert"
+	opDelete        = "delete"
+	opReset         = "reset"
+	opSetOverride   = "set_override"
+	opClearOverride = "clear_override"
+)
+
+// memoryOp is a single mutation of a MemoryRepo, it is what a record in the WAL holds.
+type memoryOp struct {
+	Op       string          `json:"op"`
+	Domain   string          `json:"domain"`
+	Type     string          `json:"type,omitempty"`
+	Override models.Override `json:"override"`
+	At       time.Time       `json:"at"`
+
+	// ID is set when the operation creates the domain, so replaying the log hands out the same ids.
+	ID int64 `json:"id,omitempty"`
+}
+
+// memorySnapshot is the compacted state of a MemoryRepo. Replaying the WAL segments starting at Segment on top of it
+// restores the repo.
+type memorySnapshot struct {
+	Segment int             `json:"segment"`
+	LastID  int64           `json:"last_id"`
+	Domains []models.Domain `json:"domains"`
+}
+
+const snapshotFile = "snapshot.json"
+
+// DurableConfig configures the persistence of a MemoryRepo.
+type DurableConfig struct {
+	// Dir holds the snapshot and the WAL segments, it is created if needed.
+	Dir string
+	// Sync decides when appended operations are fsynced.
+	Sync wal.SyncPolicy
+	// SyncInterval is how often the WAL is fsynced with wal.SyncInterval, 1s by default.
+	SyncInterval time.Duration
+	// SnapshotInterval is how often the state is compacted into a new snapshot, 5m by default.
+	SnapshotInterval time.Duration
+	// Log receives the errors of the background syncs and snapshots, it is optional.
+	Log *zerolog.Logger
+}
+
+// memoryWAL persists the mutations of a MemoryRepo into numbered WAL segments next to the latest snapshot. Every
+// snapshot starts a new segment, so the segments before it can be removed once the snapshot is on disk.
+type memoryWAL struct {
+	cfg DurableConfig
+
+	mu      sync.Mutex
+	log     *wal.Log
+	segment int
+
+	// snapMu makes sure only one snapshot is written at a time.
+	snapMu sync.Mutex
+
+	shutdown chan struct{}
+	wg       sync.WaitGroup
+}
+
+// NewDurableMemoryRepo returns a MemoryRepo that survives restarts. The latest snapshot in the directory is loaded
+// and the WAL written since is replayed on top of it, a record torn by a crash at the end of the log is dropped.
+// Every mutation is then appended to the WAL before it is applied. Close the repo to stop the background work and
+// write a final snapshot.
+func NewDurableMemoryRepo(cfg DurableConfig) (MemoryRepo, error) {
+	if cfg.SyncInterval <= 0 {
+		cfg.SyncInterval = time.Second
+	}
+	if cfg.SnapshotInterval <= 0 {
+		cfg.SnapshotInterval = 5 * time.Minute
+	}
+	if cfg.Log == nil {
+		nop := zerolog.Nop()
+		cfg.Log = &nop
+	}
+
+	if err := os.MkdirAll(cfg.Dir, 0o750); err != nil {
+		return MemoryRepo{}, fmt.Errorf("error creating data directory: %w", err)
+	}
+
+	mr := NewMemoryRepo()
+	w := &memoryWAL{cfg: cfg, shutdown: make(chan struct{})}
+
+	mr.state.mu.Lock()
+	err := w.restore(mr)
+	mr.state.mu.Unlock()
+	if err != nil {
+		return MemoryRepo{}, err
+	}
+	mr.wal = w
+
+	w.wg.Add(1)
+	go w.run(mr)
+
+	return mr, nil
+}
+
+// restore loads the snapshot, replays the segments written since and opens the last one for appending.
+func (w *memoryWAL) restore(mr MemoryRepo) error {
+	snap, err := readSnapshot(filepath.Join(w.cfg.Dir, snapshotFile))
+	if err != nil {
+		return err
+	}
+	for _, d := range snap.Domains {
+		mr.Storage[d.Domain] = d
+	}
+	mr.state.lastID = snap.LastID
+
+	segments, err := w.segments()
+	if err != nil {
+		return err
+	}
+
+	w.segment = snap.Segment
+	if w.segment == 0 {
+		w.segment = 1
+	}
+	for _, segment := range segments {
+		path := w.path(segment)
+
+		// Left behind by a crash between writing a snapshot and removing the segments it covers.
+		if segment < snap.Segment {
+			if err := os.Remove(path); err != nil {
+				return fmt.Errorf("error removing wal segment: %w", err)
+			}
+			continue
+		}
+
+		if err := w.replay(mr, path); err != nil {
+			return err
+		}
+		w.segment = segment
+	}
+
+	log, err := wal.Open(w.path(w.segment), w.cfg.Sync)
+	if err != nil {
+		return err
+	}
+	w.log = log
+
+	return nil
+}
+
+func (w *memoryWAL) replay(mr MemoryRepo, path string) error {
+	log, err := wal.Open(path, wal.SyncNever)
+	if err != nil {
+		return err
+	}
+	defer log.Close()
+
+	torn, err := log.Replay(func(payload []byte) error {
+		var op memoryOp
+		if err := json.Unmarshal(payload, &op); err != nil {
+			return fmt.Errorf("error decoding wal record: %w", err)
+		}
+		mr.mutate(op)
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("error replaying %s: %w", path, err)
+	}
+
+	if torn > 0 {
+		w.cfg.Log.Warn().Str("segment", path).Int64("bytes", torn).Msg("dropped torn wal record")
+	}
+
+	return nil
+}
+
+func readSnapshot(path string) (memorySnapshot, error) {
+	var snap memorySnapshot
+
+	f, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return snap, nil
+	}
+	if err != nil {
+		return snap, fmt.Errorf("error opening snapshot: %w", err)
+	}
+	defer f.Close()
+
+	if err := json.NewDecoder(bufio.NewReader(f)).Decode(&snap); err != nil {
+		return snap, fmt.Errorf("error decoding snapshot: %w", err)
+	}
+
+	return snap, nil
+}
+
+// segments returns the numbers of the WAL segments in the directory in order.
+func (w *memoryWAL) segments() ([]int, error) {
+	paths, err := filepath.Glob(filepath.Join(w.cfg.Dir, "wal-*.log"))
+	if err != nil {
+		return nil, err
+	}
+
+	segments := make([]int, 0, len(paths))
+	for _, path := range paths {
+		var segment int
+		if _, err := fmt.Sscanf(filepath.Base(path), "wal-%d.log", &segment); err != nil {
+			continue
+		}
+		segments = append(segments, segment)
+	}
+	sort.Ints(segments)
+
+	return segments, nil
+}
+
+func (w *memoryWAL) path(segment int) string {
+	return filepath.Join(w.cfg.Dir, fmt.Sprintf("wal-%08d.log", segment))
+}
+
+func (w *memoryWAL) append(op memoryOp) error {
+	payload, err := json.Marshal(op)
+	if err != nil {
+		return err
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.log.Append(payload)
+}
+
+func (w *memoryWAL) sync() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.log.Sync()
+}
+
+// run syncs the WAL and takes snapshots in the background until the repo is closed.
+func (w *memoryWAL) run(mr MemoryRepo) {
+	defer w.wg.Done()
+
+	snapshots := time.NewTicker(w.cfg.SnapshotInterval)
+	defer snapshots.Stop()
+
+	// Only the interval policy needs the syncs, a nil channel never fires.
+	var syncs <-chan time.Time
+	if w.cfg.Sync == wal.SyncInterval {
+		ticker := time.NewTicker(w.cfg.SyncInterval)
+		defer ticker.Stop()
+		syncs = ticker.C
+	}
+
+	for {
+		select {
+		case <-w.shutdown:
+			return
+		case <-syncs:
+			if err := w.sync(); err != nil {
+				w.cfg.Log.Error().Err(err).Msg("syncing wal")
+			}
+		case <-snapshots.C:
+			if err := w.snapshot(mr); err != nil {
+				w.cfg.Log.Error().Err(err).Msg("writing snapshot")
+			}
+		}
+	}
+}
+
+// snapshot compacts the state into a new snapshot. The copy of the map and the switch to a new segment happen under
+// the write lock so the snapshot and the segments after it line up exactly, the snapshot itself is written without
+// holding up the repo.
+func (w *memoryWAL) snapshot(mr MemoryRepo) error {
+	w.snapMu.Lock()
+	defer w.snapMu.Unlock()
+
+	mr.state.mu.Lock()
+	snap := memorySnapshot{
+		LastID:  mr.state.lastID,
+		Domains: make([]models.Domain, 0, len(mr.Storage)),
+	}
+	for _, d := range mr.Storage {
+		snap.Domains = append(snap.Domains, d)
+	}
+	err := w.rotate()
+	snap.Segment = w.segment
+	mr.state.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	if err := writeSnapshot(w.cfg.Dir, snap); err != nil {
+		return err
+	}
+
+	segments, err := w.segments()
+	if err != nil {
+		return err
+	}
+	for _, segment := range segments {
+		if segment < snap.Segment {
+			if err := os.Remove(w.path(segment)); err != nil {
+				return fmt.Errorf("error removing wal segment: %w", err)
+			}
+		}
+	}
+
+	return nil
+}
+
+// rotate closes the current segment and starts appending to the next one.
+func (w *memoryWAL) rotate() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	next, err := wal.Open(w.path(w.segment+1), w.cfg.Sync)
+	if err != nil {
+		return err
+	}
+	if err := w.log.Close(); err != nil {
+		next.Close()
+		return err
+	}
+	w.log = next
+	w.segment++
+
+	return nil
+}
+
+// writeSnapshot writes the snapshot to a temporary file and renames it into place, so a crash never leaves a
+// partial snapshot behind.
+func writeSnapshot(dir string, snap memorySnapshot) error {
+	if err := writeJSONFile(dir, snapshotFile, snap); err != nil {
+		return fmt.Errorf("error writing snapshot: %w", err)
+	}
+	return nil
+}
+
+// writeJSONFile encodes v into a temporary file in dir and renames it to name once it is synced, the file is either
+// the old or the new one after a crash.
+func writeJSONFile(dir, name string, v interface{}) error {
+	tmp := filepath.Join(dir, name+".tmp")
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o640)
+	if err != nil {
+		return fmt.Errorf("error creating %s: %w", name, err)
+	}
+
+	bw := bufio.NewWriter(f)
+	if err := json.NewEncoder(bw).Encode(v); err != nil {
+		f.Close()
+		return fmt.Errorf("error encoding %s: %w", name, err)
+	}
+	if err := bw.Flush(); err != nil {
+		f.Close()
+		return fmt.Errorf("error writing %s: %w", name, err)
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return fmt.Errorf("error syncing %s: %w", name, err)
+	}
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("error closing %s: %w", name, err)
+	}
+
+	if err := os.Rename(tmp, filepath.Join(dir, name)); err != nil {
+		return fmt.Errorf("error renaming %s: %w", name, err)
+	}
+
+	// Sync the directory so the rename itself is durable.
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+// Snapshot compacts the state of a durable repo into a new snapshot and drops the WAL it replaces. It does nothing
+// for a repo that isn't durable.
+func (mr MemoryRepo) Snapshot() error {
+	if mr.wal == nil {
+		return nil
+	}
+	return mr.wal.snapshot(mr)
+}
+
+// Close stops the background work of a durable repo, writes a final snapshot and closes the WAL. It does nothing
+// for a repo that isn't durable.
+func (mr MemoryRepo) Close() error {
+	if mr.wal == nil {
+		return nil
+	}
+
+	close(mr.wal.shutdown)
+	mr.wal.wg.Wait()
+
+	if err := mr.wal.snapshot(mr); err != nil {
+		return err
+	}
+
+	mr.wal.mu.Lock()
+	defer mr.wal.mu.Unlock()
+	return mr.wal.log.Close()
+}
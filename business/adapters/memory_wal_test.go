@@ -0,0 +1,158 @@
+package adapters
+
+import (
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/mailgun/catchall"
+	"github.com/penthious/catchall/business/models"
+	"github.com/penthious/catchall/foundation/wal"
+	"github.com/stretchr/testify/assert"
+)
+
+func openDurable(t *testing.T, dir string) MemoryRepo {
+	t.Helper()
+	mr, err := NewDurableMemoryRepo(DurableConfig{Dir: dir, Sync: wal.SyncAlways, SnapshotInterval: time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return mr
+}
+
+// crash stops the repo the way a killed process would, without the final snapshot of Close.
+func crash(t *testing.T, mr MemoryRepo) {
+	t.Helper()
+	close(mr.wal.shutdown)
+	mr.wal.wg.Wait()
+	if err := mr.wal.log.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDurableMemoryRepo(t *testing.T) {
+	dir := t.TempDir()
+	override := models.Override{Status: models.StatusCatchAll, Reason: "pinned", ExpiresAt: time.Now().Add(time.Hour).UTC()}
+
+	mr := openDurable(t, dir)
+	for i := 0; i < 3; i++ {
+		if err := mr.Insert(catchall.Event{Domain: "a.com", Type: catchall.TypeDelivered}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, err := range []error{
+		mr.Insert(catchall.Event{Domain: "b.com", Type: catchall.TypeBounced}),
+		mr.Insert(catchall.Event{Domain: "c.com", Type: catchall.TypeDelivered}),
+		mr.SetOverride("d.com", override),
+		mr.Reset("b.com"),
+		mr.Delete("c.com"),
+	} {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	assert.Error(t, mr.Insert(catchall.Event{Domain: "e.com", Type: "opened"}))
+	want := copyStorage(mr)
+	crash(t, mr)
+
+	t.Run("replays the wal", func(t *testing.T) {
+		mr := openDurable(t, dir)
+		assert.Equal(t, want, copyStorage(mr))
+		assert.Equal(t, 3, mr.Storage["a.com"].Delivered)
+		assert.Equal(t, 0, mr.Storage["b.com"].Bounced)
+		assert.NotContains(t, mr.Storage, "c.com")
+		assert.NotContains(t, mr.Storage, "e.com")
+		assert.True(t, mr.Storage["d.com"].Override.Active(time.Now()))
+
+		// a domain created after the restart must not reuse an id
+		if err := mr.Insert(catchall.Event{Domain: "f.com", Type: catchall.TypeDelivered}); err != nil {
+			t.Fatal(err)
+		}
+		for domain, d := range want {
+			assert.NotEqual(t, d.ID, mr.Storage["f.com"].ID, domain)
+		}
+		want = copyStorage(mr)
+
+		if err := mr.Close(); err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	t.Run("restores the snapshot", func(t *testing.T) {
+		segments, _ := filepath.Glob(filepath.Join(dir, "wal-*.log"))
+		assert.Len(t, segments, 1, "the segments covered by the snapshot are removed")
+
+		mr := openDurable(t, dir)
+		assert.Equal(t, want, copyStorage(mr))
+		if err := mr.Close(); err != nil {
+			t.Fatal(err)
+		}
+	})
+}
+
+func TestDurableMemoryRepoTornRecord(t *testing.T) {
+	dir := t.TempDir()
+
+	mr := openDurable(t, dir)
+	for i := 0; i < 5; i++ {
+		if err := mr.Insert(catchall.Event{Domain: "a.com", Type: catchall.TypeDelivered}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	crash(t, mr)
+
+	// Simulate a crash halfway through the next append, a header promising more payload than made it to disk.
+	segments, _ := filepath.Glob(filepath.Join(dir, "wal-*.log"))
+	if len(segments) != 1 {
+		t.Fatalf("expected a single segment, got %v", segments)
+	}
+	info, err := os.Stat(segments[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.OpenFile(segments[0], os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	torn := make([]byte, 8, 20)
+	binary.LittleEndian.PutUint32(torn[0:4], 100)
+	torn = append(torn, []byte(`{"op":"ins`)...)
+	if _, err := f.Write(torn); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	mr = openDurable(t, dir)
+	assert.Equal(t, 5, mr.Storage["a.com"].Delivered, "every complete record is replayed")
+
+	truncated, err := os.Stat(segments[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, info.Size(), truncated.Size(), "the torn record is truncated")
+
+	// records appended after the recovery must be readable on the next boot
+	if err := mr.Insert(catchall.Event{Domain: "a.com", Type: catchall.TypeBounced}); err != nil {
+		t.Fatal(err)
+	}
+	crash(t, mr)
+
+	mr = openDurable(t, dir)
+	assert.Equal(t, 5, mr.Storage["a.com"].Delivered)
+	assert.Equal(t, 1, mr.Storage["a.com"].Bounced)
+	if err := mr.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func copyStorage(mr MemoryRepo) map[string]models.Domain {
+	mr.state.mu.RLock()
+	defer mr.state.mu.RUnlock()
+	storage := make(map[string]models.Domain, len(mr.Storage))
+	for k, v := range mr.Storage {
+		storage[k] = v
+	}
+	return storage
+}
@@ -0,0 +1,128 @@
+package adapters
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/penthious/catchall/business/models"
+	"github.com/penthious/catchall/business/ports"
+)
+
+var _ ports.WebhookStore = (*MemoryWebhookStore)(nil)
+
+// NewMemoryWebhookStore returns a new MemoryWebhookStore.
+func NewMemoryWebhookStore() *MemoryWebhookStore {
+	return &MemoryWebhookStore{
+		subscriptions: make(map[string]models.Subscription),
+		deliveries:    make(map[string]models.Delivery),
+	}
+}
+
+// MemoryWebhookStore keeps subscriptions and the delivery queue in memory. Unlike MemoryRepo it owns its own lock, so
+// it is handed out as a pointer.
+type MemoryWebhookStore struct {
+	mu            sync.Mutex
+	subscriptions map[string]models.Subscription
+	deliveries    map[string]models.Delivery
+}
+
+// CreateSubscription stores the subscription.
+func (m *MemoryWebhookStore) CreateSubscription(sub models.Subscription) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.subscriptions[sub.ID] = sub
+	return nil
+}
+
+// Subscription returns the subscription with the given id.
+func (m *MemoryWebhookStore) Subscription(id string) (models.Subscription, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	sub, ok := m.subscriptions[id]
+	if !ok {
+		return models.Subscription{}, ports.ErrSubscriptionNotFound
+	}
+	return sub, nil
+}
+
+// Subscriptions returns every subscription ordered by creation time.
+func (m *MemoryWebhookStore) Subscriptions() ([]models.Subscription, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	subs := make([]models.Subscription, 0, len(m.subscriptions))
+	for _, sub := range m.subscriptions {
+		subs = append(subs, sub)
+	}
+	sort.Slice(subs, func(i, j int) bool { return subs[i].CreatedAt.Before(subs[j].CreatedAt) })
+	return subs, nil
+}
+
+// DeleteSubscription removes the subscription with the given id.
+func (m *MemoryWebhookStore) DeleteSubscription(id string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.subscriptions[id]; !ok {
+		return ports.ErrSubscriptionNotFound
+	}
+	delete(m.subscriptions, id)
+	return nil
+}
+
+// Enqueue adds the deliveries to the queue.
+func (m *MemoryWebhookStore) Enqueue(deliveries ...models.Delivery) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, d := range deliveries {
+		m.deliveries[d.ID] = d
+	}
+	return nil
+}
+
+// Claim returns the pending deliveries that are due and leases them out.
+func (m *MemoryWebhookStore) Claim(now time.Time, lease time.Duration, limit int) ([]models.Delivery, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	due := make([]models.Delivery, 0)
+	for _, d := range m.deliveries {
+		if d.State == models.DeliveryPending && !d.NextAttempt.After(now) {
+			due = append(due, d)
+		}
+	}
+	sort.Slice(due, func(i, j int) bool { return due[i].NextAttempt.Before(due[j].NextAttempt) })
+	if len(due) > limit {
+		due = due[:limit]
+	}
+
+	for i := range due {
+		due[i].NextAttempt = now.Add(lease)
+		m.deliveries[due[i].ID] = due[i]
+	}
+	return due, nil
+}
+
+// UpdateDelivery replaces the stored delivery. Delivered payloads are dropped from the queue.
+func (m *MemoryWebhookStore) UpdateDelivery(delivery models.Delivery) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if delivery.State == models.DeliveryDelivered {
+		delete(m.deliveries, delivery.ID)
+		return nil
+	}
+	m.deliveries[delivery.ID] = delivery
+	return nil
+}
+
+// DeadLetters returns the deliveries that ran out of attempts.
+func (m *MemoryWebhookStore) DeadLetters() ([]models.Delivery, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	dead := make([]models.Delivery, 0)
+	for _, d := range m.deliveries {
+		if d.State == models.DeliveryDead {
+			dead = append(dead, d)
+		}
+	}
+	sort.Slice(dead, func(i, j int) bool { return dead[i].CreatedAt.Before(dead[j].CreatedAt) })
+	return dead, nil
+}
@@ -0,0 +1,200 @@
+package adapters
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"sync"
+
+	"github.com/mailgun/catchall"
+	"github.com/penthious/catchall/business/models"
+	"github.com/penthious/catchall/business/ports"
+	"github.com/penthious/catchall/foundation/nats"
+)
+
+var _ ports.Source = (*NatsSource)(nil)
+
+// natsAck is the reply to a message of a JetStream consumer that acknowledges it.
+var natsAck = []byte("+ACK")
+
+// NatsSourceConfig configures a NatsSource, zero values are replaced with the defaults.
+type NatsSourceConfig struct {
+	Conn nats.Config
+	// Subject the events are published on, catchall.events by default.
+	Subject string
+	// Queue is the queue group of the subscription, the instances in the same group share the events. catchall by
+	// default.
+	Queue string
+}
+
+// NatsEvent is the JSON payload of an event published on NATS.
+type NatsEvent struct {
+	// ID identifies the event, a message carrying an ID that was already seen is a redelivery. Optional for the
+	// messages of a JetStream consumer, whose stream sequence identifies them.
+	ID     string `json:"id,omitempty"`
+	Domain string `json:"domain"`
+	Type   string `json:"type"`
+}
+
+// NatsSource pulls the events from a NATS subject. With core NATS a message is delivered at most once and Commit does
+// nothing. Subscribed to the deliver subject of a JetStream push consumer with explicit acks, the messages are acked
+// by Commit and redelivered by the server when they aren't. The connection is made again by the first Fetch after it
+// was lost.
+type NatsSource struct {
+	cfg NatsSourceConfig
+
+	mu   sync.Mutex
+	conn *nats.Conn
+	sub  *nats.Subscription
+}
+
+// NewNatsSource connects to the server and subscribes to the subject.
+func NewNatsSource(cfg NatsSourceConfig) (*NatsSource, error) {
+	if cfg.Subject == "" {
+		cfg.Subject = "catchall.events"
+	}
+	if cfg.Queue == "" {
+		cfg.Queue = "catchall"
+	}
+
+	s := NatsSource{cfg: cfg}
+	if _, err := s.subscription(); err != nil {
+		return nil, err
+	}
+	return &s, nil
+}
+
+// subscription returns the subscription, connecting and subscribing again when the connection was lost.
+func (s *NatsSource) subscription() (*nats.Subscription, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.conn != nil {
+		select {
+		case <-s.conn.Done():
+			s.conn, s.sub = nil, nil
+		default:
+			return s.sub, nil
+		}
+	}
+
+	conn, err := nats.Connect(s.cfg.Conn)
+	if err != nil {
+		return nil, err
+	}
+	sub, err := conn.Subscribe(s.cfg.Subject, s.cfg.Queue)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	s.conn, s.sub = conn, sub
+	return sub, nil
+}
+
+// Fetch waits for a message, and returns it along with the ones already received up to max.
+func (s *NatsSource) Fetch(ctx context.Context, max int) ([]models.Message, error) {
+	sub, err := s.subscription()
+	if err != nil {
+		return nil, err
+	}
+
+	var msgs []models.Message
+	select {
+	case msg, ok := <-sub.C:
+		if !ok {
+			return nil, s.err()
+		}
+		msgs = append(msgs, natsMessage(msg))
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+
+	for len(msgs) < max {
+		select {
+		case msg, ok := <-sub.C:
+			if !ok {
+				return msgs, nil
+			}
+			msgs = append(msgs, natsMessage(msg))
+		default:
+			return msgs, nil
+		}
+	}
+	return msgs, nil
+}
+
+// Commit acks the messages that were delivered with a reply subject.
+func (s *NatsSource) Commit(_ context.Context, msgs []models.Message) error {
+	s.mu.Lock()
+	conn := s.conn
+	s.mu.Unlock()
+	if conn == nil {
+		return nats.ErrClosed
+	}
+
+	for _, msg := range msgs {
+		if msg.Ack == "" {
+			continue
+		}
+		if err := conn.Publish(msg.Ack, natsAck); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Close closes the connection.
+func (s *NatsSource) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.conn == nil {
+		return nil
+	}
+	err := s.conn.Close()
+	s.conn, s.sub = nil, nil
+	return err
+}
+
+func (s *NatsSource) err() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.conn == nil {
+		return nats.ErrClosed
+	}
+	return s.conn.Err()
+}
+
+// natsMessage decodes the event of the message. A payload that can't be decoded gives an empty event, which is
+// rejected like any other invalid event.
+func natsMessage(msg nats.Msg) models.Message {
+	var e NatsEvent
+	_ = json.Unmarshal(msg.Data, &e)
+
+	id := e.ID
+	if id == "" {
+		id = jetStreamID(msg.Reply)
+	}
+
+	return models.Message{
+		ID:    id,
+		Event: catchall.Event{Domain: e.Domain, Type: e.Type},
+		Ack:   msg.Reply,
+	}
+}
+
+// jetStreamID returns the stream and stream sequence of a message delivered by JetStream from its ack subject, empty
+// for any other reply subject. The subject is $JS.ACK.<stream>.<consumer>.<delivered>.<stream seq>.<consumer seq>.
+// <timestamp>.<pending>, or with the domain and the account hash after $JS.ACK on newer servers.
+func jetStreamID(reply string) string {
+	tokens := strings.Split(reply, ".")
+	if len(tokens) < 9 || tokens[0] != "$JS" || tokens[1] != "ACK" {
+		return ""
+	}
+	if len(tokens) == 9 {
+		return tokens[2] + "/" + tokens[5]
+	}
+	if len(tokens) >= 11 {
+		return tokens[4] + "/" + tokens[7]
+	}
+	return ""
+}
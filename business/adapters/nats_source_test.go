@@ -0,0 +1,136 @@
+package adapters
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/mailgun/catchall"
+	"github.com/penthious/catchall/business/models"
+	"github.com/penthious/catchall/foundation/nats"
+	"github.com/penthious/catchall/foundation/nats/natstest"
+	"github.com/stretchr/testify/assert"
+)
+
+func newNatsSource(t *testing.T) (*NatsSource, *nats.Conn, *natstest.Server) {
+	t.Helper()
+	srv, err := natstest.NewServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { srv.Close() })
+
+	source, err := NewNatsSource(NatsSourceConfig{Conn: nats.Config{Addr: srv.Addr()}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { source.Close() })
+
+	conn, err := nats.Connect(nats.Config{Addr: srv.Addr()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	return source, conn, srv
+}
+
+func fetch(t *testing.T, source *NatsSource, n int) []models.Message {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	var msgs []models.Message
+	for len(msgs) < n {
+		got, err := source.Fetch(ctx, n-len(msgs))
+		if err != nil {
+			t.Fatal(err)
+		}
+		msgs = append(msgs, got...)
+	}
+	return msgs
+}
+
+func TestNatsSource(t *testing.T) {
+	source, conn, _ := newNatsSource(t)
+
+	assert.NoError(t, conn.Publish("catchall.events", []byte(`{"id":"1","domain":"a.com","type":"delivered"}`)))
+	assert.NoError(t, conn.Publish("catchall.events", []byte(`not json`)))
+	assert.NoError(t, conn.Publish("other.events", []byte(`{"id":"2","domain":"b.com","type":"bounced"}`)))
+	assert.NoError(t, conn.Flush())
+
+	msgs := fetch(t, source, 2)
+	assert.Equal(t, models.Message{ID: "1", Event: catchall.Event{Domain: "a.com", Type: catchall.TypeDelivered}}, msgs[0])
+	assert.Equal(t, models.Message{}, msgs[1], "a payload that can't be decoded gives an invalid event")
+	assert.NoError(t, source.Commit(context.Background(), msgs), "messages without a reply subject have nothing to ack")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	_, err := source.Fetch(ctx, 10)
+	assert.ErrorIs(t, err, context.DeadlineExceeded, "the messages of other subjects aren't received")
+}
+
+func TestNatsSourceAck(t *testing.T) {
+	source, conn, _ := newNatsSource(t)
+
+	acks, err := conn.Subscribe("$JS.ACK.>", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	reply := "$JS.ACK.EVENTS.catchall.1.42.7.1700000000000000000.0"
+	assert.NoError(t, conn.PublishRequest("catchall.events", reply, []byte(`{"domain":"a.com","type":"bounced"}`)))
+	assert.NoError(t, conn.Flush())
+
+	msgs := fetch(t, source, 1)
+	assert.Equal(t, "EVENTS/42", msgs[0].ID, "the stream sequence identifies the message")
+	assert.Equal(t, reply, msgs[0].Ack)
+	assert.NoError(t, source.Commit(context.Background(), msgs))
+
+	select {
+	case ack := <-acks.C:
+		assert.Equal(t, reply, ack.Subject)
+		assert.Equal(t, "+ACK", string(ack.Data))
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected the message to be acked")
+	}
+}
+
+func TestNatsSourceReconnect(t *testing.T) {
+	source, conn, srv := newNatsSource(t)
+
+	srv.Disconnect()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	_, err := source.Fetch(ctx, 10)
+	assert.Error(t, err, "the lost connection is reported")
+
+	conn, err = nats.Connect(nats.Config{Addr: srv.Addr()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	// the next fetch subscribes again, publish until the subscription is in place
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		for {
+			select {
+			case <-done:
+				return
+			case <-time.After(5 * time.Millisecond):
+				conn.Publish("catchall.events", []byte(`{"id":"1","domain":"a.com","type":"delivered"}`))
+			}
+		}
+	}()
+
+	msgs := fetch(t, source, 1)
+	assert.Equal(t, "1", msgs[0].ID)
+}
+
+func TestJetStreamID(t *testing.T) {
+	assert.Equal(t, "EVENTS/42", jetStreamID("$JS.ACK.EVENTS.catchall.1.42.7.1700000000000000000.0"))
+	assert.Equal(t, "EVENTS/42", jetStreamID("$JS.ACK.hub.ACCHASH.EVENTS.catchall.1.42.7.1700000000000000000.0.token"))
+	assert.Empty(t, jetStreamID("_INBOX.abc"))
+	assert.Empty(t, jetStreamID("$JS.ACK.EVENTS.catchall.1.42"))
+}
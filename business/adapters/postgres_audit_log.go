@@ -0,0 +1,67 @@
+package adapters
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/penthious/catchall/business/models"
+	"github.com/penthious/catchall/business/ports"
+	"github.com/penthious/catchall/foundation/database"
+	"github.com/uptrace/bun"
+)
+
+var _ ports.AuditLog = PostgresAuditLog{}
+
+// NewPostgresAuditLog returns a new PostgresAuditLog.
+func NewPostgresAuditLog(db *bun.DB) PostgresAuditLog {
+
+	// Create the audit table if it doesn't exist
+	// TODO: Move this to a migration via goose or something
+	_, err := db.NewCreateTable().Model((*models.AuditEntry)(nil)).Exec(context.Background())
+	if err != nil && !strings.Contains(err.Error(), "already exists") {
+		// see NewPostgresRepo for why this panics
+		panic(err)
+	}
+	if _, err := db.ExecContext(context.Background(), `CREATE INDEX IF NOT EXISTS audit_log_at_idx ON audit_log (at)`); err != nil {
+		panic(err)
+	}
+
+	return PostgresAuditLog{db: db}
+}
+
+// PostgresAuditLog stores the audit log in postgres. Entries are only ever inserted.
+type PostgresAuditLog struct{ db *bun.DB }
+
+// Append inserts the entry, tagged with its trace ID should the insert be slow.
+func (p PostgresAuditLog) Append(entry models.AuditEntry) error {
+	ctx := database.WithTraceID(context.Background(), entry.TraceID)
+	if _, err := p.db.NewInsert().Model(&entry).Exec(ctx); err != nil {
+		return fmt.Errorf("error inserting audit entry: %w", err)
+	}
+	return nil
+}
+
+// Query returns the entries selected by the query, oldest first.
+func (p PostgresAuditLog) Query(q models.AuditQuery) ([]models.AuditEntry, error) {
+	entries := make([]models.AuditEntry, 0)
+	query := p.db.NewSelect().Model(&entries)
+
+	if !q.From.IsZero() {
+		query.Where("at >= ?", q.From)
+	}
+	if !q.To.IsZero() {
+		query.Where("at < ?", q.To)
+	}
+	if q.Action != "" {
+		query.Where("action = ?", q.Action)
+	}
+	if q.Target != "" {
+		query.Where("target = ?", q.Target)
+	}
+
+	if err := query.Order("at", "id").Limit(q.Limit).Scan(context.Background()); err != nil {
+		return nil, fmt.Errorf("error querying audit log: %w", err)
+	}
+	return entries, nil
+}
@@ -0,0 +1,140 @@
+package adapters
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/penthious/catchall/business/models"
+	"github.com/penthious/catchall/business/ports"
+	"github.com/uptrace/bun"
+	"github.com/uptrace/bun/driver/pgdriver"
+)
+
+var _ ports.Backfiller = PostgresBackfill{}
+
+// NewPostgresBackfill returns a new PostgresBackfill.
+func NewPostgresBackfill(db *bun.DB) PostgresBackfill {
+
+	// the domains table is created along with the repo
+	NewPostgresRepo(db)
+
+	// TODO: Move this to a migration via goose or something
+	_, err := db.ExecContext(context.Background(), `CREATE TABLE IF NOT EXISTS backfill_checkpoints (
+		source VARCHAR PRIMARY KEY,
+		offset_bytes BIGINT NOT NULL,
+		updated_at TIMESTAMPTZ NOT NULL DEFAULT current_timestamp
+	)`)
+	if err != nil {
+		// see NewPostgresRepo for why this panics
+		panic(err)
+	}
+
+	return PostgresBackfill{db: db}
+}
+
+// PostgresBackfill loads batches of deltas with COPY into a staging table and merges them into the domains in the
+// same transaction that moves the checkpoint, so a batch is never applied twice.
+type PostgresBackfill struct{ db *bun.DB }
+
+// Checkpoint returns the offset the source was loaded up to.
+func (p PostgresBackfill) Checkpoint(source string) (int64, error) {
+	var offset int64
+	err := p.db.QueryRowContext(context.Background(),
+		`SELECT offset_bytes FROM backfill_checkpoints WHERE source = ?`, source).Scan(&offset)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, fmt.Errorf("error querying checkpoint: %w", err)
+	}
+	return offset, nil
+}
+
+// Load copies the deltas into a temporary staging table and merges them into the domains with a single upsert.
+func (p PostgresBackfill) Load(source string, offset int64, deltas []models.Delta) (err error) {
+	ctx := context.Background()
+
+	// COPY has to run on the connection of the transaction, so the transaction is driven by hand on a single conn.
+	conn, err := p.db.Conn(ctx)
+	if err != nil {
+		return fmt.Errorf("error getting connection: %w", err)
+	}
+	defer conn.Close()
+
+	if _, err := conn.ExecContext(ctx, "BEGIN"); err != nil {
+		return fmt.Errorf("error beginning transaction: %w", err)
+	}
+	defer func() {
+		if err != nil {
+			_, _ = conn.ExecContext(ctx, "ROLLBACK")
+		}
+	}()
+
+	if _, err := conn.ExecContext(ctx, `CREATE TEMPORARY TABLE backfill_staging (
+		domain VARCHAR NOT NULL,
+		bounced BIGINT NOT NULL,
+		delivered BIGINT NOT NULL,
+		last_seen TIMESTAMPTZ
+	) ON COMMIT DROP`); err != nil {
+		return fmt.Errorf("error creating staging table: %w", err)
+	}
+
+	if _, err := pgdriver.CopyFrom(ctx, conn, bytes.NewReader(copyRows(deltas)),
+		`COPY backfill_staging (domain, bounced, delivered, last_seen) FROM STDIN`); err != nil {
+		return fmt.Errorf("error copying deltas: %w", err)
+	}
+
+	if _, err := conn.ExecContext(ctx, `INSERT INTO domains (domain, bounced, delivered, last_seen)
+		SELECT domain, bounced, delivered, COALESCE(last_seen, current_timestamp) FROM backfill_staging
+		ON CONFLICT (domain) DO UPDATE SET
+			bounced = domains.bounced + EXCLUDED.bounced,
+			delivered = domains.delivered + EXCLUDED.delivered,
+			last_seen = GREATEST(domains.last_seen, EXCLUDED.last_seen)`); err != nil {
+		return fmt.Errorf("error merging deltas: %w", err)
+	}
+
+	if _, err := conn.ExecContext(ctx, `INSERT INTO backfill_checkpoints (source, offset_bytes) VALUES (?, ?)
+		ON CONFLICT (source) DO UPDATE SET offset_bytes = EXCLUDED.offset_bytes, updated_at = current_timestamp`,
+		source, offset); err != nil {
+		return fmt.Errorf("error moving checkpoint: %w", err)
+	}
+
+	// a batch changes too many domains to name them, the caches of the other instances are flushed instead
+	if err := notifyFlush(ctx, conn); err != nil {
+		return fmt.Errorf("error notifying the batch: %w", err)
+	}
+
+	if _, err := conn.ExecContext(ctx, "COMMIT"); err != nil {
+		return fmt.Errorf("error committing batch: %w", err)
+	}
+	return nil
+}
+
+// copyEscaper escapes the characters that are special in the text format of COPY.
+var copyEscaper = strings.NewReplacer(`\`, `\\`, "\t", `\t`, "\n", `\n`, "\r", `\r`)
+
+// copyRows encodes the deltas in the text format of COPY, a zero last seen is written as NULL.
+func copyRows(deltas []models.Delta) []byte {
+	var buf bytes.Buffer
+	for _, dl := range deltas {
+		buf.WriteString(copyEscaper.Replace(dl.Domain))
+		buf.WriteByte('\t')
+		buf.WriteString(strconv.Itoa(dl.Bounced))
+		buf.WriteByte('\t')
+		buf.WriteString(strconv.Itoa(dl.Delivered))
+		buf.WriteByte('\t')
+		if dl.LastSeen.IsZero() {
+			buf.WriteString(`\N`)
+		} else {
+			buf.WriteString(dl.LastSeen.UTC().Format(time.RFC3339Nano))
+		}
+		buf.WriteByte('\n')
+	}
+	return buf.Bytes()
+}
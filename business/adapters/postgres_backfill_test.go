@@ -0,0 +1,55 @@
+package adapters
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/mailgun/catchall"
+	"github.com/penthious/catchall/business/models"
+	"github.com/penthious/catchall/business/ports/portstest"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCopyRows(t *testing.T) {
+	rows := copyRows([]models.Delta{
+		{Domain: "a.com", Bounced: 1, Delivered: 2, LastSeen: time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)},
+		{Domain: "b\t\\.com", Delivered: 3},
+	})
+	assert.Equal(t, "a.com\t1\t2\t2020-01-01T00:00:00Z\nb\\t\\\\.com\t0\t3\t\\N\n", string(rows))
+}
+
+func TestPostgresBackfill(t *testing.T) {
+	db := portstest.Postgres(t)
+	b := NewPostgresBackfill(db)
+	if _, err := db.ExecContext(context.Background(), `TRUNCATE domains, backfill_checkpoints RESTART IDENTITY`); err != nil {
+		t.Fatal(err)
+	}
+	repo := NewPostgresRepo(db)
+	if err := repo.Insert(catchall.Event{Domain: "a.com", Type: catchall.TypeDelivered}); err != nil {
+		t.Fatal(err)
+	}
+
+	offset, err := b.Checkpoint("events.csv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Zero(t, offset)
+
+	old := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	if err := b.Load("events.csv", 100, []models.Delta{
+		{Domain: "a.com", Delivered: 10, LastSeen: old},
+		{Domain: "b.com", Bounced: 2},
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	offset, _ = b.Checkpoint("events.csv")
+	assert.Equal(t, int64(100), offset)
+
+	a, _ := repo.Query("a.com")
+	assert.Equal(t, 11, a.Delivered)
+	assert.True(t, a.LastSeen.After(old), "an older timestamp doesn't move last seen back")
+	d, _ := repo.Query("b.com")
+	assert.Equal(t, 2, d.Bounced)
+}
@@ -0,0 +1,162 @@
+package adapters
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/penthious/catchall/business/ports"
+	"github.com/uptrace/bun"
+)
+
+var _ ports.Dedup = (*PostgresDedup)(nil)
+
+// NewPostgresDedup returns a new PostgresDedup remembering the IDs for ttl, 24h when zero. The partitions are sized
+// by ttl, so the event_ids table has to be dropped when ttl is changed.
+func NewPostgresDedup(db *bun.DB, ttl time.Duration) *PostgresDedup {
+	if ttl <= 0 {
+		ttl = 24 * time.Hour
+	}
+
+	// TODO: Move this to a migration via goose or something
+	_, err := db.ExecContext(context.Background(), `CREATE TABLE IF NOT EXISTS event_ids (
+		bucket BIGINT NOT NULL,
+		id VARCHAR NOT NULL,
+		seen_at TIMESTAMPTZ NOT NULL,
+		PRIMARY KEY (bucket, id)
+	) PARTITION BY RANGE (bucket)`)
+	if err != nil {
+		// see NewPostgresRepo for why this panics
+		panic(err)
+	}
+
+	return &PostgresDedup{db: db, ttl: ttl, now: time.Now}
+}
+
+// PostgresDedup remembers the IDs in the event_ids table, partitioned into buckets of ttl by the time the IDs were
+// claimed. An ID is looked up in the partitions that can hold IDs claimed less than ttl ago, the current one, the one
+// before it and the one after it, and the older partitions are dropped whole instead of deleting the expired IDs row
+// by row. The IDs are shared by every instance using the same database.
+type PostgresDedup struct {
+	db  *bun.DB
+	ttl time.Duration
+	now func() time.Time
+
+	mu sync.Mutex
+	// bucket is the bucket the partitions were last created and dropped for.
+	bucket int64
+}
+
+// Claim inserts the ID into the partition of the current bucket unless it was claimed less than ttl ago. Two
+// concurrent claims of an ID conflict on the primary key, only one of them inserts it.
+func (p *PostgresDedup) Claim(id string) (bool, error) {
+	now := p.now()
+	bucket := p.bucketOf(now)
+	if err := p.maintain(bucket); err != nil {
+		return false, err
+	}
+
+	var claimed string
+	err := p.db.QueryRowContext(context.Background(), `INSERT INTO event_ids (bucket, id, seen_at)
+		SELECT ?, ?, ?
+		WHERE NOT EXISTS (SELECT 1 FROM event_ids WHERE bucket IN (?) AND id = ? AND seen_at > ?)
+		ON CONFLICT DO NOTHING
+		RETURNING id`,
+		bucket, id, now, bun.In(p.buckets(bucket)), id, now.Add(-p.ttl)).Scan(&claimed)
+	if errors.Is(err, sql.ErrNoRows) {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("error claiming event id: %w", err)
+	}
+	return true, nil
+}
+
+// Release deletes the ID from the partitions it can be in.
+func (p *PostgresDedup) Release(id string) error {
+	bucket := p.bucketOf(p.now())
+	_, err := p.db.ExecContext(context.Background(), `DELETE FROM event_ids WHERE bucket IN (?) AND id = ?`,
+		bun.In(p.buckets(bucket)), id)
+	if err != nil {
+		return fmt.Errorf("error releasing event id: %w", err)
+	}
+	return nil
+}
+
+// width is the size of a bucket in seconds.
+func (p *PostgresDedup) width() int64 {
+	width := int64(p.ttl / time.Second)
+	if width < 1 {
+		width = 1
+	}
+	return width
+}
+
+// buckets returns the buckets an ID claimed less than ttl ago can be in: the one before the bucket, the bucket itself,
+// and the next one in case another instance's clock is ahead. They are looked up by equality, the primary key starts
+// with the bucket so a range on it would scan every ID of a partition instead of seeking to the one claimed.
+func (p *PostgresDedup) buckets(bucket int64) []int64 {
+	return []int64{bucket - p.width(), bucket, bucket + p.width()}
+}
+
+// bucketOf returns the start of the bucket of the time, in unix seconds.
+func (p *PostgresDedup) bucketOf(t time.Time) int64 {
+	return t.Unix() / p.width() * p.width()
+}
+
+// maintain creates the partitions of the bucket and the next one, and drops the partitions older than the one before
+// it, once per bucket.
+func (p *PostgresDedup) maintain(bucket int64) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.bucket == bucket {
+		return nil
+	}
+
+	ctx := context.Background()
+	for _, b := range []int64{bucket, bucket + p.width()} {
+		_, err := p.db.ExecContext(ctx, fmt.Sprintf(
+			`CREATE TABLE IF NOT EXISTS event_ids_%d PARTITION OF event_ids FOR VALUES FROM (%d) TO (%d)`,
+			b, b, b+p.width()))
+		if err != nil && !strings.Contains(err.Error(), "already exists") {
+			return fmt.Errorf("error creating event ids partition: %w", err)
+		}
+	}
+
+	rows, err := p.db.QueryContext(ctx, `SELECT c.relname FROM pg_inherits i
+		JOIN pg_class c ON c.oid = i.inhrelid
+		WHERE i.inhparent = 'event_ids'::regclass`)
+	if err != nil {
+		return fmt.Errorf("error listing event ids partitions: %w", err)
+	}
+	var expired []string
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			rows.Close()
+			return fmt.Errorf("error listing event ids partitions: %w", err)
+		}
+		start, err := strconv.ParseInt(strings.TrimPrefix(name, "event_ids_"), 10, 64)
+		if err == nil && start < bucket-p.width() {
+			expired = append(expired, name)
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("error listing event ids partitions: %w", err)
+	}
+
+	for _, name := range expired {
+		if _, err := p.db.ExecContext(ctx, `DROP TABLE IF EXISTS `+name); err != nil {
+			return fmt.Errorf("error dropping event ids partition: %w", err)
+		}
+	}
+
+	p.bucket = bucket
+	return nil
+}
@@ -0,0 +1,47 @@
+package adapters
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/penthious/catchall/business/ports/portstest"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPostgresDedup(t *testing.T) {
+	db := portstest.Postgres(t)
+	if _, err := db.ExecContext(context.Background(), `DROP TABLE IF EXISTS event_ids`); err != nil {
+		t.Fatal(err)
+	}
+	d := NewPostgresDedup(db, time.Hour)
+	now := time.Date(2023, 1, 1, 0, 30, 0, 0, time.UTC)
+	d.now = func() time.Time { return now }
+
+	assert.True(t, claim(t, d, "a"))
+	assert.False(t, claim(t, d, "a"))
+	assert.NoError(t, d.Release("a"))
+	assert.True(t, claim(t, d, "a"), "a released ID is claimed again")
+
+	now = now.Add(45 * time.Minute)
+	assert.False(t, claim(t, d, "a"), "the ID is found in the previous partition")
+
+	now = now.Add(20 * time.Minute)
+	assert.True(t, claim(t, d, "a"), "the ID expired")
+
+	now = now.Add(3 * time.Hour)
+	assert.True(t, claim(t, d, "b"))
+
+	var partitions int
+	err := db.QueryRowContext(context.Background(),
+		`SELECT count(*) FROM pg_inherits WHERE inhparent = 'event_ids'::regclass`).Scan(&partitions)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, 2, partitions, "the expired partitions are dropped")
+
+	ahead := NewPostgresDedup(db, time.Hour)
+	ahead.now = func() time.Time { return now.Add(time.Hour) }
+	assert.True(t, claim(t, ahead, "c"))
+	assert.False(t, claim(t, d, "c"), "the ID claimed by an instance whose clock is ahead is found in the next partition")
+}
@@ -0,0 +1,77 @@
+package adapters
+
+import (
+	"database/sql/driver"
+	"errors"
+	"io"
+	"net"
+	"syscall"
+
+	"github.com/uptrace/bun/driver/pgdriver"
+)
+
+// The SQLSTATE codes of the errors postgres returns while it is briefly unable to serve a query, or because the query
+// lost a conflict with another one.
+var transientCodes = map[string]bool{
+	"40001": true, // serialization_failure
+	"40P01": true, // deadlock_detected
+	"57P01": true, // admin_shutdown
+	"57P02": true, // crash_shutdown
+	"57P03": true, // cannot_connect_now
+	"53300": true, // too_many_connections
+	"08000": true, // connection_exception
+	"08001": true, // sqlclient_unable_to_establish_sqlconnection
+	"08003": true, // connection_does_not_exist
+	"08004": true, // sqlserver_rejected_establishment_of_sqlconnection
+	"08006": true, // connection_failure
+}
+
+// unappliedCodes are the transient codes that mean the statement was rolled back or never started.
+var unappliedCodes = map[string]bool{
+	"40001": true,
+	"40P01": true,
+	"57P01": true,
+	"57P03": true,
+	"53300": true,
+	"08001": true,
+	"08004": true,
+}
+
+// pgError is implemented by pgdriver.Error, Field('C') is the SQLSTATE code.
+type pgError interface {
+	error
+	Field(k byte) string
+}
+
+var _ pgError = pgdriver.Error{}
+
+// IsTransientPostgresError reports whether the error is from postgres or the connection to it failing in a way that
+// making the same call again may succeed.
+func IsTransientPostgresError(err error) bool {
+	var pgErr pgError
+	if errors.As(err, &pgErr) {
+		return transientCodes[pgErr.Field('C')]
+	}
+
+	var netErr net.Error
+	return errors.Is(err, driver.ErrBadConn) ||
+		errors.Is(err, io.EOF) ||
+		errors.Is(err, io.ErrUnexpectedEOF) ||
+		errors.Is(err, syscall.ECONNRESET) ||
+		errors.Is(err, syscall.ECONNREFUSED) ||
+		errors.Is(err, syscall.EPIPE) ||
+		errors.As(err, &netErr)
+}
+
+// IsUnappliedPostgresError reports whether the error certainly left the write unapplied: postgres rolled it back, or
+// the connection couldn't be made so it was never sent. A connection that dropped while the write was in flight may
+// have committed it.
+func IsUnappliedPostgresError(err error) bool {
+	var pgErr pgError
+	if errors.As(err, &pgErr) {
+		return unappliedCodes[pgErr.Field('C')]
+	}
+
+	var opErr *net.OpError
+	return errors.Is(err, syscall.ECONNREFUSED) || errors.As(err, &opErr) && opErr.Op == "dial"
+}
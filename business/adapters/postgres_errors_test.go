@@ -0,0 +1,46 @@
+package adapters
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"syscall"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// codeError is a postgres error with its SQLSTATE code.
+type codeError string
+
+func (e codeError) Error() string       { return "postgres error " + string(e) }
+func (e codeError) Field(k byte) string { return map[byte]string{'C': string(e)}[k] }
+
+func TestPostgresErrors(t *testing.T) {
+	dial := &net.OpError{Op: "dial", Net: "tcp", Err: syscall.ECONNREFUSED}
+	read := &net.OpError{Op: "read", Net: "tcp", Err: syscall.ECONNRESET}
+
+	for _, tc := range []struct {
+		name      string
+		err       error
+		transient bool
+		unapplied bool
+	}{
+		{"serialization failure", codeError("40001"), true, true},
+		{"admin shutdown", codeError("57P01"), true, true},
+		{"too many connections", codeError("53300"), true, true},
+		{"connection failure", codeError("08006"), true, false},
+		{"unique violation", codeError("23505"), false, false},
+		{"wrapped", fmt.Errorf("error applying deltas: %w", codeError("40P01")), true, true},
+		{"refused", dial, true, true},
+		{"reset", read, true, false},
+		{"eof", io.EOF, true, false},
+		{"other", errors.New("invalid input"), false, false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			assert.Equal(t, tc.transient, IsTransientPostgresError(tc.err))
+			assert.Equal(t, tc.unapplied, IsUnappliedPostgresError(tc.err))
+		})
+	}
+}
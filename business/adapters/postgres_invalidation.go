@@ -0,0 +1,257 @@
+package adapters
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/penthious/catchall/business/ports"
+	"github.com/rs/zerolog"
+	"github.com/uptrace/bun"
+	"github.com/uptrace/bun/driver/pgdriver"
+)
+
+// DomainsChannel is the channel PostgresRepo notifies the domains whose status changed on. The payload is the names of
+// the domains separated by newlines, or flushPayload when too many changed to name them.
+const DomainsChannel = "catchall_domains"
+
+const (
+	flushPayload = "*"
+	// maxPayload is the longest payload postgres accepts in a notification.
+	maxPayload = 7999
+)
+
+// notifyDomains notifies the other instances that the domains changed, batching as many names per notification as fit.
+// The notifications are sent when the transaction of conn commits, and dropped if it rolls back.
+func notifyDomains(ctx context.Context, conn bun.IConn, domains []string) error {
+	var payload strings.Builder
+	send := func() error {
+		if payload.Len() == 0 {
+			return nil
+		}
+		_, err := conn.ExecContext(ctx, "SELECT pg_notify(?, ?)", DomainsChannel, payload.String())
+		payload.Reset()
+		return err
+	}
+
+	for _, domain := range domains {
+		if len(domain) > maxPayload {
+			// a name that doesn't fit can't be evicted on its own
+			payload.Reset()
+			payload.WriteString(flushPayload)
+			return send()
+		}
+		if payload.Len()+1+len(domain) > maxPayload {
+			if err := send(); err != nil {
+				return err
+			}
+		}
+		if payload.Len() > 0 {
+			payload.WriteByte('\n')
+		}
+		payload.WriteString(domain)
+	}
+	return send()
+}
+
+// notifyFlush notifies the other instances that any domain may have changed.
+func notifyFlush(ctx context.Context, conn bun.IConn) error {
+	_, err := conn.ExecContext(ctx, "SELECT pg_notify(?, ?)", DomainsChannel, flushPayload)
+	return err
+}
+
+// InvalidationConfig contains the settings for the PostgresInvalidationListener, zero values are replaced with the
+// defaults.
+type InvalidationConfig struct {
+	Log *zerolog.Logger
+	// PingInterval is how long the listener waits for a notification before it checks that the connection is alive.
+	PingInterval time.Duration
+	// RetryInterval is how long the listener waits before connecting again after it lost the connection.
+	RetryInterval time.Duration
+	// Reevict evicts the domains a second time after this long when set. Reads from replicas can still return the
+	// domain from before the change right after the notification, this evicts what they cached.
+	Reevict time.Duration
+}
+
+// PostgresInvalidationListener listens for the domains changed through any instance and evicts them from the local
+// cache. The notifications sent while it isn't listening are lost, so the whole cache is flushed every time it starts
+// listening again.
+type PostgresInvalidationListener struct {
+	db    *bun.DB
+	cache ports.Invalidator
+	cfg   InvalidationConfig
+
+	// mu guards ln, which Close closes to interrupt the receive that is blocked on it.
+	mu sync.Mutex
+	ln *pgdriver.Listener
+
+	shutdown chan struct{}
+	done     chan struct{}
+}
+
+// NewPostgresInvalidationListener returns a listener that evicts the notified domains from cache, call Start to
+// begin listening. The db must be the primary, replicas don't receive notifications.
+func NewPostgresInvalidationListener(db *bun.DB, cache ports.Invalidator, cfg InvalidationConfig) *PostgresInvalidationListener {
+	if cfg.Log == nil {
+		nop := zerolog.Nop()
+		cfg.Log = &nop
+	}
+	if cfg.PingInterval == 0 {
+		cfg.PingInterval = 30 * time.Second
+	}
+	if cfg.RetryInterval == 0 {
+		cfg.RetryInterval = time.Second
+	}
+
+	return &PostgresInvalidationListener{
+		db:       db,
+		cache:    cache,
+		cfg:      cfg,
+		shutdown: make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+}
+
+// Start listens in the background until Close is called.
+func (l *PostgresInvalidationListener) Start() {
+	go l.run()
+}
+
+// Close stops listening and waits for the listener to return.
+func (l *PostgresInvalidationListener) Close() error {
+	l.mu.Lock()
+	close(l.shutdown)
+	if l.ln != nil {
+		_ = l.ln.Close()
+	}
+	l.mu.Unlock()
+
+	<-l.done
+	return nil
+}
+
+func (l *PostgresInvalidationListener) run() {
+	defer close(l.done)
+
+	for first := true; ; first = false {
+		ln, err := l.listen()
+		if ln == nil {
+			return
+		}
+		if err != nil {
+			l.cfg.Log.Error().Err(err).Msg("error listening for cache invalidations")
+			_ = ln.Close()
+			if !l.sleep(l.cfg.RetryInterval) {
+				return
+			}
+			continue
+		}
+
+		// whatever changed since the last connection was lost hasn't been evicted
+		if !first {
+			l.cache.Flush()
+			l.cfg.Log.Info().Msg("listening for cache invalidations again, flushed the cache")
+		}
+
+		err = l.receive(ln)
+		_ = ln.Close()
+		if l.isClosed() {
+			return
+		}
+		l.cfg.Log.Error().Err(err).Msg("lost the connection listening for cache invalidations")
+	}
+}
+
+// listen opens a new connection listening on the channel, it returns a nil listener once Close was called.
+func (l *PostgresInvalidationListener) listen() (*pgdriver.Listener, error) {
+	l.mu.Lock()
+	if l.isClosed() {
+		l.mu.Unlock()
+		return nil, nil
+	}
+	ln := pgdriver.NewListener(l.db)
+	l.ln = ln
+	l.mu.Unlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), l.cfg.PingInterval)
+	defer cancel()
+	return ln, ln.Listen(ctx, DomainsChannel)
+}
+
+// receive evicts the notified domains until the connection fails. A wait that times out sends a ping through the
+// channel, and a second one in a row means the connection silently died.
+func (l *PostgresInvalidationListener) receive(ln *pgdriver.Listener) error {
+	pinged := false
+	for {
+		_, payload, err := ln.ReceiveTimeout(context.Background(), l.cfg.PingInterval)
+		var netErr net.Error
+		switch {
+		case errors.As(err, &netErr) && netErr.Timeout():
+			if pinged {
+				return errors.New("ping timeout")
+			}
+			ctx, cancel := context.WithTimeout(context.Background(), l.cfg.PingInterval)
+			err := pgdriver.Notify(ctx, l.db, DomainsChannel, "")
+			cancel()
+			if err != nil {
+				return err
+			}
+			pinged = true
+			continue
+		case err != nil:
+			return err
+		}
+
+		pinged = false
+		l.evict(payload)
+	}
+}
+
+// evict drops the domains named in the payload from the cache, an empty payload is a ping.
+func (l *PostgresInvalidationListener) evict(payload string) {
+	switch payload {
+	case "":
+		return
+	case flushPayload:
+		l.cache.Flush()
+		return
+	}
+
+	domains := strings.Split(payload, "\n")
+	for _, domain := range domains {
+		l.cache.Invalidate(domain)
+	}
+
+	if l.cfg.Reevict > 0 {
+		time.AfterFunc(l.cfg.Reevict, func() {
+			for _, domain := range domains {
+				l.cache.Invalidate(domain)
+			}
+		})
+	}
+}
+
+func (l *PostgresInvalidationListener) isClosed() bool {
+	select {
+	case <-l.shutdown:
+		return true
+	default:
+		return false
+	}
+}
+
+// sleep waits for d, and returns false when Close was called in the meantime.
+func (l *PostgresInvalidationListener) sleep(d time.Duration) bool {
+	t := time.NewTimer(d)
+	defer t.Stop()
+
+	select {
+	case <-t.C:
+		return true
+	case <-l.shutdown:
+		return false
+	}
+}
@@ -0,0 +1,149 @@
+package adapters
+
+import (
+	"context"
+	"database/sql"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/mailgun/catchall"
+	"github.com/penthious/catchall/business/models"
+	"github.com/penthious/catchall/business/ports/portstest"
+	"github.com/stretchr/testify/assert"
+	"github.com/uptrace/bun"
+)
+
+// recordingConn records the payloads of the notifications sent through it.
+type recordingConn struct {
+	bun.IConn
+	payloads []string
+}
+
+func (c *recordingConn) ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error) {
+	c.payloads = append(c.payloads, args[1].(string))
+	return nil, nil
+}
+
+// recordingInvalidator records what the listener evicts.
+type recordingInvalidator struct {
+	mu          sync.Mutex
+	invalidated []string
+	flushes     int
+}
+
+func (r *recordingInvalidator) Invalidate(domain string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.invalidated = append(r.invalidated, domain)
+}
+
+func (r *recordingInvalidator) Flush() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.flushes++
+}
+
+func (r *recordingInvalidator) saw(domain string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, d := range r.invalidated {
+		if d == domain {
+			return true
+		}
+	}
+	return false
+}
+
+func TestNotifyDomains(t *testing.T) {
+	t.Run("batches the names", func(t *testing.T) {
+		domains := make([]string, 0)
+		for i := 0; i < 1000; i++ {
+			domains = append(domains, strings.Repeat("a", 19))
+		}
+
+		conn := &recordingConn{}
+		if err := notifyDomains(context.Background(), conn, domains); err != nil {
+			t.Fatal(err)
+		}
+
+		assert.Len(t, conn.payloads, 3)
+		names := 0
+		for _, p := range conn.payloads {
+			assert.LessOrEqual(t, len(p), maxPayload)
+			names += len(strings.Split(p, "\n"))
+		}
+		assert.Equal(t, 1000, names)
+	})
+
+	t.Run("flushes for a name that doesn't fit", func(t *testing.T) {
+		conn := &recordingConn{}
+		if err := notifyDomains(context.Background(), conn, []string{"a.com", strings.Repeat("a", maxPayload+1)}); err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, []string{flushPayload}, conn.payloads)
+	})
+
+	t.Run("nothing to notify", func(t *testing.T) {
+		conn := &recordingConn{}
+		if err := notifyDomains(context.Background(), conn, nil); err != nil {
+			t.Fatal(err)
+		}
+		assert.Empty(t, conn.payloads)
+	})
+}
+
+func TestStatusChanged(t *testing.T) {
+	now := time.Now()
+	deltas := []models.Delta{
+		{Domain: "new.com", Delivered: 1},
+		{Domain: "bounced.com", Bounced: 1},
+		{Domain: "still-unknown.com", Delivered: 1},
+		{Domain: "still-bounced.com", Bounced: 1},
+		{Domain: "catch-all.com", Delivered: 1},
+		{Domain: "overridden.com", Bounced: 1},
+	}
+	applied := []models.Domain{
+		{Domain: "new.com", Delivered: 1},
+		{Domain: "bounced.com", Bounced: 1, Delivered: 3},
+		{Domain: "still-unknown.com", Delivered: 2},
+		{Domain: "still-bounced.com", Bounced: 2},
+		{Domain: "catch-all.com", Delivered: models.CatchAllThreshold},
+		{Domain: "overridden.com", Bounced: 1, Delivered: 1, Override: models.Override{
+			Status:    models.StatusCatchAll,
+			ExpiresAt: now.Add(time.Hour),
+		}},
+	}
+
+	assert.Equal(t, []string{"new.com", "bounced.com", "catch-all.com"}, statusChanged(deltas, applied, now))
+}
+
+func TestPostgresInvalidation(t *testing.T) {
+	db := portstest.Postgres(t)
+	repo := NewPostgresRepo(db)
+	if _, err := db.ExecContext(context.Background(), `TRUNCATE domains RESTART IDENTITY`); err != nil {
+		t.Fatal(err)
+	}
+
+	cache := &recordingInvalidator{}
+	l := NewPostgresInvalidationListener(db, cache, InvalidationConfig{})
+	l.Start()
+	t.Cleanup(func() { _ = l.Close() })
+
+	// the listener may not be listening yet, so keep writing until a notification arrives
+	assert.Eventually(t, func() bool {
+		_ = repo.SetOverride("ready.com", models.Override{})
+		return cache.saw("ready.com")
+	}, 5*time.Second, 50*time.Millisecond)
+
+	if err := repo.Insert(catchall.Event{Domain: "a.com", Type: catchall.TypeDelivered}); err != nil {
+		t.Fatal(err)
+	}
+	assert.Eventually(t, func() bool { return cache.saw("a.com") }, 5*time.Second, 10*time.Millisecond)
+
+	if err := repo.Reset("b.com"); err != nil {
+		t.Fatal(err)
+	}
+	assert.Eventually(t, func() bool { return cache.saw("b.com") }, 5*time.Second, 10*time.Millisecond)
+}
@@ -2,16 +2,22 @@ package adapters
 
 import (
 	"context"
+	"database/sql"
+	"errors"
 	"fmt"
 	"github.com/mailgun/catchall"
 	"github.com/penthious/catchall/business/models"
 	"github.com/penthious/catchall/business/ports"
-	webErr "github.com/penthious/catchall/foundation/web/errors"
+	"github.com/penthious/catchall/foundation/database"
 	"github.com/uptrace/bun"
+	"github.com/uptrace/bun/dialect/pgdialect"
 	"strings"
+	"time"
 )
 
 var _ ports.DB = PostgresRepo{}
+var _ ports.DeltaWriter = PostgresRepo{}
+var _ ports.PrimaryReader = PostgresRepo{}
 
 // NewPostgresRepo returns a new PostgresRepo.
 func NewPostgresRepo(db *bun.DB) PostgresRepo {
@@ -26,53 +32,303 @@ func NewPostgresRepo(db *bun.DB) PostgresRepo {
 		panic(err)
 	}
 
+	// Columns and indexes added after the table was first created, along with the keyset indexes for listing.
+	// TODO: Move this to a migration via goose or something
+	migrations := []string{
+		`ALTER TABLE domains ADD COLUMN IF NOT EXISTS last_seen TIMESTAMPTZ NOT NULL DEFAULT current_timestamp`,
+		`ALTER TABLE domains ADD COLUMN IF NOT EXISTS override_status VARCHAR`,
+		`ALTER TABLE domains ADD COLUMN IF NOT EXISTS override_reason VARCHAR`,
+		`ALTER TABLE domains ADD COLUMN IF NOT EXISTS override_expires_at TIMESTAMPTZ`,
+		`CREATE INDEX IF NOT EXISTS domains_last_seen_id_idx ON domains (last_seen, id)`,
+		`CREATE INDEX IF NOT EXISTS domains_delivered_id_idx ON domains (delivered, id)`,
+		`CREATE INDEX IF NOT EXISTS domains_bounced_id_idx ON domains (bounced, id)`,
+	}
+	for _, m := range migrations {
+		if _, err := db.ExecContext(context.Background(), m); err != nil {
+			panic(err)
+		}
+	}
+
 	return PostgresRepo{db: db}
 }
 
+// NewReplicatedPostgresRepo returns a PostgresRepo that writes to the primary of the cluster and reads domains from its
+// healthy replicas, so lookups and listings may lag the writes by up to the maximum replica lag.
+func NewReplicatedPostgresRepo(cluster *database.Cluster) PostgresRepo {
+	p := NewPostgresRepo(cluster.Primary)
+	p.reader = cluster.Reader
+	return p
+}
+
 // PostgresRepo manages the set of API's for domain data.
-type PostgresRepo struct{ db *bun.DB }
+type PostgresRepo struct {
+	db *bun.DB
+	// reader picks the pool Query, QueryMany and List read from, the primary when nil.
+	reader func() *bun.DB
+}
+
+func (p PostgresRepo) read() *bun.DB {
+	if p.reader == nil {
+		return p.db
+	}
+	return p.reader()
+}
 
-// Query returns the domain for the given domain name.
+// Query returns the domain for the given domain name, or ports.ErrNotFound when it is unknown.
 func (p PostgresRepo) Query(domain string) (models.Domain, error) {
+	return p.query(p.read(), domain)
+}
+
+// QueryPrimary is Query reading from the primary, so it sees the writes that already returned.
+func (p PostgresRepo) QueryPrimary(domain string) (models.Domain, error) {
+	return p.query(p.db, domain)
+}
+
+func (p PostgresRepo) query(db *bun.DB, domain string) (models.Domain, error) {
 	var d models.Domain
-	if err := p.db.NewSelect().Model(&models.Domain{}).Where("domain = ?", domain).Scan(context.Background(), &d); err != nil {
+	err := db.NewSelect().Model(&models.Domain{}).Where("domain = ?", domain).Scan(context.Background(), &d)
+	if errors.Is(err, sql.ErrNoRows) {
+		return models.Domain{}, ports.ErrNotFound
+	}
+	if err != nil {
 		return models.Domain{}, fmt.Errorf("error querying domain: %w", err)
 	}
 	return d, nil
 }
 
-// Insert inserts the given event into the database.
+// QueryMany returns the domains for the given domain names in a single round trip.
+func (p PostgresRepo) QueryMany(domains []string) (map[string]models.Domain, error) {
+	ds := make([]models.Domain, 0, len(domains))
+	if err := p.read().NewSelect().Model(&ds).Where("domain = ANY(?)", pgdialect.Array(domains)).Scan(context.Background()); err != nil {
+		return nil, fmt.Errorf("error querying domains: %w", err)
+	}
+
+	found := make(map[string]models.Domain, len(ds))
+	for _, d := range ds {
+		found[d.Domain] = d
+	}
+	return found, nil
+}
+
+// Insert increments the count of the event type with an upsert, so concurrent events for the same domain are never
+// lost to a read-modify-write race.
 func (p PostgresRepo) Insert(event catchall.Event) error {
+	dl, err := ports.EventDelta(event, time.Now())
+	if err != nil {
+		return err
+	}
+	return p.ApplyDeltas([]models.Delta{dl})
+}
+
+// ApplyDeltas adds the deltas to their domains with a single upsert, creating the domains that don't exist yet. The
+// domains whose status changed are notified on DomainsChannel when the upsert commits.
+func (p PostgresRepo) ApplyDeltas(deltas []models.Delta) error {
+	if len(deltas) == 0 {
+		return nil
+	}
+
+	ds := make([]models.Domain, len(deltas))
+	for i, dl := range deltas {
+		ds[i] = models.Domain{Domain: dl.Domain, Bounced: dl.Bounced, Delivered: dl.Delivered, LastSeen: dl.LastSeen}
+	}
 
-	d, err := p.Query(event.Domain)
-	if webErr.IsNoRowsError(err) {
-		d.Domain = event.Domain
-		switch event.Type {
-		case catchall.TypeBounced:
-			d.Bounced = 1
-		case catchall.TypeDelivered:
-			d.Delivered = 1
+	err := p.db.RunInTx(context.Background(), nil, func(ctx context.Context, tx bun.Tx) error {
+		applied := make([]models.Domain, 0, len(ds))
+		_, err := tx.NewInsert().
+			Model(&ds).
+			On("CONFLICT (domain) DO UPDATE").
+			Set("bounced = d.bounced + EXCLUDED.bounced").
+			Set("delivered = d.delivered + EXCLUDED.delivered").
+			Set("last_seen = GREATEST(d.last_seen, EXCLUDED.last_seen)").
+			Returning("*").
+			Exec(ctx, &applied)
+		if err != nil {
+			return err
 		}
+		return notifyDomains(ctx, tx, statusChanged(deltas, applied, time.Now()))
+	})
+	if err != nil {
+		return fmt.Errorf("error applying deltas: %w", err)
+	}
+	return nil
+}
+
+// statusChanged returns the domains whose status at now the deltas changed, given the domains after they were applied.
+// A domain with no counts before the deltas is always returned, it may be new and cached as unknown.
+func statusChanged(deltas []models.Delta, applied []models.Domain, now time.Time) []string {
+	byDomain := make(map[string]models.Delta, len(deltas))
+	for _, dl := range deltas {
+		byDomain[dl.Domain] = dl
+	}
 
-		if _, err := p.db.NewInsert().Model(&d).Exec(context.Background()); err != nil {
-			return fmt.Errorf("error inserting domain: %w", err)
+	changed := make([]string, 0)
+	for _, after := range applied {
+		dl := byDomain[after.Domain]
+		before := after
+		before.Bounced -= dl.Bounced
+		before.Delivered -= dl.Delivered
+		if before.Bounced == 0 && before.Delivered == 0 || before.StatusAt(now) != after.StatusAt(now) {
+			changed = append(changed, after.Domain)
 		}
-		return nil
 	}
+	return changed
+}
+
+// Delete removes the row of the domain.
+func (p PostgresRepo) Delete(domain string) error {
+	err := p.notifying(domain, func(ctx context.Context, tx bun.Tx) error {
+		_, err := tx.NewDelete().Model((*models.Domain)(nil)).Where("domain = ?", domain).Exec(ctx)
+		return err
+	})
 	if err != nil {
-		return fmt.Errorf("error querying domain: %w", err)
+		return fmt.Errorf("error deleting domain: %w", err)
 	}
+	return nil
+}
 
-	switch event.Type {
-	case catchall.TypeBounced:
-		d.Bounced++
-	case catchall.TypeDelivered:
-		d.Delivered++
+// Reset zeroes the counts of the domain.
+func (p PostgresRepo) Reset(domain string) error {
+	err := p.notifying(domain, func(ctx context.Context, tx bun.Tx) error {
+		_, err := tx.NewUpdate().
+			Model((*models.Domain)(nil)).
+			Set("bounced = 0").
+			Set("delivered = 0").
+			Where("domain = ?", domain).
+			Exec(ctx)
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("error resetting domain: %w", err)
 	}
+	return nil
+}
 
-	if _, err := p.db.NewUpdate().Model(&d).Where("domain = ?", event.Domain).Exec(context.Background()); err != nil {
-		return fmt.Errorf("error updating domain: %w", err)
+// SetOverride upserts the override of the domain.
+func (p PostgresRepo) SetOverride(domain string, override models.Override) error {
+	d := models.Domain{
+		Domain:   domain,
+		LastSeen: time.Now().UTC(),
+		Override: override,
+	}
+	err := p.notifying(domain, func(ctx context.Context, tx bun.Tx) error {
+		_, err := tx.NewInsert().
+			Model(&d).
+			On("CONFLICT (domain) DO UPDATE").
+			Set("override_status = EXCLUDED.override_status").
+			Set("override_reason = EXCLUDED.override_reason").
+			Set("override_expires_at = EXCLUDED.override_expires_at").
+			Exec(ctx)
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("error setting override: %w", err)
 	}
+	return nil
+}
 
+// ClearOverride nulls the override columns of the domain.
+func (p PostgresRepo) ClearOverride(domain string) error {
+	err := p.notifying(domain, func(ctx context.Context, tx bun.Tx) error {
+		_, err := tx.NewUpdate().
+			Model((*models.Domain)(nil)).
+			Set("override_status = NULL").
+			Set("override_reason = NULL").
+			Set("override_expires_at = NULL").
+			Where("domain = ?", domain).
+			Exec(ctx)
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("error clearing override: %w", err)
+	}
 	return nil
 }
+
+// notifying runs the write in a transaction that notifies the domain on DomainsChannel when it commits.
+func (p PostgresRepo) notifying(domain string, write func(ctx context.Context, tx bun.Tx) error) error {
+	return p.db.RunInTx(context.Background(), nil, func(ctx context.Context, tx bun.Tx) error {
+		if err := write(ctx, tx); err != nil {
+			return err
+		}
+		return notifyDomains(ctx, tx, []string{domain})
+	})
+}
+
+// List returns a page of domains using keyset pagination on the sort column and id, so deep pages cost the same as
+// the first one.
+func (p PostgresRepo) List(q models.DomainQuery) ([]models.Domain, *models.Cursor, error) {
+	column := "id"
+	switch q.Sort {
+	case models.SortLastSeen, models.SortDelivered, models.SortBounced:
+		column = string(q.Sort)
+	}
+
+	direction, op := "ASC", ">"
+	if q.Desc {
+		direction, op = "DESC", "<"
+	}
+
+	ds := make([]models.Domain, 0, q.Limit+1)
+	query := p.read().NewSelect().Model(&ds)
+	filterDomains(query, q.Filter.At(time.Now()))
+
+	if q.After != nil {
+		var key interface{} = q.After.Key
+		if q.Sort == models.SortLastSeen {
+			key = time.Unix(0, q.After.Key).UTC()
+		}
+		query.Where("(?, id) "+op+" (?, ?)", bun.Ident(column), key, q.After.ID)
+	}
+
+	// Fetch one more than the limit to know whether there is a next page.
+	err := query.
+		OrderExpr("? "+direction+", id "+direction, bun.Ident(column)).
+		Limit(q.Limit + 1).
+		Scan(context.Background())
+	if err != nil {
+		return nil, nil, fmt.Errorf("error listing domains: %w", err)
+	}
+
+	if len(ds) <= q.Limit {
+		return ds, nil, nil
+	}
+
+	ds = ds[:q.Limit]
+	return ds, q.CursorFor(ds[len(ds)-1]), nil
+}
+
+// filterDomains adds the where clauses for the filter to the query.
+func filterDomains(query *bun.SelectQuery, f models.DomainFilter) {
+	if f.Status != "" {
+		query.Where(statusExpr+" = ?", f.Now.UTC(), models.StatusNotCatchAll, models.CatchAllThreshold,
+			models.StatusCatchAll, models.StatusUnknown, f.Status)
+	}
+
+	if f.MinDelivered > 0 {
+		query.Where("delivered >= ?", f.MinDelivered)
+	}
+
+	if f.HasBounces != nil {
+		if *f.HasBounces {
+			query.Where("bounced > 0")
+		} else {
+			query.Where("bounced = 0")
+		}
+	}
+
+	if f.Suffix != "" {
+		// the suffix on a label boundary, like models.HasDomainSuffix
+		query.Where("(domain = ? OR domain LIKE ?)", f.Suffix, "%."+likeEscaper.Replace(f.Suffix))
+	}
+}
+
+// statusExpr is models.Domain.StatusAt in SQL, an active override wins over the counts. It takes the time, the not
+// catch-all status, the threshold, the catch-all status and the unknown status as arguments.
+const statusExpr = `CASE
+	WHEN override_status IS NOT NULL AND override_expires_at > ? THEN override_status
+	WHEN bounced > 0 THEN ?
+	WHEN delivered >= ? THEN ?
+	ELSE ? END`
+
+// likeEscaper escapes the wildcards of a LIKE pattern.
+var likeEscaper = strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`)
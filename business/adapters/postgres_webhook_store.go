@@ -0,0 +1,142 @@
+package adapters
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/penthious/catchall/business/models"
+	"github.com/penthious/catchall/business/ports"
+	"github.com/uptrace/bun"
+)
+
+var _ ports.WebhookStore = PostgresWebhookStore{}
+
+// NewPostgresWebhookStore returns a new PostgresWebhookStore.
+func NewPostgresWebhookStore(db *bun.DB) PostgresWebhookStore {
+
+	// Create the webhook tables if they don't exist
+	// TODO: Move this to a migration via goose or something
+	for _, model := range []interface{}{(*models.Subscription)(nil), (*models.Delivery)(nil)} {
+		_, err := db.NewCreateTable().Model(model).Exec(context.Background())
+		if err != nil && !strings.Contains(err.Error(), "already exists") {
+			// see NewPostgresRepo for why this panics
+			panic(err)
+		}
+	}
+
+	return PostgresWebhookStore{db: db}
+}
+
+// PostgresWebhookStore persists webhook subscriptions and the delivery queue in postgres, so that queued deliveries
+// survive a restart.
+type PostgresWebhookStore struct{ db *bun.DB }
+
+// CreateSubscription stores the subscription.
+func (p PostgresWebhookStore) CreateSubscription(sub models.Subscription) error {
+	if _, err := p.db.NewInsert().Model(&sub).Exec(context.Background()); err != nil {
+		return fmt.Errorf("error inserting subscription: %w", err)
+	}
+	return nil
+}
+
+// Subscription returns the subscription with the given id.
+func (p PostgresWebhookStore) Subscription(id string) (models.Subscription, error) {
+	var sub models.Subscription
+	if err := p.db.NewSelect().Model(&sub).Where("id = ?", id).Scan(context.Background()); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return models.Subscription{}, ports.ErrSubscriptionNotFound
+		}
+		return models.Subscription{}, fmt.Errorf("error querying subscription: %w", err)
+	}
+	return sub, nil
+}
+
+// Subscriptions returns every subscription ordered by creation time.
+func (p PostgresWebhookStore) Subscriptions() ([]models.Subscription, error) {
+	subs := make([]models.Subscription, 0)
+	if err := p.db.NewSelect().Model(&subs).Order("created_at").Scan(context.Background()); err != nil {
+		return nil, fmt.Errorf("error querying subscriptions: %w", err)
+	}
+	return subs, nil
+}
+
+// DeleteSubscription removes the subscription with the given id.
+func (p PostgresWebhookStore) DeleteSubscription(id string) error {
+	res, err := p.db.NewDelete().Model((*models.Subscription)(nil)).Where("id = ?", id).Exec(context.Background())
+	if err != nil {
+		return fmt.Errorf("error deleting subscription: %w", err)
+	}
+	if n, err := res.RowsAffected(); err == nil && n == 0 {
+		return ports.ErrSubscriptionNotFound
+	}
+	return nil
+}
+
+// Enqueue adds the deliveries to the queue.
+func (p PostgresWebhookStore) Enqueue(deliveries ...models.Delivery) error {
+	if len(deliveries) == 0 {
+		return nil
+	}
+	if _, err := p.db.NewInsert().Model(&deliveries).Exec(context.Background()); err != nil {
+		return fmt.Errorf("error inserting deliveries: %w", err)
+	}
+	return nil
+}
+
+// Claim returns the pending deliveries that are due and leases them out. Rows locked by another instance are skipped
+// so several instances can drain the same queue.
+func (p PostgresWebhookStore) Claim(now time.Time, lease time.Duration, limit int) ([]models.Delivery, error) {
+	due := p.db.NewSelect().
+		Model((*models.Delivery)(nil)).
+		Column("id").
+		Where("state = ?", models.DeliveryPending).
+		Where("next_attempt <= ?", now).
+		Order("next_attempt").
+		Limit(limit).
+		For("UPDATE SKIP LOCKED")
+
+	deliveries := make([]models.Delivery, 0)
+	err := p.db.NewUpdate().
+		Model((*models.Delivery)(nil)).
+		Set("next_attempt = ?", now.Add(lease)).
+		Where("id IN (?)", due).
+		Returning("*").
+		Scan(context.Background(), &deliveries)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return nil, fmt.Errorf("error claiming deliveries: %w", err)
+	}
+	return deliveries, nil
+}
+
+// UpdateDelivery stores the outcome of a delivery attempt. Delivered payloads are dropped from the queue.
+func (p PostgresWebhookStore) UpdateDelivery(delivery models.Delivery) error {
+	if delivery.State == models.DeliveryDelivered {
+		if _, err := p.db.NewDelete().Model(&delivery).WherePK().Exec(context.Background()); err != nil {
+			return fmt.Errorf("error deleting delivery: %w", err)
+		}
+		return nil
+	}
+
+	if _, err := p.db.NewUpdate().Model(&delivery).WherePK().Exec(context.Background()); err != nil {
+		return fmt.Errorf("error updating delivery: %w", err)
+	}
+	return nil
+}
+
+// DeadLetters returns the deliveries that ran out of attempts.
+func (p PostgresWebhookStore) DeadLetters() ([]models.Delivery, error) {
+	dead := make([]models.Delivery, 0)
+	err := p.db.NewSelect().
+		Model(&dead).
+		Where("state = ?", models.DeliveryDead).
+		Order("created_at").
+		Scan(context.Background())
+	if err != nil {
+		return nil, fmt.Errorf("error querying dead letters: %w", err)
+	}
+	return dead, nil
+}
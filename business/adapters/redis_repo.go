@@ -0,0 +1,318 @@
+package adapters
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/mailgun/catchall"
+	"github.com/penthious/catchall/business/models"
+	"github.com/penthious/catchall/business/ports"
+	"github.com/penthious/catchall/foundation/redis"
+)
+
+var _ ports.DB = RedisRepo{}
+var _ ports.DeltaWriter = RedisRepo{}
+
+// The keys and hash fields of the redis repo. Every domain is a hash under its own key, the set of domain names
+// stands in for the table scan of List, and the counter hands out the ids.
+const (
+	redisDomainPrefix = "catchall:domain:"
+	redisDomainSet    = "catchall:domains"
+	redisIDCounter    = "catchall:domain_id"
+
+	fieldID                = "id"
+	fieldDomain            = "domain"
+	fieldBounced           = "bounced"
+	fieldDelivered         = "delivered"
+	fieldLastSeen          = "last_seen"
+	fieldOverrideStatus    = "override_status"
+	fieldOverrideReason    = "override_reason"
+	fieldOverrideExpiresAt = "override_expires_at"
+)
+
+// NewRedisRepo returns a new RedisRepo.
+func NewRedisRepo(client *redis.Client) RedisRepo {
+	return RedisRepo{client: client}
+}
+
+// RedisRepo stores every domain as a redis hash, incrementing its counts with HINCRBY.
+type RedisRepo struct{ client *redis.Client }
+
+func domainKey(domain string) string {
+	return redisDomainPrefix + domain
+}
+
+// Query returns the domain, or ports.ErrNotFound when it is unknown.
+func (r RedisRepo) Query(domain string) (models.Domain, error) {
+	v, err := r.client.Do("HGETALL", domainKey(domain))
+	if err != nil {
+		return models.Domain{}, fmt.Errorf("error querying domain: %w", err)
+	}
+
+	d, ok, err := parseDomain(v)
+	if err != nil {
+		return models.Domain{}, fmt.Errorf("error parsing domain %s: %w", domain, err)
+	}
+	if !ok {
+		return models.Domain{}, ports.ErrNotFound
+	}
+	return d, nil
+}
+
+// QueryMany pipelines an HGETALL per domain.
+func (r RedisRepo) QueryMany(domains []string) (map[string]models.Domain, error) {
+	return r.queryMany(domains)
+}
+
+func (r RedisRepo) queryMany(domains []string) (map[string]models.Domain, error) {
+	found := make(map[string]models.Domain, len(domains))
+	if len(domains) == 0 {
+		return found, nil
+	}
+
+	cmds := make([][]string, len(domains))
+	for i, domain := range domains {
+		cmds[i] = []string{"HGETALL", domainKey(domain)}
+	}
+	values, err := r.client.Pipeline(cmds...)
+	if err != nil {
+		return nil, fmt.Errorf("error querying domains: %w", err)
+	}
+
+	for i, v := range values {
+		d, ok, err := parseDomain(v)
+		if err != nil {
+			return nil, fmt.Errorf("error parsing domain %s: %w", domains[i], err)
+		}
+		if ok {
+			found[domains[i]] = d
+		}
+	}
+	return found, nil
+}
+
+// parseDomain parses the reply of HGETALL. A hash without an id isn't a domain, it is left over from a write that
+// raced a delete, so it is reported as unknown.
+func parseDomain(v redis.Value) (models.Domain, bool, error) {
+	fields := v.StringMap()
+	if fields[fieldID] == "" {
+		return models.Domain{}, false, nil
+	}
+
+	var d models.Domain
+	var err error
+	if d.ID, err = strconv.ParseInt(fields[fieldID], 10, 64); err != nil {
+		return models.Domain{}, false, err
+	}
+	d.Domain = fields[fieldDomain]
+	if d.Bounced, err = atoi(fields[fieldBounced]); err != nil {
+		return models.Domain{}, false, err
+	}
+	if d.Delivered, err = atoi(fields[fieldDelivered]); err != nil {
+		return models.Domain{}, false, err
+	}
+	if d.LastSeen, err = parseTime(fields[fieldLastSeen]); err != nil {
+		return models.Domain{}, false, err
+	}
+	d.Override.Status = models.Status(fields[fieldOverrideStatus])
+	d.Override.Reason = fields[fieldOverrideReason]
+	if d.Override.ExpiresAt, err = parseTime(fields[fieldOverrideExpiresAt]); err != nil {
+		return models.Domain{}, false, err
+	}
+
+	return d, true, nil
+}
+
+func atoi(s string) (int, error) {
+	if s == "" {
+		return 0, nil
+	}
+	return strconv.Atoi(s)
+}
+
+func parseTime(s string) (time.Time, error) {
+	if s == "" {
+		return time.Time{}, nil
+	}
+	return time.Parse(time.RFC3339Nano, s)
+}
+
+func formatTime(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	return t.UTC().Format(time.RFC3339Nano)
+}
+
+// Insert increments the count of the event type with HINCRBY.
+func (r RedisRepo) Insert(event catchall.Event) error {
+	dl, err := ports.EventDelta(event, time.Now())
+	if err != nil {
+		return err
+	}
+	return r.ApplyDeltas([]models.Delta{dl})
+}
+
+// ApplyDeltas adds the deltas to their domains in a single transaction, creating the domains that don't exist yet.
+func (r RedisRepo) ApplyDeltas(deltas []models.Delta) error {
+	if len(deltas) == 0 {
+		return nil
+	}
+
+	domains := make([]string, len(deltas))
+	for i, dl := range deltas {
+		domains[i] = dl.Domain
+	}
+	ids, err := r.newIDs(domains)
+	if err != nil {
+		return err
+	}
+
+	cmds := make([][]string, 0, len(deltas)*4+1)
+	for _, dl := range deltas {
+		key := domainKey(dl.Domain)
+		if id, ok := ids[dl.Domain]; ok {
+			cmds = append(cmds, []string{"HSETNX", key, fieldID, strconv.FormatInt(id, 10)})
+		}
+		if dl.Bounced != 0 {
+			cmds = append(cmds, []string{"HINCRBY", key, fieldBounced, strconv.Itoa(dl.Bounced)})
+		}
+		if dl.Delivered != 0 {
+			cmds = append(cmds, []string{"HINCRBY", key, fieldDelivered, strconv.Itoa(dl.Delivered)})
+		}
+		cmds = append(cmds, []string{"HSET", key, fieldDomain, dl.Domain, fieldLastSeen, formatTime(dl.LastSeen)})
+	}
+	cmds = append(cmds, append([]string{"SADD", redisDomainSet}, domains...))
+
+	if _, err := r.client.Tx(cmds...); err != nil {
+		return fmt.Errorf("error applying deltas: %w", err)
+	}
+	return nil
+}
+
+// newIDs reserves an id for every domain that doesn't have one yet. The ids are set with HSETNX, so when two writers
+// race to create a domain one of the ids is simply skipped, like a sequence in postgres.
+func (r RedisRepo) newIDs(domains []string) (map[string]int64, error) {
+	cmds := make([][]string, len(domains))
+	for i, domain := range domains {
+		cmds[i] = []string{"HEXISTS", domainKey(domain), fieldID}
+	}
+	values, err := r.client.Pipeline(cmds...)
+	if err != nil {
+		return nil, fmt.Errorf("error checking domains: %w", err)
+	}
+
+	missing := make([]string, 0)
+	for i, v := range values {
+		if v.Int == 0 {
+			missing = append(missing, domains[i])
+		}
+	}
+	if len(missing) == 0 {
+		return nil, nil
+	}
+
+	last, err := r.client.Do("INCRBY", redisIDCounter, strconv.Itoa(len(missing)))
+	if err != nil {
+		return nil, fmt.Errorf("error reserving ids: %w", err)
+	}
+
+	ids := make(map[string]int64, len(missing))
+	first := last.Int - int64(len(missing)) + 1
+	for i, domain := range missing {
+		ids[domain] = first + int64(i)
+	}
+	return ids, nil
+}
+
+// Delete removes the hash of the domain and its name from the set.
+func (r RedisRepo) Delete(domain string) error {
+	if _, err := r.client.Tx(
+		[]string{"DEL", domainKey(domain)},
+		[]string{"SREM", redisDomainSet, domain},
+	); err != nil {
+		return fmt.Errorf("error deleting domain: %w", err)
+	}
+	return nil
+}
+
+// Reset zeroes the counts of the domain if it exists.
+func (r RedisRepo) Reset(domain string) error {
+	exists, err := r.client.Do("HEXISTS", domainKey(domain), fieldID)
+	if err != nil {
+		return fmt.Errorf("error resetting domain: %w", err)
+	}
+	if exists.Int == 0 {
+		return nil
+	}
+
+	if _, err := r.client.Do("HSET", domainKey(domain), fieldBounced, "0", fieldDelivered, "0"); err != nil {
+		return fmt.Errorf("error resetting domain: %w", err)
+	}
+	return nil
+}
+
+// SetOverride sets the override fields of the domain, creating the domain if it is unknown.
+func (r RedisRepo) SetOverride(domain string, override models.Override) error {
+	ids, err := r.newIDs([]string{domain})
+	if err != nil {
+		return err
+	}
+
+	key := domainKey(domain)
+	var cmds [][]string
+	if id, ok := ids[domain]; ok {
+		cmds = append(cmds,
+			[]string{"HSETNX", key, fieldID, strconv.FormatInt(id, 10)},
+			[]string{"HSETNX", key, fieldLastSeen, formatTime(time.Now())},
+		)
+	}
+	cmds = append(cmds,
+		[]string{"HSET", key,
+			fieldDomain, domain,
+			fieldOverrideStatus, string(override.Status),
+			fieldOverrideReason, override.Reason,
+			fieldOverrideExpiresAt, formatTime(override.ExpiresAt),
+		},
+		[]string{"SADD", redisDomainSet, domain},
+	)
+
+	if _, err := r.client.Tx(cmds...); err != nil {
+		return fmt.Errorf("error setting override: %w", err)
+	}
+	return nil
+}
+
+// ClearOverride removes the override fields of the domain.
+func (r RedisRepo) ClearOverride(domain string) error {
+	if _, err := r.client.Do("HDEL", domainKey(domain), fieldOverrideStatus, fieldOverrideReason, fieldOverrideExpiresAt); err != nil {
+		return fmt.Errorf("error clearing override: %w", err)
+	}
+	return nil
+}
+
+// List reads every domain in the set, then filters and sorts them like the memory repo does. Redis has no secondary
+// indexes to page on, so the cost grows with the number of domains rather than the size of the page.
+func (r RedisRepo) List(q models.DomainQuery) ([]models.Domain, *models.Cursor, error) {
+	members, err := r.client.Do("SMEMBERS", redisDomainSet)
+	if err != nil {
+		return nil, nil, fmt.Errorf("error listing domains: %w", err)
+	}
+
+	domains, err := r.queryMany(members.Strings())
+	if err != nil {
+		return nil, nil, err
+	}
+
+	filter := q.Filter.At(time.Now())
+	matched := make([]models.Domain, 0, len(domains))
+	for _, d := range domains {
+		if filter.Matches(d) {
+			matched = append(matched, d)
+		}
+	}
+
+	page, next := paginate(matched, q)
+	return page, next, nil
+}
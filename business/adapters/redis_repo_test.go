@@ -0,0 +1,29 @@
+package adapters
+
+import (
+	"testing"
+
+	"github.com/penthious/catchall/foundation/redis"
+	"github.com/penthious/catchall/foundation/redis/redistest"
+)
+
+func newRedisRepo(t *testing.T) RedisRepo {
+	t.Helper()
+	srv, err := redistest.NewServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { srv.Close() })
+
+	client, err := redis.Open(redis.Config{Addr: srv.Addr(), PoolSize: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { client.Close() })
+
+	return NewRedisRepo(client)
+}
+
+func TestRedisRepo(t *testing.T) {
+	testDeltaRepo(t, newRedisRepo(t))
+}
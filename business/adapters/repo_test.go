@@ -0,0 +1,137 @@
+package adapters
+
+import (
+	"testing"
+	"time"
+
+	"github.com/mailgun/catchall"
+	"github.com/penthious/catchall/business/models"
+	"github.com/penthious/catchall/business/ports"
+	"github.com/stretchr/testify/assert"
+)
+
+type deltaRepo interface {
+	ports.DB
+	ports.DeltaWriter
+}
+
+// testDeltaRepo runs the same scenario against every repo that writes deltas, starting from an empty store.
+func testDeltaRepo(t *testing.T, r deltaRepo) {
+	t.Helper()
+
+	for i := 0; i < 3; i++ {
+		if err := r.Insert(catchall.Event{Domain: "a.com", Type: catchall.TypeDelivered}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := r.Insert(catchall.Event{Domain: "b.com", Type: catchall.TypeBounced}); err != nil {
+		t.Fatal(err)
+	}
+	assert.Error(t, r.Insert(catchall.Event{Domain: "c.com", Type: "opened"}))
+
+	t.Run("query", func(t *testing.T) {
+		a, err := r.Query("a.com")
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, int64(1), a.ID)
+		assert.Equal(t, "a.com", a.Domain)
+		assert.Equal(t, 3, a.Delivered)
+		assert.WithinDuration(t, time.Now(), a.LastSeen, time.Minute)
+
+		b, _ := r.Query("b.com")
+		assert.Equal(t, int64(2), b.ID)
+		assert.Equal(t, models.StatusNotCatchAll, b.Status())
+
+		_, err = r.Query("c.com")
+		assert.ErrorIs(t, err, ports.ErrNotFound)
+
+		found, err := r.QueryMany([]string{"a.com", "b.com", "c.com"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Len(t, found, 2)
+		assert.Equal(t, a, found["a.com"])
+	})
+
+	t.Run("batched deltas", func(t *testing.T) {
+		err := r.ApplyDeltas([]models.Delta{
+			{Domain: "a.com", Delivered: 997, LastSeen: time.Now()},
+			{Domain: "d.com", Bounced: 2, Delivered: 5, LastSeen: time.Now()},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		a, _ := r.Query("a.com")
+		assert.Equal(t, 1000, a.Delivered)
+		assert.Equal(t, models.StatusCatchAll, a.Status())
+		d, _ := r.Query("d.com")
+		assert.Equal(t, int64(3), d.ID)
+		assert.Equal(t, 2, d.Bounced)
+		assert.Equal(t, 5, d.Delivered)
+	})
+
+	t.Run("admin", func(t *testing.T) {
+		expires := time.Now().Add(time.Hour).UTC().Truncate(time.Microsecond)
+		override := models.Override{Status: models.StatusCatchAll, Reason: "pinned", ExpiresAt: expires}
+		for _, err := range []error{
+			r.SetOverride("b.com", override),
+			r.SetOverride("e.com", override),
+			r.Reset("d.com"),
+			r.Reset("missing.com"),
+			r.Delete("a.com"),
+			r.ClearOverride("missing.com"),
+		} {
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		b, _ := r.Query("b.com")
+		assert.Equal(t, override, b.Override)
+		assert.Equal(t, models.StatusCatchAll, b.Status())
+		assert.Equal(t, 1, b.Bounced, "the override keeps the counts")
+
+		e, _ := r.Query("e.com")
+		assert.Equal(t, int64(4), e.ID)
+		assert.False(t, e.LastSeen.IsZero())
+
+		d, _ := r.Query("d.com")
+		assert.Zero(t, d.Bounced+d.Delivered)
+
+		_, err := r.Query("a.com")
+		assert.ErrorIs(t, err, ports.ErrNotFound)
+		_, err = r.Query("missing.com")
+		assert.ErrorIs(t, err, ports.ErrNotFound)
+
+		if err := r.ClearOverride("b.com"); err != nil {
+			t.Fatal(err)
+		}
+		b, _ = r.Query("b.com")
+		assert.Equal(t, models.Override{}, b.Override)
+	})
+
+	t.Run("list", func(t *testing.T) {
+		q := models.DomainQuery{Sort: models.SortID, Limit: 2}
+		page, next, err := r.List(q)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !assert.Len(t, page, 2) || !assert.NotNil(t, next) {
+			t.FailNow()
+		}
+		assert.Equal(t, "b.com", page[0].Domain)
+		assert.Equal(t, "d.com", page[1].Domain)
+
+		q.After = next
+		page, next, err = r.List(q)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Nil(t, next)
+		if assert.Len(t, page, 1) {
+			assert.Equal(t, "e.com", page[0].Domain)
+		}
+	})
+}
@@ -0,0 +1,193 @@
+package adapters
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/mailgun/catchall"
+	"github.com/penthious/catchall/business/models"
+	"github.com/penthious/catchall/business/ports"
+)
+
+var _ ports.DB = ShardedMemoryRepo{}
+
+// DefaultShards is the number of shards of a ShardedMemoryRepo when none is given.
+const DefaultShards = 64
+
+// memoryShard owns the domains that hash to it.
+type memoryShard struct {
+	mu      sync.RWMutex
+	domains map[string]models.Domain
+
+	// pad the shard to its own cache line so the locks of neighbouring shards don't contend on multi-core machines.
+	_ [32]byte
+}
+
+// ShardedMemoryRepo spreads the domains over shards that each have their own map and lock, so events for different
+// domains rarely wait on each other. Like MemoryRepo it has value semantics, every copy shares the same shards.
+type ShardedMemoryRepo struct {
+	shards []memoryShard
+	lastID *int64
+}
+
+// NewShardedMemoryRepo returns a ShardedMemoryRepo with the given number of shards, or DefaultShards when it isn't
+// positive.
+func NewShardedMemoryRepo(shards int) ShardedMemoryRepo {
+	if shards <= 0 {
+		shards = DefaultShards
+	}
+
+	sr := ShardedMemoryRepo{
+		shards: make([]memoryShard, shards),
+		lastID: new(int64),
+	}
+	for i := range sr.shards {
+		sr.shards[i].domains = make(map[string]models.Domain)
+	}
+
+	return sr
+}
+
+// shard hashes the domain with FNV-1a, inlined since hash/fnv allocates on every call which shows up on the hot path.
+func (sr ShardedMemoryRepo) shard(domain string) *memoryShard {
+	h := uint32(2166136261)
+	for i := 0; i < len(domain); i++ {
+		h ^= uint32(domain[i])
+		h *= 16777619
+	}
+	return &sr.shards[h%uint32(len(sr.shards))]
+}
+
+// Query returns the domain from its shard, or ports.ErrNotFound when it is unknown.
+func (sr ShardedMemoryRepo) Query(domain string) (models.Domain, error) {
+	s := sr.shard(domain)
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	d, ok := s.domains[domain]
+	if !ok {
+		return models.Domain{}, ports.ErrNotFound
+	}
+	return d, nil
+}
+
+// QueryMany groups the domains by shard so every shard is locked once.
+func (sr ShardedMemoryRepo) QueryMany(domains []string) (map[string]models.Domain, error) {
+	byShard := make(map[*memoryShard][]string)
+	for _, domain := range domains {
+		s := sr.shard(domain)
+		byShard[s] = append(byShard[s], domain)
+	}
+
+	found := make(map[string]models.Domain, len(domains))
+	for s, domains := range byShard {
+		s.mu.RLock()
+		for _, domain := range domains {
+			if d, ok := s.domains[domain]; ok {
+				found[domain] = d
+			}
+		}
+		s.mu.RUnlock()
+	}
+
+	return found, nil
+}
+
+// Insert adds the domain to its shard and increments the count based on the event type.
+func (sr ShardedMemoryRepo) Insert(event catchall.Event) error {
+	if err := ports.ValidateEvent(event); err != nil {
+		return err
+	}
+
+	s := sr.shard(event.Domain)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	d := sr.get(s, event.Domain)
+	if event.Type == catchall.TypeBounced {
+		d.Bounced++
+	} else {
+		d.Delivered++
+	}
+	d.LastSeen = time.Now().UTC()
+
+	s.domains[event.Domain] = d
+	return nil
+}
+
+// get returns the domain from the shard, or a new domain with the next id when it isn't there. The caller must hold
+// the write lock of the shard.
+func (sr ShardedMemoryRepo) get(s *memoryShard, domain string) models.Domain {
+	if d, ok := s.domains[domain]; ok {
+		return d
+	}
+	return models.Domain{ID: atomic.AddInt64(sr.lastID, 1), Domain: domain, LastSeen: time.Now().UTC()}
+}
+
+// Delete removes the domain from its shard.
+func (sr ShardedMemoryRepo) Delete(domain string) error {
+	s := sr.shard(domain)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.domains, domain)
+	return nil
+}
+
+// Reset zeroes the counts of the domain if it is in its shard.
+func (sr ShardedMemoryRepo) Reset(domain string) error {
+	s := sr.shard(domain)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	d, ok := s.domains[domain]
+	if !ok {
+		return nil
+	}
+	d.Bounced, d.Delivered = 0, 0
+	s.domains[domain] = d
+	return nil
+}
+
+// SetOverride sets the override of the domain, adding the domain to its shard if needed.
+func (sr ShardedMemoryRepo) SetOverride(domain string, override models.Override) error {
+	s := sr.shard(domain)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	d := sr.get(s, domain)
+	d.Override = override
+	s.domains[domain] = d
+	return nil
+}
+
+// ClearOverride removes the override of the domain if it is in its shard.
+func (sr ShardedMemoryRepo) ClearOverride(domain string) error {
+	s := sr.shard(domain)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	d, ok := s.domains[domain]
+	if !ok {
+		return nil
+	}
+	d.Override = models.Override{}
+	s.domains[domain] = d
+	return nil
+}
+
+// List filters every shard in turn and returns the page after the cursor. The shards are locked one at a time, so
+// unlike MemoryRepo the page isn't a consistent view across shards.
+func (sr ShardedMemoryRepo) List(q models.DomainQuery) ([]models.Domain, *models.Cursor, error) {
+	filter := q.Filter.At(time.Now())
+	matched := make([]models.Domain, 0)
+	for i := range sr.shards {
+		s := &sr.shards[i]
+		s.mu.RLock()
+		for _, d := range s.domains {
+			if filter.Matches(d) {
+				matched = append(matched, d)
+			}
+		}
+		s.mu.RUnlock()
+	}
+
+	page, next := paginate(matched, q)
+	return page, next, nil
+}
@@ -0,0 +1,166 @@
+package adapters
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/mailgun/catchall"
+	"github.com/penthious/catchall/business/models"
+	"github.com/penthious/catchall/business/ports"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestShardedMemoryRepo(t *testing.T) {
+	sr := NewShardedMemoryRepo(8)
+
+	const workers, perWorker = 8, 500
+	var wg sync.WaitGroup
+	wg.Add(workers)
+	for w := 0; w < workers; w++ {
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < perWorker; i++ {
+				event := catchall.Event{Domain: fmt.Sprintf("%d.com", i%50), Type: catchall.TypeDelivered}
+				if i%10 == 0 {
+					event.Type = catchall.TypeBounced
+				}
+				if err := sr.Insert(event); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+
+	page, next, err := sr.List(models.DomainQuery{Sort: models.SortID, Limit: 100})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Nil(t, next)
+	assert.Len(t, page, 50)
+
+	ids := make(map[int64]bool)
+	var delivered, bounced int
+	for i, d := range page {
+		assert.False(t, ids[d.ID], "ids are unique")
+		ids[d.ID] = true
+		if i > 0 {
+			assert.Less(t, page[i-1].ID, d.ID)
+		}
+		delivered += d.Delivered
+		bounced += d.Bounced
+	}
+	assert.Equal(t, workers*perWorker*9/10, delivered, "no increment is lost")
+	assert.Equal(t, workers*perWorker/10, bounced)
+
+	assert.Error(t, sr.Insert(catchall.Event{Domain: "x.com", Type: "opened"}))
+
+	found, err := sr.QueryMany([]string{"0.com", "1.com", "missing.com"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Len(t, found, 2)
+
+	override := models.Override{Status: models.StatusCatchAll, Reason: "pinned", ExpiresAt: time.Now().Add(time.Hour)}
+	for _, err := range []error{
+		sr.Reset("0.com"),
+		sr.SetOverride("1.com", override),
+		sr.SetOverride("new.com", override),
+		sr.ClearOverride("1.com"),
+		sr.Delete("2.com"),
+		sr.Reset("missing.com"),
+		sr.ClearOverride("missing.com"),
+	} {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	d, _ := sr.Query("0.com")
+	assert.Zero(t, d.Delivered+d.Bounced)
+	d, _ = sr.Query("1.com")
+	assert.Equal(t, models.Override{}, d.Override)
+	d, _ = sr.Query("new.com")
+	assert.Equal(t, models.StatusCatchAll, d.Status())
+	assert.NotZero(t, d.ID)
+	d, _ = sr.Query("2.com")
+	assert.Zero(t, d.ID)
+	d, _ = sr.Query("missing.com")
+	assert.Zero(t, d.ID)
+}
+
+// benchmarkDomains is the pool of domains the benchmarks spread their events over.
+var benchmarkDomains = func() []string {
+	domains := make([]string, 10_000)
+	for i := range domains {
+		domains[i] = fmt.Sprintf("domain-%d.com", i)
+	}
+	return domains
+}()
+
+func benchmarkRepos() map[string]func() ports.DB {
+	return map[string]func() ports.DB{
+		"memory":  func() ports.DB { return NewMemoryRepo() },
+		"sharded": func() ports.DB { return NewShardedMemoryRepo(0) },
+	}
+}
+
+// BenchmarkParallelInsert compares the repos with every core inserting events for different domains.
+func BenchmarkParallelInsert(b *testing.B) {
+	for name, newRepo := range benchmarkRepos() {
+		b.Run(name, func(b *testing.B) {
+			db := newRepo()
+			var next uint64
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				i := atomic.AddUint64(&next, 7919)
+				for pb.Next() {
+					i++
+					event := catchall.Event{Domain: benchmarkDomains[i%uint64(len(benchmarkDomains))], Type: catchall.TypeDelivered}
+					if err := db.Insert(event); err != nil {
+						b.Error(err)
+						return
+					}
+				}
+			})
+		})
+	}
+}
+
+// BenchmarkParallelMixed compares the repos under a read heavy load, nine queries for every insert.
+func BenchmarkParallelMixed(b *testing.B) {
+	for name, newRepo := range benchmarkRepos() {
+		b.Run(name, func(b *testing.B) {
+			db := newRepo()
+			for _, domain := range benchmarkDomains {
+				if err := db.Insert(catchall.Event{Domain: domain, Type: catchall.TypeDelivered}); err != nil {
+					b.Fatal(err)
+				}
+			}
+
+			var next uint64
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				i := atomic.AddUint64(&next, 7919)
+				for pb.Next() {
+					i++
+					domain := benchmarkDomains[i%uint64(len(benchmarkDomains))]
+					var err error
+					if i%10 == 0 {
+						err = db.Insert(catchall.Event{Domain: domain, Type: catchall.TypeBounced})
+					} else {
+						_, err = db.Query(domain)
+					}
+					if err != nil {
+						b.Error(err)
+						return
+					}
+				}
+			})
+		})
+	}
+}
@@ -0,0 +1,104 @@
+// Package audit records who changed what through the API.
+package audit
+
+import (
+	"encoding/json"
+	"sync/atomic"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/penthious/catchall/business/models"
+	"github.com/penthious/catchall/business/ports"
+	"github.com/rs/zerolog"
+)
+
+// Config contains the settings for the Recorder, zero values are replaced with the defaults.
+type Config struct {
+	// EventSample records one in every EventSample ingested events, so a high event rate doesn't double the writes of
+	// the database. 1, the default, records every event.
+	EventSample int
+}
+
+// Recorder appends entries to the audit log. A nil Recorder records nothing, so handlers don't need to know whether
+// auditing is enabled.
+type Recorder struct {
+	store ports.AuditLog
+	log   *zerolog.Logger
+	cfg   Config
+
+	events atomic.Uint64
+}
+
+// NewRecorder returns a Recorder appending to the audit log.
+func NewRecorder(store ports.AuditLog, log *zerolog.Logger, cfg Config) *Recorder {
+	if cfg.EventSample <= 0 {
+		cfg.EventSample = 1
+	}
+
+	return &Recorder{
+		store: store,
+		log:   log,
+		cfg:   cfg,
+	}
+}
+
+// Event is the state recorded for an ingested event. Sample is the number of events the entry stands for.
+type Event struct {
+	Type   string `json:"type"`
+	ID     string `json:"id,omitempty"`
+	Sample int    `json:"sample"`
+}
+
+// RecordEvent records the ingestion of an event of the type into the domain, one in every EventSample calls.
+func (r *Recorder) RecordEvent(actor string, traceID uuid.UUID, domain string, eventType string, id string) {
+	if r == nil {
+		return
+	}
+	if (r.events.Add(1)-1)%uint64(r.cfg.EventSample) != 0 {
+		return
+	}
+
+	r.Record(actor, traceID, "event."+eventType, domain, nil, Event{Type: eventType, ID: id, Sample: r.cfg.EventSample})
+}
+
+// Record appends an entry for the action on target. Before and after are the state of the target around the action,
+// nil leaves them out. By the time an action is recorded it has already happened, so failures are logged rather than
+// failing the request.
+func (r *Recorder) Record(actor string, traceID uuid.UUID, action string, target string, before interface{}, after interface{}) {
+	if r == nil {
+		return
+	}
+
+	entry := models.AuditEntry{
+		At:      time.Now().UTC(),
+		Actor:   actor,
+		TraceID: traceID.String(),
+		Action:  action,
+		Target:  target,
+		Before:  r.marshal(before),
+		After:   r.marshal(after),
+	}
+
+	if err := r.store.Append(entry); err != nil {
+		r.log.Error().
+			Err(err).
+			Str("actor", entry.Actor).
+			Str("trace_id", entry.TraceID).
+			Str("action", entry.Action).
+			Str("target", entry.Target).
+			Msg("audit append")
+	}
+}
+
+func (r *Recorder) marshal(state interface{}) json.RawMessage {
+	if state == nil {
+		return nil
+	}
+
+	b, err := json.Marshal(state)
+	if err != nil {
+		r.log.Error().Err(err).Msg("audit marshal")
+		return nil
+	}
+	return b
+}
@@ -0,0 +1,306 @@
+// Package backfill loads historical events from a file in bulk, aggregated into per domain increments.
+package backfill
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/mailgun/catchall"
+	"github.com/penthious/catchall/business/models"
+	"github.com/penthious/catchall/business/ports"
+)
+
+// Format is the encoding of an event file.
+type Format string
+
+// The supported formats, both have one event per line. A CSV line is `domain,type[,timestamp]` and may be preceded by
+// a header, an NDJSON line is `{"domain": "...", "type": "...", "timestamp": "..."}`. The timestamp is RFC 3339 and
+// optional, it becomes the last_seen of the domain.
+const (
+	FormatCSV    Format = "csv"
+	FormatNDJSON Format = "ndjson"
+)
+
+// FormatOf returns the format of the file from its extension.
+func FormatOf(path string) (Format, error) {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".csv":
+		return FormatCSV, nil
+	case ".ndjson", ".jsonl":
+		return FormatNDJSON, nil
+	}
+	return "", fmt.Errorf("unknown format of %s, expected .csv, .ndjson or .jsonl", path)
+}
+
+// Config contains the settings of a backfill, zero values are replaced with the defaults.
+type Config struct {
+	// Source names the file in the checkpoints, the absolute path of the file by default.
+	Source string
+	// Format is the encoding of the file, taken from its extension by default.
+	Format Format
+	// BatchDomains is the number of domains aggregated in memory before they are loaded.
+	BatchDomains int
+	// BatchBytes is how much of the file is read before the aggregated domains are loaded regardless of their number,
+	// which bounds how much is read again after an interruption.
+	BatchBytes int64
+	// ProgressInterval is how often Progress is called while reading, it is also called after every batch.
+	ProgressInterval time.Duration
+	// Progress is called with the progress so far, it may be nil.
+	Progress func(Progress)
+}
+
+// Progress reports how far a backfill got.
+type Progress struct {
+	// Offset is how far into the file the events have been read, Size is the size of the file.
+	Offset int64
+	Size   int64
+	// Resumed is the offset the backfill resumed from.
+	Resumed int64
+	// Events is the number of events read, Skipped the number of malformed lines and unknown event types.
+	Events  int64
+	Skipped int64
+	// Batches is the number of batches loaded.
+	Batches int
+	Elapsed time.Duration
+}
+
+// Percent returns how much of the file has been read.
+func (p Progress) Percent() float64 {
+	if p.Size == 0 {
+		return 100
+	}
+	return float64(p.Offset) * 100 / float64(p.Size)
+}
+
+// Rate returns how many bytes per second were read by this run, not counting what an earlier run read before it was
+// resumed. It is zero until any time has passed.
+func (p Progress) Rate() float64 {
+	if p.Elapsed <= 0 {
+		return 0
+	}
+	return float64(p.Offset-p.Resumed) / p.Elapsed.Seconds()
+}
+
+// Run streams the events of the file at path into b, resuming from the checkpoint of the file. The events are summed
+// per domain in memory and loaded in batches, each batch moving the checkpoint to the end of the last line it covers.
+// When ctx is cancelled the events read so far are loaded before Run returns the error of ctx.
+func Run(ctx context.Context, b ports.Backfiller, path string, cfg Config) (Progress, error) {
+	if cfg.Source == "" {
+		abs, err := filepath.Abs(path)
+		if err != nil {
+			return Progress{}, err
+		}
+		cfg.Source = abs
+	}
+	if cfg.Format == "" {
+		format, err := FormatOf(path)
+		if err != nil {
+			return Progress{}, err
+		}
+		cfg.Format = format
+	}
+	if cfg.BatchDomains <= 0 {
+		cfg.BatchDomains = 100_000
+	}
+	if cfg.BatchBytes <= 0 {
+		cfg.BatchBytes = 256 << 20
+	}
+	if cfg.ProgressInterval <= 0 {
+		cfg.ProgressInterval = 10 * time.Second
+	}
+	if cfg.Progress == nil {
+		cfg.Progress = func(Progress) {}
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return Progress{}, err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return Progress{}, err
+	}
+
+	offset, err := b.Checkpoint(cfg.Source)
+	if err != nil {
+		return Progress{}, fmt.Errorf("error reading checkpoint: %w", err)
+	}
+	if offset > info.Size() {
+		return Progress{}, fmt.Errorf("%s is shorter than its checkpoint at %d bytes, it changed since", path, offset)
+	}
+	if _, err := f.Seek(offset, io.SeekStart); err != nil {
+		return Progress{}, err
+	}
+
+	r := &runner{
+		b:        b,
+		cfg:      cfg,
+		pending:  make(map[string]models.Delta),
+		start:    time.Now(),
+		progress: Progress{Offset: offset, Size: info.Size(), Resumed: offset},
+	}
+	err = r.read(ctx, bufio.NewReaderSize(f, 1<<20))
+	return r.progress, err
+}
+
+type runner struct {
+	b   ports.Backfiller
+	cfg Config
+
+	pending    map[string]models.Delta
+	checkpoint int64
+
+	start    time.Time
+	reported time.Time
+	progress Progress
+}
+
+func (r *runner) read(ctx context.Context, br *bufio.Reader) error {
+	r.checkpoint = r.progress.Offset
+	for lines := 0; ; lines++ {
+		if lines%4096 == 0 {
+			if err := ctx.Err(); err != nil {
+				if ferr := r.flush(); ferr != nil {
+					return ferr
+				}
+				return err
+			}
+			if time.Since(r.reported) >= r.cfg.ProgressInterval {
+				r.report()
+			}
+		}
+
+		line, err := br.ReadBytes('\n')
+		if len(line) > 0 {
+			// a last line without a newline is complete once the end of the file is reached
+			first := r.progress.Offset == 0
+			r.progress.Offset += int64(len(line))
+			r.add(line, first)
+		}
+		if errors.Is(err, io.EOF) {
+			return r.flush()
+		}
+		if err != nil {
+			return err
+		}
+
+		if len(r.pending) >= r.cfg.BatchDomains || r.progress.Offset-r.checkpoint >= r.cfg.BatchBytes {
+			if err := r.flush(); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// add parses the line and sums the event into the pending deltas of its domain, first is set for the first line of
+// the file which may be a CSV header.
+func (r *runner) add(line []byte, first bool) {
+	line = bytes.TrimRight(line, "\r\n")
+	if len(line) == 0 {
+		return
+	}
+
+	var event catchall.Event
+	var at time.Time
+	var err error
+	switch r.cfg.Format {
+	case FormatNDJSON:
+		event, at, err = parseNDJSON(line)
+	default:
+		if first && bytes.HasPrefix(line, []byte("domain,")) {
+			return
+		}
+		event, at, err = parseCSV(line)
+	}
+	if err != nil || event.Domain == "" {
+		r.progress.Skipped++
+		return
+	}
+
+	dl := models.Delta{Domain: event.Domain, LastSeen: at}
+	switch event.Type {
+	case catchall.TypeBounced:
+		dl.Bounced = 1
+	case catchall.TypeDelivered:
+		dl.Delivered = 1
+	default:
+		r.progress.Skipped++
+		return
+	}
+
+	r.pending[event.Domain] = r.pending[event.Domain].Add(dl)
+	r.progress.Events++
+}
+
+// parseCSV only goes through encoding/csv for quoted lines, plain ones are split on the commas which is much cheaper.
+func parseCSV(line []byte) (catchall.Event, time.Time, error) {
+	s := string(line)
+	var fields []string
+	if strings.ContainsRune(s, '"') {
+		var err error
+		if fields, err = csv.NewReader(strings.NewReader(s)).Read(); err != nil {
+			return catchall.Event{}, time.Time{}, err
+		}
+	} else {
+		fields = strings.Split(s, ",")
+	}
+	if len(fields) < 2 || len(fields) > 3 {
+		return catchall.Event{}, time.Time{}, fmt.Errorf("expected 2 or 3 fields, got %d", len(fields))
+	}
+
+	event := catchall.Event{Domain: strings.TrimSpace(fields[0]), Type: strings.TrimSpace(fields[1])}
+	if len(fields) == 2 || strings.TrimSpace(fields[2]) == "" {
+		return event, time.Time{}, nil
+	}
+	at, err := time.Parse(time.RFC3339, strings.TrimSpace(fields[2]))
+	return event, at, err
+}
+
+func parseNDJSON(line []byte) (catchall.Event, time.Time, error) {
+	var e struct {
+		catchall.Event
+		Timestamp time.Time `json:"timestamp"`
+	}
+	err := json.Unmarshal(line, &e)
+	return e.Event, e.Timestamp, err
+}
+
+// flush loads the pending deltas and moves the checkpoint to the current offset.
+func (r *runner) flush() error {
+	if r.progress.Offset == r.checkpoint {
+		return nil
+	}
+
+	deltas := make([]models.Delta, 0, len(r.pending))
+	for _, dl := range r.pending {
+		deltas = append(deltas, dl)
+	}
+	if err := r.b.Load(r.cfg.Source, r.progress.Offset, deltas); err != nil {
+		return fmt.Errorf("error loading batch ending at offset %d: %w", r.progress.Offset, err)
+	}
+
+	r.pending = make(map[string]models.Delta)
+	r.checkpoint = r.progress.Offset
+	r.progress.Batches++
+	r.report()
+
+	return nil
+}
+
+func (r *runner) report() {
+	r.reported = time.Now()
+	r.progress.Elapsed = time.Since(r.start)
+	r.cfg.Progress(r.progress)
+}
@@ -0,0 +1,176 @@
+package backfill
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/penthious/catchall/business/models"
+	"github.com/stretchr/testify/assert"
+)
+
+// memoryBackfiller applies the batches to a map of domains, and can be made to fail after a number of batches.
+type memoryBackfiller struct {
+	domains     map[string]models.Delta
+	checkpoints map[string]int64
+	batches     int
+	failAfter   int
+}
+
+func newMemoryBackfiller() *memoryBackfiller {
+	return &memoryBackfiller{
+		domains:     make(map[string]models.Delta),
+		checkpoints: make(map[string]int64),
+		failAfter:   -1,
+	}
+}
+
+func (m *memoryBackfiller) Checkpoint(source string) (int64, error) {
+	return m.checkpoints[source], nil
+}
+
+func (m *memoryBackfiller) Load(source string, offset int64, deltas []models.Delta) error {
+	if m.failAfter == 0 {
+		return errors.New("database unavailable")
+	}
+	m.failAfter--
+
+	for _, dl := range deltas {
+		m.domains[dl.Domain] = m.domains[dl.Domain].Add(dl)
+	}
+	m.checkpoints[source] = offset
+	m.batches++
+	return nil
+}
+
+func writeFile(t *testing.T, name string, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestRun(t *testing.T) {
+	t.Run("csv", func(t *testing.T) {
+		path := writeFile(t, "events.csv", strings.Join([]string{
+			"domain,type,timestamp",
+			"a.com,delivered,2020-01-01T00:00:00Z",
+			"a.com,delivered,2021-06-01T00:00:00Z",
+			`"b.com",bounced,`,
+			"a.com,opened,2022-01-01T00:00:00Z",
+			"not a line",
+			"c.com,delivered",
+		}, "\n"))
+
+		b := newMemoryBackfiller()
+		progress, err := Run(context.Background(), b, path, Config{})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		assert.Equal(t, int64(4), progress.Events)
+		assert.Equal(t, int64(2), progress.Skipped, "the unknown type and the malformed line are skipped")
+		assert.Equal(t, progress.Size, progress.Offset)
+		assert.Equal(t, 100.0, progress.Percent())
+		assert.Equal(t, 1, progress.Batches)
+
+		assert.Equal(t, 2, b.domains["a.com"].Delivered)
+		assert.Equal(t, time.Date(2021, 6, 1, 0, 0, 0, 0, time.UTC), b.domains["a.com"].LastSeen, "the latest timestamp wins")
+		assert.Equal(t, 1, b.domains["b.com"].Bounced)
+		assert.Equal(t, 1, b.domains["c.com"].Delivered)
+		assert.True(t, b.domains["c.com"].LastSeen.IsZero())
+	})
+
+	t.Run("ndjson", func(t *testing.T) {
+		path := writeFile(t, "events.ndjson", strings.Join([]string{
+			`{"domain": "a.com", "type": "delivered", "timestamp": "2020-01-01T00:00:00Z"}`,
+			`{"domain": "a.com", "type": "bounced"}`,
+			`{"domain": "", "type": "bounced"}`,
+			`{"domain": "b.com"`,
+			``,
+		}, "\n"))
+
+		b := newMemoryBackfiller()
+		progress, err := Run(context.Background(), b, path, Config{})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		assert.Equal(t, int64(2), progress.Events)
+		assert.Equal(t, int64(2), progress.Skipped)
+		assert.Equal(t, models.Delta{
+			Domain:    "a.com",
+			Bounced:   1,
+			Delivered: 1,
+			LastSeen:  time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC),
+		}, b.domains["a.com"])
+	})
+
+	t.Run("unknown format", func(t *testing.T) {
+		_, err := Run(context.Background(), newMemoryBackfiller(), writeFile(t, "events.txt", ""), Config{})
+		assert.Error(t, err)
+	})
+}
+
+func TestRunResumes(t *testing.T) {
+	var content strings.Builder
+	for i := 0; i < 100; i++ {
+		content.WriteString("a.com,delivered\n")
+		content.WriteString("b.com,bounced\n")
+	}
+	path := writeFile(t, "events.csv", content.String())
+
+	// a batch every two domains, the third batch fails
+	b := newMemoryBackfiller()
+	b.failAfter = 2
+	cfg := Config{Source: "events", BatchDomains: 2}
+	_, err := Run(context.Background(), b, path, cfg)
+	assert.Error(t, err)
+	assert.Equal(t, 2, b.batches)
+	assert.Equal(t, int64(2*len("a.com,delivered\nb.com,bounced\n")), b.checkpoints["events"])
+
+	b.failAfter = -1
+	progress, err := Run(context.Background(), b, path, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, int64(2*len("a.com,delivered\nb.com,bounced\n")), progress.Resumed)
+	assert.Equal(t, progress.Size, b.checkpoints["events"])
+	assert.Equal(t, int64(196), progress.Events, "only the events after the checkpoint are read again")
+	assert.Equal(t, 100, b.domains["a.com"].Delivered, "every event is loaded exactly once")
+	assert.Equal(t, 100, b.domains["b.com"].Bounced)
+
+	t.Run("changed file", func(t *testing.T) {
+		if err := os.WriteFile(path, []byte("a.com,delivered\n"), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		_, err := Run(context.Background(), b, path, cfg)
+		assert.Error(t, err)
+	})
+}
+
+func TestRunCancelled(t *testing.T) {
+	path := writeFile(t, "events.csv", "a.com,delivered\nb.com,bounced\n")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	b := newMemoryBackfiller()
+	_, err := Run(ctx, b, path, Config{})
+	assert.ErrorIs(t, err, context.Canceled)
+	assert.Zero(t, b.checkpoints[path], "nothing was read before the cancellation")
+}
+
+func TestProgressRate(t *testing.T) {
+	p := Progress{Size: 1000, Offset: 600, Resumed: 200}
+	assert.Zero(t, p.Rate(), "no time has passed yet")
+
+	p.Elapsed = 2 * time.Second
+	assert.Equal(t, 200.0, p.Rate(), "the resumed bytes weren't read by this run")
+}
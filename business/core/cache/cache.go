@@ -0,0 +1,345 @@
+// Package cache provides a read-through cache in front of any ports.DB.
+package cache
+
+import (
+	"container/list"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/mailgun/catchall"
+	"github.com/penthious/catchall/business/models"
+	"github.com/penthious/catchall/business/ports"
+)
+
+var _ ports.DB = (*Repo)(nil)
+var _ ports.Invalidator = (*Repo)(nil)
+var _ ports.PrimaryReader = (*Repo)(nil)
+var _ ports.Spooler = (*Repo)(nil)
+var _ ports.DeltaWriter = (*DeltaRepo)(nil)
+
+// Config contains the settings for the cache, zero values are replaced with the defaults.
+type Config struct {
+	// Size is the most domains the cache holds before it evicts the least recently used.
+	Size int
+	// TTL is how long a cached domain is served before it is read again.
+	TTL time.Duration
+}
+
+// Stats are the counters of the cache since it was created.
+type Stats struct {
+	Hits      uint64 `json:"hits"`
+	Misses    uint64 `json:"misses"`
+	Evictions uint64 `json:"evictions"`
+	Size      int    `json:"size"`
+}
+
+type entry struct {
+	key    string
+	domain models.Domain
+	// found is false for the domains the DB doesn't know. The ID can't tell, a DB overlaid with a write-behind buffer
+	// returns the domains that only have pending increments without one.
+	found bool
+	// primary is set for the domains read from the primary, only those are served to QueryPrimary.
+	primary bool
+	expires time.Time
+}
+
+// call is a read of the DB that concurrent misses for the same domain wait on.
+type call struct {
+	wg      sync.WaitGroup
+	primary bool
+	domain  models.Domain
+	err     error
+
+	// stale is set when the domain was written while it was being read, the result is then returned to the callers
+	// waiting on it but not cached.
+	stale bool
+}
+
+// Repo caches the results of Query in a bounded LRU with a TTL. Every write through the Repo invalidates the domain,
+// and concurrent misses for the same domain share a single read of the DB.
+type Repo struct {
+	ports.DB
+	cfg Config
+	now func() time.Time
+
+	mu       sync.Mutex
+	lru      *list.List
+	entries  map[string]*list.Element
+	inflight map[string]*call
+
+	// invalidations counts the invalidations, a batch read only caches its results when none happened while it read.
+	invalidations uint64
+
+	hits      uint64
+	misses    uint64
+	evictions uint64
+}
+
+// NewRepo wraps db with a cache.
+func NewRepo(db ports.DB, cfg Config) *Repo {
+	if cfg.Size == 0 {
+		cfg.Size = 10_000
+	}
+	if cfg.TTL == 0 {
+		cfg.TTL = time.Minute
+	}
+
+	return &Repo{
+		DB:       db,
+		cfg:      cfg,
+		now:      time.Now,
+		lru:      list.New(),
+		entries:  make(map[string]*list.Element),
+		inflight: make(map[string]*call),
+	}
+}
+
+// DeltaRepo is the Repo of a DB that implements ports.DeltaWriter, so a write-behind buffer above it keeps writing its
+// batches in one call.
+type DeltaRepo struct {
+	*Repo
+	w ports.DeltaWriter
+}
+
+// NewDeltaRepo wraps db with a cache that writes batches through to it.
+func NewDeltaRepo(db interface {
+	ports.DB
+	ports.DeltaWriter
+}, cfg Config) *DeltaRepo {
+	return &DeltaRepo{Repo: NewRepo(db, cfg), w: db}
+}
+
+// ApplyDeltas writes the deltas through to the DB and invalidates their domains.
+func (r *DeltaRepo) ApplyDeltas(deltas []models.Delta) error {
+	defer func() {
+		for _, dl := range deltas {
+			r.Invalidate(dl.Domain)
+		}
+	}()
+	return r.w.ApplyDeltas(deltas)
+}
+
+// Query returns the domain from the cache, reading it from the DB on a miss. Unknown domains are cached too, so
+// repeated lookups of a domain that was never seen don't reach the DB either.
+func (r *Repo) Query(domain string) (models.Domain, error) {
+	return r.query(domain, false)
+}
+
+// QueryPrimary returns the domain from the cache when it was read from the primary of the DB, and reads it from the
+// primary otherwise. Since every write invalidates the domain, what it returns is never older than the last write.
+func (r *Repo) QueryPrimary(domain string) (models.Domain, error) {
+	return r.query(domain, true)
+}
+
+// query serves the domain from the cache and reads it on a miss, from the primary when primary is set. A read from the
+// primary doesn't wait on a read of the same domain from a replica, it replaces it.
+func (r *Repo) query(domain string, primary bool) (models.Domain, error) {
+	r.mu.Lock()
+	if e, ok := r.get(domain); ok && (e.primary || !primary) {
+		r.mu.Unlock()
+		atomic.AddUint64(&r.hits, 1)
+		if !e.found {
+			return models.Domain{}, ports.ErrNotFound
+		}
+		return e.domain, nil
+	}
+	atomic.AddUint64(&r.misses, 1)
+
+	if c, ok := r.inflight[domain]; ok {
+		if c.primary || !primary {
+			r.mu.Unlock()
+			c.wg.Wait()
+			return c.domain, c.err
+		}
+		c.stale = true
+	}
+
+	c := &call{primary: primary}
+	c.wg.Add(1)
+	r.inflight[domain] = c
+	r.mu.Unlock()
+
+	if primary {
+		c.domain, c.err = ports.QueryPrimary(r.DB, domain)
+	} else {
+		c.domain, c.err = r.DB.Query(domain)
+	}
+
+	r.mu.Lock()
+	if !c.stale {
+		delete(r.inflight, domain)
+		if c.err == nil || errors.Is(c.err, ports.ErrNotFound) {
+			r.set(domain, c.domain, c.err == nil, primary)
+		}
+	}
+	r.mu.Unlock()
+	c.wg.Done()
+
+	return c.domain, c.err
+}
+
+// QueryMany serves the cached domains and reads the rest from the DB in one call. Unknown domains aren't cached since
+// they are left out of the result.
+func (r *Repo) QueryMany(domains []string) (map[string]models.Domain, error) {
+	found := make(map[string]models.Domain, len(domains))
+	missing := make([]string, 0)
+
+	r.mu.Lock()
+	invalidations := r.invalidations
+	for _, domain := range domains {
+		e, ok := r.get(domain)
+		if !ok {
+			missing = append(missing, domain)
+			continue
+		}
+		// Query caches unknown domains too.
+		if e.found {
+			found[domain] = e.domain
+		}
+	}
+	r.mu.Unlock()
+	atomic.AddUint64(&r.hits, uint64(len(domains)-len(missing)))
+	atomic.AddUint64(&r.misses, uint64(len(missing)))
+
+	if len(missing) == 0 {
+		return found, nil
+	}
+
+	loaded, err := r.DB.QueryMany(missing)
+	if err != nil {
+		return nil, err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	fresh := r.invalidations == invalidations
+	for domain, d := range loaded {
+		found[domain] = d
+		if fresh {
+			r.set(domain, d, true, false)
+		}
+	}
+
+	return found, nil
+}
+
+// get returns the cached entry of the domain unless it expired, the caller must hold mu.
+func (r *Repo) get(domain string) (*entry, bool) {
+	el, ok := r.entries[domain]
+	if !ok {
+		return nil, false
+	}
+
+	e := el.Value.(*entry)
+	if r.now().After(e.expires) {
+		r.lru.Remove(el)
+		delete(r.entries, domain)
+		return nil, false
+	}
+
+	r.lru.MoveToFront(el)
+	return e, true
+}
+
+// set caches the domain, found or not, and evicts the least recently used domains over the size, the caller must
+// hold mu.
+func (r *Repo) set(domain string, d models.Domain, found, primary bool) {
+	e := &entry{key: domain, domain: d, found: found, primary: primary, expires: r.now().Add(r.cfg.TTL)}
+	if el, ok := r.entries[domain]; ok {
+		el.Value = e
+		r.lru.MoveToFront(el)
+		return
+	}
+
+	r.entries[domain] = r.lru.PushFront(e)
+	for r.lru.Len() > r.cfg.Size {
+		oldest := r.lru.Back()
+		r.lru.Remove(oldest)
+		delete(r.entries, oldest.Value.(*entry).key)
+		atomic.AddUint64(&r.evictions, 1)
+	}
+}
+
+// Invalidate drops the domain from the cache, and makes sure a read of it that is in flight isn't cached.
+func (r *Repo) Invalidate(domain string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.invalidations++
+	if el, ok := r.entries[domain]; ok {
+		r.lru.Remove(el)
+		delete(r.entries, domain)
+	}
+	if c, ok := r.inflight[domain]; ok {
+		c.stale = true
+		delete(r.inflight, domain)
+	}
+}
+
+// Flush drops every domain from the cache, and makes sure none of the reads in flight are cached.
+func (r *Repo) Flush() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.invalidations++
+	r.lru.Init()
+	r.entries = make(map[string]*list.Element)
+	for domain, c := range r.inflight {
+		c.stale = true
+		delete(r.inflight, domain)
+	}
+}
+
+// Insert writes the event through to the DB and invalidates the domain.
+func (r *Repo) Insert(event catchall.Event) error {
+	defer r.Invalidate(event.Domain)
+	return r.DB.Insert(event)
+}
+
+// Delete deletes the domain from the DB and invalidates it.
+func (r *Repo) Delete(domain string) error {
+	defer r.Invalidate(domain)
+	return r.DB.Delete(domain)
+}
+
+// Reset resets the domain in the DB and invalidates it.
+func (r *Repo) Reset(domain string) error {
+	defer r.Invalidate(domain)
+	return r.DB.Reset(domain)
+}
+
+// SetOverride sets the override in the DB and invalidates the domain.
+func (r *Repo) SetOverride(domain string, override models.Override) error {
+	defer r.Invalidate(domain)
+	return r.DB.SetOverride(domain, override)
+}
+
+// ClearOverride clears the override in the DB and invalidates the domain.
+func (r *Repo) ClearOverride(domain string) error {
+	defer r.Invalidate(domain)
+	return r.DB.ClearOverride(domain)
+}
+
+// Spooling reports whether the DB is a ports.Spooler that is spooling, so a write-behind buffer above the cache can
+// still tell.
+func (r *Repo) Spooling() bool {
+	s, ok := r.DB.(ports.Spooler)
+	return ok && s.Spooling()
+}
+
+// Stats returns the counters of the cache.
+func (r *Repo) Stats() Stats {
+	r.mu.Lock()
+	size := r.lru.Len()
+	r.mu.Unlock()
+
+	return Stats{
+		Hits:      atomic.LoadUint64(&r.hits),
+		Misses:    atomic.LoadUint64(&r.misses),
+		Evictions: atomic.LoadUint64(&r.evictions),
+		Size:      size,
+	}
+}
@@ -0,0 +1,316 @@
+package cache
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/mailgun/catchall"
+	"github.com/penthious/catchall/business/adapters"
+	"github.com/penthious/catchall/business/core/writebehind"
+	"github.com/penthious/catchall/business/models"
+	"github.com/penthious/catchall/business/ports"
+	"github.com/penthious/catchall/business/ports/portstest"
+	"github.com/stretchr/testify/assert"
+)
+
+// countingDB counts the queries that reach the DB, and holds them until release is closed when it is set.
+type countingDB struct {
+	ports.DB
+	queries int64
+	release chan struct{}
+}
+
+func (db *countingDB) Query(domain string) (models.Domain, error) {
+	atomic.AddInt64(&db.queries, 1)
+	if db.release != nil {
+		<-db.release
+	}
+	return db.DB.Query(domain)
+}
+
+func (db *countingDB) count() int64 {
+	return atomic.LoadInt64(&db.queries)
+}
+
+func TestCache(t *testing.T) {
+	db := &countingDB{DB: adapters.NewMemoryRepo()}
+	r := NewRepo(db, Config{Size: 2, TTL: time.Minute})
+	now := time.Now()
+	r.now = func() time.Time { return now }
+
+	if err := r.Insert(catchall.Event{Domain: "a.com", Type: catchall.TypeDelivered}); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("hits after a miss", func(t *testing.T) {
+		for i := 0; i < 3; i++ {
+			d, err := r.Query("a.com")
+			if err != nil {
+				t.Fatal(err)
+			}
+			assert.Equal(t, 1, d.Delivered)
+		}
+		assert.Equal(t, int64(1), db.count())
+		assert.Equal(t, Stats{Hits: 2, Misses: 1, Size: 1}, r.Stats())
+	})
+
+	t.Run("writes invalidate", func(t *testing.T) {
+		if err := r.Insert(catchall.Event{Domain: "a.com", Type: catchall.TypeDelivered}); err != nil {
+			t.Fatal(err)
+		}
+		d, _ := r.Query("a.com")
+		assert.Equal(t, 2, d.Delivered)
+
+		if err := r.SetOverride("a.com", models.Override{Status: models.StatusCatchAll, ExpiresAt: now.Add(time.Hour)}); err != nil {
+			t.Fatal(err)
+		}
+		d, _ = r.Query("a.com")
+		assert.Equal(t, models.StatusCatchAll, d.Override.Status)
+
+		if err := r.Reset("a.com"); err != nil {
+			t.Fatal(err)
+		}
+		d, _ = r.Query("a.com")
+		assert.Zero(t, d.Delivered)
+		assert.Equal(t, int64(4), db.count())
+	})
+
+	t.Run("entries expire", func(t *testing.T) {
+		now = now.Add(2 * time.Minute)
+		r.Query("a.com")
+		assert.Equal(t, int64(5), db.count())
+	})
+
+	t.Run("the least recently used domain is evicted", func(t *testing.T) {
+		r.Query("b.com")
+		r.Query("a.com")
+		r.Query("c.com")
+		assert.Equal(t, uint64(1), r.Stats().Evictions)
+		assert.Equal(t, 2, r.Stats().Size)
+
+		before := db.count()
+		r.Query("a.com")
+		assert.Equal(t, before, db.count(), "a.com was used more recently than b.com")
+		r.Query("b.com")
+		assert.Equal(t, before+1, db.count())
+	})
+
+	t.Run("batches only read the misses", func(t *testing.T) {
+		found, err := r.QueryMany([]string{"a.com", "b.com", "missing.com"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Len(t, found, 1, "the memory repo only knows a.com")
+	})
+}
+
+func TestCacheSingleflight(t *testing.T) {
+	db := &countingDB{DB: adapters.NewMemoryRepo(), release: make(chan struct{})}
+	r := NewRepo(db, Config{})
+
+	const callers = 10
+	var wg sync.WaitGroup
+	wg.Add(callers)
+	for i := 0; i < callers; i++ {
+		go func() {
+			defer wg.Done()
+			if _, err := r.Query("a.com"); !errors.Is(err, ports.ErrNotFound) {
+				t.Error(err)
+			}
+		}()
+	}
+
+	assert.Eventually(t, func() bool { return r.Stats().Misses == callers }, time.Second, time.Millisecond)
+	close(db.release)
+	wg.Wait()
+
+	assert.Equal(t, int64(1), db.count(), "concurrent misses share a single read")
+
+	_, err := r.Query("a.com")
+	assert.ErrorIs(t, err, ports.ErrNotFound)
+	assert.Equal(t, int64(1), db.count(), "unknown domains are cached too")
+}
+
+func TestCacheInvalidateInFlight(t *testing.T) {
+	db := &countingDB{DB: adapters.NewMemoryRepo(), release: make(chan struct{})}
+	r := NewRepo(db, Config{})
+
+	done := make(chan models.Domain)
+	go func() {
+		d, _ := r.Query("a.com")
+		done <- d
+	}()
+	assert.Eventually(t, func() bool { return db.count() == 1 }, time.Second, time.Millisecond)
+
+	// the read in flight started before the write, so what it returns must not be cached
+	if err := r.Insert(catchall.Event{Domain: "a.com", Type: catchall.TypeBounced}); err != nil {
+		t.Fatal(err)
+	}
+	close(db.release)
+	<-done
+
+	d, err := r.Query("a.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, 1, d.Bounced)
+}
+
+func TestCacheFlush(t *testing.T) {
+	db := &countingDB{DB: adapters.NewMemoryRepo()}
+	r := NewRepo(db, Config{})
+
+	r.Query("a.com")
+	r.Query("b.com")
+	assert.Equal(t, 2, r.Stats().Size)
+
+	r.Flush()
+	assert.Zero(t, r.Stats().Size)
+
+	r.Query("a.com")
+	assert.Equal(t, int64(3), db.count(), "flushed domains are read again")
+}
+
+func TestCacheOverBuffer(t *testing.T) {
+	db := &countingDB{DB: adapters.NewMemoryRepo()}
+	buf := writebehind.NewBuffer(db, writebehind.Config{FlushInterval: time.Hour})
+	r := NewRepo(buf, Config{})
+
+	// The domain only has pending increments, the buffer returns it without an ID.
+	if err := buf.Insert(catchall.Event{Domain: "a.com", Type: catchall.TypeBounced}); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 2; i++ {
+		d, err := r.Query("a.com")
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, 1, d.Bounced)
+
+		found, err := r.QueryMany([]string{"a.com"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, 1, found["a.com"].Bounced)
+	}
+	assert.Equal(t, int64(1), db.count(), "the hits are served as found")
+
+	if err := r.Insert(catchall.Event{Domain: "a.com", Type: catchall.TypeBounced}); err != nil {
+		t.Fatal(err)
+	}
+	d, err := r.Query("a.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, 2, d.Bounced)
+	assert.Equal(t, int64(2), db.count(), "the insert invalidated the domain")
+}
+
+// deltaDB applies the batches of a write-behind buffer one event at a time.
+type deltaDB struct {
+	*countingDB
+}
+
+func (db deltaDB) ApplyDeltas(deltas []models.Delta) error {
+	for _, dl := range deltas {
+		for i := 0; i < dl.Delivered; i++ {
+			if err := db.Insert(catchall.Event{Domain: dl.Domain, Type: catchall.TypeDelivered}); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func TestDeltaRepoBelowBuffer(t *testing.T) {
+	db := &countingDB{DB: adapters.NewMemoryRepo()}
+	r := NewDeltaRepo(deltaDB{db}, Config{})
+	buf := writebehind.NewBuffer(r, writebehind.Config{FlushInterval: time.Hour})
+
+	query := func() int {
+		d, err := buf.Query("a.com")
+		if err != nil && !errors.Is(err, ports.ErrNotFound) {
+			t.Fatal(err)
+		}
+		return d.Delivered
+	}
+
+	for i := 1; i <= 3; i++ {
+		if err := buf.Insert(catchall.Event{Domain: "a.com", Type: catchall.TypeDelivered}); err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, i, query())
+	}
+	assert.Equal(t, int64(1), db.count(), "the pending increments are added to the cached domain")
+
+	if err := buf.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, 3, query())
+	assert.Equal(t, int64(2), db.count(), "the flush invalidated the domain")
+}
+
+func TestCacheConformance(t *testing.T) {
+	portstest.Run(t, func(t *testing.T) ports.DB {
+		return NewRepo(adapters.NewMemoryRepo(), Config{})
+	})
+}
+
+// replicatedDB counts the reads of the primary apart from the reads of a replica.
+type replicatedDB struct {
+	*countingDB
+	primary int64
+}
+
+func (db *replicatedDB) QueryPrimary(domain string) (models.Domain, error) {
+	atomic.AddInt64(&db.primary, 1)
+	return db.DB.Query(domain)
+}
+
+func TestCacheQueryPrimary(t *testing.T) {
+	db := &replicatedDB{countingDB: &countingDB{DB: adapters.NewMemoryRepo()}}
+	r := NewRepo(db, Config{})
+	if err := r.Insert(catchall.Event{Domain: "a.com", Type: catchall.TypeDelivered}); err != nil {
+		t.Fatal(err)
+	}
+
+	r.Query("a.com")
+	r.QueryPrimary("a.com")
+	assert.Equal(t, int64(1), atomic.LoadInt64(&db.primary), "a domain read from a replica is read from the primary")
+
+	r.QueryPrimary("a.com")
+	r.Query("a.com")
+	assert.Equal(t, int64(1), atomic.LoadInt64(&db.primary), "a domain read from the primary is served to both")
+	assert.Equal(t, int64(1), db.count())
+
+	if err := r.Insert(catchall.Event{Domain: "a.com", Type: catchall.TypeDelivered}); err != nil {
+		t.Fatal(err)
+	}
+	d, err := r.QueryPrimary("a.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, 2, d.Delivered)
+	assert.Equal(t, int64(2), atomic.LoadInt64(&db.primary), "the insert invalidated the domain")
+}
+
+// spoolingDB is a DB that spools every write.
+type spoolingDB struct {
+	ports.DB
+}
+
+func (db spoolingDB) Spooling() bool {
+	return true
+}
+
+func TestSpoolingBelowBuffer(t *testing.T) {
+	buf := writebehind.NewBuffer(NewRepo(spoolingDB{adapters.NewMemoryRepo()}, Config{}), writebehind.Config{})
+	err := buf.Insert(catchall.Event{Domain: "a.com", Type: catchall.TypeDelivered})
+	assert.ErrorIs(t, err, ports.ErrSpooled, "the buffer sees through the cache")
+
+	assert.False(t, NewRepo(adapters.NewMemoryRepo(), Config{}).Spooling())
+}
@@ -0,0 +1,278 @@
+// Package consumer writes the events pulled from a message broker into a ports.DB.
+package consumer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"github.com/mailgun/catchall"
+	"github.com/penthious/catchall/business/models"
+	"github.com/penthious/catchall/business/ports"
+	"github.com/rs/zerolog"
+)
+
+// Config contains the settings for the Consumer, zero values are replaced with the defaults.
+type Config struct {
+	Log *zerolog.Logger
+	// BatchSize is the most messages fetched and committed at once, 100 by default.
+	BatchSize int
+	// RetryDelay is how long to wait after the source or the DB failed before trying again, 1s by default.
+	RetryDelay time.Duration
+	// Remember is the number of IDs of inserted messages kept to recognize their redelivery, 100,000 by default.
+	Remember int
+	// Flush writes out what the DB buffers, it is called before every commit so that a message is only committed once
+	// its event was written. A flush that fails is tried again like an insert. Leave it nil when the DB doesn't buffer.
+	Flush func() error
+}
+
+// Stats are the counters of the Consumer since it was created.
+type Stats struct {
+	Consumed uint64 `json:"consumed"`
+	Inserted uint64 `json:"inserted"`
+	// Duplicates is the number of redelivered messages that were already inserted.
+	Duplicates uint64 `json:"duplicates"`
+	// Invalid is the number of messages whose event no DB stores, they are committed without being inserted.
+	Invalid uint64 `json:"invalid"`
+	// Errors is the number of failed fetches, inserts, flushes and commits, which are all tried again.
+	Errors uint64 `json:"errors"`
+}
+
+// Consumer fetches the messages of a ports.Source in batches, inserts their events and commits the batch once every
+// event of it was inserted and flushed. An insert that fails is tried again until it succeeds, so no event is
+// skipped. A batch that isn't committed, because the process stopped or the commit failed, is delivered again by the
+// broker. The IDs of the last inserted messages are remembered so their redelivery isn't counted twice, and with a
+// ports.IdempotentDB the IDs are also checked against its dedup window.
+type Consumer struct {
+	db     ports.DB
+	source ports.Source
+	cfg    Config
+	seen   *recent
+
+	consumed   atomic.Uint64
+	inserted   atomic.Uint64
+	duplicates atomic.Uint64
+	invalid    atomic.Uint64
+	failures   atomic.Uint64
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+// NewConsumer returns a Consumer of the source writing into db, call Start to begin consuming. The db has to have
+// written an event by the time Insert returns or the next Flush does, an insert answered with ports.ErrQueued is tried
+// again like a failed one, so give the consumer the DB below an ingest queue.
+func NewConsumer(db ports.DB, source ports.Source, cfg Config) *Consumer {
+	if cfg.Log == nil {
+		nop := zerolog.Nop()
+		cfg.Log = &nop
+	}
+	if cfg.BatchSize <= 0 {
+		cfg.BatchSize = 100
+	}
+	if cfg.RetryDelay <= 0 {
+		cfg.RetryDelay = time.Second
+	}
+	if cfg.Remember <= 0 {
+		cfg.Remember = 100_000
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	return &Consumer{
+		db:     db,
+		source: source,
+		cfg:    cfg,
+		seen:   newRecent(cfg.Remember),
+		ctx:    ctx,
+		cancel: cancel,
+		done:   make(chan struct{}),
+	}
+}
+
+// Start consumes in the background until Shutdown is called.
+func (c *Consumer) Start() {
+	go func() {
+		defer close(c.done)
+		for c.ctx.Err() == nil {
+			c.consume()
+		}
+	}()
+}
+
+// consume handles a batch of messages.
+func (c *Consumer) consume() {
+	msgs, err := c.source.Fetch(c.ctx, c.cfg.BatchSize)
+	if c.ctx.Err() != nil {
+		return
+	}
+	if err != nil {
+		c.failures.Add(1)
+		c.cfg.Log.Error().Err(err).Msg("fetching events")
+		c.wait()
+		return
+	}
+	c.consumed.Add(uint64(len(msgs)))
+
+	inserted := c.insert(msgs)
+	if inserted == 0 || !c.flush() {
+		return
+	}
+
+	// The commit is made even when shutting down, so the events inserted aren't delivered again.
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := c.source.Commit(ctx, msgs[:inserted]); err != nil {
+		c.failures.Add(1)
+		c.cfg.Log.Error().Err(err).Int("messages", inserted).Msg("committing events, they will be delivered again")
+	}
+}
+
+// insert inserts the events of the messages in order, trying every failed insert again until it succeeds. It returns
+// the number of messages handled before the consumer was shut down.
+func (c *Consumer) insert(msgs []models.Message) int {
+	for i, msg := range msgs {
+		for {
+			err := c.handle(msg)
+			if err == nil {
+				break
+			}
+			c.failures.Add(1)
+			c.cfg.Log.Error().Err(err).Str("id", msg.ID).Str("domain", msg.Event.Domain).Msg("inserting event")
+			if !c.wait() {
+				return i
+			}
+		}
+	}
+	return len(msgs)
+}
+
+// flush writes out what the DB buffers, trying again until it succeeds. It returns false when the consumer was shut
+// down first, the messages are then left uncommitted and delivered again.
+func (c *Consumer) flush() bool {
+	if c.cfg.Flush == nil {
+		return true
+	}
+	for {
+		err := c.cfg.Flush()
+		if err == nil {
+			return true
+		}
+		c.failures.Add(1)
+		c.cfg.Log.Error().Err(err).Msg("flushing events")
+		if !c.wait() {
+			return false
+		}
+	}
+}
+
+// handle inserts the event of the message unless it is invalid or the message was already inserted.
+func (c *Consumer) handle(msg models.Message) error {
+	if msg.ID != "" && c.seen.contains(msg.ID) {
+		c.duplicates.Add(1)
+		return nil
+	}
+
+	if msg.Event.Domain == "" || (msg.Event.Type != catchall.TypeBounced && msg.Event.Type != catchall.TypeDelivered) {
+		c.invalid.Add(1)
+		c.cfg.Log.Warn().Str("id", msg.ID).Str("domain", msg.Event.Domain).Str("type", msg.Event.Type).
+			Msg("dropping invalid event")
+		return nil
+	}
+
+	err := c.insertOnce(msg)
+	if errors.Is(err, ports.ErrDuplicate) {
+		c.duplicates.Add(1)
+		c.seen.add(msg.ID)
+		return nil
+	}
+	// A queued event may still be lost, its message is only committed once the event was written.
+	if errors.Is(err, ports.ErrQueued) {
+		return fmt.Errorf("event was queued rather than written: %w", err)
+	}
+	if err != nil && !errors.Is(err, ports.ErrSpooled) {
+		return err
+	}
+
+	c.inserted.Add(1)
+	if msg.ID != "" {
+		c.seen.add(msg.ID)
+	}
+	return nil
+}
+
+// insertOnce inserts the event of a message with an ID at most once when the DB is a ports.IdempotentDB, so that the
+// redeliveries this consumer doesn't remember, and the events also posted over HTTP, aren't counted twice.
+func (c *Consumer) insertOnce(msg models.Message) error {
+	if db, ok := c.db.(ports.IdempotentDB); ok && msg.ID != "" {
+		return db.InsertOnce(msg.ID, msg.Event)
+	}
+	return c.db.Insert(msg.Event)
+}
+
+// wait waits RetryDelay, and returns false when the consumer was shut down in the meantime.
+func (c *Consumer) wait() bool {
+	timer := time.NewTimer(c.cfg.RetryDelay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-c.ctx.Done():
+		return false
+	}
+}
+
+// Stats returns the counters of the consumer.
+func (c *Consumer) Stats() Stats {
+	return Stats{
+		Consumed:   c.consumed.Load(),
+		Inserted:   c.inserted.Load(),
+		Duplicates: c.duplicates.Load(),
+		Invalid:    c.invalid.Load(),
+		Errors:     c.failures.Load(),
+	}
+}
+
+// Shutdown stops consuming after the batch in progress, waiting for it to be committed or the context to expire, and
+// closes the source.
+func (c *Consumer) Shutdown(ctx context.Context) error {
+	c.cancel()
+
+	select {
+	case <-c.done:
+		return c.source.Close()
+	case <-ctx.Done():
+		return fmt.Errorf("consumer shutdown: %w", ctx.Err())
+	}
+}
+
+// recent is a set of the last IDs added to it, the oldest is forgotten once it is full. It is only used by the
+// goroutine of the consumer.
+type recent struct {
+	ids  map[string]struct{}
+	ring []string
+	next int
+}
+
+func newRecent(size int) *recent {
+	return &recent{
+		ids:  make(map[string]struct{}, size),
+		ring: make([]string, size),
+	}
+}
+
+func (r *recent) contains(id string) bool {
+	_, ok := r.ids[id]
+	return ok
+}
+
+func (r *recent) add(id string) {
+	if old := r.ring[r.next]; old != "" {
+		delete(r.ids, old)
+	}
+	r.ring[r.next] = id
+	r.ids[id] = struct{}{}
+	r.next = (r.next + 1) % len(r.ring)
+}
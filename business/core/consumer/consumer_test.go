@@ -0,0 +1,241 @@
+package consumer
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/mailgun/catchall"
+	"github.com/penthious/catchall/business/adapters"
+	"github.com/penthious/catchall/business/core/dedup"
+	"github.com/penthious/catchall/business/core/writebehind"
+	"github.com/penthious/catchall/business/models"
+	"github.com/penthious/catchall/business/ports"
+	"github.com/stretchr/testify/assert"
+)
+
+// flakyDB fails the first inserts.
+type flakyDB struct {
+	adapters.MemoryRepo
+
+	mu       sync.Mutex
+	failures int
+}
+
+func (db *flakyDB) Insert(event catchall.Event) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if db.failures > 0 {
+		db.failures--
+		return errors.New("connection reset")
+	}
+	return db.MemoryRepo.Insert(event)
+}
+
+// rewindingSource fails the first commit and starts reading again from the committed offset, like a broker
+// redelivering a batch that wasn't acked.
+type rewindingSource struct {
+	*adapters.MemoryBrokerSource
+	broker *adapters.MemoryBroker
+
+	mu       sync.Mutex
+	rewinded bool
+}
+
+func (s *rewindingSource) source() *adapters.MemoryBrokerSource {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.MemoryBrokerSource
+}
+
+func (s *rewindingSource) Fetch(ctx context.Context, max int) ([]models.Message, error) {
+	return s.source().Fetch(ctx, max)
+}
+
+func (s *rewindingSource) Commit(ctx context.Context, msgs []models.Message) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.rewinded {
+		s.rewinded = true
+		s.MemoryBrokerSource = s.broker.Source("events", "catchall")
+		return errors.New("commit failed")
+	}
+	return s.MemoryBrokerSource.Commit(ctx, msgs)
+}
+
+func publish(broker *adapters.MemoryBroker, domain, eventType string, n int) {
+	for i := 0; i < n; i++ {
+		broker.Publish("events", catchall.Event{Domain: domain, Type: eventType})
+	}
+}
+
+// waitCommitted waits for the group to commit the topic up to the offset.
+func waitCommitted(t *testing.T, broker *adapters.MemoryBroker, offset int64) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for broker.Committed("events", "catchall") < offset {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected the offset %d to be committed, got %d", offset, broker.Committed("events", "catchall"))
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestConsumer(t *testing.T) {
+	broker := adapters.NewMemoryBroker()
+	db := adapters.NewMemoryRepo()
+	c := NewConsumer(db, broker.Source("events", "catchall"), Config{BatchSize: 4})
+	c.Start()
+
+	publish(broker, "a.com", catchall.TypeDelivered, 10)
+	publish(broker, "a.com", catchall.TypeBounced, 2)
+	broker.Publish("events", catchall.Event{Domain: "a.com", Type: "opened"}, catchall.Event{Type: catchall.TypeBounced})
+
+	waitCommitted(t, broker, 14)
+	assert.NoError(t, c.Shutdown(context.Background()))
+
+	d, _ := db.Query("a.com")
+	assert.Equal(t, 10, d.Delivered)
+	assert.Equal(t, 2, d.Bounced)
+
+	stats := c.Stats()
+	assert.Equal(t, uint64(14), stats.Consumed)
+	assert.Equal(t, uint64(12), stats.Inserted)
+	assert.Equal(t, uint64(2), stats.Invalid)
+	assert.Zero(t, stats.Errors)
+}
+
+func TestConsumerRetries(t *testing.T) {
+	broker := adapters.NewMemoryBroker()
+	db := &flakyDB{MemoryRepo: adapters.NewMemoryRepo(), failures: 3}
+	c := NewConsumer(db, broker.Source("events", "catchall"), Config{RetryDelay: time.Millisecond})
+	c.Start()
+
+	publish(broker, "a.com", catchall.TypeDelivered, 5)
+
+	waitCommitted(t, broker, 5)
+	assert.NoError(t, c.Shutdown(context.Background()))
+
+	d, _ := db.Query("a.com")
+	assert.Equal(t, 5, d.Delivered, "no event is skipped")
+
+	stats := c.Stats()
+	assert.Equal(t, uint64(5), stats.Inserted)
+	assert.Equal(t, uint64(3), stats.Errors)
+}
+
+func TestConsumerRedelivery(t *testing.T) {
+	broker := adapters.NewMemoryBroker()
+	publish(broker, "a.com", catchall.TypeDelivered, 3)
+
+	db := adapters.NewMemoryRepo()
+	source := &rewindingSource{MemoryBrokerSource: broker.Source("events", "catchall"), broker: broker}
+	c := NewConsumer(db, source, Config{})
+	c.Start()
+
+	waitCommitted(t, broker, 3)
+	assert.NoError(t, c.Shutdown(context.Background()))
+
+	d, _ := db.Query("a.com")
+	assert.Equal(t, 3, d.Delivered, "the redelivered events are inserted once")
+
+	stats := c.Stats()
+	assert.Equal(t, uint64(6), stats.Consumed)
+	assert.Equal(t, uint64(3), stats.Inserted)
+	assert.Equal(t, uint64(3), stats.Duplicates)
+	assert.Equal(t, uint64(1), stats.Errors)
+}
+
+func TestConsumerIdempotentDB(t *testing.T) {
+	broker := adapters.NewMemoryBroker()
+	publish(broker, "a.com", catchall.TypeDelivered, 2)
+
+	store := adapters.NewMemoryDedup(adapters.DedupConfig{})
+	if _, err := store.Claim("events/0"); err != nil {
+		t.Fatal(err)
+	}
+
+	mem := adapters.NewMemoryRepo()
+	c := NewConsumer(dedup.NewRepo(mem, store, dedup.Config{}), broker.Source("events", "catchall"), Config{})
+	c.Start()
+
+	waitCommitted(t, broker, 2)
+	assert.NoError(t, c.Shutdown(context.Background()))
+
+	d, _ := mem.Query("a.com")
+	assert.Equal(t, 1, d.Delivered, "the event already counted by another instance isn't counted again")
+
+	stats := c.Stats()
+	assert.Equal(t, uint64(1), stats.Inserted)
+	assert.Equal(t, uint64(1), stats.Duplicates)
+}
+
+func TestConsumerShutdown(t *testing.T) {
+	broker := adapters.NewMemoryBroker()
+	db := &flakyDB{MemoryRepo: adapters.NewMemoryRepo(), failures: 1_000_000}
+	c := NewConsumer(db, broker.Source("events", "catchall"), Config{RetryDelay: time.Hour})
+	c.Start()
+
+	publish(broker, "a.com", catchall.TypeDelivered, 2)
+	time.Sleep(10 * time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	assert.NoError(t, c.Shutdown(ctx), "a failing insert doesn't hold the shutdown")
+	assert.Zero(t, broker.Committed("events", "catchall"), "the events that weren't inserted aren't committed")
+}
+
+// queueDB queues every insert without writing it, like the ingest queue does.
+type queueDB struct {
+	adapters.MemoryRepo
+}
+
+func (db queueDB) Insert(catchall.Event) error {
+	return ports.ErrQueued
+}
+
+func TestConsumerQueuedIsNotInserted(t *testing.T) {
+	broker := adapters.NewMemoryBroker()
+	c := NewConsumer(queueDB{adapters.NewMemoryRepo()}, broker.Source("events", "catchall"), Config{RetryDelay: time.Hour})
+	c.Start()
+
+	publish(broker, "a.com", catchall.TypeDelivered, 2)
+	assert.Eventually(t, func() bool { return c.Stats().Errors == 1 }, time.Second, time.Millisecond)
+	assert.NoError(t, c.Shutdown(context.Background()))
+
+	assert.Zero(t, broker.Committed("events", "catchall"), "the queued events weren't written so they aren't committed")
+	assert.Zero(t, c.Stats().Inserted)
+}
+
+func TestConsumerFlushesBeforeCommit(t *testing.T) {
+	broker := adapters.NewMemoryBroker()
+	db := &flakyDB{MemoryRepo: adapters.NewMemoryRepo(), failures: 2}
+	buf := writebehind.NewBuffer(db, writebehind.Config{FlushInterval: time.Hour})
+	c := NewConsumer(buf, broker.Source("events", "catchall"), Config{RetryDelay: time.Millisecond, Flush: buf.Flush})
+	c.Start()
+
+	publish(broker, "a.com", catchall.TypeDelivered, 3)
+
+	waitCommitted(t, broker, 3)
+	d, _ := db.Query("a.com")
+	assert.Equal(t, 3, d.Delivered, "the buffered events were written before they were committed")
+	assert.NoError(t, c.Shutdown(context.Background()))
+
+	stats := c.Stats()
+	assert.Equal(t, uint64(3), stats.Inserted)
+	assert.Equal(t, uint64(2), stats.Errors, "the failed flushes were tried again")
+}
+
+func TestRecent(t *testing.T) {
+	r := newRecent(2)
+	r.add("a")
+	r.add("b")
+	assert.True(t, r.contains("a"))
+
+	r.add("c")
+	assert.False(t, r.contains("a"), "the oldest ID is forgotten")
+	assert.True(t, r.contains("b"))
+	assert.True(t, r.contains("c"))
+}
@@ -0,0 +1,108 @@
+// Package dedup counts the events carrying an ID at most once within the window of a ports.Dedup store.
+package dedup
+
+import (
+	"errors"
+	"sync/atomic"
+
+	"github.com/mailgun/catchall"
+	"github.com/penthious/catchall/business/models"
+	"github.com/penthious/catchall/business/ports"
+	"github.com/rs/zerolog"
+)
+
+var (
+	_ ports.DB           = (*Repo)(nil)
+	_ ports.IdempotentDB = (*Repo)(nil)
+)
+
+// Config contains the settings for the Repo, zero values are replaced with the defaults.
+type Config struct {
+	Log *zerolog.Logger
+}
+
+// Stats are the counters of the Repo since it was created.
+type Stats struct {
+	// Checked is the number of events with an ID looked up in the store.
+	Checked uint64 `json:"checked"`
+	// Duplicates is the number of events acknowledged without being counted.
+	Duplicates uint64 `json:"duplicates"`
+	// Unchecked is the number of events counted without knowing whether they were duplicates, because the store
+	// failed.
+	Unchecked uint64 `json:"unchecked"`
+}
+
+// Repo claims the ID of an event in the store before inserting it, and releases the ID when the insert fails so the
+// retry of the event is counted. The events without an ID are inserted as is. When the store fails the event is
+// counted anyway, a duplicate counted while the store is down is preferred to an event lost.
+type Repo struct {
+	ports.DB
+	store ports.Dedup
+	cfg   Config
+
+	checked    atomic.Uint64
+	duplicates atomic.Uint64
+	unchecked  atomic.Uint64
+}
+
+// NewRepo returns a Repo in front of db remembering the IDs in store.
+func NewRepo(db ports.DB, store ports.Dedup, cfg Config) *Repo {
+	if cfg.Log == nil {
+		nop := zerolog.Nop()
+		cfg.Log = &nop
+	}
+
+	return &Repo{DB: db, store: store, cfg: cfg}
+}
+
+// InsertOnce inserts the event unless its ID was already claimed, and returns ports.ErrDuplicate then. An event that
+// is spooled is counted and its ID stays claimed. So does the ID of an event that is queued, unless the queue gives up
+// on writing it.
+func (r *Repo) InsertOnce(id string, event catchall.Event) error {
+	if id == "" {
+		return r.DB.Insert(event)
+	}
+
+	r.checked.Add(1)
+	first, err := r.store.Claim(id)
+	if err != nil {
+		r.unchecked.Add(1)
+		r.cfg.Log.Warn().Err(err).Str("id", id).Msg("dedup store failed, counting the event unchecked")
+		return r.DB.Insert(event)
+	}
+	if !first {
+		r.duplicates.Add(1)
+		return ports.ErrDuplicate
+	}
+
+	if q, ok := r.DB.(ports.Enqueuer); ok {
+		err = q.Enqueue(event, func() { r.release(id) })
+	} else {
+		err = r.DB.Insert(event)
+	}
+	if err != nil && !errors.Is(err, ports.ErrQueued) && !errors.Is(err, ports.ErrSpooled) {
+		r.release(id)
+	}
+	return err
+}
+
+// release forgets the ID of an event that wasn't written, so that its retry is counted.
+func (r *Repo) release(id string) {
+	if err := r.store.Release(id); err != nil {
+		r.cfg.Log.Error().Err(err).Str("id", id).Msg("releasing the ID of a failed event, its retry is dropped")
+	}
+}
+
+// QueryPrimary passes the read through to the primary of the DB.
+func (r *Repo) QueryPrimary(domain string) (models.Domain, error) {
+	return ports.QueryPrimary(r.DB, domain)
+}
+
+// Stats returns the counters of the repo.
+func (r *Repo) Stats() Stats {
+	return Stats{
+		Checked:    r.checked.Load(),
+		Duplicates: r.duplicates.Load(),
+		Unchecked:  r.unchecked.Load(),
+	}
+}
@@ -0,0 +1,90 @@
+package dedup
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/mailgun/catchall"
+	"github.com/penthious/catchall/business/adapters"
+	"github.com/penthious/catchall/business/ports"
+	"github.com/stretchr/testify/assert"
+)
+
+// failingDB fails every insert into the domain "fail.com".
+type failingDB struct {
+	adapters.MemoryRepo
+}
+
+func (db failingDB) Insert(event catchall.Event) error {
+	if event.Domain == "fail.com" {
+		return errors.New("connection reset")
+	}
+	return db.MemoryRepo.Insert(event)
+}
+
+// brokenStore fails every claim.
+type brokenStore struct{}
+
+func (brokenStore) Claim(string) (bool, error) { return false, errors.New("connection refused") }
+func (brokenStore) Release(string) error       { return nil }
+
+func TestRepo(t *testing.T) {
+	db := failingDB{adapters.NewMemoryRepo()}
+	r := NewRepo(db, adapters.NewMemoryDedup(adapters.DedupConfig{}), Config{})
+	delivered := catchall.Event{Domain: "a.com", Type: catchall.TypeDelivered}
+
+	assert.NoError(t, r.InsertOnce("1", delivered))
+	assert.ErrorIs(t, r.InsertOnce("1", delivered), ports.ErrDuplicate)
+	assert.NoError(t, r.InsertOnce("2", delivered))
+	assert.NoError(t, r.InsertOnce("", delivered), "events without an ID aren't checked")
+	assert.NoError(t, r.InsertOnce("", delivered))
+
+	d, _ := r.Query("a.com")
+	assert.Equal(t, 4, d.Delivered)
+
+	t.Run("the ID of a failed event is released", func(t *testing.T) {
+		failing := catchall.Event{Domain: "fail.com", Type: catchall.TypeBounced}
+		assert.Error(t, r.InsertOnce("3", failing))
+		assert.Error(t, r.InsertOnce("3", failing), "the retry isn't a duplicate")
+	})
+
+	stats := r.Stats()
+	assert.Equal(t, uint64(5), stats.Checked)
+	assert.Equal(t, uint64(1), stats.Duplicates)
+	assert.Zero(t, stats.Unchecked)
+}
+
+func TestRepoBrokenStore(t *testing.T) {
+	r := NewRepo(adapters.NewMemoryRepo(), brokenStore{}, Config{})
+	delivered := catchall.Event{Domain: "a.com", Type: catchall.TypeDelivered}
+
+	assert.NoError(t, r.InsertOnce("1", delivered))
+	assert.NoError(t, r.InsertOnce("1", delivered), "events are counted while the store is down")
+
+	d, _ := r.Query("a.com")
+	assert.Equal(t, 2, d.Delivered)
+	assert.Equal(t, uint64(2), r.Stats().Unchecked)
+}
+
+// queueDB queues every event and keeps what to call when the queue gives up on it.
+type queueDB struct {
+	adapters.MemoryRepo
+	failed []func()
+}
+
+func (db *queueDB) Enqueue(event catchall.Event, failed func()) error {
+	db.failed = append(db.failed, failed)
+	return ports.ErrQueued
+}
+
+func TestRepoQueued(t *testing.T) {
+	db := &queueDB{MemoryRepo: adapters.NewMemoryRepo()}
+	r := NewRepo(db, adapters.NewMemoryDedup(adapters.DedupConfig{}), Config{})
+	delivered := catchall.Event{Domain: "a.com", Type: catchall.TypeDelivered}
+
+	assert.ErrorIs(t, r.InsertOnce("1", delivered), ports.ErrQueued)
+	assert.ErrorIs(t, r.InsertOnce("1", delivered), ports.ErrDuplicate, "the ID stays claimed while the event is queued")
+
+	db.failed[0]()
+	assert.ErrorIs(t, r.InsertOnce("1", delivered), ports.ErrQueued, "the queue gave up on the event, its retry is counted")
+}
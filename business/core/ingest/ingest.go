@@ -0,0 +1,317 @@
+// Package ingest accepts the events into a bounded queue and writes them to a ports.DB from a pool of workers, so that
+// the requests don't wait on the database.
+package ingest
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/mailgun/catchall"
+	"github.com/penthious/catchall/business/models"
+	"github.com/penthious/catchall/business/ports"
+	"github.com/rs/zerolog"
+)
+
+var _ ports.DB = (*Queue)(nil)
+var _ ports.PrimaryReader = (*Queue)(nil)
+var _ ports.Enqueuer = (*Queue)(nil)
+
+// ErrFull is returned by Insert when the queue has no room for the event, the client is asked to retry a second later.
+var ErrFull error = fullError{}
+
+type fullError struct{}
+
+func (fullError) Error() string {
+	return "ingest queue full"
+}
+
+// RetryAfter tells the client when to try again.
+func (fullError) RetryAfter() time.Duration {
+	return time.Second
+}
+
+// Config contains the settings for the Queue, zero values are replaced with the defaults.
+type Config struct {
+	Log *zerolog.Logger
+	// Size is the most events waiting in the queue, Insert fails with ErrFull beyond it. 10,000 by default.
+	Size int
+	// Workers is the number of workers writing the events, 4 by default.
+	Workers int
+	// BatchSize is the most events a worker takes from the queue at once, 100 by default.
+	BatchSize int
+	// MinBackoff and MaxBackoff bound the wait before a batch that failed is written again, it doubles after every
+	// failure. 100ms and 10s by default.
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+}
+
+// Stats are the counters of the Queue since it was created.
+type Stats struct {
+	Enqueued uint64 `json:"enqueued"`
+	Written  uint64 `json:"written"`
+	// Retried is the number of batches that failed to be written and were tried again.
+	Retried uint64 `json:"retried"`
+	// Failed is the number of events that were given up on because the DB still failed them when the shutdown
+	// deadline passed.
+	Failed uint64 `json:"failed"`
+	// Rejected is the number of events that were answered with ErrFull.
+	Rejected uint64 `json:"rejected"`
+	// Depth is the number of events waiting in the queue out of Size.
+	Depth int `json:"depth"`
+	Size  int `json:"size"`
+	// Lag is how long the oldest event of the last batch waited in the queue.
+	Lag time.Duration `json:"lag"`
+}
+
+// item is an event waiting in the queue, failed is called when it is given up on.
+type item struct {
+	event  catchall.Event
+	at     time.Time
+	failed func()
+}
+
+// Queue is a ports.DB whose Insert puts the event in a bounded queue and returns ports.ErrQueued, the workers write
+// the events in the background. The other calls go straight to the DB, so a read may not see the events still in the
+// queue yet.
+//
+// The workers write the events in batches of what is waiting, summed per domain into a single ApplyDeltas when the DB
+// implements ports.DeltaWriter and with one Insert per event otherwise. A batch the DB fails is written again with
+// backoff until it is written, so while the DB fails the queue fills up and the events are answered with ErrFull.
+type Queue struct {
+	ports.DB
+	cfg Config
+
+	// mu is held for reading while an event is put in the queue, and for writing when the queue is closed.
+	mu     sync.RWMutex
+	items  chan item
+	closed bool
+
+	enqueued atomic.Uint64
+	written  atomic.Uint64
+	retried  atomic.Uint64
+	failed   atomic.Uint64
+	rejected atomic.Uint64
+	lag      atomic.Int64
+
+	wg   sync.WaitGroup
+	done chan struct{}
+	// abandon is closed once the shutdown deadline passed, the batches that fail are given up on from then on.
+	abandon     chan struct{}
+	abandonOnce sync.Once
+}
+
+// NewQueue returns a Queue in front of db, call Start to begin writing.
+func NewQueue(db ports.DB, cfg Config) *Queue {
+	if cfg.Log == nil {
+		nop := zerolog.Nop()
+		cfg.Log = &nop
+	}
+	if cfg.Size <= 0 {
+		cfg.Size = 10_000
+	}
+	if cfg.Workers <= 0 {
+		cfg.Workers = 4
+	}
+	if cfg.BatchSize <= 0 {
+		cfg.BatchSize = 100
+	}
+	if cfg.MinBackoff <= 0 {
+		cfg.MinBackoff = 100 * time.Millisecond
+	}
+	if cfg.MaxBackoff <= 0 {
+		cfg.MaxBackoff = 10 * time.Second
+	}
+
+	return &Queue{
+		DB:      db,
+		cfg:     cfg,
+		items:   make(chan item, cfg.Size),
+		done:    make(chan struct{}),
+		abandon: make(chan struct{}),
+	}
+}
+
+// Insert puts the event in the queue and returns ports.ErrQueued, or ErrFull when the queue has no room for it. Once
+// the queue is shut down the event is written right away.
+func (q *Queue) Insert(event catchall.Event) error {
+	return q.Enqueue(event, nil)
+}
+
+// Enqueue is Insert calling failed when the event is given up on after it was queued, see Shutdown.
+func (q *Queue) Enqueue(event catchall.Event, failed func()) error {
+	if err := ports.ValidateEvent(event); err != nil {
+		return err
+	}
+
+	q.mu.RLock()
+	defer q.mu.RUnlock()
+
+	if q.closed {
+		return q.DB.Insert(event)
+	}
+
+	select {
+	case q.items <- item{event: event, at: time.Now(), failed: failed}:
+		q.enqueued.Add(1)
+		return ports.ErrQueued
+	default:
+		q.rejected.Add(1)
+		return ErrFull
+	}
+}
+
+// QueryPrimary passes the read through to the primary of the DB, the queued events aren't in it yet just like with
+// Query.
+func (q *Queue) QueryPrimary(domain string) (models.Domain, error) {
+	return ports.QueryPrimary(q.DB, domain)
+}
+
+// Start runs the workers in the background until Shutdown is called.
+func (q *Queue) Start() {
+	for i := 0; i < q.cfg.Workers; i++ {
+		q.wg.Add(1)
+		go q.work()
+	}
+	go func() {
+		q.wg.Wait()
+		close(q.done)
+	}()
+}
+
+// work writes the events in batches of what is waiting in the queue, up to BatchSize, until the queue is closed and
+// empty.
+func (q *Queue) work() {
+	defer q.wg.Done()
+
+	batch := make([]item, 0, q.cfg.BatchSize)
+	for it := range q.items {
+		batch = append(batch[:0], it)
+
+	fill:
+		for len(batch) < q.cfg.BatchSize {
+			select {
+			case it, ok := <-q.items:
+				if !ok {
+					break fill
+				}
+				batch = append(batch, it)
+			default:
+				break fill
+			}
+		}
+
+		q.write(batch)
+	}
+}
+
+// write writes the batch to the DB, and writes what the DB failed again with backoff until it is written. Once the
+// shutdown deadline passed what fails is given up on, it is logged and counted as failed.
+func (q *Queue) write(batch []item) {
+	q.lag.Store(int64(time.Since(batch[0].at)))
+
+	backoff := q.cfg.MinBackoff
+	for {
+		unwritten, err := q.insert(batch)
+		q.written.Add(uint64(len(batch) - len(unwritten)))
+		if err == nil {
+			return
+		}
+		batch = unwritten
+
+		select {
+		case <-q.abandon:
+			q.failed.Add(uint64(len(batch)))
+			q.cfg.Log.Error().Err(err).Int("events", len(batch)).Msg("giving up on queued events")
+			for _, it := range batch {
+				if it.failed != nil {
+					it.failed()
+				}
+			}
+			return
+		default:
+		}
+
+		q.retried.Add(1)
+		q.cfg.Log.Warn().Err(err).Int("events", len(batch)).Dur("backoff", backoff).Msg("writing queued events")
+		select {
+		case <-time.After(backoff):
+		case <-q.abandon:
+		}
+		if backoff *= 2; backoff > q.cfg.MaxBackoff {
+			backoff = q.cfg.MaxBackoff
+		}
+	}
+}
+
+// insert writes the batch and returns the events that weren't written when it fails. Events the DB spooled are as good
+// as written.
+func (q *Queue) insert(batch []item) ([]item, error) {
+	if w, ok := q.DB.(ports.DeltaWriter); ok {
+		if err := w.ApplyDeltas(merge(batch)); err != nil && !errors.Is(err, ports.ErrSpooled) {
+			return batch, err
+		}
+		return nil, nil
+	}
+
+	for i, it := range batch {
+		if err := q.DB.Insert(it.event); err != nil && !errors.Is(err, ports.ErrSpooled) {
+			return batch[i:], err
+		}
+	}
+	return nil, nil
+}
+
+// merge sums the events of the batch per domain, sorted so that concurrent writers lock the rows in the same order.
+func merge(batch []item) []models.Delta {
+	byDomain := make(map[string]models.Delta)
+	for _, it := range batch {
+		dl, _ := ports.EventDelta(it.event, it.at)
+		byDomain[dl.Domain] = byDomain[dl.Domain].Add(dl)
+	}
+
+	deltas := make([]models.Delta, 0, len(byDomain))
+	for _, dl := range byDomain {
+		deltas = append(deltas, dl)
+	}
+	sort.Slice(deltas, func(i, j int) bool { return deltas[i].Domain < deltas[j].Domain })
+	return deltas
+}
+
+// Stats returns the counters of the queue.
+func (q *Queue) Stats() Stats {
+	return Stats{
+		Enqueued: q.enqueued.Load(),
+		Written:  q.written.Load(),
+		Retried:  q.retried.Load(),
+		Failed:   q.failed.Load(),
+		Rejected: q.rejected.Load(),
+		Depth:    len(q.items),
+		Size:     q.cfg.Size,
+		Lag:      time.Duration(q.lag.Load()),
+	}
+}
+
+// Shutdown closes the queue and waits for the workers to write the events left in it, or the context to expire. Once
+// it expired the batches the DB fails are no longer written again but given up on, and the failed callbacks of their
+// events are called. The events inserted after it are written right away.
+func (q *Queue) Shutdown(ctx context.Context) error {
+	q.mu.Lock()
+	if !q.closed {
+		q.closed = true
+		close(q.items)
+	}
+	q.mu.Unlock()
+
+	select {
+	case <-q.done:
+		return nil
+	case <-ctx.Done():
+		q.abandonOnce.Do(func() { close(q.abandon) })
+		return fmt.Errorf("ingest shutdown: %d events left: %w", len(q.items), ctx.Err())
+	}
+}
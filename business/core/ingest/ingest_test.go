@@ -0,0 +1,215 @@
+package ingest
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/mailgun/catchall"
+	"github.com/penthious/catchall/business/adapters"
+	"github.com/penthious/catchall/business/core/cache"
+	"github.com/penthious/catchall/business/core/transition"
+	"github.com/penthious/catchall/business/core/writebehind"
+	"github.com/penthious/catchall/business/models"
+	"github.com/penthious/catchall/business/ports"
+	"github.com/stretchr/testify/assert"
+)
+
+// deltaDB is a memory repo that writes batches like the postgres repo does.
+type deltaDB struct {
+	adapters.MemoryRepo
+
+	mu      sync.Mutex
+	batches [][]models.Delta
+}
+
+func (db *deltaDB) ApplyDeltas(deltas []models.Delta) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	db.batches = append(db.batches, deltas)
+
+	for _, dl := range deltas {
+		for i := 0; i < dl.Bounced; i++ {
+			if err := db.MemoryRepo.Insert(catchall.Event{Domain: dl.Domain, Type: catchall.TypeBounced}); err != nil {
+				return err
+			}
+		}
+		for i := 0; i < dl.Delivered; i++ {
+			if err := db.MemoryRepo.Insert(catchall.Event{Domain: dl.Domain, Type: catchall.TypeDelivered}); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// failingDB fails the first fails inserts into the domain "fail.com", every one of them when fails is negative.
+type failingDB struct {
+	adapters.MemoryRepo
+
+	mu    sync.Mutex
+	fails int
+}
+
+func (db *failingDB) Insert(event catchall.Event) error {
+	if event.Domain == "fail.com" {
+		db.mu.Lock()
+		defer db.mu.Unlock()
+		if db.fails != 0 {
+			db.fails--
+			return errors.New("connection reset")
+		}
+	}
+	return db.MemoryRepo.Insert(event)
+}
+
+func enqueue(t *testing.T, q *Queue, domain, eventType string, n int) {
+	t.Helper()
+	for i := 0; i < n; i++ {
+		if err := q.Insert(catchall.Event{Domain: domain, Type: eventType}); !errors.Is(err, ports.ErrQueued) {
+			t.Fatalf("expected the event to be queued, got %v", err)
+		}
+	}
+}
+
+func TestQueue(t *testing.T) {
+	db := &failingDB{MemoryRepo: adapters.NewMemoryRepo(), fails: 2}
+	q := NewQueue(db, Config{Size: 100, Workers: 3, MinBackoff: time.Millisecond})
+	q.Start()
+
+	enqueue(t, q, "a.com", catchall.TypeDelivered, 50)
+	enqueue(t, q, "a.com", catchall.TypeBounced, 2)
+	enqueue(t, q, "fail.com", catchall.TypeBounced, 1)
+
+	assert.Error(t, q.Insert(catchall.Event{Type: catchall.TypeDelivered}), "invalid events fail right away")
+
+	assert.NoError(t, q.Shutdown(context.Background()))
+
+	d, _ := db.Query("a.com")
+	assert.Equal(t, 50, d.Delivered)
+	assert.Equal(t, 2, d.Bounced)
+	d, _ = db.Query("fail.com")
+	assert.Equal(t, 1, d.Bounced, "the failed write was tried again")
+
+	stats := q.Stats()
+	assert.Equal(t, uint64(53), stats.Enqueued)
+	assert.Equal(t, uint64(53), stats.Written)
+	assert.Equal(t, uint64(2), stats.Retried)
+	assert.Zero(t, stats.Failed)
+	assert.Zero(t, stats.Depth)
+	assert.Equal(t, 100, stats.Size)
+
+	t.Run("events after the shutdown are written right away", func(t *testing.T) {
+		assert.NoError(t, q.Insert(catchall.Event{Domain: "a.com", Type: catchall.TypeDelivered}))
+		d, _ := db.Query("a.com")
+		assert.Equal(t, 51, d.Delivered)
+	})
+}
+
+func TestQueueGivesUpAfterShutdown(t *testing.T) {
+	db := &failingDB{MemoryRepo: adapters.NewMemoryRepo(), fails: -1}
+	q := NewQueue(db, Config{MinBackoff: time.Millisecond})
+	q.Start()
+
+	var gaveUp atomic.Bool
+	err := q.Enqueue(catchall.Event{Domain: "fail.com", Type: catchall.TypeBounced}, func() { gaveUp.Store(true) })
+	assert.ErrorIs(t, err, ports.ErrQueued)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	assert.Error(t, q.Shutdown(ctx), "the event is still being written")
+
+	assert.Eventually(t, gaveUp.Load, time.Second, time.Millisecond)
+	assert.Equal(t, uint64(1), q.Stats().Failed)
+	assert.Greater(t, q.Stats().Retried, uint64(1))
+}
+
+func TestQueueFull(t *testing.T) {
+	db := adapters.NewMemoryRepo()
+	q := NewQueue(db, Config{Size: 3})
+
+	enqueue(t, q, "a.com", catchall.TypeDelivered, 3)
+	err := q.Insert(catchall.Event{Domain: "a.com", Type: catchall.TypeDelivered})
+	assert.ErrorIs(t, err, ErrFull)
+
+	var retry interface{ RetryAfter() time.Duration }
+	if assert.ErrorAs(t, err, &retry) {
+		assert.Equal(t, time.Second, retry.RetryAfter())
+	}
+
+	stats := q.Stats()
+	assert.Equal(t, uint64(1), stats.Rejected)
+	assert.Equal(t, 3, stats.Depth)
+
+	t.Run("shutdown drains the queue", func(t *testing.T) {
+		time.Sleep(10 * time.Millisecond)
+		q.Start()
+		assert.NoError(t, q.Shutdown(context.Background()))
+
+		d, _ := db.Query("a.com")
+		assert.Equal(t, 3, d.Delivered)
+		assert.Greater(t, q.Stats().Lag, 10*time.Millisecond, "the events waited in the queue")
+	})
+}
+
+type recorder struct {
+	mu          sync.Mutex
+	transitions map[string]models.Status
+}
+
+func (r *recorder) Notify(t models.Transition) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.transitions[t.Domain] = t.To
+}
+
+func TestQueueBatches(t *testing.T) {
+	db := &deltaDB{MemoryRepo: adapters.NewMemoryRepo()}
+	rec := &recorder{transitions: make(map[string]models.Status)}
+	q := NewQueue(transition.NewRepo(cache.NewDeltaRepo(db, cache.Config{}), rec), Config{Size: 2000, Workers: 1})
+
+	// queued before the worker starts so it takes full batches
+	enqueue(t, q, "a.com", catchall.TypeDelivered, models.CatchAllThreshold)
+	enqueue(t, q, "b.com", catchall.TypeBounced, 2)
+	q.Start()
+	assert.NoError(t, q.Shutdown(context.Background()))
+
+	assert.Len(t, db.batches, 11, "the events were written in batches of 100")
+	d, _ := db.Query("a.com")
+	assert.Equal(t, models.CatchAllThreshold, d.Delivered)
+	assert.Equal(t, map[string]models.Status{"a.com": models.StatusCatchAll, "b.com": models.StatusNotCatchAll},
+		rec.transitions, "the transitions of the batches were detected")
+}
+
+func TestQueueBatchedBelow(t *testing.T) {
+	db := &deltaDB{MemoryRepo: adapters.NewMemoryRepo()}
+	// stacked like the postgres repo
+	buf := writebehind.NewBuffer(cache.NewDeltaRepo(db, cache.Config{}), writebehind.Config{FlushInterval: time.Hour})
+	rec := &recorder{transitions: make(map[string]models.Status)}
+	q := NewQueue(transition.NewRepo(buf, rec), Config{Size: 2000})
+	q.Start()
+
+	enqueue(t, q, "a.com", catchall.TypeDelivered, models.CatchAllThreshold)
+	enqueue(t, q, "b.com", catchall.TypeBounced, 2)
+	assert.NoError(t, q.Shutdown(context.Background()))
+	if err := buf.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, map[string]models.Status{"a.com": models.StatusCatchAll, "b.com": models.StatusNotCatchAll},
+		rec.transitions, "the transitions were detected above the buffer")
+
+	if assert.Len(t, db.batches, 1, "the buffer wrote the events in one batch") {
+		got := db.batches[0]
+		for i := range got {
+			got[i].LastSeen = time.Time{}
+		}
+		assert.Equal(t, []models.Delta{
+			{Domain: "a.com", Delivered: models.CatchAllThreshold},
+			{Domain: "b.com", Bounced: 2},
+		}, got)
+	}
+}
@@ -0,0 +1,268 @@
+// Package resilience retries the transient errors of a ports.DB and stops calling it while it is down.
+package resilience
+
+import (
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/mailgun/catchall"
+	"github.com/penthious/catchall/business/models"
+	"github.com/penthious/catchall/business/ports"
+	"github.com/rs/zerolog"
+)
+
+var _ ports.DB = (*Repo)(nil)
+var _ ports.DeltaWriter = (*DeltaRepo)(nil)
+var _ ports.PrimaryReader = (*Repo)(nil)
+
+// Config contains the settings for the Repo, zero values are replaced with the defaults.
+type Config struct {
+	Log *zerolog.Logger
+	// Transient reports whether an error is from the DB being briefly unavailable or from a conflict, so that making
+	// the call again may succeed. Nothing is retried when nil.
+	Transient func(err error) bool
+	// Unapplied reports whether a transient error means a write certainly wasn't applied. Increments are only retried
+	// then, since retrying one that was applied before the connection dropped would count its events twice. Increments
+	// aren't retried when nil.
+	Unapplied func(err error) bool
+	// Attempts is the most times a call is made, 3 by default.
+	Attempts int
+	// BaseDelay is the most the first retry waits, doubled for every retry up to MaxDelay. The wait is picked at random
+	// up to that, so the callers that failed together don't retry together. 50ms and 1s by default.
+	BaseDelay time.Duration
+	MaxDelay  time.Duration
+	// FailureThreshold is the number of calls in a row that fail with a transient error, after their retries, which
+	// opens the circuit. 5 by default.
+	FailureThreshold int
+	// OpenTimeout is how long the circuit stays open, failing every call without reaching the DB, before a single call
+	// is let through to try the DB again. 10s by default.
+	OpenTimeout time.Duration
+}
+
+// state is the state of the circuit breaker.
+type state int
+
+const (
+	// closed lets every call through.
+	closed state = iota
+	// open fails every call until the open timeout passed.
+	open
+	// halfOpen lets a single trial call through, the others fail until it decides whether to close or open again.
+	halfOpen
+)
+
+// Repo retries the calls to the DB that fail with a transient error with jittered exponential backoff, and breaks the
+// circuit once enough calls in a row failed. While the circuit is open every call fails fast with a
+// ports.UnavailableError telling when the DB is tried again.
+type Repo struct {
+	ports.DB
+	cfg   Config
+	now   func() time.Time
+	sleep func(time.Duration)
+
+	mu       sync.Mutex
+	state    state
+	failures int
+	until    time.Time
+}
+
+// DeltaRepo is the Repo of a DB that implements ports.DeltaWriter.
+type DeltaRepo struct {
+	*Repo
+	w ports.DeltaWriter
+}
+
+// NewRepo wraps db, the result implements ports.DeltaWriter when db does so it keeps writing batches in one call.
+func NewRepo(db ports.DB, cfg Config) ports.DB {
+	if cfg.Log == nil {
+		nop := zerolog.Nop()
+		cfg.Log = &nop
+	}
+	if cfg.Transient == nil {
+		cfg.Transient = func(error) bool { return false }
+	}
+	if cfg.Unapplied == nil {
+		cfg.Unapplied = func(error) bool { return false }
+	}
+	if cfg.Attempts <= 0 {
+		cfg.Attempts = 3
+	}
+	if cfg.BaseDelay <= 0 {
+		cfg.BaseDelay = 50 * time.Millisecond
+	}
+	if cfg.MaxDelay <= 0 {
+		cfg.MaxDelay = time.Second
+	}
+	if cfg.FailureThreshold <= 0 {
+		cfg.FailureThreshold = 5
+	}
+	if cfg.OpenTimeout <= 0 {
+		cfg.OpenTimeout = 10 * time.Second
+	}
+
+	r := &Repo{
+		DB:    db,
+		cfg:   cfg,
+		now:   time.Now,
+		sleep: time.Sleep,
+	}
+	if w, ok := db.(ports.DeltaWriter); ok {
+		return &DeltaRepo{Repo: r, w: w}
+	}
+	return r
+}
+
+// call makes the call through the circuit breaker, retrying it while it fails with an error retryable accepts.
+func (r *Repo) call(retryable func(error) bool, fn func() error) error {
+	if err := r.allow(); err != nil {
+		return err
+	}
+
+	var err error
+	for attempt := 0; attempt < r.cfg.Attempts; attempt++ {
+		if attempt > 0 {
+			r.sleep(r.backoff(attempt))
+		}
+		if err = fn(); err == nil || !retryable(err) {
+			break
+		}
+	}
+
+	r.record(err)
+	return err
+}
+
+// backoff returns a random wait up to the exponential delay of the retry.
+func (r *Repo) backoff(retry int) time.Duration {
+	ceiling := r.cfg.BaseDelay << (retry - 1)
+	if ceiling > r.cfg.MaxDelay || ceiling <= 0 {
+		ceiling = r.cfg.MaxDelay
+	}
+	return time.Duration(rand.Int63n(int64(ceiling)) + 1)
+}
+
+// allow returns the error to fail the call with when the circuit doesn't let it through.
+func (r *Repo) allow() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	switch r.state {
+	case open:
+		if r.now().Before(r.until) {
+			return ports.UnavailableError{Until: r.until}
+		}
+		r.state = halfOpen
+		r.cfg.Log.Info().Msg("trying the database again")
+		return nil
+	case halfOpen:
+		return ports.UnavailableError{Until: r.now().Add(time.Second)}
+	}
+	return nil
+}
+
+// record moves the circuit along with the result of a call. Only transient errors count as failures, the others are
+// the DB answering.
+func (r *Repo) record(err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if err == nil || !r.cfg.Transient(err) {
+		if r.state != closed {
+			r.cfg.Log.Info().Msg("database is back, closing the circuit")
+		}
+		r.state = closed
+		r.failures = 0
+		return
+	}
+
+	r.failures++
+	if r.state == halfOpen || r.failures >= r.cfg.FailureThreshold {
+		r.state = open
+		r.until = r.now().Add(r.cfg.OpenTimeout)
+		r.cfg.Log.Error().
+			Err(err).
+			Int("failures", r.failures).
+			Time("until", r.until).
+			Msg("database is unavailable, opening the circuit")
+	}
+}
+
+// Query retries the transient errors of the DB.
+func (r *Repo) Query(domain string) (models.Domain, error) {
+	var d models.Domain
+	err := r.call(r.cfg.Transient, func() error {
+		var err error
+		d, err = r.DB.Query(domain)
+		return err
+	})
+	return d, err
+}
+
+// QueryPrimary retries the transient errors of the DB.
+func (r *Repo) QueryPrimary(domain string) (models.Domain, error) {
+	var d models.Domain
+	err := r.call(r.cfg.Transient, func() error {
+		var err error
+		d, err = ports.QueryPrimary(r.DB, domain)
+		return err
+	})
+	return d, err
+}
+
+// QueryMany retries the transient errors of the DB.
+func (r *Repo) QueryMany(domains []string) (map[string]models.Domain, error) {
+	var found map[string]models.Domain
+	err := r.call(r.cfg.Transient, func() error {
+		var err error
+		found, err = r.DB.QueryMany(domains)
+		return err
+	})
+	return found, err
+}
+
+// List retries the transient errors of the DB.
+func (r *Repo) List(q models.DomainQuery) ([]models.Domain, *models.Cursor, error) {
+	var ds []models.Domain
+	var cursor *models.Cursor
+	err := r.call(r.cfg.Transient, func() error {
+		var err error
+		ds, cursor, err = r.DB.List(q)
+		return err
+	})
+	return ds, cursor, err
+}
+
+// Insert only retries the transient errors that certainly left the event unapplied.
+func (r *Repo) Insert(event catchall.Event) error {
+	return r.call(r.unapplied, func() error { return r.DB.Insert(event) })
+}
+
+// Delete retries the transient errors of the DB, deleting twice is the same as once.
+func (r *Repo) Delete(domain string) error {
+	return r.call(r.cfg.Transient, func() error { return r.DB.Delete(domain) })
+}
+
+// Reset retries the transient errors of the DB, resetting twice is the same as once.
+func (r *Repo) Reset(domain string) error {
+	return r.call(r.cfg.Transient, func() error { return r.DB.Reset(domain) })
+}
+
+// SetOverride retries the transient errors of the DB, setting the override twice is the same as once.
+func (r *Repo) SetOverride(domain string, override models.Override) error {
+	return r.call(r.cfg.Transient, func() error { return r.DB.SetOverride(domain, override) })
+}
+
+// ClearOverride retries the transient errors of the DB, clearing the override twice is the same as once.
+func (r *Repo) ClearOverride(domain string) error {
+	return r.call(r.cfg.Transient, func() error { return r.DB.ClearOverride(domain) })
+}
+
+// ApplyDeltas only retries the transient errors that certainly left the deltas unapplied.
+func (r *DeltaRepo) ApplyDeltas(deltas []models.Delta) error {
+	return r.call(r.unapplied, func() error { return r.w.ApplyDeltas(deltas) })
+}
+
+func (r *Repo) unapplied(err error) bool {
+	return r.cfg.Transient(err) && r.cfg.Unapplied(err)
+}
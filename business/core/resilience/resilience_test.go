@@ -0,0 +1,166 @@
+package resilience
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/mailgun/catchall"
+	"github.com/penthious/catchall/business/adapters"
+	"github.com/penthious/catchall/business/models"
+	"github.com/penthious/catchall/business/ports"
+	"github.com/penthious/catchall/business/ports/portstest"
+	"github.com/stretchr/testify/assert"
+)
+
+var (
+	errBlip    = errors.New("connection reset")
+	errRefused = errors.New("connection refused")
+)
+
+// flakyDB fails the next calls with the queued errors before reaching the DB.
+type flakyDB struct {
+	ports.DB
+	errs  []error
+	calls int
+}
+
+func (db *flakyDB) fail() error {
+	db.calls++
+	if len(db.errs) == 0 {
+		return nil
+	}
+	err := db.errs[0]
+	db.errs = db.errs[1:]
+	return err
+}
+
+func (db *flakyDB) Query(domain string) (models.Domain, error) {
+	if err := db.fail(); err != nil {
+		return models.Domain{}, err
+	}
+	return db.DB.Query(domain)
+}
+
+func (db *flakyDB) Insert(event catchall.Event) error {
+	if err := db.fail(); err != nil {
+		return err
+	}
+	return db.DB.Insert(event)
+}
+
+func newRepo(t *testing.T, db ports.DB) (*Repo, *time.Time) {
+	t.Helper()
+	r := NewRepo(db, Config{
+		Transient:        func(err error) bool { return errors.Is(err, errBlip) || errors.Is(err, errRefused) },
+		Unapplied:        func(err error) bool { return errors.Is(err, errRefused) },
+		FailureThreshold: 2,
+		OpenTimeout:      10 * time.Second,
+	})
+
+	repo := r.(*Repo)
+	now := time.Now()
+	repo.now = func() time.Time { return now }
+	repo.sleep = func(time.Duration) {}
+	return repo, &now
+}
+
+func TestRetries(t *testing.T) {
+	db := &flakyDB{DB: adapters.NewMemoryRepo()}
+	r, _ := newRepo(t, db)
+
+	t.Run("reads are retried", func(t *testing.T) {
+		db.errs, db.calls = []error{errBlip, errBlip}, 0
+		_, err := r.Query("a.com")
+		assert.ErrorIs(t, err, ports.ErrNotFound)
+		assert.Equal(t, 3, db.calls)
+	})
+
+	t.Run("gives up after the attempts", func(t *testing.T) {
+		db.errs, db.calls = []error{errBlip, errBlip, errBlip}, 0
+		_, err := r.Query("a.com")
+		assert.ErrorIs(t, err, errBlip)
+		assert.Equal(t, 3, db.calls)
+		db.errs = nil
+		r.Query("a.com")
+	})
+
+	t.Run("other errors aren't retried", func(t *testing.T) {
+		db.errs, db.calls = []error{errors.New("syntax error")}, 0
+		_, err := r.Query("a.com")
+		assert.Error(t, err)
+		assert.Equal(t, 1, db.calls)
+	})
+
+	t.Run("increments are only retried when they weren't applied", func(t *testing.T) {
+		db.errs, db.calls = []error{errBlip}, 0
+		err := r.Insert(catchall.Event{Domain: "a.com", Type: catchall.TypeDelivered})
+		assert.ErrorIs(t, err, errBlip)
+		assert.Equal(t, 1, db.calls)
+
+		db.errs, db.calls = []error{errRefused}, 0
+		err = r.Insert(catchall.Event{Domain: "a.com", Type: catchall.TypeDelivered})
+		assert.NoError(t, err)
+		assert.Equal(t, 2, db.calls)
+
+		d, _ := db.DB.Query("a.com")
+		assert.Equal(t, 1, d.Delivered, "the event was applied once")
+	})
+}
+
+func TestCircuitBreaker(t *testing.T) {
+	db := &flakyDB{DB: adapters.NewMemoryRepo()}
+	r, now := newRepo(t, db)
+
+	// two calls in a row fail after their retries
+	db.errs = []error{errBlip, errBlip, errBlip, errBlip, errBlip, errBlip}
+	r.Query("a.com")
+	r.Query("a.com")
+
+	db.calls = 0
+	_, err := r.Query("a.com")
+	var unavailable ports.UnavailableError
+	if assert.ErrorAs(t, err, &unavailable) {
+		assert.ErrorIs(t, err, ports.ErrUnavailable)
+		assert.Equal(t, now.Add(10*time.Second), unavailable.Until)
+	}
+	assert.Zero(t, db.calls, "an open circuit fails fast")
+
+	t.Run("a failed trial opens it again", func(t *testing.T) {
+		*now = now.Add(11 * time.Second)
+		db.errs = []error{errBlip, errBlip, errBlip}
+		_, err := r.Query("a.com")
+		assert.ErrorIs(t, err, errBlip)
+
+		_, err = r.Query("a.com")
+		assert.ErrorIs(t, err, ports.ErrUnavailable)
+	})
+
+	t.Run("a successful trial closes it", func(t *testing.T) {
+		*now = now.Add(11 * time.Second)
+		db.calls = 0
+		_, err := r.Query("a.com")
+		assert.ErrorIs(t, err, ports.ErrNotFound, "the DB answering counts as a success")
+
+		_, err = r.Query("a.com")
+		assert.ErrorIs(t, err, ports.ErrNotFound)
+		assert.Equal(t, 2, db.calls)
+	})
+}
+
+func TestBackoff(t *testing.T) {
+	r := NewRepo(adapters.NewMemoryRepo(), Config{BaseDelay: 10 * time.Millisecond, MaxDelay: 50 * time.Millisecond}).(*Repo)
+	for retry, ceiling := range map[int]time.Duration{1: 10, 2: 20, 3: 40, 4: 50, 60: 50} {
+		for i := 0; i < 100; i++ {
+			d := r.backoff(retry)
+			assert.Greater(t, d, time.Duration(0))
+			assert.LessOrEqual(t, d, ceiling*time.Millisecond)
+		}
+	}
+}
+
+func TestConformance(t *testing.T) {
+	portstest.Run(t, func(t *testing.T) ports.DB {
+		return NewRepo(adapters.NewMemoryRepo(), Config{})
+	})
+}
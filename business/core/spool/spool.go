@@ -0,0 +1,274 @@
+// Package spool keeps the increments a ports.DB can't take while it is down on a ports.Spool, and writes them once it
+// is back.
+package spool
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"sync/atomic"
+	"time"
+
+	"github.com/mailgun/catchall"
+	"github.com/penthious/catchall/business/models"
+	"github.com/penthious/catchall/business/ports"
+	"github.com/rs/zerolog"
+)
+
+var _ ports.DB = (*Repo)(nil)
+var _ ports.Spooler = (*Repo)(nil)
+var _ ports.DeltaWriter = (*DeltaRepo)(nil)
+var _ ports.PrimaryReader = (*Repo)(nil)
+
+// Config contains the settings for the Repo, zero values are replaced with the defaults.
+type Config struct {
+	Log *zerolog.Logger
+	// Unavailable reports whether an error means the DB is down, so that the increment is spooled instead of failing.
+	// Only ports.ErrUnavailable is when nil.
+	Unavailable func(err error) bool
+	// ReplayInterval is how often the replayer tries to write the spooled batches while there are any, 1s by default.
+	ReplayInterval time.Duration
+	// ReplayBatches is the most spooled batches merged into a single write, 100 by default.
+	ReplayBatches int
+}
+
+// Stats are the counters of a Repo, the batches are single events or the batches of a ports.DeltaWriter.
+type Stats struct {
+	// Spooled is the number of batches written to the spool.
+	Spooled uint64 `json:"spooled"`
+	// Replayed is the number of spooled batches written to the DB.
+	Replayed uint64 `json:"replayed"`
+	// Rejected is the number of batches the spool had no room for, they failed with the error of the DB.
+	Rejected uint64 `json:"rejected"`
+	// Pending is the number of batches in the spool and PendingBytes their size.
+	Pending      int   `json:"pending"`
+	PendingBytes int64 `json:"pending_bytes"`
+}
+
+// Repo spools the increments that fail because the DB is down, and answers them with ports.ErrSpooled. While the spool
+// holds batches every increment goes to the back of it without trying the DB, and a replayer writes them in order
+// once the DB is back. A batch is acked after it was written, so a crash in between writes it again: every increment
+// is counted at least once. The reads don't see the increments until they are replayed.
+type Repo struct {
+	ports.DB
+	spool ports.Spool
+	cfg   Config
+
+	spooled  atomic.Uint64
+	replayed atomic.Uint64
+	rejected atomic.Uint64
+
+	shutdown chan struct{}
+	done     chan struct{}
+}
+
+// DeltaRepo is the Repo of a DB that implements ports.DeltaWriter.
+type DeltaRepo struct {
+	*Repo
+	w ports.DeltaWriter
+}
+
+// NewRepo wraps db, call Start to begin replaying the spool. The result implements ports.DeltaWriter when db does so
+// it keeps writing batches in one call, the spooled batches are then replayed with it too.
+func NewRepo(db ports.DB, spool ports.Spool, cfg Config) ports.DB {
+	if cfg.Log == nil {
+		nop := zerolog.Nop()
+		cfg.Log = &nop
+	}
+	if cfg.Unavailable == nil {
+		cfg.Unavailable = func(err error) bool { return errors.Is(err, ports.ErrUnavailable) }
+	}
+	if cfg.ReplayInterval <= 0 {
+		cfg.ReplayInterval = time.Second
+	}
+	if cfg.ReplayBatches <= 0 {
+		cfg.ReplayBatches = 100
+	}
+
+	r := &Repo{
+		DB:       db,
+		spool:    spool,
+		cfg:      cfg,
+		shutdown: make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+	if w, ok := db.(ports.DeltaWriter); ok {
+		return &DeltaRepo{Repo: r, w: w}
+	}
+	return r
+}
+
+// Insert writes the event, or spools it and returns ports.ErrSpooled.
+func (r *Repo) Insert(event catchall.Event) error {
+	dl, err := ports.EventDelta(event, time.Now())
+	if err != nil {
+		return err
+	}
+
+	return r.write([]models.Delta{dl}, func() error { return r.DB.Insert(event) })
+}
+
+// ApplyDeltas writes the deltas, or spools them and returns ports.ErrSpooled.
+func (r *DeltaRepo) ApplyDeltas(deltas []models.Delta) error {
+	return r.write(deltas, func() error { return r.w.ApplyDeltas(deltas) })
+}
+
+// QueryPrimary reads the domain from the primary of the DB, the spooled increments aren't in it until they are
+// replayed just like with Query.
+func (r *Repo) QueryPrimary(domain string) (models.Domain, error) {
+	return ports.QueryPrimary(r.DB, domain)
+}
+
+// Spooling reports whether the spool holds batches, the increments are spooled rather than written until it is empty.
+func (r *Repo) Spooling() bool {
+	batches, _ := r.spool.Size()
+	return batches > 0
+}
+
+// write makes the write unless the spool holds batches, and spools the deltas when the DB is down. When the spool is
+// full the write fails with the error of the DB, or is tried against the DB when it wasn't yet.
+func (r *Repo) write(deltas []models.Delta, fn func() error) error {
+	var cause error
+	if !r.Spooling() {
+		cause = fn()
+		if cause == nil || !r.cfg.Unavailable(cause) {
+			return cause
+		}
+	}
+
+	if err := r.spool.Append(deltas); err != nil {
+		r.rejected.Add(1)
+		r.cfg.Log.Error().Err(err).Int("domains", len(deltas)).Msg("spooling increments")
+		if cause == nil {
+			return fn()
+		}
+		return cause
+	}
+
+	r.spooled.Add(1)
+	return ports.ErrSpooled
+}
+
+// Start replays the spool every ReplayInterval in the background until Shutdown is called, starting with the batches
+// left by an earlier process.
+func (r *Repo) Start() {
+	go func() {
+		defer close(r.done)
+
+		ticker := time.NewTicker(r.cfg.ReplayInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-r.shutdown:
+				return
+			case <-ticker.C:
+			}
+
+			if err := r.Replay(); err != nil {
+				log := r.cfg.Log.Error()
+				if r.cfg.Unavailable(err) {
+					log = r.cfg.Log.Debug()
+				}
+				log.Err(err).Msg("replaying spool")
+			}
+		}
+	}()
+}
+
+// Replay writes the spooled batches to the DB oldest first until the spool is empty, a write that fails leaves its
+// batches in the spool for the next replay.
+func (r *Repo) Replay() error {
+	for {
+		select {
+		case <-r.shutdown:
+			return nil
+		default:
+		}
+
+		batches, err := r.spool.Peek(r.cfg.ReplayBatches)
+		if err != nil {
+			return fmt.Errorf("error reading spool: %w", err)
+		}
+		if len(batches) == 0 {
+			return nil
+		}
+
+		if err := r.apply(merge(batches)); err != nil {
+			return fmt.Errorf("error writing %d spooled batches: %w", len(batches), err)
+		}
+		if err := r.spool.Ack(len(batches)); err != nil {
+			return fmt.Errorf("error acking spool: %w", err)
+		}
+		r.replayed.Add(uint64(len(batches)))
+
+		if !r.Spooling() {
+			r.cfg.Log.Info().Uint64("replayed", r.replayed.Load()).Msg("spool replayed")
+		}
+	}
+}
+
+// apply writes the deltas to the DB with a single call when it implements ports.DeltaWriter, and one Insert per event
+// otherwise. The events inserted before one fails are written again by the next replay.
+func (r *Repo) apply(deltas []models.Delta) error {
+	if w, ok := r.DB.(ports.DeltaWriter); ok {
+		return w.ApplyDeltas(deltas)
+	}
+
+	for _, dl := range deltas {
+		for i := 0; i < dl.Bounced; i++ {
+			if err := r.DB.Insert(catchall.Event{Domain: dl.Domain, Type: catchall.TypeBounced}); err != nil {
+				return err
+			}
+		}
+		for i := 0; i < dl.Delivered; i++ {
+			if err := r.DB.Insert(catchall.Event{Domain: dl.Domain, Type: catchall.TypeDelivered}); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// merge adds up the batches per domain, sorted so that concurrent writers lock the rows in the same order.
+func merge(batches [][]models.Delta) []models.Delta {
+	byDomain := make(map[string]models.Delta)
+	for _, batch := range batches {
+		for _, dl := range batch {
+			byDomain[dl.Domain] = byDomain[dl.Domain].Add(dl)
+		}
+	}
+
+	deltas := make([]models.Delta, 0, len(byDomain))
+	for _, dl := range byDomain {
+		deltas = append(deltas, dl)
+	}
+	sort.Slice(deltas, func(i, j int) bool { return deltas[i].Domain < deltas[j].Domain })
+	return deltas
+}
+
+// Stats returns the counters along with the size of the spool.
+func (r *Repo) Stats() Stats {
+	pending, bytes := r.spool.Size()
+	return Stats{
+		Spooled:      r.spooled.Load(),
+		Replayed:     r.replayed.Load(),
+		Rejected:     r.rejected.Load(),
+		Pending:      pending,
+		PendingBytes: bytes,
+	}
+}
+
+// Shutdown stops the replayer, waiting for the replay in progress or the context to expire. The batches left in the
+// spool are replayed by the next process.
+func (r *Repo) Shutdown(ctx context.Context) error {
+	close(r.shutdown)
+
+	select {
+	case <-r.done:
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("spool shutdown: %w", ctx.Err())
+	}
+}
@@ -0,0 +1,211 @@
+package spool
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/mailgun/catchall"
+	"github.com/penthious/catchall/business/adapters"
+	"github.com/penthious/catchall/business/models"
+	"github.com/penthious/catchall/business/ports"
+	"github.com/penthious/catchall/business/ports/portstest"
+	"github.com/stretchr/testify/assert"
+)
+
+// downDB is a memory repo whose writes fail as though the database was down while down is set.
+type downDB struct {
+	adapters.MemoryRepo
+
+	mu      sync.Mutex
+	down    bool
+	err     error
+	batches [][]models.Delta
+}
+
+func (db *downDB) setDown(down bool) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	db.down = down
+}
+
+func (db *downDB) fail() error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if db.err != nil {
+		err := db.err
+		db.err = nil
+		return err
+	}
+	if db.down {
+		return ports.UnavailableError{Until: time.Now().Add(time.Second)}
+	}
+	return nil
+}
+
+func (db *downDB) Insert(event catchall.Event) error {
+	if err := db.fail(); err != nil {
+		return err
+	}
+	return db.MemoryRepo.Insert(event)
+}
+
+// deltaDB is a downDB that writes batches like the postgres repo does.
+type deltaDB struct {
+	*downDB
+}
+
+func (db deltaDB) ApplyDeltas(deltas []models.Delta) error {
+	if err := db.fail(); err != nil {
+		return err
+	}
+	db.mu.Lock()
+	db.batches = append(db.batches, deltas)
+	db.mu.Unlock()
+
+	for _, dl := range deltas {
+		for i := 0; i < dl.Bounced; i++ {
+			if err := db.MemoryRepo.Insert(catchall.Event{Domain: dl.Domain, Type: catchall.TypeBounced}); err != nil {
+				return err
+			}
+		}
+		for i := 0; i < dl.Delivered; i++ {
+			if err := db.MemoryRepo.Insert(catchall.Event{Domain: dl.Domain, Type: catchall.TypeDelivered}); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func newSpool(t *testing.T, cfg adapters.SpoolConfig) *adapters.FileSpool {
+	t.Helper()
+	if cfg.Dir == "" {
+		cfg.Dir = t.TempDir()
+	}
+	s, err := adapters.NewFileSpool(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.Close() })
+	return s
+}
+
+func TestSpool(t *testing.T) {
+	db := &downDB{MemoryRepo: adapters.NewMemoryRepo()}
+	r := NewRepo(db, newSpool(t, adapters.SpoolConfig{}), Config{}).(*Repo)
+
+	delivered := catchall.Event{Domain: "a.com", Type: catchall.TypeDelivered}
+	assert.NoError(t, r.Insert(delivered))
+	assert.False(t, r.Spooling())
+
+	db.setDown(true)
+	assert.ErrorIs(t, r.Insert(delivered), ports.ErrSpooled)
+	assert.True(t, r.Spooling())
+
+	t.Run("a replay while the DB is down keeps the batches", func(t *testing.T) {
+		assert.ErrorIs(t, r.Replay(), ports.ErrUnavailable)
+		assert.Equal(t, 1, r.Stats().Pending)
+	})
+
+	db.setDown(false)
+	assert.ErrorIs(t, r.Insert(delivered), ports.ErrSpooled, "events queue up behind the spooled ones")
+
+	if err := r.Replay(); err != nil {
+		t.Fatal(err)
+	}
+	assert.False(t, r.Spooling())
+	d, _ := db.MemoryRepo.Query("a.com")
+	assert.Equal(t, 3, d.Delivered)
+
+	stats := r.Stats()
+	assert.Equal(t, uint64(2), stats.Spooled)
+	assert.Equal(t, uint64(2), stats.Replayed)
+	assert.Zero(t, stats.Pending)
+	assert.Zero(t, stats.PendingBytes)
+
+	t.Run("other errors aren't spooled", func(t *testing.T) {
+		assert.ErrorIs(t, r.Insert(catchall.Event{Type: catchall.TypeDelivered}), ports.ErrEmptyDomain)
+
+		syntax := errors.New("syntax error")
+		db.err = syntax
+		assert.ErrorIs(t, r.Insert(delivered), syntax)
+		assert.False(t, r.Spooling())
+	})
+}
+
+func TestSpoolFull(t *testing.T) {
+	db := &downDB{MemoryRepo: adapters.NewMemoryRepo(), down: true}
+	r := NewRepo(db, newSpool(t, adapters.SpoolConfig{MaxBytes: 100}), Config{}).(*Repo)
+
+	delivered := catchall.Event{Domain: "a.com", Type: catchall.TypeDelivered}
+	assert.ErrorIs(t, r.Insert(delivered), ports.ErrSpooled)
+
+	err := r.Insert(delivered)
+	assert.ErrorIs(t, err, ports.ErrUnavailable, "the event fails with the error of the DB")
+	assert.Equal(t, uint64(1), r.Stats().Rejected)
+
+	t.Run("the DB is tried when it is back", func(t *testing.T) {
+		db.setDown(false)
+		assert.NoError(t, r.Insert(delivered))
+		d, _ := db.MemoryRepo.Query("a.com")
+		assert.Equal(t, 1, d.Delivered)
+	})
+}
+
+func TestReplayDeltas(t *testing.T) {
+	db := deltaDB{&downDB{MemoryRepo: adapters.NewMemoryRepo(), down: true}}
+	r := NewRepo(db, newSpool(t, adapters.SpoolConfig{}), Config{}).(*DeltaRepo)
+
+	assert.ErrorIs(t, r.ApplyDeltas([]models.Delta{{Domain: "a.com", Bounced: 2}, {Domain: "b.com", Delivered: 1}}),
+		ports.ErrSpooled)
+	assert.ErrorIs(t, r.Insert(catchall.Event{Domain: "a.com", Type: catchall.TypeDelivered}), ports.ErrSpooled)
+	assert.ErrorIs(t, r.ApplyDeltas([]models.Delta{{Domain: "c.com", Bounced: 1}}), ports.ErrSpooled)
+
+	db.setDown(false)
+	if err := r.Replay(); err != nil {
+		t.Fatal(err)
+	}
+
+	if assert.Len(t, db.batches, 1, "the spooled batches are merged into one write") {
+		got := db.batches[0]
+		for i := range got {
+			got[i].LastSeen = time.Time{}
+		}
+		assert.Equal(t, []models.Delta{
+			{Domain: "a.com", Bounced: 2, Delivered: 1},
+			{Domain: "b.com", Delivered: 1},
+			{Domain: "c.com", Bounced: 1},
+		}, got)
+	}
+}
+
+func TestReplayAfterRestart(t *testing.T) {
+	dir := t.TempDir()
+	db := &downDB{MemoryRepo: adapters.NewMemoryRepo(), down: true}
+
+	s, err := adapters.NewFileSpool(adapters.SpoolConfig{Dir: dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := NewRepo(db, s, Config{}).(*Repo)
+	assert.ErrorIs(t, r.Insert(catchall.Event{Domain: "a.com", Type: catchall.TypeBounced}), ports.ErrSpooled)
+	s.Close()
+
+	db.setDown(false)
+	r = NewRepo(db, newSpool(t, adapters.SpoolConfig{Dir: dir}), Config{ReplayInterval: time.Millisecond}).(*Repo)
+	r.Start()
+	assert.Eventually(t, func() bool { return !r.Spooling() }, time.Second, time.Millisecond)
+	assert.NoError(t, r.Shutdown(context.Background()))
+
+	d, _ := db.MemoryRepo.Query("a.com")
+	assert.Equal(t, 1, d.Bounced)
+}
+
+func TestConformance(t *testing.T) {
+	portstest.Run(t, func(t *testing.T) ports.DB {
+		return NewRepo(adapters.NewMemoryRepo(), newSpool(t, adapters.SpoolConfig{}), Config{})
+	})
+}
@@ -0,0 +1,130 @@
+// Package stream fans classification transitions out to live subscribers.
+package stream
+
+import (
+	"errors"
+	"strings"
+	"sync"
+
+	"github.com/penthious/catchall/business/models"
+	"github.com/penthious/catchall/business/ports"
+)
+
+// ErrSlowConsumer is reported by a client that was disconnected because its buffer filled up.
+var ErrSlowConsumer = errors.New("slow consumer")
+
+// ErrClosed is reported by a client that was disconnected because the broker shut down.
+var ErrClosed = errors.New("broker closed")
+
+var _ ports.Notifier = (*Broker)(nil)
+
+// Broker fans every transition it is notified about out to its clients. Each client has a bounded buffer, a client
+// that falls behind far enough to fill it is disconnected rather than slowing down the broker or the other clients.
+type Broker struct {
+	mu      sync.Mutex
+	clients map[*Client]struct{}
+	buffer  int
+	closed  bool
+}
+
+// NewBroker returns a Broker that gives every client a buffer of the given size.
+func NewBroker(buffer int) *Broker {
+	return &Broker{
+		clients: make(map[*Client]struct{}),
+		buffer:  buffer,
+	}
+}
+
+// Client is a single subscriber of the broker.
+type Client struct {
+	suffix string
+	events chan models.Transition
+	err    error
+}
+
+// Events returns the channel the client receives transitions on, it is closed when the client is disconnected.
+func (c *Client) Events() <-chan models.Transition {
+	return c.events
+}
+
+// Err returns why the client was disconnected, it must only be called after Events is closed.
+func (c *Client) Err() error {
+	return c.err
+}
+
+// Subscribe adds a client that receives the transitions of every domain ending in suffix on a label boundary, so
+// example.com and .com match mail.example.com but ample.com doesn't. An empty suffix matches every domain.
+func (b *Broker) Subscribe(suffix string) *Client {
+	c := &Client{
+		suffix: strings.TrimPrefix(strings.ToLower(suffix), "."),
+		events: make(chan models.Transition, b.buffer),
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed {
+		c.err = ErrClosed
+		close(c.events)
+		return c
+	}
+	b.clients[c] = struct{}{}
+	return c
+}
+
+// Unsubscribe removes the client, it is safe to call for a client that was already disconnected.
+func (b *Broker) Unsubscribe(c *Client) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.disconnect(c, nil)
+}
+
+// Notify sends the transition to every matching client without blocking.
+func (b *Broker) Notify(t models.Transition) {
+	domain := strings.ToLower(t.Domain)
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for c := range b.clients {
+		if !c.matches(domain) {
+			continue
+		}
+
+		select {
+		case c.events <- t:
+		default:
+			b.disconnect(c, ErrSlowConsumer)
+		}
+	}
+}
+
+// matches reports whether the domain is the suffix of the client or one of its subdomains.
+func (c *Client) matches(domain string) bool {
+	return models.HasDomainSuffix(domain, c.suffix)
+}
+
+// Clients returns the number of connected clients.
+func (b *Broker) Clients() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return len(b.clients)
+}
+
+// Close disconnects every client, clients subscribing afterwards are disconnected straight away.
+func (b *Broker) Close() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.closed = true
+	for c := range b.clients {
+		b.disconnect(c, ErrClosed)
+	}
+}
+
+// disconnect removes the client and closes its channel, the caller must hold the lock.
+func (b *Broker) disconnect(c *Client, err error) {
+	if _, ok := b.clients[c]; !ok {
+		return
+	}
+	delete(b.clients, c)
+	c.err = err
+	close(c.events)
+}
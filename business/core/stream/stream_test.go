@@ -0,0 +1,83 @@
+package stream
+
+import (
+	"testing"
+
+	"github.com/penthious/catchall/business/models"
+	"github.com/stretchr/testify/assert"
+)
+
+func transition(domain string) models.Transition {
+	return models.Transition{Domain: domain, From: models.StatusUnknown, To: models.StatusCatchAll}
+}
+
+func TestFanOut(t *testing.T) {
+	b := NewBroker(10)
+	all := b.Subscribe("")
+	com := b.Subscribe(".com")
+
+	b.Notify(transition("example.com"))
+	b.Notify(transition("example.org"))
+
+	assert.Len(t, all.Events(), 2)
+	assert.Len(t, com.Events(), 1)
+	assert.Equal(t, "example.com", (<-com.Events()).Domain)
+}
+
+func TestSuffixLabelBoundary(t *testing.T) {
+	b := NewBroker(10)
+	c := b.Subscribe("Example.com")
+
+	b.Notify(transition("example.com"))
+	b.Notify(transition("mail.example.com"))
+	b.Notify(transition("badexample.com"))
+
+	assert.Len(t, c.Events(), 2)
+	assert.Equal(t, "example.com", (<-c.Events()).Domain)
+	assert.Equal(t, "mail.example.com", (<-c.Events()).Domain)
+
+	ample := b.Subscribe("ample.com")
+	b.Notify(transition("example.com"))
+	assert.Empty(t, ample.Events(), "the suffix only matches whole labels")
+}
+
+func TestSlowConsumerDisconnected(t *testing.T) {
+	b := NewBroker(2)
+	slow := b.Subscribe("")
+	fast := b.Subscribe("")
+
+	for i := 0; i < 3; i++ {
+		b.Notify(transition("example.com"))
+		<-fast.Events()
+	}
+
+	received := 0
+	for range slow.Events() {
+		received++
+	}
+	assert.Equal(t, 2, received)
+	assert.ErrorIs(t, slow.Err(), ErrSlowConsumer)
+	assert.Equal(t, 1, b.Clients())
+}
+
+func TestUnsubscribeAndClose(t *testing.T) {
+	b := NewBroker(1)
+	c := b.Subscribe("")
+	b.Unsubscribe(c)
+	b.Unsubscribe(c)
+
+	_, ok := <-c.Events()
+	assert.False(t, ok)
+	assert.NoError(t, c.Err())
+
+	c = b.Subscribe("")
+	b.Close()
+	_, ok = <-c.Events()
+	assert.False(t, ok)
+	assert.ErrorIs(t, c.Err(), ErrClosed)
+
+	c = b.Subscribe("")
+	_, ok = <-c.Events()
+	assert.False(t, ok)
+	assert.ErrorIs(t, c.Err(), ErrClosed)
+}
@@ -0,0 +1,219 @@
+// Package transition detects changes in the classification of a domain.
+package transition
+
+import (
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/mailgun/catchall"
+	"github.com/penthious/catchall/business/models"
+	"github.com/penthious/catchall/business/ports"
+)
+
+// stripes is the number of locks inserts are spread over. Inserts for the same domain always share a lock so the
+// before and after state of a domain can't interleave with another insert for it.
+const stripes = 64
+
+var _ ports.DB = (*Repo)(nil)
+var _ ports.PrimaryReader = (*Repo)(nil)
+var _ ports.DeltaWriter = (*DeltaRepo)(nil)
+
+// Repo decorates a ports.DB and tells its notifiers whenever an insert changes the classification of a domain.
+// Every other method is passed straight through to the wrapped DB.
+type Repo struct {
+	ports.DB
+	notifiers []ports.Notifier
+	locks     [stripes]sync.Mutex
+}
+
+// DeltaRepo is the Repo of a DB that implements ports.DeltaWriter.
+type DeltaRepo struct {
+	*Repo
+	w ports.DeltaWriter
+}
+
+// NewRepo wraps db so that the notifiers are called on every classification transition. The result implements
+// ports.DeltaWriter when db does, so batches are still written in one call.
+func NewRepo(db ports.DB, notifiers ...ports.Notifier) ports.DB {
+	r := &Repo{
+		DB:        db,
+		notifiers: notifiers,
+	}
+	if w, ok := db.(ports.DeltaWriter); ok {
+		return &DeltaRepo{Repo: r, w: w}
+	}
+	return r
+}
+
+// Insert applies the event to the wrapped DB and notifies about the transition if the classification changed.
+func (r *Repo) Insert(event catchall.Event) error {
+	mu := r.lock(event.Domain)
+	mu.Lock()
+
+	// The event is still inserted when the domain can't be read, a DB that is down may spool it to be written later.
+	// Whatever transition it causes then goes unnoticed. The domain is read from the primary, a replica may not have
+	// the previous event yet.
+	before, err := ports.QueryPrimary(r.DB, event.Domain)
+	known := err == nil || errors.Is(err, ports.ErrNotFound)
+
+	if err := r.DB.Insert(event); err != nil || !known {
+		mu.Unlock()
+		return err
+	}
+	mu.Unlock()
+
+	after := before
+	switch event.Type {
+	case catchall.TypeBounced:
+		after.Bounced++
+	case catchall.TypeDelivered:
+		after.Delivered++
+	}
+
+	r.notify(event.Domain, before, after)
+
+	return nil
+}
+
+// ApplyDeltas applies the deltas to the wrapped DB in one call and notifies about the transitions they caused, like
+// Insert does for a single event. The domains of the batch stay locked until it is written.
+func (r *DeltaRepo) ApplyDeltas(deltas []models.Delta) error {
+	unlock := r.lockAll(deltas)
+
+	before := make([]models.Domain, len(deltas))
+	known := make([]bool, len(deltas))
+	for i, dl := range deltas {
+		var err error
+		before[i], err = ports.QueryPrimary(r.DB, dl.Domain)
+		known[i] = err == nil || errors.Is(err, ports.ErrNotFound)
+	}
+
+	if err := r.w.ApplyDeltas(deltas); err != nil {
+		unlock()
+		return err
+	}
+	unlock()
+
+	for i, dl := range deltas {
+		if known[i] {
+			r.notify(dl.Domain, before[i], dl.Apply(before[i]))
+		}
+	}
+
+	return nil
+}
+
+// Delete removes the domain and notifies about the transition back to unknown.
+func (r *Repo) Delete(domain string) error {
+	return r.apply(domain, func() error { return r.DB.Delete(domain) })
+}
+
+// Reset zeroes the counts of the domain and notifies about the transition it caused.
+func (r *Repo) Reset(domain string) error {
+	return r.apply(domain, func() error { return r.DB.Reset(domain) })
+}
+
+// SetOverride pins the classification of the domain and notifies about the transition it caused.
+func (r *Repo) SetOverride(domain string, override models.Override) error {
+	return r.apply(domain, func() error { return r.DB.SetOverride(domain, override) })
+}
+
+// ClearOverride removes the override of the domain and notifies about the transition it caused.
+func (r *Repo) ClearOverride(domain string) error {
+	return r.apply(domain, func() error { return r.DB.ClearOverride(domain) })
+}
+
+// apply runs fn under the lock of the domain and notifies about the transition it caused. Unlike Insert the after
+// state is read back from the primary of the wrapped DB, these are rare admin operations so the extra query doesn't
+// matter.
+func (r *Repo) apply(domain string, fn func() error) error {
+	before, after, err := func() (models.Domain, models.Domain, error) {
+		mu := r.lock(domain)
+		mu.Lock()
+		defer mu.Unlock()
+
+		before, err := ports.QueryPrimary(r.DB, domain)
+		if err != nil && !errors.Is(err, ports.ErrNotFound) {
+			return before, before, fmt.Errorf("error querying domain: %w", err)
+		}
+
+		if err := fn(); err != nil {
+			return before, before, err
+		}
+
+		after, err := ports.QueryPrimary(r.DB, domain)
+		if err != nil && !errors.Is(err, ports.ErrNotFound) {
+			return before, before, fmt.Errorf("error querying domain: %w", err)
+		}
+
+		return before, after, nil
+	}()
+	if err != nil {
+		return err
+	}
+
+	r.notify(domain, before, after)
+
+	return nil
+}
+
+// QueryPrimary passes the read through to the primary of the wrapped DB.
+func (r *Repo) QueryPrimary(domain string) (models.Domain, error) {
+	return ports.QueryPrimary(r.DB, domain)
+}
+
+// notify calls every notifier when the classification of the domain differs between before and after.
+func (r *Repo) notify(domain string, before models.Domain, after models.Domain) {
+	if before.Status() == after.Status() {
+		return
+	}
+
+	t := models.Transition{
+		Domain: domain,
+		From:   before.Status(),
+		To:     after.Status(),
+		At:     time.Now().UTC(),
+	}
+	for _, n := range r.notifiers {
+		n.Notify(t)
+	}
+}
+
+// lock returns the lock that guards the domain.
+func (r *Repo) lock(domain string) *sync.Mutex {
+	return &r.locks[stripe(domain)]
+}
+
+// lockAll takes the locks of every domain of the deltas, in the order of the stripes so that concurrent batches can't
+// deadlock, and returns the func releasing them.
+func (r *Repo) lockAll(deltas []models.Delta) func() {
+	taken := make(map[uint32]bool)
+	for _, dl := range deltas {
+		taken[stripe(dl.Domain)] = true
+	}
+	order := make([]uint32, 0, len(taken))
+	for s := range taken {
+		order = append(order, s)
+	}
+	sort.Slice(order, func(i, j int) bool { return order[i] < order[j] })
+
+	for _, s := range order {
+		r.locks[s].Lock()
+	}
+	return func() {
+		for _, s := range order {
+			r.locks[s].Unlock()
+		}
+	}
+}
+
+// stripe returns the index of the lock that guards the domain.
+func stripe(domain string) uint32 {
+	h := fnv.New32a()
+	h.Write([]byte(domain))
+	return h.Sum32() % stripes
+}
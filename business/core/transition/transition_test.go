@@ -0,0 +1,263 @@
+package transition
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/mailgun/catchall"
+	"github.com/penthious/catchall/business/adapters"
+	"github.com/penthious/catchall/business/core/cache"
+	"github.com/penthious/catchall/business/core/writebehind"
+	"github.com/penthious/catchall/business/models"
+	"github.com/penthious/catchall/business/ports"
+	"github.com/stretchr/testify/assert"
+)
+
+type recorder struct {
+	mu          sync.Mutex
+	transitions []models.Transition
+}
+
+func (r *recorder) Notify(t models.Transition) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.transitions = append(r.transitions, t)
+}
+
+func TestInsertNotifiesTransitions(t *testing.T) {
+	rec := &recorder{}
+	repo := NewRepo(adapters.NewMemoryRepo(), rec)
+
+	var wg sync.WaitGroup
+	for i := 0; i < models.CatchAllThreshold+10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := repo.Insert(catchall.Event{Type: catchall.TypeDelivered, Domain: "example.com"}); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	for i := 0; i < 2; i++ {
+		if err := repo.Insert(catchall.Event{Type: catchall.TypeBounced, Domain: "example.com"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if !assert.Len(t, rec.transitions, 2) {
+		t.FailNow()
+	}
+	assert.Equal(t, models.StatusUnknown, rec.transitions[0].From)
+	assert.Equal(t, models.StatusCatchAll, rec.transitions[0].To)
+	assert.Equal(t, models.StatusCatchAll, rec.transitions[1].From)
+	assert.Equal(t, models.StatusNotCatchAll, rec.transitions[1].To)
+	assert.Equal(t, "example.com", rec.transitions[1].Domain)
+}
+
+func TestInsertErrorDoesNotNotify(t *testing.T) {
+	rec := &recorder{}
+	repo := NewRepo(adapters.NewMemoryRepo(), rec)
+
+	err := repo.Insert(catchall.Event{Type: "opened", Domain: "example.com"})
+	assert.Error(t, err)
+	assert.Empty(t, rec.transitions)
+}
+
+// unreadableDB fails every read, like a DB that is down behind a spool that still takes the writes.
+type unreadableDB struct {
+	adapters.MemoryRepo
+}
+
+func (db unreadableDB) Query(string) (models.Domain, error) {
+	return models.Domain{}, ports.ErrUnavailable
+}
+
+func (db unreadableDB) Insert(event catchall.Event) error {
+	if err := db.MemoryRepo.Insert(event); err != nil {
+		return err
+	}
+	return ports.ErrSpooled
+}
+
+func TestInsertWithoutQuery(t *testing.T) {
+	rec := &recorder{}
+	db := unreadableDB{adapters.NewMemoryRepo()}
+	repo := NewRepo(db, rec)
+
+	for i := 0; i < models.CatchAllThreshold+10; i++ {
+		err := repo.Insert(catchall.Event{Type: catchall.TypeDelivered, Domain: "example.com"})
+		assert.ErrorIs(t, err, ports.ErrSpooled, "the event is still inserted")
+	}
+	assert.Empty(t, rec.transitions)
+}
+
+// countingDB counts the reads and writes that reach the DB.
+type countingDB struct {
+	ports.DB
+	queries int64
+	inserts int64
+}
+
+func (db *countingDB) Query(domain string) (models.Domain, error) {
+	atomic.AddInt64(&db.queries, 1)
+	return db.DB.Query(domain)
+}
+
+func (db *countingDB) Insert(event catchall.Event) error {
+	atomic.AddInt64(&db.inserts, 1)
+	return db.DB.Insert(event)
+}
+
+func TestInsertDBCallsPerEvent(t *testing.T) {
+	mem := adapters.NewMemoryRepo()
+	if err := mem.Insert(catchall.Event{Type: catchall.TypeDelivered, Domain: "example.com"}); err != nil {
+		t.Fatal(err)
+	}
+
+	rec := &recorder{}
+	db := &countingDB{DB: mem}
+	// stacked like the postgres repo, the buffer serves the pending increments and the cache below it what is written
+	buf := writebehind.NewBuffer(cache.NewRepo(db, cache.Config{}), writebehind.Config{FlushInterval: time.Hour})
+	repo := NewRepo(buf, rec)
+
+	const events = models.CatchAllThreshold
+	for i := 0; i < events; i++ {
+		if err := repo.Insert(catchall.Event{Type: catchall.TypeDelivered, Domain: "example.com"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	assert.Equal(t, int64(1), atomic.LoadInt64(&db.queries), "only the first event reads the domain")
+	assert.Zero(t, atomic.LoadInt64(&db.inserts), "the events wait in the buffer")
+
+	if err := buf.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	d, err := repo.Query("example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, events+1, d.Delivered)
+	assert.Equal(t, int64(2), atomic.LoadInt64(&db.queries), "the flush invalidated the domain")
+
+	if assert.Len(t, rec.transitions, 1) {
+		assert.Equal(t, models.StatusCatchAll, rec.transitions[0].To)
+	}
+}
+
+func TestAdminNotifiesTransitions(t *testing.T) {
+	rec := &recorder{}
+	repo := NewRepo(adapters.NewMemoryRepo(), rec)
+
+	override := models.Override{Status: models.StatusCatchAll, Reason: "pinned", ExpiresAt: time.Now().Add(time.Hour)}
+	steps := []func() error{
+		func() error { return repo.SetOverride("example.com", override) },
+		func() error { return repo.Insert(catchall.Event{Type: catchall.TypeBounced, Domain: "example.com"}) },
+		func() error { return repo.ClearOverride("example.com") },
+		func() error { return repo.Reset("example.com") },
+		func() error { return repo.Delete("example.com") },
+	}
+	for _, step := range steps {
+		if err := step(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	want := [][2]models.Status{
+		{models.StatusUnknown, models.StatusCatchAll},
+		{models.StatusCatchAll, models.StatusNotCatchAll},
+		{models.StatusNotCatchAll, models.StatusUnknown},
+	}
+	var got [][2]models.Status
+	for _, tr := range rec.transitions {
+		got = append(got, [2]models.Status{tr.From, tr.To})
+	}
+	assert.Equal(t, want, got)
+}
+
+// laggingDB is a DB whose Query reads a replica that hasn't seen any write yet, only QueryPrimary sees them.
+type laggingDB struct {
+	ports.DB
+}
+
+func (db laggingDB) Query(string) (models.Domain, error) {
+	return models.Domain{}, ports.ErrNotFound
+}
+
+func (db laggingDB) QueryPrimary(domain string) (models.Domain, error) {
+	return db.DB.Query(domain)
+}
+
+func TestTransitionsReadThePrimary(t *testing.T) {
+	rec := &recorder{}
+	// the cache and the buffer pass the reads from the primary through like in the postgres stack
+	buf := writebehind.NewBuffer(cache.NewRepo(laggingDB{adapters.NewMemoryRepo()}, cache.Config{}), writebehind.Config{
+		FlushInterval: time.Hour,
+	})
+	repo := NewRepo(buf, rec)
+
+	override := models.Override{Status: models.StatusCatchAll, ExpiresAt: time.Now().Add(time.Hour)}
+	if err := repo.SetOverride("example.com", override); err != nil {
+		t.Fatal(err)
+	}
+	if err := repo.Insert(catchall.Event{Type: catchall.TypeBounced, Domain: "example.com"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := buf.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if err := repo.ClearOverride("example.com"); err != nil {
+		t.Fatal(err)
+	}
+
+	var got []models.Status
+	for _, tr := range rec.transitions {
+		got = append(got, tr.To)
+	}
+	assert.Equal(t, []models.Status{models.StatusCatchAll, models.StatusNotCatchAll}, got,
+		"the state after every write is read back from the primary")
+}
+
+// deltaDB applies the batches one event at a time.
+type deltaDB struct {
+	ports.DB
+}
+
+func (db deltaDB) ApplyDeltas(deltas []models.Delta) error {
+	for _, dl := range deltas {
+		for i := 0; i < dl.Delivered; i++ {
+			if err := db.Insert(catchall.Event{Domain: dl.Domain, Type: catchall.TypeDelivered}); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func TestApplyDeltasNotifiesTransitions(t *testing.T) {
+	_, ok := NewRepo(adapters.NewMemoryRepo()).(ports.DeltaWriter)
+	assert.False(t, ok, "batches are only written in one call when the DB does so")
+
+	rec := &recorder{}
+	repo := NewRepo(deltaDB{adapters.NewMemoryRepo()}, rec).(ports.DeltaWriter)
+
+	batch := []models.Delta{
+		{Domain: "a.com", Delivered: models.CatchAllThreshold - 1},
+		{Domain: "b.com", Delivered: 1},
+	}
+	if err := repo.ApplyDeltas(batch); err != nil {
+		t.Fatal(err)
+	}
+	assert.Empty(t, rec.transitions)
+
+	if err := repo.ApplyDeltas([]models.Delta{{Domain: "a.com", Delivered: 1}}); err != nil {
+		t.Fatal(err)
+	}
+	if assert.Len(t, rec.transitions, 1) {
+		assert.Equal(t, "a.com", rec.transitions[0].Domain)
+		assert.Equal(t, models.StatusCatchAll, rec.transitions[0].To)
+	}
+}
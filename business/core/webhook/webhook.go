@@ -0,0 +1,267 @@
+// Package webhook delivers classification transitions to subscribed URLs.
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/penthious/catchall/business/models"
+	"github.com/penthious/catchall/business/ports"
+	"github.com/rs/zerolog"
+)
+
+// The headers set on every callback.
+const (
+	HeaderDelivery  = "X-Catchall-Delivery"
+	HeaderSignature = "X-Catchall-Signature"
+)
+
+var _ ports.Notifier = (*Dispatcher)(nil)
+
+// Config contains the settings for the Dispatcher, zero values are replaced with the defaults.
+type Config struct {
+	Log          *zerolog.Logger
+	Store        ports.WebhookStore
+	Client       *http.Client
+	PollInterval time.Duration
+	BatchSize    int
+	MaxAttempts  int
+	MinBackoff   time.Duration
+	MaxBackoff   time.Duration
+}
+
+// Dispatcher queues a delivery per subscription for every transition it is notified about, and works through the
+// queue in the background retrying failed deliveries with exponential backoff until they run out of attempts.
+type Dispatcher struct {
+	cfg      Config
+	lease    time.Duration
+	shutdown chan struct{}
+	done     chan struct{}
+}
+
+// NewDispatcher returns a Dispatcher, call Start to begin delivering.
+func NewDispatcher(cfg Config) *Dispatcher {
+	if cfg.Client == nil {
+		cfg.Client = &http.Client{Timeout: 10 * time.Second}
+	}
+	if cfg.PollInterval == 0 {
+		cfg.PollInterval = time.Second
+	}
+	if cfg.BatchSize == 0 {
+		cfg.BatchSize = 100
+	}
+	if cfg.MaxAttempts == 0 {
+		cfg.MaxAttempts = 10
+	}
+	if cfg.MinBackoff == 0 {
+		cfg.MinBackoff = time.Second
+	}
+	if cfg.MaxBackoff == 0 {
+		cfg.MaxBackoff = time.Hour
+	}
+
+	return &Dispatcher{
+		cfg: cfg,
+		// the deliveries of a batch are sent concurrently, so a claimed delivery is in flight for at most one timeout.
+		// The margin covers reading the subscription and storing the outcome.
+		lease:    cfg.Client.Timeout + 30*time.Second,
+		shutdown: make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+}
+
+// Notify queues a delivery of the transition for every subscription.
+func (d *Dispatcher) Notify(t models.Transition) {
+	if err := d.enqueue(t); err != nil {
+		d.cfg.Log.Error().Err(err).Str("domain", t.Domain).Msg("webhook enqueue")
+	}
+}
+
+func (d *Dispatcher) enqueue(t models.Transition) error {
+	subs, err := d.cfg.Store.Subscriptions()
+	if err != nil {
+		return fmt.Errorf("error listing subscriptions: %w", err)
+	}
+	if len(subs) == 0 {
+		return nil
+	}
+
+	payload, err := json.Marshal(t)
+	if err != nil {
+		return fmt.Errorf("error marshalling transition: %w", err)
+	}
+
+	now := time.Now().UTC()
+	deliveries := make([]models.Delivery, len(subs))
+	for i, sub := range subs {
+		deliveries[i] = models.Delivery{
+			ID:             uuid.NewString(),
+			SubscriptionID: sub.ID,
+			Payload:        payload,
+			State:          models.DeliveryPending,
+			NextAttempt:    now,
+			CreatedAt:      now,
+		}
+	}
+
+	return d.cfg.Store.Enqueue(deliveries...)
+}
+
+// Start runs the delivery loop in the background until Shutdown is called.
+func (d *Dispatcher) Start() {
+	go func() {
+		defer close(d.done)
+
+		ticker := time.NewTicker(d.cfg.PollInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-d.shutdown:
+				return
+			case <-ticker.C:
+				d.deliverDue(time.Now().UTC())
+			}
+		}
+	}()
+}
+
+// Shutdown stops the delivery loop, waiting for the batch in flight to finish or the context to expire. Anything
+// left in the queue is picked up again on the next start.
+func (d *Dispatcher) Shutdown(ctx context.Context) error {
+	close(d.shutdown)
+
+	select {
+	case <-d.done:
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("webhook dispatcher shutdown: %w", ctx.Err())
+	}
+}
+
+// deliverDue attempts every delivery that is due at now, all of them at once so the batch takes as long as its
+// slowest subscriber rather than the sum of them.
+func (d *Dispatcher) deliverDue(now time.Time) {
+	deliveries, err := d.cfg.Store.Claim(now, d.lease, d.cfg.BatchSize)
+	if err != nil {
+		d.cfg.Log.Error().Err(err).Msg("webhook claim")
+		return
+	}
+
+	var wg sync.WaitGroup
+	for _, delivery := range deliveries {
+		wg.Add(1)
+		go func(delivery models.Delivery) {
+			defer wg.Done()
+			delivery = d.attempt(delivery, now)
+			if err := d.cfg.Store.UpdateDelivery(delivery); err != nil {
+				d.cfg.Log.Error().Err(err).Str("delivery", delivery.ID).Msg("webhook update")
+			}
+		}(delivery)
+	}
+	wg.Wait()
+}
+
+// attempt sends the delivery once and returns it with its new state.
+func (d *Dispatcher) attempt(delivery models.Delivery, now time.Time) models.Delivery {
+	delivery.Attempts++
+
+	sub, err := d.cfg.Store.Subscription(delivery.SubscriptionID)
+	if errors.Is(err, ports.ErrSubscriptionNotFound) {
+		delivery.State = models.DeliveryDead
+		delivery.LastError = err.Error()
+		return delivery
+	}
+	if err == nil {
+		err = d.send(sub, delivery)
+	}
+
+	switch {
+	case err == nil:
+		delivery.State = models.DeliveryDelivered
+		delivery.LastError = ""
+	case delivery.Attempts >= d.cfg.MaxAttempts:
+		delivery.State = models.DeliveryDead
+		delivery.LastError = err.Error()
+	default:
+		delivery.NextAttempt = now.Add(d.backoff(delivery.Attempts))
+		delivery.LastError = err.Error()
+	}
+
+	if delivery.State == models.DeliveryDead {
+		d.cfg.Log.Warn().
+			Str("delivery", delivery.ID).
+			Str("subscription", delivery.SubscriptionID).
+			Int("attempts", delivery.Attempts).
+			Str("error", delivery.LastError).
+			Msg("webhook dead lettered")
+	}
+
+	return delivery
+}
+
+// send posts the signed payload to the subscriber, any non 2xx response is an error. The payload is signed with the
+// time it is sent at rather than the time the batch started, so the deliveries at the end of a slow batch still fall
+// in the replay window of the receivers.
+func (d *Dispatcher) send(sub models.Subscription, delivery models.Delivery) error {
+	req, err := http.NewRequest(http.MethodPost, sub.URL, bytes.NewReader(delivery.Payload))
+	if err != nil {
+		return fmt.Errorf("error creating request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(HeaderDelivery, delivery.ID)
+	req.Header.Set(HeaderSignature, Sign(sub.Secret, time.Now().Unix(), delivery.Payload))
+
+	resp, err := d.cfg.Client.Do(req)
+	if err != nil {
+		return fmt.Errorf("error sending webhook: %w", err)
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, 1<<16))
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("unexpected status code: %d", resp.StatusCode)
+	}
+
+	return nil
+}
+
+// backoff returns how long to wait before the next attempt, doubling with every attempt up to MaxBackoff. Up to 10%
+// jitter is added so retries for the same subscriber spread out.
+func (d *Dispatcher) backoff(attempts int) time.Duration {
+	wait := d.cfg.MaxBackoff
+	if shift := attempts - 1; shift < 32 {
+		if b := d.cfg.MinBackoff << shift; b > 0 && b < wait {
+			wait = b
+		}
+	}
+
+	return wait + time.Duration(rand.Int63n(int64(wait)/10+1))
+}
+
+// Sign returns the value of the signature header for the payload, in the form `t=<unix time>,v1=<hex hmac>`. The
+// HMAC-SHA256 is taken over `<unix time>.<payload>` with the subscription secret, receivers should recompute it and
+// reject stale timestamps to prevent replays.
+func Sign(secret string, timestamp int64, payload []byte) string {
+	ts := strconv.FormatInt(timestamp, 10)
+
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(ts))
+	mac.Write([]byte("."))
+	mac.Write(payload)
+
+	return "t=" + ts + ",v1=" + hex.EncodeToString(mac.Sum(nil))
+}
@@ -0,0 +1,200 @@
+package webhook
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/penthious/catchall/business/adapters"
+	"github.com/penthious/catchall/business/models"
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+)
+
+// receiver is an httptest server that records the callbacks it gets and fails the first `fail` of them.
+type receiver struct {
+	*httptest.Server
+	mu       sync.Mutex
+	fail     int
+	requests []*http.Request
+	bodies   [][]byte
+}
+
+func newReceiver(t *testing.T, fail int) *receiver {
+	r := &receiver{fail: fail}
+	r.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		body, _ := io.ReadAll(req.Body)
+
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		r.requests = append(r.requests, req)
+		r.bodies = append(r.bodies, body)
+		if len(r.requests) <= r.fail {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	t.Cleanup(r.Close)
+	return r
+}
+
+func (r *receiver) count() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return len(r.requests)
+}
+
+func newDispatcher(t *testing.T, url string, maxAttempts int) (*Dispatcher, *adapters.MemoryWebhookStore) {
+	log := zerolog.Nop()
+	store := adapters.NewMemoryWebhookStore()
+	if err := store.CreateSubscription(models.Subscription{ID: "sub", URL: url, Secret: "shh"}); err != nil {
+		t.Fatal(err)
+	}
+
+	d := NewDispatcher(Config{
+		Log:         &log,
+		Store:       store,
+		MaxAttempts: maxAttempts,
+		MinBackoff:  time.Second,
+		MaxBackoff:  time.Minute,
+	})
+	return d, store
+}
+
+var transition = models.Transition{
+	Domain: "example.com",
+	From:   models.StatusUnknown,
+	To:     models.StatusCatchAll,
+}
+
+func TestDeliverSigned(t *testing.T) {
+	r := newReceiver(t, 0)
+	d, _ := newDispatcher(t, r.URL, 3)
+
+	d.Notify(transition)
+	// the batch is late, the signature still carries the time the payload was sent at
+	now := time.Now().Add(time.Hour)
+	before := time.Now().Unix()
+	d.deliverDue(now)
+	after := time.Now().Unix()
+
+	if !assert.Equal(t, 1, r.count()) {
+		t.FailNow()
+	}
+	req, body := r.requests[0], r.bodies[0]
+	assert.Contains(t, string(body), `"domain":"example.com"`)
+	assert.Contains(t, string(body), `"to":"catch-all"`)
+	assert.NotEmpty(t, req.Header.Get(HeaderDelivery))
+
+	sig := req.Header.Get(HeaderSignature)
+	ts, err := strconv.ParseInt(strings.TrimPrefix(strings.Split(sig, ",")[0], "t="), 10, 64)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.True(t, ts >= before && ts <= after, "signed at %d, sent between %d and %d", ts, before, after)
+	assert.Equal(t, Sign("shh", ts, body), sig)
+	assert.NotEqual(t, Sign("wrong", ts, body), sig)
+
+	// delivered payloads leave the queue
+	d.deliverDue(now.Add(time.Hour))
+	assert.Equal(t, 1, r.count())
+}
+
+func TestDeliverConcurrently(t *testing.T) {
+	const delay = 200 * time.Millisecond
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		time.Sleep(delay)
+	}))
+	t.Cleanup(srv.Close)
+	d, store := newDispatcher(t, srv.URL, 3)
+
+	for i := 0; i < 5; i++ {
+		d.Notify(transition)
+	}
+	start := time.Now()
+	d.deliverDue(time.Now())
+	assert.Less(t, time.Since(start), 3*delay, "the slow deliveries were sent at once")
+
+	due, err := store.Claim(time.Now().Add(time.Hour), d.lease, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Empty(t, due, "every delivery was made")
+	assert.Equal(t, 10*time.Second+30*time.Second, d.lease, "a claim is leased for about one timeout")
+}
+
+func TestRetryWithBackoff(t *testing.T) {
+	r := newReceiver(t, 2)
+	d, store := newDispatcher(t, r.URL, 5)
+
+	d.Notify(transition)
+	now := time.Now()
+
+	d.deliverDue(now)
+	assert.Equal(t, 1, r.count())
+
+	// not due yet, the first retry waits at least MinBackoff
+	d.deliverDue(now.Add(500 * time.Millisecond))
+	assert.Equal(t, 1, r.count())
+
+	now = now.Add(2 * time.Second)
+	d.deliverDue(now)
+	assert.Equal(t, 2, r.count())
+
+	// the second retry waits at least twice as long
+	d.deliverDue(now.Add(1500 * time.Millisecond))
+	assert.Equal(t, 2, r.count())
+
+	d.deliverDue(now.Add(3 * time.Second))
+	assert.Equal(t, 3, r.count())
+
+	dead, err := store.DeadLetters()
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Empty(t, dead)
+}
+
+func TestDeadLetter(t *testing.T) {
+	r := newReceiver(t, 100)
+	d, store := newDispatcher(t, r.URL, 3)
+
+	d.Notify(transition)
+	now := time.Now()
+	for i := 0; i < 5; i++ {
+		d.deliverDue(now)
+		now = now.Add(time.Hour)
+	}
+
+	assert.Equal(t, 3, r.count())
+
+	dead, err := store.DeadLetters()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !assert.Len(t, dead, 1) {
+		t.FailNow()
+	}
+	assert.Equal(t, 3, dead[0].Attempts)
+	assert.Equal(t, models.DeliveryDead, dead[0].State)
+	assert.Contains(t, dead[0].LastError, "500")
+}
+
+func TestStartShutdown(t *testing.T) {
+	r := newReceiver(t, 0)
+	d, _ := newDispatcher(t, r.URL, 3)
+	d.cfg.PollInterval = 10 * time.Millisecond
+
+	d.Start()
+	d.Notify(transition)
+
+	assert.Eventually(t, func() bool { return r.count() == 1 }, time.Second, 10*time.Millisecond)
+	assert.NoError(t, d.Shutdown(context.Background()))
+}
@@ -0,0 +1,354 @@
+// Package writebehind buffers the increments of a ports.DB in memory and writes them in batches.
+package writebehind
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/mailgun/catchall"
+	"github.com/penthious/catchall/business/models"
+	"github.com/penthious/catchall/business/ports"
+	"github.com/rs/zerolog"
+)
+
+var _ ports.DB = (*Buffer)(nil)
+var _ ports.PrimaryReader = (*Buffer)(nil)
+var _ ports.DeltaWriter = (*Buffer)(nil)
+
+// Config contains the settings for the Buffer, zero values are replaced with the defaults.
+type Config struct {
+	Log *zerolog.Logger
+	// MaxDomains is the number of domains with pending increments that triggers a flush.
+	MaxDomains int
+	// FlushInterval is the longest an increment waits to be written.
+	FlushInterval time.Duration
+}
+
+// Buffer coalesces the increments of every domain in memory and writes them in a single batch once MaxDomains
+// domains are pending or FlushInterval has passed. Reads merge the pending increments into what the DB returns so
+// they stay consistent with the events that were accepted.
+type Buffer struct {
+	ports.DB
+	cfg Config
+
+	// flushMu is held while a batch is written and while domains are deleted or reset, reads don't take it.
+	flushMu sync.Mutex
+
+	mu      sync.Mutex
+	pending map[string]models.Delta
+	// flight is the batch being written, nil between flushes, and flushes counts the batches taken out of pending.
+	// Together they tell a read whether a batch may have been written while it read the DB.
+	flight  *batch
+	flushes uint64
+
+	full     chan struct{}
+	shutdown chan struct{}
+	done     chan struct{}
+	drainErr error
+}
+
+// batch is a set of increments taken out of pending to be written, done is closed once it is written or back in
+// pending.
+type batch struct {
+	deltas map[string]models.Delta
+	done   chan struct{}
+}
+
+// has reports whether the batch holds increments of any of the domains.
+func (bt *batch) has(domains []string) bool {
+	for _, domain := range domains {
+		if _, ok := bt.deltas[domain]; ok {
+			return true
+		}
+	}
+	return false
+}
+
+// NewBuffer returns a Buffer in front of db, call Start to begin flushing in the background. The DB writes the
+// batches with a single call when it implements ports.DeltaWriter, and one Insert per event otherwise.
+func NewBuffer(db ports.DB, cfg Config) *Buffer {
+	if cfg.Log == nil {
+		nop := zerolog.Nop()
+		cfg.Log = &nop
+	}
+	if cfg.MaxDomains == 0 {
+		cfg.MaxDomains = 1000
+	}
+	if cfg.FlushInterval == 0 {
+		cfg.FlushInterval = 500 * time.Millisecond
+	}
+
+	return &Buffer{
+		DB:       db,
+		cfg:      cfg,
+		pending:  make(map[string]models.Delta),
+		full:     make(chan struct{}, 1),
+		shutdown: make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+}
+
+// Insert adds the event to the pending increments of its domain. It returns ports.ErrSpooled when the DB is a
+// ports.Spooler that is spooling, the increment is then written late.
+func (b *Buffer) Insert(event catchall.Event) error {
+	dl, err := ports.EventDelta(event, time.Now())
+	if err != nil {
+		return err
+	}
+
+	return b.ApplyDeltas([]models.Delta{dl})
+}
+
+// ApplyDeltas adds the deltas to the pending increments of their domains, all at once. Like Insert it returns
+// ports.ErrSpooled when the DB is spooling.
+func (b *Buffer) ApplyDeltas(deltas []models.Delta) error {
+	b.mu.Lock()
+	for _, dl := range deltas {
+		b.pending[dl.Domain] = b.pending[dl.Domain].Add(dl)
+	}
+	full := len(b.pending) >= b.cfg.MaxDomains
+	b.mu.Unlock()
+
+	if full {
+		select {
+		case b.full <- struct{}{}:
+		default:
+		}
+	}
+
+	// The increment is held here, but will be spooled by the flush rather than written.
+	if s, ok := b.DB.(ports.Spooler); ok && s.Spooling() {
+		return ports.ErrSpooled
+	}
+
+	return nil
+}
+
+// Query returns the domain from the DB with its pending increments added.
+func (b *Buffer) Query(domain string) (models.Domain, error) {
+	return b.query(domain, b.DB.Query)
+}
+
+// QueryPrimary returns the domain from the primary of the DB with its pending increments added.
+func (b *Buffer) QueryPrimary(domain string) (models.Domain, error) {
+	return b.query(domain, func(domain string) (models.Domain, error) { return ports.QueryPrimary(b.DB, domain) })
+}
+
+func (b *Buffer) query(domain string, query func(string) (models.Domain, error)) (models.Domain, error) {
+	var d models.Domain
+	var err error
+	pending := b.read([]string{domain}, func() {
+		d, err = query(domain)
+	})
+	dl, ok := pending[domain]
+
+	if err != nil {
+		if !ok || !errors.Is(err, ports.ErrNotFound) {
+			return d, err
+		}
+		d = models.Domain{}
+	}
+	if ok {
+		d = dl.Apply(d)
+	}
+
+	return d, nil
+}
+
+// QueryMany returns the domains from the DB with their pending increments added, including the domains that only
+// have pending increments so far.
+func (b *Buffer) QueryMany(domains []string) (map[string]models.Domain, error) {
+	var found map[string]models.Domain
+	var err error
+	pending := b.read(domains, func() {
+		found, err = b.DB.QueryMany(domains)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	for domain, dl := range pending {
+		found[domain] = dl.Apply(found[domain])
+	}
+
+	return found, nil
+}
+
+// read calls fn to read the domains from the DB and returns their pending increments to add to what it read, so that
+// every increment is counted exactly once. A batch being written may or may not be in what fn reads, so a read of one
+// of its domains waits for that batch, and a read that overlaps the start of a batch is done again. Reads of other
+// domains go on while a batch is written.
+func (b *Buffer) read(domains []string, fn func()) map[string]models.Delta {
+	for {
+		b.mu.Lock()
+		flight, flushes := b.flight, b.flushes
+		b.mu.Unlock()
+
+		if flight != nil && flight.has(domains) {
+			<-flight.done
+			continue
+		}
+
+		fn()
+
+		b.mu.Lock()
+		if b.flushes != flushes {
+			b.mu.Unlock()
+			continue
+		}
+		pending := make(map[string]models.Delta)
+		for _, domain := range domains {
+			if dl, ok := b.pending[domain]; ok {
+				pending[domain] = dl
+			}
+		}
+		b.mu.Unlock()
+
+		return pending
+	}
+}
+
+// List flushes the pending increments first, the counts are sorted and filtered on by the DB.
+func (b *Buffer) List(q models.DomainQuery) ([]models.Domain, *models.Cursor, error) {
+	if err := b.Flush(); err != nil {
+		return nil, nil, err
+	}
+	return b.DB.List(q)
+}
+
+// Delete drops the pending increments of the domain along with the domain.
+func (b *Buffer) Delete(domain string) error {
+	b.flushMu.Lock()
+	defer b.flushMu.Unlock()
+
+	b.drop(domain)
+	return b.DB.Delete(domain)
+}
+
+// Reset drops the pending increments of the domain and zeroes its counts.
+func (b *Buffer) Reset(domain string) error {
+	b.flushMu.Lock()
+	defer b.flushMu.Unlock()
+
+	b.drop(domain)
+	return b.DB.Reset(domain)
+}
+
+func (b *Buffer) drop(domain string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	delete(b.pending, domain)
+}
+
+// Flush writes every pending increment. Increments that fail to be written stay pending for the next flush.
+func (b *Buffer) Flush() error {
+	b.flushMu.Lock()
+	defer b.flushMu.Unlock()
+
+	b.mu.Lock()
+	if len(b.pending) == 0 {
+		b.mu.Unlock()
+		return nil
+	}
+	flight := &batch{deltas: b.pending, done: make(chan struct{})}
+	b.pending = make(map[string]models.Delta)
+	b.flight = flight
+	b.flushes++
+	b.mu.Unlock()
+
+	// Sorted so that concurrent writers lock the rows in the same order.
+	deltas := make([]models.Delta, 0, len(flight.deltas))
+	for _, dl := range flight.deltas {
+		deltas = append(deltas, dl)
+	}
+	sort.Slice(deltas, func(i, j int) bool { return deltas[i].Domain < deltas[j].Domain })
+
+	unwritten, err := b.write(deltas)
+
+	b.mu.Lock()
+	for _, dl := range unwritten {
+		b.pending[dl.Domain] = dl.Add(b.pending[dl.Domain])
+	}
+	b.flight = nil
+	b.mu.Unlock()
+	close(flight.done)
+
+	if err != nil {
+		return fmt.Errorf("error flushing %d domains: %w", len(unwritten), err)
+	}
+	return nil
+}
+
+// write applies the deltas to the DB and returns the deltas that weren't applied when it fails. Deltas the DB spooled
+// are as good as applied.
+func (b *Buffer) write(deltas []models.Delta) ([]models.Delta, error) {
+	if w, ok := b.DB.(ports.DeltaWriter); ok {
+		if err := w.ApplyDeltas(deltas); err != nil && !errors.Is(err, ports.ErrSpooled) {
+			return deltas, err
+		}
+		return nil, nil
+	}
+
+	for i, dl := range deltas {
+		for dl.Bounced > 0 {
+			err := b.DB.Insert(catchall.Event{Domain: dl.Domain, Type: catchall.TypeBounced})
+			if err != nil && !errors.Is(err, ports.ErrSpooled) {
+				return append([]models.Delta{dl}, deltas[i+1:]...), err
+			}
+			dl.Bounced--
+		}
+		for dl.Delivered > 0 {
+			err := b.DB.Insert(catchall.Event{Domain: dl.Domain, Type: catchall.TypeDelivered})
+			if err != nil && !errors.Is(err, ports.ErrSpooled) {
+				return append([]models.Delta{dl}, deltas[i+1:]...), err
+			}
+			dl.Delivered--
+		}
+	}
+
+	return nil, nil
+}
+
+// Start runs the flush loop in the background until Shutdown is called.
+func (b *Buffer) Start() {
+	go func() {
+		defer close(b.done)
+
+		ticker := time.NewTicker(b.cfg.FlushInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-b.shutdown:
+				b.drainErr = b.Flush()
+				return
+			case <-ticker.C:
+			case <-b.full:
+			}
+
+			if err := b.Flush(); err != nil {
+				b.cfg.Log.Error().Err(err).Msg("write-behind flush")
+			}
+		}
+	}()
+}
+
+// Shutdown stops the flush loop and drains the pending increments, waiting for the final flush or the context to
+// expire. Whatever can't be written by then is lost.
+func (b *Buffer) Shutdown(ctx context.Context) error {
+	close(b.shutdown)
+
+	select {
+	case <-b.done:
+		if b.drainErr != nil {
+			return fmt.Errorf("write-behind drain: %w", b.drainErr)
+		}
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("write-behind shutdown: %w", ctx.Err())
+	}
+}
@@ -0,0 +1,274 @@
+package writebehind
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/mailgun/catchall"
+	"github.com/penthious/catchall/business/adapters"
+	"github.com/penthious/catchall/business/models"
+	"github.com/penthious/catchall/business/ports"
+	"github.com/stretchr/testify/assert"
+)
+
+// deltaDB is a memory repo that writes batches like the postgres repo does, and can be made to fail.
+type deltaDB struct {
+	adapters.MemoryRepo
+
+	mu      sync.Mutex
+	batches [][]models.Delta
+	fail    int
+}
+
+func (db *deltaDB) ApplyDeltas(deltas []models.Delta) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if db.fail > 0 {
+		db.fail--
+		return errors.New("database unavailable")
+	}
+	db.batches = append(db.batches, deltas)
+
+	for _, dl := range deltas {
+		for i := 0; i < dl.Bounced; i++ {
+			if err := db.MemoryRepo.Insert(catchall.Event{Domain: dl.Domain, Type: catchall.TypeBounced}); err != nil {
+				return err
+			}
+		}
+		for i := 0; i < dl.Delivered; i++ {
+			if err := db.MemoryRepo.Insert(catchall.Event{Domain: dl.Domain, Type: catchall.TypeDelivered}); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (db *deltaDB) batchCount() int {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	return len(db.batches)
+}
+
+func insert(t *testing.T, b *Buffer, domain, eventType string, n int) {
+	t.Helper()
+	for i := 0; i < n; i++ {
+		if err := b.Insert(catchall.Event{Domain: domain, Type: eventType}); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestBuffer(t *testing.T) {
+	db := &deltaDB{MemoryRepo: adapters.NewMemoryRepo()}
+	b := NewBuffer(db, Config{MaxDomains: 100, FlushInterval: time.Hour})
+
+	insert(t, b, "hot.com", catchall.TypeDelivered, 500)
+	insert(t, b, "hot.com", catchall.TypeBounced, 2)
+	insert(t, b, "cold.com", catchall.TypeDelivered, 1)
+	assert.Error(t, b.Insert(catchall.Event{Domain: "hot.com", Type: "opened"}))
+
+	t.Run("reads merge the pending increments", func(t *testing.T) {
+		stored, _ := db.MemoryRepo.Query("hot.com")
+		assert.Zero(t, stored.Delivered, "nothing is written before the flush")
+
+		d, err := b.Query("hot.com")
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, "hot.com", d.Domain)
+		assert.Equal(t, 500, d.Delivered)
+		assert.Equal(t, 2, d.Bounced)
+		assert.False(t, d.LastSeen.IsZero())
+
+		found, err := b.QueryMany([]string{"hot.com", "cold.com", "missing.com"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Len(t, found, 2)
+		assert.Equal(t, 1, found["cold.com"].Delivered)
+	})
+
+	t.Run("a flush writes one batch per flush", func(t *testing.T) {
+		if err := b.Flush(); err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, 1, db.batchCount())
+		assert.Len(t, db.batches[0], 2)
+
+		stored, _ := db.MemoryRepo.Query("hot.com")
+		assert.Equal(t, 500, stored.Delivered)
+
+		insert(t, b, "hot.com", catchall.TypeDelivered, 1)
+		d, _ := b.Query("hot.com")
+		assert.Equal(t, 501, d.Delivered, "the DB and the pending increments add up")
+	})
+
+	t.Run("failed flushes keep the increments", func(t *testing.T) {
+		db.fail = 1
+		assert.Error(t, b.Flush())
+
+		insert(t, b, "hot.com", catchall.TypeDelivered, 1)
+		d, _ := b.Query("hot.com")
+		assert.Equal(t, 502, d.Delivered)
+
+		if err := b.Flush(); err != nil {
+			t.Fatal(err)
+		}
+		stored, _ := db.MemoryRepo.Query("hot.com")
+		assert.Equal(t, 502, stored.Delivered)
+	})
+
+	t.Run("delete and reset drop the pending increments", func(t *testing.T) {
+		insert(t, b, "hot.com", catchall.TypeDelivered, 5)
+		if err := b.Reset("hot.com"); err != nil {
+			t.Fatal(err)
+		}
+		d, _ := b.Query("hot.com")
+		assert.Zero(t, d.Delivered)
+
+		insert(t, b, "cold.com", catchall.TypeDelivered, 5)
+		if err := b.Delete("cold.com"); err != nil {
+			t.Fatal(err)
+		}
+		if err := b.Flush(); err != nil {
+			t.Fatal(err)
+		}
+		d, _ = b.Query("cold.com")
+		assert.Zero(t, d.ID)
+		assert.Zero(t, d.Delivered)
+	})
+}
+
+func TestBufferTriggers(t *testing.T) {
+	t.Run("size", func(t *testing.T) {
+		db := &deltaDB{MemoryRepo: adapters.NewMemoryRepo()}
+		b := NewBuffer(db, Config{MaxDomains: 2, FlushInterval: time.Hour})
+		b.Start()
+		defer b.Shutdown(context.Background())
+
+		insert(t, b, "a.com", catchall.TypeDelivered, 10)
+		insert(t, b, "b.com", catchall.TypeDelivered, 1)
+		assert.Eventually(t, func() bool { return db.batchCount() == 1 }, time.Second, time.Millisecond)
+	})
+
+	t.Run("time", func(t *testing.T) {
+		db := &deltaDB{MemoryRepo: adapters.NewMemoryRepo()}
+		b := NewBuffer(db, Config{MaxDomains: 100, FlushInterval: 10 * time.Millisecond})
+		b.Start()
+		defer b.Shutdown(context.Background())
+
+		insert(t, b, "a.com", catchall.TypeDelivered, 1)
+		assert.Eventually(t, func() bool { return db.batchCount() == 1 }, time.Second, time.Millisecond)
+	})
+
+	t.Run("shutdown drains", func(t *testing.T) {
+		db := &deltaDB{MemoryRepo: adapters.NewMemoryRepo()}
+		b := NewBuffer(db, Config{MaxDomains: 100, FlushInterval: time.Hour})
+		b.Start()
+
+		insert(t, b, "a.com", catchall.TypeBounced, 3)
+		if err := b.Shutdown(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+		stored, _ := db.MemoryRepo.Query("a.com")
+		assert.Equal(t, 3, stored.Bounced)
+	})
+}
+
+func TestBufferWithoutDeltaWriter(t *testing.T) {
+	db := adapters.NewMemoryRepo()
+	b := NewBuffer(db, Config{})
+
+	insert(t, b, "a.com", catchall.TypeDelivered, 3)
+	insert(t, b, "a.com", catchall.TypeBounced, 1)
+	if err := b.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	stored, _ := db.Query("a.com")
+	assert.Equal(t, 3, stored.Delivered)
+	assert.Equal(t, 1, stored.Bounced)
+}
+
+// spoolingDB is a deltaDB that spools every batch.
+type spoolingDB struct {
+	*deltaDB
+}
+
+func (db spoolingDB) ApplyDeltas(deltas []models.Delta) error {
+	if err := db.deltaDB.ApplyDeltas(deltas); err != nil {
+		return err
+	}
+	return ports.ErrSpooled
+}
+
+func (db spoolingDB) Spooling() bool {
+	return true
+}
+
+func TestBufferSpooling(t *testing.T) {
+	db := spoolingDB{&deltaDB{MemoryRepo: adapters.NewMemoryRepo()}}
+	b := NewBuffer(db, Config{})
+
+	err := b.Insert(catchall.Event{Domain: "a.com", Type: catchall.TypeDelivered})
+	assert.ErrorIs(t, err, ports.ErrSpooled, "the caller is told the event is written late")
+
+	assert.NoError(t, b.Flush(), "a spooled batch is as good as written")
+	assert.NoError(t, b.Flush())
+	assert.Equal(t, 1, db.batchCount())
+}
+
+// slowDB holds every batch until it is released.
+type slowDB struct {
+	*deltaDB
+	writing chan struct{}
+	release chan struct{}
+}
+
+func (db slowDB) ApplyDeltas(deltas []models.Delta) error {
+	db.writing <- struct{}{}
+	<-db.release
+	return db.deltaDB.ApplyDeltas(deltas)
+}
+
+func TestBufferReadsDuringFlush(t *testing.T) {
+	db := slowDB{
+		deltaDB: &deltaDB{MemoryRepo: adapters.NewMemoryRepo()},
+		writing: make(chan struct{}),
+		release: make(chan struct{}),
+	}
+	b := NewBuffer(db, Config{MaxDomains: 100, FlushInterval: time.Hour})
+
+	insert(t, b, "flushed.com", catchall.TypeDelivered, 2)
+	flushed := make(chan error, 1)
+	go func() { flushed <- b.Flush() }()
+	<-db.writing
+
+	insert(t, b, "flushed.com", catchall.TypeDelivered, 1)
+	insert(t, b, "other.com", catchall.TypeDelivered, 1)
+
+	d, err := b.Query("other.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, 1, d.Delivered, "domains that aren't being written are read during the flush")
+
+	read := make(chan models.Domain, 1)
+	go func() {
+		d, _ := b.Query("flushed.com")
+		read <- d
+	}()
+	select {
+	case <-read:
+		t.Fatal("a domain of the batch was read before the batch was written")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	close(db.release)
+	assert.NoError(t, <-flushed)
+	assert.Equal(t, 3, (<-read).Delivered, "the batch is counted once")
+}
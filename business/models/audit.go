@@ -0,0 +1,46 @@
+package models
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/uptrace/bun"
+)
+
+// AuditEntry records a single mutating or admin operation.
+type AuditEntry struct {
+	bun.BaseModel `bun:"table:audit_log,alias:al"`
+	ID            int64 `bun:",pk,autoincrement" json:"-"`
+
+	At      time.Time       `bun:",notnull" json:"at"`
+	Actor   string          `json:"actor"`
+	TraceID string          `json:"trace_id"`
+	Action  string          `json:"action"`
+	Target  string          `json:"target"`
+	Before  json.RawMessage `bun:"type:jsonb,nullzero" json:"before,omitempty"`
+	After   json.RawMessage `bun:"type:jsonb,nullzero" json:"after,omitempty"`
+}
+
+// AuditQuery selects audit entries, zero values don't filter.
+type AuditQuery struct {
+	From   time.Time
+	To     time.Time
+	Action string
+	Target string
+	Limit  int
+}
+
+// Matches reports whether the entry is selected by the query, From is inclusive and To is exclusive.
+func (q AuditQuery) Matches(e AuditEntry) bool {
+	switch {
+	case !q.From.IsZero() && e.At.Before(q.From):
+		return false
+	case !q.To.IsZero() && !e.At.Before(q.To):
+		return false
+	case q.Action != "" && e.Action != q.Action:
+		return false
+	case q.Target != "" && e.Target != q.Target:
+		return false
+	}
+	return true
+}
@@ -1,6 +1,23 @@
 package models
 
-import "github.com/uptrace/bun"
+import (
+	"time"
+
+	"github.com/uptrace/bun"
+)
+
+// CatchAllThreshold is the number of deliveries, without a single bounce, after which a domain is considered catch-all.
+const CatchAllThreshold = 1_000
+
+// Status is the catch-all classification of a domain.
+type Status string
+
+// The set of classifications a domain can be in.
+const (
+	StatusUnknown     Status = "unknown"
+	StatusCatchAll    Status = "catch-all"
+	StatusNotCatchAll Status = "not catch-all"
+)
 
 // Domain is the domain model.
 // TODO: remove bun dependency, only here to make it easier to create the table (see adapters/postgres_repo.go)
@@ -11,4 +28,81 @@ type Domain struct {
 	Domain    string `bun:",unique"`
 	Bounced   int
 	Delivered int
+	LastSeen  time.Time `bun:",nullzero,notnull,default:current_timestamp"`
+	Override  Override  `bun:"embed:override_"`
+}
+
+// Override pins the classification of a domain regardless of its counts until it expires.
+type Override struct {
+	Status    Status    `bun:",nullzero"`
+	Reason    string    `bun:",nullzero"`
+	ExpiresAt time.Time `bun:",nullzero"`
+}
+
+// Active reports whether the override is set and hasn't expired at now.
+func (o Override) Active(now time.Time) bool {
+	return o.Status != "" && now.Before(o.ExpiresAt)
+}
+
+// Status classifies the domain as of now, see StatusAt.
+func (d Domain) Status() Status {
+	return d.StatusAt(time.Now())
+}
+
+// StatusAt classifies the domain at the given time. An active override always wins, otherwise the classification
+// comes from the event counts where a single bounce means the domain is not a catch-all.
+func (d Domain) StatusAt(now time.Time) Status {
+	if d.Override.Active(now) {
+		return d.Override.Status
+	}
+
+	if d.Bounced > 0 {
+		return StatusNotCatchAll
+	}
+
+	if d.Delivered >= CatchAllThreshold {
+		return StatusCatchAll
+	}
+
+	return StatusUnknown
+}
+
+// Transition describes a change in the classification of a domain.
+type Transition struct {
+	Domain string    `json:"domain"`
+	From   Status    `json:"from"`
+	To     Status    `json:"to"`
+	At     time.Time `json:"at"`
+}
+
+// Delta is the sum of the events for a domain that have not been written yet.
+type Delta struct {
+	Domain    string
+	Bounced   int
+	Delivered int
+	LastSeen  time.Time
+}
+
+// Add merges the other delta for the same domain into the delta, either may be the zero Delta.
+func (dl Delta) Add(other Delta) Delta {
+	if dl.Domain == "" {
+		dl.Domain = other.Domain
+	}
+	dl.Bounced += other.Bounced
+	dl.Delivered += other.Delivered
+	if other.LastSeen.After(dl.LastSeen) {
+		dl.LastSeen = other.LastSeen
+	}
+	return dl
+}
+
+// Apply returns the domain with the delta added to it.
+func (dl Delta) Apply(d Domain) Domain {
+	d.Domain = dl.Domain
+	d.Bounced += dl.Bounced
+	d.Delivered += dl.Delivered
+	if dl.LastSeen.After(d.LastSeen) {
+		d.LastSeen = dl.LastSeen
+	}
+	return d
 }
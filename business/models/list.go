@@ -0,0 +1,160 @@
+package models
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"strings"
+	"time"
+)
+
+// ErrInvalidCursor is returned when a cursor can't be decoded or belongs to a different sort order.
+var ErrInvalidCursor = errors.New("invalid cursor")
+
+// DomainSort is the column domains are listed by.
+type DomainSort string
+
+// The set of orders domains can be listed in.
+const (
+	SortID        DomainSort = "id"
+	SortLastSeen  DomainSort = "last_seen"
+	SortDelivered DomainSort = "delivered"
+	SortBounced   DomainSort = "bounced"
+)
+
+// DomainFilter narrows down the domains being listed, zero values don't filter.
+type DomainFilter struct {
+	Status       Status
+	MinDelivered int
+	HasBounces   *bool
+	// Suffix matches the domain itself and its subdomains, see HasDomainSuffix.
+	Suffix string
+	// Now is the time the status of every domain is evaluated at, the time of the request. Zero is the time the
+	// filter is first used.
+	Now time.Time
+}
+
+// At returns the filter with Now set, so every domain of a listing is classified at the same time.
+func (f DomainFilter) At(now time.Time) DomainFilter {
+	if f.Now.IsZero() {
+		f.Now = now
+	}
+	return f
+}
+
+// Matches reports whether the domain passes the filter.
+func (f DomainFilter) Matches(d Domain) bool {
+	switch {
+	case f.Status != "" && d.StatusAt(f.Now) != f.Status:
+		return false
+	case d.Delivered < f.MinDelivered:
+		return false
+	case f.HasBounces != nil && *f.HasBounces != (d.Bounced > 0):
+		return false
+	case !HasDomainSuffix(d.Domain, f.Suffix):
+		return false
+	}
+	return true
+}
+
+// HasDomainSuffix reports whether domain is suffix or one of its subdomains, so example.com and com match
+// mail.example.com but ample.com doesn't. An empty suffix matches every domain.
+func HasDomainSuffix(domain, suffix string) bool {
+	return suffix == "" || domain == suffix || strings.HasSuffix(domain, "."+suffix)
+}
+
+// DomainQuery describes a single page of a domain listing.
+type DomainQuery struct {
+	Filter DomainFilter
+	Sort   DomainSort
+	Desc   bool
+	// After is the cursor of the previous page, nil for the first page.
+	After *Cursor
+	Limit int
+}
+
+// Cursor points at the last domain of a page, the next page starts right after it. Domains are ordered by the sort
+// key first and the id second, so the position is stable even when many domains share a key.
+type Cursor struct {
+	Sort DomainSort `json:"o"`
+	Desc bool       `json:"d,omitempty"`
+	Key  int64      `json:"k"`
+	ID   int64      `json:"i"`
+}
+
+// CursorFor returns the cursor pointing at d in the order of the query.
+func (q DomainQuery) CursorFor(d Domain) *Cursor {
+	return &Cursor{
+		Sort: q.Sort,
+		Desc: q.Desc,
+		Key:  q.Key(d),
+		ID:   d.ID,
+	}
+}
+
+// Key returns the value of the sort column for d.
+func (q DomainQuery) Key(d Domain) int64 {
+	switch q.Sort {
+	case SortLastSeen:
+		return d.LastSeen.UnixNano()
+	case SortDelivered:
+		return int64(d.Delivered)
+	case SortBounced:
+		return int64(d.Bounced)
+	default:
+		return d.ID
+	}
+}
+
+// Less reports whether a comes before b in the order of the query.
+func (q DomainQuery) Less(a, b Domain) bool {
+	ka, kb := q.Key(a), q.Key(b)
+	if ka == kb {
+		ka, kb = a.ID, b.ID
+	}
+	if q.Desc {
+		return ka > kb
+	}
+	return ka < kb
+}
+
+// AfterCursor reports whether d comes after the cursor of the query, every domain does on the first page.
+func (q DomainQuery) AfterCursor(d Domain) bool {
+	if q.After == nil {
+		return true
+	}
+
+	key, after := q.Key(d), q.After.Key
+	if key == after {
+		key, after = d.ID, q.After.ID
+	}
+	if q.Desc {
+		return key < after
+	}
+	return key > after
+}
+
+// Encode returns the cursor as an opaque string for clients.
+func (c Cursor) Encode() string {
+	b, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// DecodeCursor decodes a cursor returned by Encode and checks it was issued for the same order as the query.
+func (q DomainQuery) DecodeCursor(s string) (*Cursor, error) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, ErrInvalidCursor
+	}
+
+	var c Cursor
+	if err := json.Unmarshal(b, &c); err != nil {
+		return nil, ErrInvalidCursor
+	}
+
+	if c.Sort != q.Sort || c.Desc != q.Desc {
+		return nil, ErrInvalidCursor
+	}
+
+	return &c, nil
+}
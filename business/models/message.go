@@ -0,0 +1,13 @@
+package models
+
+import "github.com/mailgun/catchall"
+
+// Message is an event delivered by a message broker.
+type Message struct {
+	// ID identifies the message at the broker, a message delivered again has the same ID. It is empty when the broker
+	// can't tell, redeliveries of the message are then counted again.
+	ID    string
+	Event catchall.Event
+	// Ack is what the source needs to commit the message, it means nothing outside of it.
+	Ack string
+}
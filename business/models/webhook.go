@@ -0,0 +1,41 @@
+package models
+
+import (
+	"time"
+
+	"github.com/uptrace/bun"
+)
+
+// Subscription is a URL registered to receive classification transitions.
+type Subscription struct {
+	bun.BaseModel `bun:"table:webhook_subscriptions,alias:ws"`
+	ID            string `bun:",pk"`
+
+	URL       string
+	Secret    string
+	CreatedAt time.Time
+}
+
+// DeliveryState is the state of a webhook delivery in the queue.
+type DeliveryState string
+
+// The set of states a delivery can be in.
+const (
+	DeliveryPending   DeliveryState = "pending"
+	DeliveryDelivered DeliveryState = "delivered"
+	DeliveryDead      DeliveryState = "dead"
+)
+
+// Delivery is a single payload queued for a subscription.
+type Delivery struct {
+	bun.BaseModel `bun:"table:webhook_deliveries,alias:wd"`
+	ID            string `bun:",pk"`
+
+	SubscriptionID string
+	Payload        []byte
+	State          DeliveryState
+	Attempts       int
+	LastError      string
+	NextAttempt    time.Time
+	CreatedAt      time.Time
+}
@@ -1,12 +1,219 @@
 package ports
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
 	"github.com/mailgun/catchall"
 	"github.com/penthious/catchall/business/models"
 )
 
+// ErrNotFound is returned by DB.Query for a domain that has never been seen.
+var ErrNotFound = errors.New("domain not found")
+
+// ErrEmptyDomain is returned when inserting an event without a domain.
+var ErrEmptyDomain = errors.New("empty domain")
+
+// ErrSubscriptionNotFound is returned when a webhook subscription does not exist.
+var ErrSubscriptionNotFound = errors.New("subscription not found")
+
+// ErrUnavailable is returned without reaching the database while it is considered down.
+var ErrUnavailable = errors.New("database unavailable")
+
+// ErrSpooled is returned for a write that couldn't be made while the database is down and was kept to be made once it
+// is back, the write is not lost.
+var ErrSpooled = errors.New("spooled to be written later")
+
+// ErrQueued is returned by Insert for an event that was accepted into a queue to be written in the background.
+var ErrQueued = errors.New("queued to be written in the background")
+
+// ErrDuplicate is returned by IdempotentDB.InsertOnce for an event whose ID was already counted, the event is
+// acknowledged without being counted again.
+var ErrDuplicate = errors.New("duplicate event")
+
+// ErrSpoolFull is returned by Spool.Append when the spool has no room left for the deltas.
+var ErrSpoolFull = errors.New("spool full")
+
+// UnavailableError is the ErrUnavailable of a database that is expected back at Until.
+type UnavailableError struct {
+	Until time.Time
+}
+
+func (e UnavailableError) Error() string {
+	return ErrUnavailable.Error()
+}
+
+func (e UnavailableError) Unwrap() error {
+	return ErrUnavailable
+}
+
+// RetryAfter returns how long until the database is tried again.
+func (e UnavailableError) RetryAfter() time.Duration {
+	return time.Until(e.Until)
+}
+
 // DB defines the interface for the database.
 type DB interface {
+	// Query returns the domain, or ErrNotFound when it has never been seen.
 	Query(domain string) (models.Domain, error)
+	// QueryMany returns the domains that exist out of the given names keyed by name, unknown names are left out.
+	QueryMany(domains []string) (map[string]models.Domain, error)
 	Insert(event catchall.Event) error
+	// Delete removes every trace of the domain, deleting an unknown domain is not an error.
+	Delete(domain string) error
+	// Reset zeroes the counts of the domain and keeps its override.
+	Reset(domain string) error
+	// SetOverride pins the classification of the domain, creating the domain if it is unknown.
+	SetOverride(domain string, override models.Override) error
+	// ClearOverride removes the override of the domain so it is classified by its counts again.
+	ClearOverride(domain string) error
+	// List returns a page of the domains matching the query and the cursor of the next page, nil on the last page.
+	List(q models.DomainQuery) ([]models.Domain, *models.Cursor, error)
+}
+
+// ValidateEvent rejects the events no DB stores, those without a domain or of an unknown type.
+func ValidateEvent(event catchall.Event) error {
+	if event.Domain == "" {
+		return fmt.Errorf("error incrementing domain: %w", ErrEmptyDomain)
+	}
+	if event.Type != catchall.TypeBounced && event.Type != catchall.TypeDelivered {
+		return fmt.Errorf("error incrementing domain: %w", fmt.Errorf("unknown status: %s", event.Type))
+	}
+	return nil
+}
+
+// EventDelta returns the increment of a single event seen at the given time.
+func EventDelta(event catchall.Event, at time.Time) (models.Delta, error) {
+	if err := ValidateEvent(event); err != nil {
+		return models.Delta{}, err
+	}
+
+	dl := models.Delta{Domain: event.Domain, LastSeen: at.UTC()}
+	if event.Type == catchall.TypeBounced {
+		dl.Bounced = 1
+	} else {
+		dl.Delivered = 1
+	}
+	return dl, nil
+}
+
+// DeltaWriter is implemented by the DB adapters that can apply many aggregated increments in a single round trip.
+// Either every delta is applied or none is.
+type DeltaWriter interface {
+	ApplyDeltas(deltas []models.Delta) error
+}
+
+// Spool holds batches of increments on durable storage while the DB can't take them, to be written in the order they
+// were appended.
+type Spool interface {
+	// Append adds the deltas to the end of the spool as one batch, or fails with ErrSpoolFull.
+	Append(deltas []models.Delta) error
+	// Peek returns up to n of the oldest batches without removing them.
+	Peek(n int) ([][]models.Delta, error)
+	// Ack removes the n oldest batches once they were written.
+	Ack(n int) error
+	// Size returns the number of batches in the spool and the bytes they take up.
+	Size() (batches int, bytes int64)
+}
+
+// Spooler is implemented by the DBs that spool the writes they can't make, so that the layers in front of them can tell
+// their callers the writes are made late.
+type Spooler interface {
+	// Spooling reports whether writes are currently spooled rather than made.
+	Spooling() bool
+}
+
+// Enqueuer is implemented by the DBs that queue the events to write them in the background.
+type Enqueuer interface {
+	// Enqueue is Insert, and when it returns ErrQueued failed is called if the event ends up not being written after
+	// all. failed may be nil.
+	Enqueue(event catchall.Event, failed func()) error
+}
+
+// IdempotentDB is implemented by the DBs that count the events carrying an ID at most once, so that events delivered
+// more than once by their sender aren't counted twice.
+type IdempotentDB interface {
+	// InsertOnce inserts the event, or returns ErrDuplicate when an event with the same ID was already inserted.
+	InsertOnce(id string, event catchall.Event) error
+}
+
+// Dedup remembers the IDs of the events that were counted for a window of time.
+type Dedup interface {
+	// Claim records the ID, and returns false when it was already recorded within the window.
+	Claim(id string) (bool, error)
+	// Release forgets the ID of an event that failed to be counted, so that its retry is counted.
+	Release(id string) error
+}
+
+// Source pulls events from a message broker. A message that isn't committed is delivered again, to the next Source
+// that joins in its place or once the broker stopped waiting for the commit.
+type Source interface {
+	// Fetch waits for at least one message, and returns up to max of them in the order of the broker.
+	Fetch(ctx context.Context, max int) ([]models.Message, error)
+	// Commit tells the broker the messages were handled, so they aren't delivered again.
+	Commit(ctx context.Context, msgs []models.Message) error
+	Close() error
+}
+
+// Backfiller bulk loads historical increments, recording how far into the source they were read so an interrupted
+// backfill resumes where it stopped.
+type Backfiller interface {
+	// Checkpoint returns the offset into the source up to which the events have been loaded, 0 for a new source.
+	Checkpoint(source string) (int64, error)
+	// Load adds the deltas to their domains and moves the checkpoint of the source to offset, all or nothing.
+	Load(source string, offset int64, deltas []models.Delta) error
+}
+
+// PrimaryReader is implemented by the DBs that read from replicas, and by the decorators of a DB that pass it through.
+// QueryPrimary reads where the writes go, so unlike Query it sees a write that just returned.
+type PrimaryReader interface {
+	QueryPrimary(domain string) (models.Domain, error)
+}
+
+// QueryPrimary reads the domain with QueryPrimary when db implements PrimaryReader, and with Query otherwise. It is
+// used to read a domain back right after writing it.
+func QueryPrimary(db DB, domain string) (models.Domain, error) {
+	if p, ok := db.(PrimaryReader); ok {
+		return p.QueryPrimary(domain)
+	}
+	return db.Query(domain)
+}
+
+// Invalidator is implemented by the caches in front of a DB, so that changes made through another instance can be
+// evicted from them.
+type Invalidator interface {
+	// Invalidate drops the domain from the cache.
+	Invalidate(domain string)
+	// Flush drops every domain from the cache.
+	Flush()
+}
+
+// Notifier defines the interface for anything that wants to be told about classification transitions.
+type Notifier interface {
+	Notify(transition models.Transition)
+}
+
+// WebhookStore defines the interface for persisting webhook subscriptions and their delivery queue.
+type WebhookStore interface {
+	CreateSubscription(sub models.Subscription) error
+	Subscription(id string) (models.Subscription, error)
+	Subscriptions() ([]models.Subscription, error)
+	DeleteSubscription(id string) error
+
+	// Enqueue adds the deliveries to the queue.
+	Enqueue(deliveries ...models.Delivery) error
+	// Claim returns up to limit pending deliveries that are due at now, and pushes their next attempt out by lease so
+	// that no other worker picks them up while they are in flight.
+	Claim(now time.Time, lease time.Duration, limit int) ([]models.Delivery, error)
+	UpdateDelivery(delivery models.Delivery) error
+	DeadLetters() ([]models.Delivery, error)
+}
+
+// AuditLog defines the interface for the append-only audit log.
+type AuditLog interface {
+	Append(entry models.AuditEntry) error
+	// Query returns the entries selected by the query, oldest first.
+	Query(q models.AuditQuery) ([]models.AuditEntry, error)
 }
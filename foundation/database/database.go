@@ -2,9 +2,14 @@ package database
 
 import (
 	"context"
+	"crypto/tls"
+	"crypto/x509"
 	"database/sql"
+	"errors"
 	"fmt"
+	"net"
 	"net/url"
+	"os"
 	"time"
 
 	"github.com/uptrace/bun"
@@ -22,17 +27,60 @@ type Config struct {
 	MaxOpenConns int
 	MaxIdleTime  time.Duration
 	DisableTLS   bool
+
+	// TLSMode is how the connection is secured, TLSRequire by default or TLSDisable when DisableTLS is set.
+	TLSMode TLSMode
+	// RootCAFile is a PEM bundle of the CAs the certificate of the server is verified against, the system roots when
+	// empty. Like libpq, TLSRequire verifies the chain as TLSVerifyCA does once a bundle is set.
+	RootCAFile string
+	// ClientCertFile and ClientKeyFile authenticate the connection with a client certificate when both are set.
+	ClientCertFile string
+	ClientKeyFile  string
+	// ServerName is the name TLSVerifyFull checks the certificate of the server for, the name of the host by default.
+	ServerName string
+
+	// Replicas are the hosts of the read replicas, opened with the same credentials as the primary by OpenCluster.
+	Replicas []string
+	// MaxReplicaLag is how far a replica may fall behind the primary before reads skip it, 5s by default.
+	MaxReplicaLag time.Duration
+	// ReplicaCheckInterval is how often the replicas are health checked, 5s by default.
+	ReplicaCheckInterval time.Duration
 }
 
+// TLSMode is the sslmode of the connection, with the same meaning as in libpq.
+type TLSMode string
+
+// The supported modes, each verifying more than the one before.
+const (
+	// TLSDisable connects in plain text.
+	TLSDisable TLSMode = "disable"
+	// TLSRequire encrypts the connection without verifying the server.
+	TLSRequire TLSMode = "require"
+	// TLSVerifyCA verifies the certificate of the server was issued by a trusted CA, whatever name it is for.
+	TLSVerifyCA TLSMode = "verify-ca"
+	// TLSVerifyFull also verifies the certificate is for the server name.
+	TLSVerifyFull TLSMode = "verify-full"
+)
+
 // Open opens a connection to the database.
 func Open(cfg Config) (*bun.DB, error) {
-	sslMode := "require"
-	if cfg.DisableTLS {
-		sslMode = "disable"
+	opts, err := connectorOptions(cfg)
+	if err != nil {
+		return nil, err
 	}
 
+	pgDB := sql.OpenDB(pgdriver.NewConnector(opts...))
+	pgDB.SetMaxOpenConns(cfg.MaxOpenConns)
+	pgDB.SetMaxIdleConns(cfg.MaxIdleConns)
+	pgDB.SetConnMaxIdleTime(cfg.MaxIdleTime)
+	db := bun.NewDB(pgDB, pgdialect.New())
+
+	return db, nil
+}
+
+// connectorOptions returns the options of the pgdriver connector for the config.
+func connectorOptions(cfg Config) ([]pgdriver.Option, error) {
 	q := make(url.Values)
-	q.Set("sslmode", sslMode)
 	q.Set("timezone", "utc")
 
 	u := url.URL{
@@ -43,13 +91,100 @@ func Open(cfg Config) (*bun.DB, error) {
 		RawQuery: q.Encode(),
 	}
 
-	pgDB := sql.OpenDB(pgdriver.NewConnector(pgdriver.WithDSN(u.String())))
-	pgDB.SetMaxOpenConns(cfg.MaxOpenConns)
-	pgDB.SetMaxIdleConns(cfg.MaxIdleConns)
-	pgDB.SetConnMaxIdleTime(cfg.MaxIdleTime)
-	db := bun.NewDB(pgDB, pgdialect.New())
+	tlsCfg, err := tlsConfig(cfg)
+	if err != nil {
+		return nil, err
+	}
 
-	return db, nil
+	// the TLS config replaces the one pgdriver derives from the DSN, which has no sslmode for that reason
+	return []pgdriver.Option{pgdriver.WithDSN(u.String()), pgdriver.WithTLSConfig(tlsCfg)}, nil
+}
+
+// tlsConfig returns the TLS config of the mode of the config, nil to connect in plain text.
+func tlsConfig(cfg Config) (*tls.Config, error) {
+	mode := cfg.TLSMode
+	if mode == "" {
+		mode = TLSRequire
+		if cfg.DisableTLS {
+			mode = TLSDisable
+		}
+	}
+	if mode == TLSDisable {
+		return nil, nil
+	}
+
+	c := tls.Config{MinVersion: tls.VersionTLS12}
+
+	if cfg.RootCAFile != "" {
+		pem, err := os.ReadFile(cfg.RootCAFile)
+		if err != nil {
+			return nil, fmt.Errorf("reading root CAs: %w", err)
+		}
+		c.RootCAs = x509.NewCertPool()
+		if !c.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", cfg.RootCAFile)
+		}
+	}
+
+	if cfg.ClientCertFile != "" || cfg.ClientKeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(cfg.ClientCertFile, cfg.ClientKeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("loading client certificate: %w", err)
+		}
+		c.Certificates = []tls.Certificate{cert}
+	}
+
+	switch mode {
+	case TLSRequire:
+		if c.RootCAs == nil {
+			c.InsecureSkipVerify = true
+			break
+		}
+		fallthrough
+	case TLSVerifyCA:
+		// crypto/tls can't verify the chain without the name, so the name check is skipped along with everything
+		// else and the chain verified by hand
+		c.InsecureSkipVerify = true
+		c.VerifyPeerCertificate = verifyChain(c.RootCAs)
+	case TLSVerifyFull:
+		c.ServerName = cfg.ServerName
+		if c.ServerName == "" {
+			c.ServerName = cfg.Host
+			if host, _, err := net.SplitHostPort(cfg.Host); err == nil {
+				c.ServerName = host
+			}
+		}
+	default:
+		return nil, fmt.Errorf("unknown TLS mode: %s", mode)
+	}
+
+	return &c, nil
+}
+
+// verifyChain returns a VerifyPeerCertificate that verifies the certificate of the server chains up to one of roots,
+// or to the system roots when nil.
+func verifyChain(roots *x509.CertPool) func([][]byte, [][]*x509.Certificate) error {
+	return func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+		if len(rawCerts) == 0 {
+			return errors.New("the server sent no certificate")
+		}
+
+		certs := make([]*x509.Certificate, len(rawCerts))
+		for i, raw := range rawCerts {
+			cert, err := x509.ParseCertificate(raw)
+			if err != nil {
+				return fmt.Errorf("parsing server certificate: %w", err)
+			}
+			certs[i] = cert
+		}
+
+		intermediates := x509.NewCertPool()
+		for _, cert := range certs[1:] {
+			intermediates.AddCert(cert)
+		}
+		_, err := certs[0].Verify(x509.VerifyOptions{Roots: roots, Intermediates: intermediates})
+		return err
+	}
 }
 
 // StatusCheck tries to ping the database to make sure it is up. It will then make a full round trip connection
@@ -0,0 +1,170 @@
+package database
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/uptrace/bun/driver/pgdriver"
+)
+
+// issue creates a certificate for name signed by parent, or self-signed when parent is nil, and returns it along with
+// its key.
+func issue(t *testing.T, name string, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		DNSNames:     []string{name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	if parent == nil {
+		tmpl.IsCA = true
+		tmpl.BasicConstraintsValid = true
+		tmpl.KeyUsage = x509.KeyUsageCertSign
+		parent, parentKey = tmpl, key
+	}
+
+	raw, err := x509.CreateCertificate(rand.Reader, tmpl, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert, key
+}
+
+func writePEM(t *testing.T, dir, name, kind string, der []byte) string {
+	t.Helper()
+	path := filepath.Join(dir, name)
+	if err := os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: kind, Bytes: der}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func connectorConfig(t *testing.T, cfg Config) *pgdriver.Config {
+	t.Helper()
+	opts, err := connectorOptions(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pgdriver.NewConnector(opts...).Config()
+}
+
+func TestConnectorOptions(t *testing.T) {
+	dir := t.TempDir()
+	ca, caKey := issue(t, "ca", nil, nil)
+	server, _ := issue(t, "db.internal", ca, caKey)
+	other, _ := issue(t, "other", nil, nil)
+	client, clientKey := issue(t, "catchall", ca, caKey)
+
+	caFile := writePEM(t, dir, "ca.pem", "CERTIFICATE", ca.Raw)
+	certFile := writePEM(t, dir, "client.pem", "CERTIFICATE", client.Raw)
+	keyDER, err := x509.MarshalECPrivateKey(clientKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyFile := writePEM(t, dir, "client.key", "EC PRIVATE KEY", keyDER)
+
+	base := Config{User: "catchall", Password: "p@ss word", Host: "db.internal:5432", Name: "domains"}
+
+	t.Run("dsn", func(t *testing.T) {
+		c := connectorConfig(t, base)
+		assert.Equal(t, "db.internal:5432", c.Addr)
+		assert.Equal(t, "catchall", c.User)
+		assert.Equal(t, "p@ss word", c.Password)
+		assert.Equal(t, "domains", c.Database)
+		assert.Equal(t, "utc", c.ConnParams["timezone"])
+	})
+
+	t.Run("require by default", func(t *testing.T) {
+		c := connectorConfig(t, base)
+		assert.True(t, c.TLSConfig.InsecureSkipVerify)
+		assert.Nil(t, c.TLSConfig.VerifyPeerCertificate)
+	})
+
+	t.Run("disable", func(t *testing.T) {
+		cfg := base
+		cfg.DisableTLS = true
+		assert.Nil(t, connectorConfig(t, cfg).TLSConfig)
+
+		cfg = base
+		cfg.TLSMode = TLSDisable
+		assert.Nil(t, connectorConfig(t, cfg).TLSConfig)
+	})
+
+	t.Run("verify-ca", func(t *testing.T) {
+		cfg := base
+		cfg.TLSMode = TLSVerifyCA
+		cfg.RootCAFile = caFile
+		c := connectorConfig(t, cfg)
+
+		assert.NotNil(t, c.TLSConfig.RootCAs)
+		assert.NoError(t, c.TLSConfig.VerifyPeerCertificate([][]byte{server.Raw}, nil))
+		assert.Error(t, c.TLSConfig.VerifyPeerCertificate([][]byte{other.Raw}, nil), "not issued by the CA")
+	})
+
+	t.Run("require with a root CA verifies the chain", func(t *testing.T) {
+		cfg := base
+		cfg.RootCAFile = caFile
+		c := connectorConfig(t, cfg)
+
+		assert.Error(t, c.TLSConfig.VerifyPeerCertificate([][]byte{other.Raw}, nil))
+	})
+
+	t.Run("verify-full", func(t *testing.T) {
+		cfg := base
+		cfg.TLSMode = TLSVerifyFull
+		cfg.RootCAFile = caFile
+		c := connectorConfig(t, cfg)
+
+		assert.False(t, c.TLSConfig.InsecureSkipVerify)
+		assert.Equal(t, "db.internal", c.TLSConfig.ServerName)
+		assert.NotNil(t, c.TLSConfig.RootCAs)
+
+		cfg.ServerName = "primary.db.internal"
+		assert.Equal(t, "primary.db.internal", connectorConfig(t, cfg).TLSConfig.ServerName)
+	})
+
+	t.Run("client certificate", func(t *testing.T) {
+		cfg := base
+		cfg.TLSMode = TLSVerifyFull
+		cfg.ClientCertFile = certFile
+		cfg.ClientKeyFile = keyFile
+		c := connectorConfig(t, cfg)
+
+		if assert.Len(t, c.TLSConfig.Certificates, 1) {
+			assert.Equal(t, client.Raw, c.TLSConfig.Certificates[0].Certificate[0])
+		}
+	})
+
+	t.Run("errors", func(t *testing.T) {
+		for name, cfg := range map[string]Config{
+			"unknown mode":    {TLSMode: "verify-everything"},
+			"missing root CA": {TLSMode: TLSVerifyCA, RootCAFile: filepath.Join(dir, "missing.pem")},
+			"not a bundle":    {TLSMode: TLSVerifyCA, RootCAFile: keyFile},
+			"key missing":     {TLSMode: TLSVerifyFull, ClientCertFile: certFile},
+		} {
+			_, err := connectorOptions(cfg)
+			assert.Error(t, err, name)
+		}
+	})
+}
@@ -0,0 +1,206 @@
+package database
+
+import (
+	"context"
+	"encoding/json"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/penthious/catchall/foundation/metrics"
+	"github.com/rs/zerolog"
+	"github.com/uptrace/bun"
+)
+
+type traceIDKey struct{}
+
+// WithTraceID returns a context that makes the QueryHook log the trace ID with the queries run with it. Only the
+// audit log runs its queries with one, the methods of ports.DB don't take a context so the domain queries of a request
+// are logged without its trace ID. The writes of the write-behind buffer sum the events of many requests, so there
+// is no single trace ID to give them either way.
+func WithTraceID(ctx context.Context, traceID string) context.Context {
+	return context.WithValue(ctx, traceIDKey{}, traceID)
+}
+
+// MonitorConfig contains the settings for the Monitor, zero values are replaced with the defaults.
+type MonitorConfig struct {
+	Log *zerolog.Logger
+	// SlowQuery is how long a query may take before it is logged, 200ms by default.
+	SlowQuery time.Duration
+	// StatsInterval is how often the stats of the pools are sampled, 10s by default.
+	StatsInterval time.Duration
+}
+
+// PoolStats are the parts of sql.DBStats that tell whether a pool is too small.
+type PoolStats struct {
+	MaxOpen      int           `json:"max_open"`
+	Open         int           `json:"open"`
+	InUse        int           `json:"in_use"`
+	Idle         int           `json:"idle"`
+	WaitCount    int64         `json:"wait_count"`
+	WaitDuration time.Duration `json:"wait_duration"`
+}
+
+// Monitor records the latency of the queries of the pools it watches per operation, logs the slow ones, and samples
+// the stats of the pools in the background. It is an expvar.Var with the latencies and the latest stats.
+type Monitor struct {
+	cfg     MonitorConfig
+	queries *metrics.Histograms
+
+	mu    sync.Mutex
+	pools map[string]*bun.DB
+	stats atomic.Pointer[map[string]PoolStats]
+
+	shutdown chan struct{}
+	wg       sync.WaitGroup
+}
+
+// NewMonitor returns a Monitor without pools, call Watch for each of them and Start to begin sampling their stats.
+func NewMonitor(cfg MonitorConfig) *Monitor {
+	if cfg.Log == nil {
+		nop := zerolog.Nop()
+		cfg.Log = &nop
+	}
+	if cfg.SlowQuery <= 0 {
+		cfg.SlowQuery = 200 * time.Millisecond
+	}
+	if cfg.StatsInterval <= 0 {
+		cfg.StatsInterval = 10 * time.Second
+	}
+
+	m := Monitor{
+		cfg:      cfg,
+		queries:  metrics.NewHistograms(metrics.LatencyBuckets),
+		pools:    make(map[string]*bun.DB),
+		shutdown: make(chan struct{}),
+	}
+	m.stats.Store(&map[string]PoolStats{})
+	return &m
+}
+
+// Watch adds a QueryHook to the pool, and samples its stats under name.
+func (m *Monitor) Watch(name string, db *bun.DB) {
+	db.AddQueryHook(QueryHook{name: name, monitor: m})
+
+	m.mu.Lock()
+	m.pools[name] = db
+	m.mu.Unlock()
+	m.sample()
+}
+
+// Start samples the stats of the pools every StatsInterval until Close is called.
+func (m *Monitor) Start() {
+	m.wg.Add(1)
+	go func() {
+		defer m.wg.Done()
+
+		ticker := time.NewTicker(m.cfg.StatsInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				m.sample()
+			case <-m.shutdown:
+				return
+			}
+		}
+	}()
+}
+
+// Close stops sampling.
+func (m *Monitor) Close() {
+	close(m.shutdown)
+	m.wg.Wait()
+}
+
+// sample stores the stats of every pool, and warns about the pools whose callers waited for a connection since the
+// last sample.
+func (m *Monitor) sample() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	prev := *m.stats.Load()
+	stats := make(map[string]PoolStats, len(m.pools))
+	for name, db := range m.pools {
+		s := db.Stats()
+		stats[name] = PoolStats{
+			MaxOpen:      s.MaxOpenConnections,
+			Open:         s.OpenConnections,
+			InUse:        s.InUse,
+			Idle:         s.Idle,
+			WaitCount:    s.WaitCount,
+			WaitDuration: s.WaitDuration,
+		}
+
+		if p, ok := prev[name]; ok && s.WaitCount > p.WaitCount {
+			m.cfg.Log.Warn().
+				Str("db", name).
+				Int64("waits", s.WaitCount-p.WaitCount).
+				Dur("waited", s.WaitDuration-p.WaitDuration).
+				Int("in_use", s.InUse).
+				Int("max_open", s.MaxOpenConnections).
+				Msg("queries waited for a connection")
+		}
+	}
+	m.stats.Store(&stats)
+}
+
+// Stats returns the latest sample of the stats of every pool by name.
+func (m *Monitor) Stats() map[string]PoolStats {
+	return *m.stats.Load()
+}
+
+// String returns the latencies of the queries and the stats of the pools as JSON, for expvar.
+func (m *Monitor) String() string {
+	b, _ := json.Marshal(struct {
+		Queries map[string]metrics.Snapshot `json:"queries"`
+		Pools   map[string]PoolStats        `json:"pools"`
+	}{
+		Queries: m.queries.Snapshot(),
+		Pools:   m.Stats(),
+	})
+	return string(b)
+}
+
+// QueryHook records the latency of every query of a pool in the histogram of its operation, and logs the queries
+// slower than the SlowQuery of the monitor.
+type QueryHook struct {
+	name    string
+	monitor *Monitor
+}
+
+// BeforeQuery implements bun.QueryHook.
+func (h QueryHook) BeforeQuery(ctx context.Context, _ *bun.QueryEvent) context.Context {
+	return ctx
+}
+
+// AfterQuery implements bun.QueryHook.
+func (h QueryHook) AfterQuery(ctx context.Context, event *bun.QueryEvent) {
+	took := time.Since(event.StartTime)
+	op := event.Operation()
+	h.monitor.queries.Observe(op, took)
+
+	if took < h.monitor.cfg.SlowQuery {
+		return
+	}
+
+	log := h.monitor.cfg.Log.Warn().
+		Str("db", h.name).
+		Str("operation", op).
+		Dur("took", took).
+		Str("query", truncate(event.Query, 1024))
+	if traceID, ok := ctx.Value(traceIDKey{}).(string); ok {
+		log = log.Str("trace_id", traceID)
+	}
+	if event.Err != nil {
+		log = log.Err(event.Err)
+	}
+	log.Msg("slow query")
+}
+
+func truncate(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	return s[:n] + "..."
+}
@@ -0,0 +1,34 @@
+package database
+
+import (
+	"bytes"
+	"context"
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+	"github.com/uptrace/bun"
+)
+
+func TestQueryHook(t *testing.T) {
+	var buf bytes.Buffer
+	log := zerolog.New(&buf)
+	m := NewMonitor(MonitorConfig{Log: &log, SlowQuery: time.Second})
+	h := QueryHook{name: "primary", monitor: m}
+
+	h.AfterQuery(context.Background(), &bun.QueryEvent{Query: "SELECT 1", StartTime: time.Now()})
+	assert.Zero(t, buf.Len(), "fast queries aren't logged")
+
+	ctx := WithTraceID(context.Background(), "trace")
+	h.AfterQuery(ctx, &bun.QueryEvent{Query: "INSERT INTO domains", StartTime: time.Now().Add(-2 * time.Second)})
+	assert.Contains(t, buf.String(), `"trace_id":"trace"`)
+	assert.Contains(t, buf.String(), `"operation":"INSERT"`)
+	assert.Contains(t, buf.String(), `"db":"primary"`)
+
+	queries := m.queries.Snapshot()
+	assert.Equal(t, uint64(1), queries["SELECT"].Count)
+	assert.Equal(t, uint64(1), queries["INSERT"].Count)
+	assert.Equal(t, uint64(0), queries["INSERT"].Buckets["1000"], "2s is over the 1s bucket")
+	assert.Equal(t, uint64(1), queries["INSERT"].Buckets["+Inf"])
+}
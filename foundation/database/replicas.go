@@ -0,0 +1,215 @@
+package database
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/uptrace/bun"
+)
+
+// lagQuery returns how far a replica is behind the primary in seconds, and whether its WAL receiver is running. A
+// replica that has replayed everything it received is not lagging, no matter how long ago the primary last wrote, but
+// only while it is still receiving. Once the receiver is gone nothing new arrives, so the lag is the age of the last
+// replayed transaction. The row of pg_stat_wal_receiver is visible without privileges, only its columns are not.
+const lagQuery = `SELECT
+	CASE
+		WHEN NOT pg_is_in_recovery() THEN 0
+		WHEN EXISTS (SELECT 1 FROM pg_stat_wal_receiver) AND pg_last_wal_receive_lsn() = pg_last_wal_replay_lsn() THEN 0
+		ELSE COALESCE(EXTRACT(EPOCH FROM now() - pg_last_xact_replay_timestamp()), 0)
+	END,
+	NOT pg_is_in_recovery() OR EXISTS (SELECT 1 FROM pg_stat_wal_receiver)`
+
+// errNotReceiving is the health check error of a replica whose WAL receiver isn't running, whatever it replayed is
+// falling further behind the primary.
+var errNotReceiving = errors.New("WAL receiver is not running")
+
+// Replica is a pool to a read replica along with its last known health.
+type Replica struct {
+	Host string
+	DB   *bun.DB
+
+	healthy atomic.Bool
+	lag     atomic.Int64
+}
+
+// Healthy reports whether the replica passed its last health check.
+func (r *Replica) Healthy() bool {
+	return r.healthy.Load()
+}
+
+// Lag returns the replication lag measured by the last health check.
+func (r *Replica) Lag() time.Duration {
+	return time.Duration(r.lag.Load())
+}
+
+// Cluster is a pool to the primary and one to each of the replicas. Reads are spread over the replicas that are
+// healthy and within the maximum lag, and go to the primary when there are none.
+type Cluster struct {
+	Primary  *bun.DB
+	Replicas []*Replica
+
+	cfg  Config
+	log  *zerolog.Logger
+	next uint64
+
+	// measure returns the lag of the replica, replaced in tests.
+	measure func(ctx context.Context, r *Replica) (time.Duration, error)
+
+	shutdown chan struct{}
+	wg       sync.WaitGroup
+}
+
+// OpenCluster opens a pool to the primary at cfg.Host and one to every host in cfg.Replicas. The replicas only
+// receive reads once a health check passed, see CheckReplicas and Start.
+func OpenCluster(cfg Config, log *zerolog.Logger) (*Cluster, error) {
+	if cfg.MaxReplicaLag <= 0 {
+		cfg.MaxReplicaLag = 5 * time.Second
+	}
+	if cfg.ReplicaCheckInterval <= 0 {
+		cfg.ReplicaCheckInterval = 5 * time.Second
+	}
+	if log == nil {
+		nop := zerolog.Nop()
+		log = &nop
+	}
+
+	primary, err := Open(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	c := &Cluster{
+		Primary:  primary,
+		cfg:      cfg,
+		log:      log,
+		measure:  measureLag,
+		shutdown: make(chan struct{}),
+	}
+	for _, host := range cfg.Replicas {
+		replicaCfg := cfg
+		replicaCfg.Host = host
+		db, err := Open(replicaCfg)
+		if err != nil {
+			c.Close()
+			return nil, fmt.Errorf("opening replica %s: %w", host, err)
+		}
+		c.Replicas = append(c.Replicas, &Replica{Host: host, DB: db})
+	}
+
+	return c, nil
+}
+
+// Reader returns the pool reads should go to, the healthy replicas in turn or the primary when none is healthy.
+func (c *Cluster) Reader() *bun.DB {
+	n := len(c.Replicas)
+	if n == 0 {
+		return c.Primary
+	}
+
+	start := atomic.AddUint64(&c.next, 1)
+	for i := 0; i < n; i++ {
+		r := c.Replicas[(start+uint64(i))%uint64(n)]
+		if r.Healthy() {
+			return r.DB
+		}
+	}
+	return c.Primary
+}
+
+// CheckReplicas checks every replica with StatusCheck and measures its lag, a replica is healthy when both succeed
+// and the lag is within cfg.MaxReplicaLag. Every check is bounded by ctx.
+func (c *Cluster) CheckReplicas(ctx context.Context) {
+	var wg sync.WaitGroup
+	for _, r := range c.Replicas {
+		wg.Add(1)
+		go func(r *Replica) {
+			defer wg.Done()
+			c.check(ctx, r)
+		}(r)
+	}
+	wg.Wait()
+}
+
+func (c *Cluster) check(ctx context.Context, r *Replica) {
+	lag, err := c.measure(ctx, r)
+	r.lag.Store(int64(lag))
+
+	healthy := err == nil && r.Lag() <= c.cfg.MaxReplicaLag
+	if was := r.healthy.Swap(healthy); was == healthy {
+		return
+	}
+
+	switch {
+	case healthy:
+		c.log.Info().Str("replica", r.Host).Dur("lag", r.Lag()).Msg("replica healthy")
+	case err != nil:
+		c.log.Warn().Err(err).Str("replica", r.Host).Msg("replica unhealthy, reading from the primary")
+	default:
+		c.log.Warn().Str("replica", r.Host).Dur("lag", r.Lag()).Msg("replica lagging, reading from the primary")
+	}
+}
+
+// measureLag runs StatusCheck against the replica and returns its lag, or errNotReceiving along with the lag when its
+// WAL receiver isn't running.
+func measureLag(ctx context.Context, r *Replica) (time.Duration, error) {
+	if err := StatusCheck(ctx, r.DB); err != nil {
+		return 0, err
+	}
+
+	var seconds float64
+	var receiving bool
+	if err := r.DB.QueryRowContext(ctx, lagQuery).Scan(&seconds, &receiving); err != nil {
+		return 0, err
+	}
+
+	lag := time.Duration(seconds * float64(time.Second))
+	if !receiving {
+		return lag, errNotReceiving
+	}
+	return lag, nil
+}
+
+// Start checks the replicas every cfg.ReplicaCheckInterval in the background until Close.
+func (c *Cluster) Start() {
+	if len(c.Replicas) == 0 {
+		return
+	}
+
+	c.wg.Add(1)
+	go func() {
+		defer c.wg.Done()
+
+		ticker := time.NewTicker(c.cfg.ReplicaCheckInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-c.shutdown:
+				return
+			case <-ticker.C:
+				ctx, cancel := context.WithTimeout(context.Background(), c.cfg.ReplicaCheckInterval)
+				c.CheckReplicas(ctx)
+				cancel()
+			}
+		}
+	}()
+}
+
+// Close stops the health checks and closes every pool.
+func (c *Cluster) Close() error {
+	close(c.shutdown)
+	c.wg.Wait()
+
+	err := c.Primary.Close()
+	for _, r := range c.Replicas {
+		if rerr := r.DB.Close(); rerr != nil && err == nil {
+			err = rerr
+		}
+	}
+	return err
+}
@@ -0,0 +1,129 @@
+package database
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/uptrace/bun"
+)
+
+// openCluster returns a cluster with the replicas, none of the pools connect until they are used.
+func openCluster(t *testing.T, replicas ...string) *Cluster {
+	t.Helper()
+	c, err := OpenCluster(Config{User: "catchall", Host: "primary", Replicas: replicas}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.Close() })
+	return c
+}
+
+// measurements sets what the health check of every replica measures, keyed by host. Hosts that aren't set measure no
+// lag.
+type measurements struct {
+	mu   sync.Mutex
+	lags map[string]time.Duration
+	errs map[string]error
+}
+
+func (m *measurements) set(host string, lag time.Duration, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.lags[host] = lag
+	m.errs[host] = err
+}
+
+func (m *measurements) measure(_ context.Context, r *Replica) (time.Duration, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.lags[r.Host], m.errs[r.Host]
+}
+
+func fakeMeasure(c *Cluster) *measurements {
+	m := &measurements{lags: make(map[string]time.Duration), errs: make(map[string]error)}
+	c.measure = m.measure
+	return m
+}
+
+// hosts returns the host of the pool every call to Reader returned.
+func hosts(c *Cluster, n int) []string {
+	byDB := map[*bun.DB]string{c.Primary: "primary"}
+	for _, r := range c.Replicas {
+		byDB[r.DB] = r.Host
+	}
+
+	got := make([]string, 0, n)
+	for i := 0; i < n; i++ {
+		got = append(got, byDB[c.Reader()])
+	}
+	return got
+}
+
+func TestReaderRotation(t *testing.T) {
+	c := openCluster(t, "r1", "r2", "r3")
+	fakeMeasure(c)
+	c.CheckReplicas(context.Background())
+
+	got := hosts(c, 6)
+	assert.ElementsMatch(t, []string{"r1", "r1", "r2", "r2", "r3", "r3"}, got)
+	assert.Equal(t, got[:3], got[3:], "the replicas are read from in turn")
+}
+
+func TestReaderFallback(t *testing.T) {
+	t.Run("without replicas", func(t *testing.T) {
+		c := openCluster(t)
+		assert.Equal(t, []string{"primary", "primary"}, hosts(c, 2))
+	})
+
+	t.Run("before the first health check", func(t *testing.T) {
+		c := openCluster(t, "r1", "r2")
+		assert.Equal(t, []string{"primary", "primary"}, hosts(c, 2))
+	})
+
+	t.Run("unhealthy replicas are skipped", func(t *testing.T) {
+		c := openCluster(t, "r1", "r2")
+		m := fakeMeasure(c)
+		m.set("r1", 0, errors.New("connection refused"))
+		c.CheckReplicas(context.Background())
+		assert.Equal(t, []string{"r2", "r2", "r2"}, hosts(c, 3))
+
+		m.set("r2", 0, errNotReceiving)
+		c.CheckReplicas(context.Background())
+		assert.Equal(t, []string{"primary", "primary"}, hosts(c, 2))
+
+		m.set("r1", 0, nil)
+		c.CheckReplicas(context.Background())
+		assert.Equal(t, []string{"r1", "r1"}, hosts(c, 2), "a replica that recovers is read from again")
+	})
+}
+
+func TestCheckReplicasLag(t *testing.T) {
+	c := openCluster(t, "r1")
+	c.cfg.MaxReplicaLag = 5 * time.Second
+	m := fakeMeasure(c)
+	r := c.Replicas[0]
+
+	tt := []struct {
+		name    string
+		lag     time.Duration
+		err     error
+		healthy bool
+	}{
+		{name: "within the maximum lag", lag: 5 * time.Second, healthy: true},
+		{name: "over the maximum lag", lag: 6 * time.Second, healthy: false},
+		{name: "caught up again", lag: 0, healthy: true},
+		{name: "WAL receiver not running", lag: time.Second, err: errNotReceiving, healthy: false},
+	}
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			m.set("r1", tc.lag, tc.err)
+			c.CheckReplicas(context.Background())
+			assert.Equal(t, tc.healthy, r.Healthy())
+			assert.Equal(t, tc.lag, r.Lag())
+		})
+	}
+}
@@ -0,0 +1,576 @@
+// Package kv provides an embedded, crash safe, ordered key-value store.
+//
+// Every key and value is held in memory in a skiplist, so reads never touch the disk. Writes are grouped in
+// transactions that are appended to a write-ahead log as a single checksummed record before they are applied, so a
+// transaction is either recovered whole or not at all. Once the log grows past a threshold the store is compacted
+// into a sorted table file and the log is started over.
+package kv
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/penthious/catchall/foundation/wal"
+)
+
+// ErrClosed is returned when using a closed store.
+var ErrClosed = errors.New("kv: store closed")
+
+// Options configures a store, zero values are replaced with the defaults.
+type Options struct {
+	// Sync decides when committed transactions are fsynced.
+	Sync wal.SyncPolicy
+	// SyncInterval is how often the log is fsynced with wal.SyncInterval, 1s by default.
+	SyncInterval time.Duration
+	// CompactSize is the size the log grows to before it is compacted into a table, 64MB by default.
+	CompactSize int64
+}
+
+const (
+	opPut    = 1
+	opDelete = 2
+)
+
+// Store is an embedded key-value store in a directory. It is safe for concurrent use, write transactions are
+// serialized.
+type Store struct {
+	dir  string
+	opts Options
+
+	// writeMu serializes the write transactions and guards the log.
+	writeMu sync.Mutex
+	log     *wal.Log
+	seq     int
+	logSize int64
+	closed  bool
+
+	// mu guards data, it is only held for writing while a committed transaction is applied.
+	mu   sync.RWMutex
+	data *skiplist
+
+	compactMu  sync.Mutex
+	compacting int32
+	compactErr error
+
+	shutdown chan struct{}
+	wg       sync.WaitGroup
+}
+
+// Open opens the store in the directory, creating it if needed, and recovers the latest table and the log written
+// after it. A transaction torn by a crash at the end of the log is dropped.
+func Open(dir string, opts Options) (*Store, error) {
+	if opts.SyncInterval <= 0 {
+		opts.SyncInterval = time.Second
+	}
+	if opts.CompactSize <= 0 {
+		opts.CompactSize = 64 << 20
+	}
+
+	if err := os.MkdirAll(dir, 0o750); err != nil {
+		return nil, fmt.Errorf("kv: creating directory: %w", err)
+	}
+
+	s := &Store{
+		dir:      dir,
+		opts:     opts,
+		data:     newSkiplist(),
+		shutdown: make(chan struct{}),
+	}
+	if err := s.recover(); err != nil {
+		return nil, err
+	}
+
+	if opts.Sync == wal.SyncInterval {
+		s.wg.Add(1)
+		go s.syncLoop()
+	}
+
+	return s, nil
+}
+
+// The files of a store, a log and a table share the sequence number when the table replaces the logs before it.
+const (
+	logFormat   = "wal-%08d.log"
+	tableFormat = "table-%08d.kv"
+)
+
+func (s *Store) path(format string, seq int) string {
+	return filepath.Join(s.dir, fmt.Sprintf(format, seq))
+}
+
+// files returns the sequence numbers of the files with the format in order.
+func (s *Store) files(format string) ([]int, error) {
+	paths, err := filepath.Glob(filepath.Join(s.dir, strings.Replace(format, "%08d", "*", 1)))
+	if err != nil {
+		return nil, err
+	}
+
+	seqs := make([]int, 0, len(paths))
+	for _, path := range paths {
+		var seq int
+		if _, err := fmt.Sscanf(filepath.Base(path), format, &seq); err != nil {
+			continue
+		}
+		seqs = append(seqs, seq)
+	}
+	sort.Ints(seqs)
+
+	return seqs, nil
+}
+
+func (s *Store) recover() error {
+	tables, err := s.files(tableFormat)
+	if err != nil {
+		return err
+	}
+
+	// Only the latest table counts, older ones are left over from a crash during the cleanup of a compaction.
+	table := 0
+	if len(tables) > 0 {
+		table = tables[len(tables)-1]
+		if err := s.loadTable(s.path(tableFormat, table)); err != nil {
+			return err
+		}
+		for _, seq := range tables[:len(tables)-1] {
+			os.Remove(s.path(tableFormat, seq))
+		}
+	}
+	os.Remove(filepath.Join(s.dir, "table.tmp"))
+
+	logs, err := s.files(logFormat)
+	if err != nil {
+		return err
+	}
+
+	s.seq = table
+	if s.seq == 0 {
+		s.seq = 1
+	}
+	for _, seq := range logs {
+		if seq < table {
+			if err := os.Remove(s.path(logFormat, seq)); err != nil {
+				return fmt.Errorf("kv: removing log: %w", err)
+			}
+			continue
+		}
+		if err := s.replay(s.path(logFormat, seq)); err != nil {
+			return err
+		}
+		s.seq = seq
+	}
+
+	log, err := wal.Open(s.path(logFormat, s.seq), s.opts.Sync)
+	if err != nil {
+		return err
+	}
+	s.log = log
+	if info, err := os.Stat(s.path(logFormat, s.seq)); err == nil {
+		s.logSize = info.Size()
+	}
+
+	return nil
+}
+
+func (s *Store) loadTable(path string) error {
+	log, err := wal.Open(path, wal.SyncNever)
+	if err != nil {
+		return err
+	}
+	defer log.Close()
+
+	torn, err := log.Replay(func(record []byte) error {
+		key, value, err := decodeEntry(record)
+		if err != nil {
+			return err
+		}
+		s.data.put(key, value)
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("kv: loading %s: %w", path, err)
+	}
+	// tables are renamed into place once they are complete, so a torn one is corrupt rather than unfinished
+	if torn > 0 {
+		return fmt.Errorf("kv: table %s is corrupt", path)
+	}
+
+	return nil
+}
+
+func (s *Store) replay(path string) error {
+	log, err := wal.Open(path, wal.SyncNever)
+	if err != nil {
+		return err
+	}
+	defer log.Close()
+
+	if _, err := log.Replay(func(record []byte) error {
+		return s.apply(record)
+	}); err != nil {
+		return fmt.Errorf("kv: replaying %s: %w", path, err)
+	}
+
+	return nil
+}
+
+// apply applies an encoded transaction to the data, the caller must hold mu for writing or be recovering.
+func (s *Store) apply(record []byte) error {
+	for len(record) > 0 {
+		op := record[0]
+		key, n, err := readBytes(record[1:])
+		if err != nil {
+			return err
+		}
+		record = record[1+n:]
+
+		switch op {
+		case opPut:
+			value, n, err := readBytes(record)
+			if err != nil {
+				return err
+			}
+			record = record[n:]
+			s.data.put(string(key), value)
+		case opDelete:
+			s.data.delete(string(key))
+		default:
+			return fmt.Errorf("kv: unknown op %d", op)
+		}
+	}
+
+	return nil
+}
+
+// Get returns the value of the key. The value must not be modified.
+func (s *Store) Get(key string) ([]byte, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.data.get(key)
+}
+
+// Scan calls fn for every key with the prefix that sorts after start, in order, until fn returns false. An empty
+// start scans the whole prefix. The values must not be modified, and fn must not write to the store.
+func (s *Store) Scan(prefix, start string, fn func(key string, value []byte) bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	from := prefix
+	if start > prefix {
+		from = start
+	}
+	s.data.ascend(from, func(key string, value []byte) bool {
+		if !strings.HasPrefix(key, prefix) {
+			return false
+		}
+		if key == start {
+			return true
+		}
+		return fn(key, value)
+	})
+}
+
+// Len returns the number of keys in the store.
+func (s *Store) Len() int {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.data.len
+}
+
+type entry struct {
+	key   string
+	value []byte
+}
+
+// Tx is a write transaction, its writes are only visible to the transaction until it commits.
+type Tx struct {
+	s      *Store
+	writes map[string][]byte
+	order  []string
+}
+
+// Get returns the value of the key as the transaction sees it. The value must not be modified.
+func (tx *Tx) Get(key string) ([]byte, bool) {
+	if value, ok := tx.writes[key]; ok {
+		return value, value != nil
+	}
+	return tx.s.Get(key)
+}
+
+// Put sets the value of the key.
+func (tx *Tx) Put(key string, value []byte) {
+	if value == nil {
+		value = []byte{}
+	}
+	tx.set(key, value)
+}
+
+// Delete removes the key.
+func (tx *Tx) Delete(key string) {
+	tx.set(key, nil)
+}
+
+func (tx *Tx) set(key string, value []byte) {
+	if _, ok := tx.writes[key]; !ok {
+		tx.order = append(tx.order, key)
+	}
+	tx.writes[key] = value
+}
+
+// IncrBy adds delta to the integer stored in the key, a missing key counts as zero, and returns the new value.
+func (tx *Tx) IncrBy(key string, delta int64) (int64, error) {
+	var n int64
+	if value, ok := tx.Get(key); ok {
+		if len(value) != 8 {
+			return 0, fmt.Errorf("kv: value of %s is not an integer", key)
+		}
+		n = int64(binary.BigEndian.Uint64(value))
+	}
+	n += delta
+
+	value := make([]byte, 8)
+	binary.BigEndian.PutUint64(value, uint64(n))
+	tx.Put(key, value)
+
+	return n, nil
+}
+
+// Int decodes a value written by IncrBy.
+func Int(value []byte) int64 {
+	if len(value) != 8 {
+		return 0
+	}
+	return int64(binary.BigEndian.Uint64(value))
+}
+
+// Update runs fn in a write transaction, which commits when fn returns nil. A committed transaction is in the log
+// before it is visible, and is fsynced according to the sync policy.
+func (s *Store) Update(fn func(tx *Tx) error) error {
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+
+	if s.closed {
+		return ErrClosed
+	}
+
+	tx := &Tx{s: s, writes: make(map[string][]byte)}
+	if err := fn(tx); err != nil {
+		return err
+	}
+	if len(tx.writes) == 0 {
+		return nil
+	}
+
+	record := make([]byte, 0, 64*len(tx.order))
+	for _, key := range tx.order {
+		value := tx.writes[key]
+		if value == nil {
+			record = append(record, opDelete)
+			record = appendBytes(record, []byte(key))
+			continue
+		}
+		record = append(record, opPut)
+		record = appendBytes(record, []byte(key))
+		record = appendBytes(record, value)
+	}
+
+	if err := s.log.Append(record); err != nil {
+		return fmt.Errorf("kv: commit: %w", err)
+	}
+	s.logSize += int64(len(record))
+
+	s.mu.Lock()
+	err := s.apply(record)
+	s.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	if s.logSize >= s.opts.CompactSize && atomic.CompareAndSwapInt32(&s.compacting, 0, 1) {
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			defer atomic.StoreInt32(&s.compacting, 0)
+			if err := s.Compact(); err != nil && !errors.Is(err, ErrClosed) {
+				s.compactMu.Lock()
+				s.compactErr = err
+				s.compactMu.Unlock()
+			}
+		}()
+	}
+
+	return nil
+}
+
+// Compact writes the whole store to a new table and removes the log it replaces. Writes are only held up while the
+// log is switched and the keys are gathered, not while the table is written.
+func (s *Store) Compact() error {
+	s.compactMu.Lock()
+	defer s.compactMu.Unlock()
+
+	s.writeMu.Lock()
+	if s.closed {
+		s.writeMu.Unlock()
+		return ErrClosed
+	}
+	next, err := wal.Open(s.path(logFormat, s.seq+1), s.opts.Sync)
+	if err != nil {
+		s.writeMu.Unlock()
+		return err
+	}
+	if err := s.log.Close(); err != nil {
+		next.Close()
+		s.writeMu.Unlock()
+		return err
+	}
+	s.log = next
+	s.seq++
+	s.logSize = 0
+	seq := s.seq
+
+	// the values are never modified once stored, so the entries can share them with the skiplist
+	entries := make([]entry, 0, s.Len())
+	s.Scan("", "", func(key string, value []byte) bool {
+		entries = append(entries, entry{key: key, value: value})
+		return true
+	})
+	s.writeMu.Unlock()
+
+	if err := s.writeTable(seq, entries); err != nil {
+		return err
+	}
+
+	logs, err := s.files(logFormat)
+	if err != nil {
+		return err
+	}
+	for _, old := range logs {
+		if old < seq {
+			os.Remove(s.path(logFormat, old))
+		}
+	}
+	tables, err := s.files(tableFormat)
+	if err != nil {
+		return err
+	}
+	for _, old := range tables {
+		if old < seq {
+			os.Remove(s.path(tableFormat, old))
+		}
+	}
+
+	return nil
+}
+
+// writeTable writes the records to a temporary file and renames it into place once it is synced, so a table is
+// either complete or not there at all.
+func (s *Store) writeTable(seq int, entries []entry) error {
+	tmp := filepath.Join(s.dir, "table.tmp")
+	os.Remove(tmp)
+
+	table, err := wal.Open(tmp, wal.SyncNever)
+	if err != nil {
+		return err
+	}
+	var record []byte
+	for _, e := range entries {
+		record = appendBytes(appendBytes(record[:0], []byte(e.key)), e.value)
+		if err := table.Append(record); err != nil {
+			table.Close()
+			return fmt.Errorf("kv: writing table: %w", err)
+		}
+	}
+	if err := table.Close(); err != nil {
+		return fmt.Errorf("kv: writing table: %w", err)
+	}
+
+	if err := os.Rename(tmp, s.path(tableFormat, seq)); err != nil {
+		return fmt.Errorf("kv: renaming table: %w", err)
+	}
+
+	d, err := os.Open(s.dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+func (s *Store) syncLoop() {
+	defer s.wg.Done()
+
+	ticker := time.NewTicker(s.opts.SyncInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.shutdown:
+			return
+		case <-ticker.C:
+			s.writeMu.Lock()
+			if !s.closed {
+				s.log.Sync()
+			}
+			s.writeMu.Unlock()
+		}
+	}
+}
+
+// Close waits for a compaction in progress, then syncs and closes the log. It returns the error of the last
+// background compaction, if any.
+func (s *Store) Close() error {
+	s.writeMu.Lock()
+	if s.closed {
+		s.writeMu.Unlock()
+		return nil
+	}
+	s.closed = true
+	s.writeMu.Unlock()
+
+	close(s.shutdown)
+	s.wg.Wait()
+
+	s.writeMu.Lock()
+	err := s.log.Close()
+	s.writeMu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	s.compactMu.Lock()
+	defer s.compactMu.Unlock()
+	return s.compactErr
+}
+
+func appendBytes(b, value []byte) []byte {
+	b = binary.AppendUvarint(b, uint64(len(value)))
+	return append(b, value...)
+}
+
+func readBytes(b []byte) ([]byte, int, error) {
+	size, n := binary.Uvarint(b)
+	if n <= 0 || uint64(len(b)-n) < size {
+		return nil, 0, errors.New("kv: malformed record")
+	}
+	return b[n : n+int(size)], n + int(size), nil
+}
+
+// decodeEntry decodes a table record, the key followed by the value.
+func decodeEntry(record []byte) (string, []byte, error) {
+	key, n, err := readBytes(record)
+	if err != nil {
+		return "", nil, err
+	}
+	value, _, err := readBytes(record[n:])
+	if err != nil {
+		return "", nil, err
+	}
+	return string(key), value, nil
+}
@@ -0,0 +1,102 @@
+package kv
+
+import "math/rand"
+
+const maxLevel = 24
+
+type node struct {
+	key   string
+	value []byte
+	next  []*node
+}
+
+// skiplist is an ordered map of keys to values, it is not safe for concurrent use.
+type skiplist struct {
+	head  *node
+	level int
+	len   int
+	rnd   *rand.Rand
+}
+
+func newSkiplist() *skiplist {
+	return &skiplist{
+		head:  &node{next: make([]*node, maxLevel)},
+		level: 1,
+		rnd:   rand.New(rand.NewSource(1)),
+	}
+}
+
+// seek returns the first node with a key at or after key, and fills prev with the last node before it on every level
+// when prev isn't nil.
+func (l *skiplist) seek(key string, prev []*node) *node {
+	n := l.head
+	for lvl := l.level - 1; lvl >= 0; lvl-- {
+		for n.next[lvl] != nil && n.next[lvl].key < key {
+			n = n.next[lvl]
+		}
+		if prev != nil {
+			prev[lvl] = n
+		}
+	}
+	return n.next[0]
+}
+
+func (l *skiplist) get(key string) ([]byte, bool) {
+	n := l.seek(key, nil)
+	if n == nil || n.key != key {
+		return nil, false
+	}
+	return n.value, true
+}
+
+func (l *skiplist) put(key string, value []byte) {
+	prev := make([]*node, maxLevel)
+	n := l.seek(key, prev)
+	if n != nil && n.key == key {
+		n.value = value
+		return
+	}
+
+	lvl := 1
+	for lvl < maxLevel && l.rnd.Intn(4) == 0 {
+		lvl++
+	}
+	if lvl > l.level {
+		for i := l.level; i < lvl; i++ {
+			prev[i] = l.head
+		}
+		l.level = lvl
+	}
+
+	n = &node{key: key, value: value, next: make([]*node, lvl)}
+	for i := 0; i < lvl; i++ {
+		n.next[i] = prev[i].next[i]
+		prev[i].next[i] = n
+	}
+	l.len++
+}
+
+func (l *skiplist) delete(key string) {
+	prev := make([]*node, maxLevel)
+	n := l.seek(key, prev)
+	if n == nil || n.key != key {
+		return
+	}
+
+	for i := 0; i < len(n.next); i++ {
+		prev[i].next[i] = n.next[i]
+	}
+	for l.level > 1 && l.head.next[l.level-1] == nil {
+		l.level--
+	}
+	l.len--
+}
+
+// ascend calls fn for every key at or after start in order until it returns false.
+func (l *skiplist) ascend(start string, fn func(key string, value []byte) bool) {
+	for n := l.seek(start, nil); n != nil; n = n.next[0] {
+		if !fn(n.key, n.value) {
+			return
+		}
+	}
+}
@@ -0,0 +1,137 @@
+// Package metrics provides the histograms the application records latencies in, published as expvars.
+package metrics
+
+import (
+	"encoding/json"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// LatencyBuckets are the upper bounds of the buckets the latencies of requests and queries are counted in.
+var LatencyBuckets = []time.Duration{
+	time.Millisecond,
+	2 * time.Millisecond,
+	5 * time.Millisecond,
+	10 * time.Millisecond,
+	25 * time.Millisecond,
+	50 * time.Millisecond,
+	100 * time.Millisecond,
+	250 * time.Millisecond,
+	500 * time.Millisecond,
+	time.Second,
+	2500 * time.Millisecond,
+	5 * time.Second,
+}
+
+// Histogram counts durations in buckets with fixed upper bounds, along with their total. It is safe for concurrent
+// use and is an expvar.Var.
+type Histogram struct {
+	bounds []time.Duration
+	// counts has a bucket per bound and a last one for the durations over every bound.
+	counts []atomic.Uint64
+	count  atomic.Uint64
+	sum    atomic.Int64
+}
+
+// NewHistogram returns a histogram with the bounds, which must be sorted.
+func NewHistogram(bounds []time.Duration) *Histogram {
+	return &Histogram{
+		bounds: bounds,
+		counts: make([]atomic.Uint64, len(bounds)+1),
+	}
+}
+
+// Observe counts the duration in the first bucket whose bound it doesn't exceed.
+func (h *Histogram) Observe(d time.Duration) {
+	i := sort.Search(len(h.bounds), func(i int) bool { return d <= h.bounds[i] })
+	h.counts[i].Add(1)
+	h.count.Add(1)
+	h.sum.Add(int64(d))
+}
+
+// Snapshot is the state of a histogram at one point in time. The buckets are cumulative and keyed by their bound in
+// milliseconds, with "+Inf" counting every duration.
+type Snapshot struct {
+	Count   uint64            `json:"count"`
+	SumMS   float64           `json:"sum_ms"`
+	Buckets map[string]uint64 `json:"buckets"`
+}
+
+// Snapshot returns the counts of the histogram so far.
+func (h *Histogram) Snapshot() Snapshot {
+	s := Snapshot{
+		Count:   h.count.Load(),
+		SumMS:   float64(h.sum.Load()) / float64(time.Millisecond),
+		Buckets: make(map[string]uint64, len(h.counts)),
+	}
+
+	var cumulative uint64
+	for i := range h.counts {
+		cumulative += h.counts[i].Load()
+		key := "+Inf"
+		if i < len(h.bounds) {
+			key = strconv.FormatFloat(float64(h.bounds[i])/float64(time.Millisecond), 'f', -1, 64)
+		}
+		s.Buckets[key] = cumulative
+	}
+	return s
+}
+
+// String returns the snapshot as JSON, for expvar.
+func (h *Histogram) String() string {
+	b, _ := json.Marshal(h.Snapshot())
+	return string(b)
+}
+
+// Histograms is a set of histograms with the same bounds keyed by a label, created on their first observation. It is
+// safe for concurrent use and is an expvar.Var.
+type Histograms struct {
+	bounds []time.Duration
+
+	mu sync.RWMutex
+	m  map[string]*Histogram
+}
+
+// NewHistograms returns an empty set of histograms with the bounds.
+func NewHistograms(bounds []time.Duration) *Histograms {
+	return &Histograms{bounds: bounds, m: make(map[string]*Histogram)}
+}
+
+// Observe counts the duration in the histogram of the label.
+func (hs *Histograms) Observe(label string, d time.Duration) {
+	hs.mu.RLock()
+	h, ok := hs.m[label]
+	hs.mu.RUnlock()
+
+	if !ok {
+		hs.mu.Lock()
+		if h, ok = hs.m[label]; !ok {
+			h = NewHistogram(hs.bounds)
+			hs.m[label] = h
+		}
+		hs.mu.Unlock()
+	}
+
+	h.Observe(d)
+}
+
+// Snapshot returns the snapshot of every histogram by its label.
+func (hs *Histograms) Snapshot() map[string]Snapshot {
+	hs.mu.RLock()
+	defer hs.mu.RUnlock()
+
+	s := make(map[string]Snapshot, len(hs.m))
+	for label, h := range hs.m {
+		s[label] = h.Snapshot()
+	}
+	return s
+}
+
+// String returns the snapshots as JSON, for expvar.
+func (hs *Histograms) String() string {
+	b, _ := json.Marshal(hs.Snapshot())
+	return string(b)
+}
@@ -0,0 +1,470 @@
+// Package nats provides a minimal client for the core protocol spoken by NATS servers.
+package nats
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Config is the required properties to use the NATS server.
+type Config struct {
+	Addr string
+	// User and Password, or Token, authenticate the connection when the server asks for it.
+	User     string
+	Password string
+	Token    string
+	// Name identifies the connection in the monitoring of the server.
+	Name        string
+	DialTimeout time.Duration
+	// IOTimeout bounds every write, and the wait for the reply of a Flush.
+	IOTimeout time.Duration
+	// PingInterval is how often the server is pinged to detect a dead connection, 2m by default.
+	PingInterval time.Duration
+	// PendingMsgs is the most messages buffered per subscription before the connection stops reading, 1024 by default.
+	PendingMsgs int
+}
+
+// ErrClosed is returned when using a closed connection.
+var ErrClosed = errors.New("nats: connection closed")
+
+// Error is an -ERR sent by the server, it closes the connection.
+type Error string
+
+func (e Error) Error() string {
+	return "nats: " + string(e)
+}
+
+// Msg is a message received on a subscription.
+type Msg struct {
+	Subject string
+	// Reply is the subject the publisher expects an answer on, empty when it doesn't.
+	Reply string
+	Data  []byte
+}
+
+// Conn is a connection to a NATS server. It is safe for concurrent use, and doesn't reconnect: once Done is closed
+// the connection is gone and Err tells why.
+type Conn struct {
+	cfg Config
+	nc  net.Conn
+	// maxPayload is the largest message the server accepts.
+	maxPayload int
+
+	wmu sync.Mutex
+	w   *bufio.Writer
+
+	mu      sync.Mutex
+	subs    map[int]*Subscription
+	nextSID int
+	pongs   []chan struct{}
+	err     error
+
+	done chan struct{}
+	wg   sync.WaitGroup
+}
+
+// Subscription receives the messages published on a subject.
+type Subscription struct {
+	Subject string
+	Queue   string
+	// C receives the messages, it is closed with the connection unless the subscription was unsubscribed.
+	C <-chan Msg
+
+	sid  int
+	msgs chan Msg
+	conn *Conn
+}
+
+// info is the part of the INFO the server sends on connect that the client needs.
+type info struct {
+	MaxPayload int `json:"max_payload"`
+}
+
+// connect are the options sent in the CONNECT.
+type connect struct {
+	Verbose  bool   `json:"verbose"`
+	Pedantic bool   `json:"pedantic"`
+	Name     string `json:"name,omitempty"`
+	User     string `json:"user,omitempty"`
+	Pass     string `json:"pass,omitempty"`
+	Token    string `json:"auth_token,omitempty"`
+	Lang     string `json:"lang"`
+	Version  string `json:"version"`
+	Protocol int    `json:"protocol"`
+}
+
+// Connect dials the server, authenticates and waits for it to answer a PING so a rejected connection fails here.
+func Connect(cfg Config) (*Conn, error) {
+	if cfg.DialTimeout <= 0 {
+		cfg.DialTimeout = 5 * time.Second
+	}
+	if cfg.IOTimeout <= 0 {
+		cfg.IOTimeout = 5 * time.Second
+	}
+	if cfg.PingInterval <= 0 {
+		cfg.PingInterval = 2 * time.Minute
+	}
+	if cfg.PendingMsgs <= 0 {
+		cfg.PendingMsgs = 1024
+	}
+
+	nc, err := net.DialTimeout("tcp", cfg.Addr, cfg.DialTimeout)
+	if err != nil {
+		return nil, fmt.Errorf("nats: dial: %w", err)
+	}
+
+	c := &Conn{
+		cfg:  cfg,
+		nc:   nc,
+		w:    bufio.NewWriter(nc),
+		subs: make(map[int]*Subscription),
+		done: make(chan struct{}),
+	}
+
+	r := bufio.NewReader(nc)
+	if err := c.handshake(r); err != nil {
+		nc.Close()
+		return nil, err
+	}
+
+	c.wg.Add(2)
+	go c.read(r)
+	go c.ping()
+
+	return c, nil
+}
+
+// handshake reads the INFO of the server, sends the CONNECT and checks the PONG to the PING that follows it.
+func (c *Conn) handshake(r *bufio.Reader) error {
+	c.nc.SetDeadline(time.Now().Add(c.cfg.DialTimeout))
+	defer c.nc.SetDeadline(time.Time{})
+
+	line, err := readLine(r)
+	if err != nil {
+		return fmt.Errorf("nats: reading info: %w", err)
+	}
+	op, args := split(line)
+	if op != "INFO" {
+		return fmt.Errorf("nats: expected INFO, got %q", line)
+	}
+	var inf info
+	if err := json.Unmarshal([]byte(args), &inf); err != nil {
+		return fmt.Errorf("nats: decoding info: %w", err)
+	}
+	c.maxPayload = inf.MaxPayload
+
+	opts, err := json.Marshal(connect{
+		Name:     c.cfg.Name,
+		User:     c.cfg.User,
+		Pass:     c.cfg.Password,
+		Token:    c.cfg.Token,
+		Lang:     "go",
+		Version:  "catchall",
+		Protocol: 1,
+	})
+	if err != nil {
+		return err
+	}
+	if _, err := fmt.Fprintf(c.w, "CONNECT %s\r\nPING\r\n", opts); err != nil {
+		return err
+	}
+	if err := c.w.Flush(); err != nil {
+		return fmt.Errorf("nats: sending connect: %w", err)
+	}
+
+	for {
+		line, err := readLine(r)
+		if err != nil {
+			return fmt.Errorf("nats: reading connect reply: %w", err)
+		}
+		op, args := split(line)
+		switch op {
+		case "PONG":
+			return nil
+		case "-ERR":
+			return Error(strings.Trim(args, "'"))
+		case "+OK", "INFO":
+		default:
+			return fmt.Errorf("nats: unexpected reply to connect %q", line)
+		}
+	}
+}
+
+// read dispatches everything the server sends until the connection fails or is closed. It is the only sender on the
+// channels of the subscriptions, so it closes them when it returns.
+func (c *Conn) read(r *bufio.Reader) {
+	defer c.wg.Done()
+	defer func() {
+		c.mu.Lock()
+		for _, sub := range c.subs {
+			close(sub.msgs)
+		}
+		c.subs = nil
+		c.mu.Unlock()
+	}()
+
+	for {
+		line, err := readLine(r)
+		if err != nil {
+			c.fail(err)
+			return
+		}
+
+		op, args := split(line)
+		switch op {
+		case "MSG":
+			msg, sid, err := readMsg(r, args)
+			if err != nil {
+				c.fail(err)
+				return
+			}
+			c.deliver(sid, msg)
+		case "PING":
+			if err := c.write("PONG\r\n"); err != nil {
+				c.fail(err)
+				return
+			}
+		case "PONG":
+			c.mu.Lock()
+			if len(c.pongs) > 0 {
+				close(c.pongs[0])
+				c.pongs = c.pongs[1:]
+			}
+			c.mu.Unlock()
+		case "-ERR":
+			c.fail(Error(strings.Trim(args, "'")))
+			return
+		case "+OK", "INFO":
+		default:
+			c.fail(fmt.Errorf("nats: unknown operation %q", line))
+			return
+		}
+	}
+}
+
+// readMsg reads the payload of a MSG with the arguments <subject> <sid> [reply-to] <#bytes>.
+func readMsg(r *bufio.Reader, args string) (Msg, int, error) {
+	fields := strings.Fields(args)
+	if len(fields) != 3 && len(fields) != 4 {
+		return Msg{}, 0, fmt.Errorf("nats: malformed MSG %q", args)
+	}
+	sid, err := strconv.Atoi(fields[1])
+	if err != nil {
+		return Msg{}, 0, fmt.Errorf("nats: malformed MSG %q", args)
+	}
+	size, err := strconv.Atoi(fields[len(fields)-1])
+	if err != nil || size < 0 {
+		return Msg{}, 0, fmt.Errorf("nats: malformed MSG %q", args)
+	}
+
+	msg := Msg{Subject: fields[0]}
+	if len(fields) == 4 {
+		msg.Reply = fields[2]
+	}
+
+	payload := make([]byte, size+2)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return Msg{}, 0, err
+	}
+	msg.Data = payload[:size]
+
+	return msg, sid, nil
+}
+
+// deliver hands the message to its subscription, waiting while the subscription is full.
+func (c *Conn) deliver(sid int, msg Msg) {
+	c.mu.Lock()
+	sub, ok := c.subs[sid]
+	c.mu.Unlock()
+	if !ok {
+		return
+	}
+
+	select {
+	case sub.msgs <- msg:
+	case <-c.done:
+	}
+}
+
+// ping checks the connection every PingInterval, and closes it when the server doesn't answer.
+func (c *Conn) ping() {
+	defer c.wg.Done()
+
+	ticker := time.NewTicker(c.cfg.PingInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := c.Flush(); err != nil {
+				c.fail(fmt.Errorf("nats: stale connection: %w", err))
+				return
+			}
+		case <-c.done:
+			return
+		}
+	}
+}
+
+// Subscribe subscribes to the subject, which may contain wildcards. With a queue group every message is delivered to
+// a single member of the group.
+func (c *Conn) Subscribe(subject, queue string) (*Subscription, error) {
+	c.mu.Lock()
+	if c.err != nil {
+		c.mu.Unlock()
+		return nil, c.err
+	}
+	c.nextSID++
+	sub := &Subscription{
+		Subject: subject,
+		Queue:   queue,
+		sid:     c.nextSID,
+		msgs:    make(chan Msg, c.cfg.PendingMsgs),
+		conn:    c,
+	}
+	sub.C = sub.msgs
+	c.subs[sub.sid] = sub
+	c.mu.Unlock()
+
+	cmd := fmt.Sprintf("SUB %s %d\r\n", subject, sub.sid)
+	if queue != "" {
+		cmd = fmt.Sprintf("SUB %s %s %d\r\n", subject, queue, sub.sid)
+	}
+	if err := c.write(cmd); err != nil {
+		return nil, err
+	}
+	return sub, nil
+}
+
+// Unsubscribe stops the messages of the subscription, the ones already received are left in C.
+func (s *Subscription) Unsubscribe() error {
+	s.conn.mu.Lock()
+	delete(s.conn.subs, s.sid)
+	s.conn.mu.Unlock()
+	return s.conn.write(fmt.Sprintf("UNSUB %d\r\n", s.sid))
+}
+
+// Publish sends the data on the subject.
+func (c *Conn) Publish(subject string, data []byte) error {
+	return c.PublishRequest(subject, "", data)
+}
+
+// PublishRequest sends the data on the subject, telling the subscribers to answer on reply.
+func (c *Conn) PublishRequest(subject, reply string, data []byte) error {
+	if c.maxPayload > 0 && len(data) > c.maxPayload {
+		return fmt.Errorf("nats: payload of %d bytes is over the maximum of %d", len(data), c.maxPayload)
+	}
+
+	header := fmt.Sprintf("PUB %s %d\r\n", subject, len(data))
+	if reply != "" {
+		header = fmt.Sprintf("PUB %s %s %d\r\n", subject, reply, len(data))
+	}
+
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	if err := c.Err(); err != nil {
+		return err
+	}
+
+	c.nc.SetWriteDeadline(time.Now().Add(c.cfg.IOTimeout))
+	c.w.WriteString(header)
+	c.w.Write(data)
+	c.w.WriteString("\r\n")
+	if err := c.w.Flush(); err != nil {
+		c.fail(err)
+		return fmt.Errorf("nats: publish: %w", err)
+	}
+	return nil
+}
+
+// Flush waits for the server to have processed everything sent before it.
+func (c *Conn) Flush() error {
+	pong := make(chan struct{})
+	c.mu.Lock()
+	c.pongs = append(c.pongs, pong)
+	c.mu.Unlock()
+
+	if err := c.write("PING\r\n"); err != nil {
+		return err
+	}
+
+	timer := time.NewTimer(c.cfg.IOTimeout)
+	defer timer.Stop()
+	select {
+	case <-pong:
+		return nil
+	case <-c.done:
+		return c.Err()
+	case <-timer.C:
+		return errors.New("nats: flush timed out")
+	}
+}
+
+func (c *Conn) write(s string) error {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	if err := c.Err(); err != nil {
+		return err
+	}
+
+	c.nc.SetWriteDeadline(time.Now().Add(c.cfg.IOTimeout))
+	c.w.WriteString(s)
+	if err := c.w.Flush(); err != nil {
+		c.fail(err)
+		return fmt.Errorf("nats: write: %w", err)
+	}
+	return nil
+}
+
+// fail closes the connection with the error, the first error is kept.
+func (c *Conn) fail(err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.err != nil {
+		return
+	}
+	c.err = err
+	close(c.done)
+	c.nc.Close()
+}
+
+// Err returns why the connection was closed, nil while it is open.
+func (c *Conn) Err() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.err
+}
+
+// Done is closed once the connection is closed.
+func (c *Conn) Done() <-chan struct{} {
+	return c.done
+}
+
+// Close closes the connection and the channels of its subscriptions.
+func (c *Conn) Close() error {
+	c.fail(ErrClosed)
+	c.wg.Wait()
+	return nil
+}
+
+// readLine reads a control line without its CRLF.
+func readLine(r *bufio.Reader) (string, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
+
+// split splits a control line into its operation, upper cased, and its arguments.
+func split(line string) (string, string) {
+	op, args, _ := strings.Cut(line, " ")
+	return strings.ToUpper(op), strings.TrimSpace(args)
+}
@@ -0,0 +1,239 @@
+// Package natstest provides an in-process server speaking enough of the NATS core protocol to test against.
+package natstest
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Server is a NATS server listening on a random local port. It routes the published messages to the matching
+// subscriptions, wildcards included, and delivers a message to a single member of every queue group.
+type Server struct {
+	ln net.Listener
+	wg sync.WaitGroup
+
+	mu     sync.Mutex
+	conns  map[*client]struct{}
+	closed bool
+	// next picks the member of a queue group that receives the next message, round robin.
+	next int
+}
+
+// client is a connection to the server.
+type client struct {
+	nc   net.Conn
+	wmu  sync.Mutex
+	w    *bufio.Writer
+	subs map[string]sub
+}
+
+type sub struct {
+	subject string
+	queue   string
+}
+
+// NewServer starts a server, Close it when done.
+func NewServer() (*Server, error) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+
+	s := &Server{
+		ln:    ln,
+		conns: make(map[*client]struct{}),
+	}
+
+	s.wg.Add(1)
+	go s.serve()
+
+	return s, nil
+}
+
+// Addr returns the address the server listens on.
+func (s *Server) Addr() string {
+	return s.ln.Addr().String()
+}
+
+// Close stops the server and closes every connection.
+func (s *Server) Close() error {
+	err := s.ln.Close()
+	s.Disconnect()
+
+	s.mu.Lock()
+	s.closed = true
+	s.mu.Unlock()
+
+	s.wg.Wait()
+	return err
+}
+
+// Disconnect closes every connection, like a server restart would, but keeps accepting new ones.
+func (s *Server) Disconnect() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for c := range s.conns {
+		c.nc.Close()
+	}
+}
+
+func (s *Server) serve() {
+	defer s.wg.Done()
+	for {
+		nc, err := s.ln.Accept()
+		if err != nil {
+			return
+		}
+
+		c := &client{nc: nc, w: bufio.NewWriter(nc), subs: make(map[string]sub)}
+		s.mu.Lock()
+		if s.closed {
+			s.mu.Unlock()
+			nc.Close()
+			return
+		}
+		s.conns[c] = struct{}{}
+		s.mu.Unlock()
+
+		s.wg.Add(1)
+		go s.handle(c)
+	}
+}
+
+func (s *Server) handle(c *client) {
+	defer s.wg.Done()
+	defer func() {
+		s.mu.Lock()
+		delete(s.conns, c)
+		s.mu.Unlock()
+		c.nc.Close()
+	}()
+
+	c.send(`INFO {"server_id":"natstest","version":"2.9.0","proto":1,"max_payload":1048576}` + "\r\n")
+
+	r := bufio.NewReader(c.nc)
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		op, args, _ := strings.Cut(strings.TrimRight(line, "\r\n"), " ")
+		fields := strings.Fields(args)
+
+		switch strings.ToUpper(op) {
+		case "CONNECT":
+		case "PING":
+			c.send("PONG\r\n")
+		case "PONG":
+		case "SUB":
+			if len(fields) != 2 && len(fields) != 3 {
+				c.send("-ERR 'Unknown Protocol Operation'\r\n")
+				return
+			}
+			sb := sub{subject: fields[0]}
+			if len(fields) == 3 {
+				sb.queue = fields[1]
+			}
+			s.mu.Lock()
+			c.subs[fields[len(fields)-1]] = sb
+			s.mu.Unlock()
+		case "UNSUB":
+			if len(fields) < 1 {
+				c.send("-ERR 'Unknown Protocol Operation'\r\n")
+				return
+			}
+			s.mu.Lock()
+			delete(c.subs, fields[0])
+			s.mu.Unlock()
+		case "PUB":
+			if len(fields) != 2 && len(fields) != 3 {
+				c.send("-ERR 'Unknown Protocol Operation'\r\n")
+				return
+			}
+			size, err := strconv.Atoi(fields[len(fields)-1])
+			if err != nil || size < 0 {
+				c.send("-ERR 'Unknown Protocol Operation'\r\n")
+				return
+			}
+			payload := make([]byte, size+2)
+			if _, err := io.ReadFull(r, payload); err != nil {
+				return
+			}
+			reply := ""
+			if len(fields) == 3 {
+				reply = fields[1]
+			}
+			s.route(fields[0], reply, payload[:size])
+		default:
+			c.send("-ERR 'Unknown Protocol Operation'\r\n")
+			return
+		}
+	}
+}
+
+// target is a subscription a message is delivered to.
+type target struct {
+	c   *client
+	sid string
+}
+
+// route delivers the message to every matching subscription without a queue group, and to one member of every queue
+// group.
+func (s *Server) route(subject, reply string, data []byte) {
+	s.mu.Lock()
+	var targets []target
+	groups := make(map[string][]target)
+	for c := range s.conns {
+		for sid, sb := range c.subs {
+			if !Match(sb.subject, subject) {
+				continue
+			}
+			if sb.queue == "" {
+				targets = append(targets, target{c, sid})
+				continue
+			}
+			groups[sb.queue] = append(groups[sb.queue], target{c, sid})
+		}
+	}
+	for _, members := range groups {
+		targets = append(targets, members[s.next%len(members)])
+	}
+	s.next++
+	s.mu.Unlock()
+
+	for _, t := range targets {
+		header := fmt.Sprintf("MSG %s %s %d\r\n", subject, t.sid, len(data))
+		if reply != "" {
+			header = fmt.Sprintf("MSG %s %s %s %d\r\n", subject, t.sid, reply, len(data))
+		}
+		t.c.send(header + string(data) + "\r\n")
+	}
+}
+
+func (c *client) send(s string) {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	c.w.WriteString(s)
+	c.w.Flush()
+}
+
+// Match reports whether the subject matches the pattern of a subscription, where * matches a single token and >
+// every token left.
+func Match(pattern, subject string) bool {
+	pt := strings.Split(pattern, ".")
+	st := strings.Split(subject, ".")
+	for i, p := range pt {
+		if p == ">" {
+			return len(st) > i
+		}
+		if i >= len(st) || (p != "*" && p != st[i]) {
+			return false
+		}
+	}
+	return len(pt) == len(st)
+}
@@ -0,0 +1,397 @@
+// Package redis provides a minimal client for the RESP2 protocol spoken by redis.
+package redis
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"time"
+)
+
+// Config is the required properties to use the redis server.
+type Config struct {
+	Addr        string
+	Password    string
+	DB          int
+	PoolSize    int
+	DialTimeout time.Duration
+	// IOTimeout bounds every round trip, including a whole pipeline.
+	IOTimeout time.Duration
+}
+
+// ErrClosed is returned when using a closed client.
+var ErrClosed = errors.New("redis: client closed")
+
+// Error is an error reply of the server.
+type Error string
+
+func (e Error) Error() string {
+	return "redis: " + string(e)
+}
+
+// The types of the values in a reply.
+const (
+	TypeSimple  = '+'
+	TypeError   = '-'
+	TypeInteger = ':'
+	TypeBulk    = '$'
+	TypeArray   = '*'
+)
+
+// Value is a single reply of the server.
+type Value struct {
+	Type  byte
+	Str   string
+	Int   int64
+	Array []Value
+	// Null is set for the null bulk string and the null array.
+	Null bool
+}
+
+// Err returns the error reply as an Error, or nil for any other reply.
+func (v Value) Err() error {
+	if v.Type == TypeError {
+		return Error(v.Str)
+	}
+	return nil
+}
+
+// StringMap returns a reply of alternating keys and values, like the one of HGETALL, as a map.
+func (v Value) StringMap() map[string]string {
+	m := make(map[string]string, len(v.Array)/2)
+	for i := 0; i+1 < len(v.Array); i += 2 {
+		m[v.Array[i].Str] = v.Array[i+1].Str
+	}
+	return m
+}
+
+// Strings returns an array reply as the strings in it.
+func (v Value) Strings() []string {
+	s := make([]string, len(v.Array))
+	for i, el := range v.Array {
+		s[i] = el.Str
+	}
+	return s
+}
+
+// Client is a pool of connections to a redis server. It is safe for concurrent use.
+type Client struct {
+	cfg  Config
+	pool chan *conn
+	quit chan struct{}
+}
+
+// Open returns a Client for the server and checks that it can be reached.
+func Open(cfg Config) (*Client, error) {
+	if cfg.PoolSize <= 0 {
+		cfg.PoolSize = 10
+	}
+	if cfg.DialTimeout <= 0 {
+		cfg.DialTimeout = 5 * time.Second
+	}
+	if cfg.IOTimeout <= 0 {
+		cfg.IOTimeout = 5 * time.Second
+	}
+
+	c := &Client{
+		cfg:  cfg,
+		pool: make(chan *conn, cfg.PoolSize),
+		quit: make(chan struct{}),
+	}
+
+	if _, err := c.Do("PING"); err != nil {
+		return nil, fmt.Errorf("redis: ping: %w", err)
+	}
+
+	return c, nil
+}
+
+// Do sends a single command and returns its reply, an error reply is returned as an Error.
+func (c *Client) Do(args ...string) (Value, error) {
+	values, err := c.roundTrip([][]string{args})
+	if err != nil {
+		return Value{}, err
+	}
+	return values[0], values[0].Err()
+}
+
+// Pipeline sends every command before reading any reply, saving a round trip per command. It returns every reply,
+// and the first error reply as an Error.
+func (c *Client) Pipeline(cmds ...[]string) ([]Value, error) {
+	values, err := c.roundTrip(cmds)
+	if err != nil {
+		return nil, err
+	}
+	for _, v := range values {
+		if err := v.Err(); err != nil {
+			return values, err
+		}
+	}
+	return values, nil
+}
+
+// Tx runs the commands in a MULTI/EXEC transaction in a single round trip, either every command is run or none is.
+// It returns the replies of the commands.
+func (c *Client) Tx(cmds ...[]string) ([]Value, error) {
+	wrapped := make([][]string, 0, len(cmds)+2)
+	wrapped = append(wrapped, []string{"MULTI"})
+	wrapped = append(wrapped, cmds...)
+	wrapped = append(wrapped, []string{"EXEC"})
+
+	values, err := c.roundTrip(wrapped)
+	if err != nil {
+		return nil, err
+	}
+
+	// a command the server refused to queue aborts the whole transaction
+	for _, v := range values[:len(values)-1] {
+		if err := v.Err(); err != nil {
+			return nil, err
+		}
+	}
+
+	exec := values[len(values)-1]
+	if err := exec.Err(); err != nil {
+		return nil, err
+	}
+	if exec.Null {
+		return nil, Error("transaction aborted")
+	}
+	for _, v := range exec.Array {
+		if err := v.Err(); err != nil {
+			return exec.Array, err
+		}
+	}
+
+	return exec.Array, nil
+}
+
+func (c *Client) roundTrip(cmds [][]string) ([]Value, error) {
+	cn, err := c.get()
+	if err != nil {
+		return nil, err
+	}
+
+	values, err := cn.roundTrip(cmds, c.cfg.IOTimeout)
+	if err != nil {
+		// the connection is out of sync with the server after a failed read or write
+		cn.Close()
+		return nil, err
+	}
+
+	c.put(cn)
+	return values, nil
+}
+
+func (c *Client) get() (*conn, error) {
+	select {
+	case <-c.quit:
+		return nil, ErrClosed
+	case cn := <-c.pool:
+		return cn, nil
+	default:
+		return c.dial()
+	}
+}
+
+func (c *Client) put(cn *conn) {
+	select {
+	case <-c.quit:
+		cn.Close()
+	case c.pool <- cn:
+	default:
+		cn.Close()
+	}
+}
+
+func (c *Client) dial() (*conn, error) {
+	nc, err := net.DialTimeout("tcp", c.cfg.Addr, c.cfg.DialTimeout)
+	if err != nil {
+		return nil, fmt.Errorf("redis: dial: %w", err)
+	}
+	cn := &conn{Conn: nc, r: bufio.NewReader(nc), w: bufio.NewWriter(nc)}
+
+	var setup [][]string
+	if c.cfg.Password != "" {
+		setup = append(setup, []string{"AUTH", c.cfg.Password})
+	}
+	if c.cfg.DB != 0 {
+		setup = append(setup, []string{"SELECT", strconv.Itoa(c.cfg.DB)})
+	}
+	if len(setup) > 0 {
+		values, err := cn.roundTrip(setup, c.cfg.IOTimeout)
+		if err == nil {
+			for _, v := range values {
+				if err = v.Err(); err != nil {
+					break
+				}
+			}
+		}
+		if err != nil {
+			cn.Close()
+			return nil, fmt.Errorf("redis: connection setup: %w", err)
+		}
+	}
+
+	return cn, nil
+}
+
+// Close closes the idle connections, connections in use are closed as they are returned.
+func (c *Client) Close() error {
+	close(c.quit)
+	for {
+		select {
+		case cn := <-c.pool:
+			cn.Close()
+		default:
+			return nil
+		}
+	}
+}
+
+type conn struct {
+	net.Conn
+	r *bufio.Reader
+	w *bufio.Writer
+}
+
+func (cn *conn) roundTrip(cmds [][]string, timeout time.Duration) ([]Value, error) {
+	if err := cn.SetDeadline(time.Now().Add(timeout)); err != nil {
+		return nil, err
+	}
+
+	for _, args := range cmds {
+		if err := WriteCommand(cn.w, args); err != nil {
+			return nil, fmt.Errorf("redis: write: %w", err)
+		}
+	}
+	if err := cn.w.Flush(); err != nil {
+		return nil, fmt.Errorf("redis: write: %w", err)
+	}
+
+	values := make([]Value, len(cmds))
+	for i := range values {
+		v, err := ReadValue(cn.r)
+		if err != nil {
+			return nil, fmt.Errorf("redis: read: %w", err)
+		}
+		values[i] = v
+	}
+
+	return values, nil
+}
+
+// WriteCommand writes the command as an array of bulk strings.
+func WriteCommand(w *bufio.Writer, args []string) error {
+	w.WriteString("*" + strconv.Itoa(len(args)) + "\r\n")
+	for _, arg := range args {
+		w.WriteString("$" + strconv.Itoa(len(arg)) + "\r\n")
+		w.WriteString(arg)
+		if _, err := w.WriteString("\r\n"); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// WriteValue writes the value in its wire format.
+func WriteValue(w *bufio.Writer, v Value) error {
+	switch v.Type {
+	case TypeSimple, TypeError:
+		w.WriteByte(v.Type)
+		w.WriteString(v.Str)
+	case TypeInteger:
+		w.WriteString(":" + strconv.FormatInt(v.Int, 10))
+	case TypeBulk:
+		if v.Null {
+			w.WriteString("$-1")
+			break
+		}
+		w.WriteString("$" + strconv.Itoa(len(v.Str)) + "\r\n")
+		w.WriteString(v.Str)
+	case TypeArray:
+		if v.Null {
+			w.WriteString("*-1")
+			break
+		}
+		w.WriteString("*" + strconv.Itoa(len(v.Array)) + "\r\n")
+		for _, el := range v.Array {
+			if err := WriteValue(w, el); err != nil {
+				return err
+			}
+		}
+		return nil
+	default:
+		return fmt.Errorf("unknown type %q", v.Type)
+	}
+	_, err := w.WriteString("\r\n")
+	return err
+}
+
+// ReadValue reads the next value from the reader.
+func ReadValue(r *bufio.Reader) (Value, error) {
+	line, err := readLine(r)
+	if err != nil {
+		return Value{}, err
+	}
+	if len(line) == 0 {
+		return Value{}, errors.New("empty line")
+	}
+
+	v := Value{Type: line[0]}
+	switch v.Type {
+	case TypeSimple, TypeError:
+		v.Str = line[1:]
+	case TypeInteger:
+		if v.Int, err = strconv.ParseInt(line[1:], 10, 64); err != nil {
+			return Value{}, fmt.Errorf("invalid integer: %w", err)
+		}
+	case TypeBulk:
+		n, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return Value{}, fmt.Errorf("invalid bulk length: %w", err)
+		}
+		if n < 0 {
+			v.Null = true
+			break
+		}
+		buf := make([]byte, n+2)
+		if _, err := io.ReadFull(r, buf); err != nil {
+			return Value{}, err
+		}
+		v.Str = string(buf[:n])
+	case TypeArray:
+		n, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return Value{}, fmt.Errorf("invalid array length: %w", err)
+		}
+		if n < 0 {
+			v.Null = true
+			break
+		}
+		v.Array = make([]Value, n)
+		for i := range v.Array {
+			if v.Array[i], err = ReadValue(r); err != nil {
+				return Value{}, err
+			}
+		}
+	default:
+		return Value{}, fmt.Errorf("unknown type %q", v.Type)
+	}
+
+	return v, nil
+}
+
+func readLine(r *bufio.Reader) (string, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	if len(line) < 2 || line[len(line)-2] != '\r' {
+		return "", errors.New("line not terminated by CRLF")
+	}
+	return line[:len(line)-2], nil
+}
@@ -0,0 +1,379 @@
+// Package redistest provides an in-process server speaking enough of the redis protocol to test against.
+package redistest
+
+import (
+	"bufio"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/penthious/catchall/foundation/redis"
+)
+
+// Server is an in-memory redis server listening on a random local port. It supports the string, hash and set
+// commands the adapters use, along with MULTI/EXEC transactions.
+type Server struct {
+	ln net.Listener
+	wg sync.WaitGroup
+
+	mu      sync.Mutex
+	strings map[string]string
+	hashes  map[string]map[string]string
+	sets    map[string]map[string]struct{}
+	conns   map[net.Conn]struct{}
+	closed  bool
+}
+
+// NewServer starts a server, Close it when done.
+func NewServer() (*Server, error) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+
+	s := &Server{
+		ln:      ln,
+		strings: make(map[string]string),
+		hashes:  make(map[string]map[string]string),
+		sets:    make(map[string]map[string]struct{}),
+		conns:   make(map[net.Conn]struct{}),
+	}
+
+	s.wg.Add(1)
+	go s.serve()
+
+	return s, nil
+}
+
+// Addr returns the address the server listens on.
+func (s *Server) Addr() string {
+	return s.ln.Addr().String()
+}
+
+// Close stops the server and closes every connection.
+func (s *Server) Close() error {
+	err := s.ln.Close()
+
+	s.mu.Lock()
+	s.closed = true
+	for c := range s.conns {
+		c.Close()
+	}
+	s.mu.Unlock()
+
+	s.wg.Wait()
+	return err
+}
+
+func (s *Server) serve() {
+	defer s.wg.Done()
+	for {
+		c, err := s.ln.Accept()
+		if err != nil {
+			return
+		}
+
+		s.mu.Lock()
+		if s.closed {
+			s.mu.Unlock()
+			c.Close()
+			return
+		}
+		s.conns[c] = struct{}{}
+		s.mu.Unlock()
+
+		s.wg.Add(1)
+		go s.handle(c)
+	}
+}
+
+func (s *Server) handle(c net.Conn) {
+	defer s.wg.Done()
+	defer func() {
+		s.mu.Lock()
+		delete(s.conns, c)
+		s.mu.Unlock()
+		c.Close()
+	}()
+
+	r := bufio.NewReader(c)
+	w := bufio.NewWriter(c)
+
+	// queued holds the commands of an open transaction, it is nil outside of one.
+	var queued [][]string
+	for {
+		v, err := redis.ReadValue(r)
+		if err != nil {
+			return
+		}
+		if v.Type != redis.TypeArray || len(v.Array) == 0 {
+			writeValue(w, errorValue("ERR protocol error"))
+			continue
+		}
+		args := v.Strings()
+		name := strings.ToUpper(args[0])
+
+		var reply redis.Value
+		switch {
+		case name == "MULTI":
+			if queued != nil {
+				reply = errorValue("ERR MULTI calls can not be nested")
+				break
+			}
+			queued = [][]string{}
+			reply = simple("OK")
+		case name == "EXEC":
+			if queued == nil {
+				reply = errorValue("ERR EXEC without MULTI")
+				break
+			}
+			reply = s.exec(queued)
+			queued = nil
+		case name == "DISCARD":
+			queued = nil
+			reply = simple("OK")
+		case queued != nil:
+			queued = append(queued, args)
+			reply = simple("QUEUED")
+		default:
+			reply = s.exec([][]string{args}).Array[0]
+		}
+
+		writeValue(w, reply)
+		if r.Buffered() == 0 {
+			if err := w.Flush(); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// writeValue buffers the reply, a failed write surfaces on the next flush.
+func writeValue(w *bufio.Writer, v redis.Value) {
+	_ = redis.WriteValue(w, v)
+}
+
+// exec runs the commands under the lock, so a transaction is never interleaved with another command.
+func (s *Server) exec(cmds [][]string) redis.Value {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	replies := make([]redis.Value, len(cmds))
+	for i, args := range cmds {
+		replies[i] = s.run(strings.ToUpper(args[0]), args[1:])
+	}
+	return redis.Value{Type: redis.TypeArray, Array: replies}
+}
+
+func (s *Server) run(name string, args []string) redis.Value {
+	switch name {
+	case "PING":
+		return simple("PONG")
+	case "AUTH", "SELECT":
+		return simple("OK")
+	case "FLUSHALL", "FLUSHDB":
+		s.strings = make(map[string]string)
+		s.hashes = make(map[string]map[string]string)
+		s.sets = make(map[string]map[string]struct{})
+		return simple("OK")
+	}
+
+	if len(args) == 0 {
+		return wrongArgs(name)
+	}
+	key := args[0]
+
+	switch name {
+	case "GET":
+		v, ok := s.strings[key]
+		if !ok {
+			return redis.Value{Type: redis.TypeBulk, Null: true}
+		}
+		return bulk(v)
+	case "SET":
+		if len(args) != 2 {
+			return wrongArgs(name)
+		}
+		s.strings[key] = args[1]
+		return simple("OK")
+	case "INCR", "INCRBY":
+		by := int64(1)
+		if name == "INCRBY" {
+			if len(args) != 2 {
+				return wrongArgs(name)
+			}
+			var err error
+			if by, err = strconv.ParseInt(args[1], 10, 64); err != nil {
+				return errorValue("ERR value is not an integer or out of range")
+			}
+		}
+		n, _ := strconv.ParseInt(s.strings[key], 10, 64)
+		n += by
+		s.strings[key] = strconv.FormatInt(n, 10)
+		return integer(n)
+	case "EXISTS":
+		var n int64
+		for _, k := range args {
+			if s.exists(k) {
+				n++
+			}
+		}
+		return integer(n)
+	case "DEL":
+		var n int64
+		for _, k := range args {
+			if s.exists(k) {
+				n++
+			}
+			delete(s.strings, k)
+			delete(s.hashes, k)
+			delete(s.sets, k)
+		}
+		return integer(n)
+	case "HSET":
+		if len(args) < 3 || len(args)%2 != 1 {
+			return wrongArgs(name)
+		}
+		h := s.hash(key)
+		var added int64
+		for i := 1; i < len(args); i += 2 {
+			if _, ok := h[args[i]]; !ok {
+				added++
+			}
+			h[args[i]] = args[i+1]
+		}
+		return integer(added)
+	case "HSETNX":
+		if len(args) != 3 {
+			return wrongArgs(name)
+		}
+		h := s.hash(key)
+		if _, ok := h[args[1]]; ok {
+			return integer(0)
+		}
+		h[args[1]] = args[2]
+		return integer(1)
+	case "HINCRBY":
+		if len(args) != 3 {
+			return wrongArgs(name)
+		}
+		by, err := strconv.ParseInt(args[2], 10, 64)
+		if err != nil {
+			return errorValue("ERR value is not an integer or out of range")
+		}
+		h := s.hash(key)
+		n, _ := strconv.ParseInt(h[args[1]], 10, 64)
+		n += by
+		h[args[1]] = strconv.FormatInt(n, 10)
+		return integer(n)
+	case "HGETALL":
+		h := s.hashes[key]
+		fields := make([]string, 0, len(h))
+		for f := range h {
+			fields = append(fields, f)
+		}
+		sort.Strings(fields)
+		reply := redis.Value{Type: redis.TypeArray, Array: make([]redis.Value, 0, len(h)*2)}
+		for _, f := range fields {
+			reply.Array = append(reply.Array, bulk(f), bulk(h[f]))
+		}
+		return reply
+	case "HEXISTS":
+		if len(args) != 2 {
+			return wrongArgs(name)
+		}
+		if _, ok := s.hashes[key][args[1]]; ok {
+			return integer(1)
+		}
+		return integer(0)
+	case "HDEL":
+		var n int64
+		for _, f := range args[1:] {
+			if _, ok := s.hashes[key][f]; ok {
+				delete(s.hashes[key], f)
+				n++
+			}
+		}
+		if len(s.hashes[key]) == 0 {
+			delete(s.hashes, key)
+		}
+		return integer(n)
+	case "SADD":
+		set, ok := s.sets[key]
+		if !ok {
+			set = make(map[string]struct{})
+			s.sets[key] = set
+		}
+		var n int64
+		for _, m := range args[1:] {
+			if _, ok := set[m]; !ok {
+				set[m] = struct{}{}
+				n++
+			}
+		}
+		return integer(n)
+	case "SREM":
+		var n int64
+		for _, m := range args[1:] {
+			if _, ok := s.sets[key][m]; ok {
+				delete(s.sets[key], m)
+				n++
+			}
+		}
+		if len(s.sets[key]) == 0 {
+			delete(s.sets, key)
+		}
+		return integer(n)
+	case "SMEMBERS":
+		members := make([]string, 0, len(s.sets[key]))
+		for m := range s.sets[key] {
+			members = append(members, m)
+		}
+		sort.Strings(members)
+		reply := redis.Value{Type: redis.TypeArray, Array: make([]redis.Value, len(members))}
+		for i, m := range members {
+			reply.Array[i] = bulk(m)
+		}
+		return reply
+	}
+
+	return errorValue("ERR unknown command '" + name + "'")
+}
+
+func (s *Server) exists(key string) bool {
+	_, str := s.strings[key]
+	_, hash := s.hashes[key]
+	_, set := s.sets[key]
+	return str || hash || set
+}
+
+func (s *Server) hash(key string) map[string]string {
+	h, ok := s.hashes[key]
+	if !ok {
+		h = make(map[string]string)
+		s.hashes[key] = h
+	}
+	return h
+}
+
+func simple(s string) redis.Value {
+	return redis.Value{Type: redis.TypeSimple, Str: s}
+}
+
+func bulk(s string) redis.Value {
+	return redis.Value{Type: redis.TypeBulk, Str: s}
+}
+
+func integer(n int64) redis.Value {
+	return redis.Value{Type: redis.TypeInteger, Int: n}
+}
+
+func errorValue(msg string) redis.Value {
+	return redis.Value{Type: redis.TypeError, Str: msg}
+}
+
+func wrongArgs(name string) redis.Value {
+	return errorValue("ERR wrong number of arguments for '" + strings.ToLower(name) + "' command")
+}
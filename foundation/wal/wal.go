@@ -0,0 +1,196 @@
+// Package wal provides an append only log of checksummed records.
+package wal
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"sync"
+)
+
+// headerSize is the size of the header in front of every record, the length of the payload followed by its CRC.
+const headerSize = 8
+
+// MaxRecordSize caps the size of a single record, anything claiming to be larger is treated as corruption.
+const MaxRecordSize = 16 << 20
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+// SyncPolicy decides when appended records are fsynced to disk.
+type SyncPolicy int
+
+// The set of sync policies.
+const (
+	// SyncAlways fsyncs after every append, nothing acknowledged is ever lost.
+	SyncAlways SyncPolicy = iota
+	// SyncInterval leaves it to the owner to call Sync periodically, at most that period of records is lost on a
+	// crash of the machine.
+	SyncInterval
+	// SyncNever leaves flushing to the OS, a crash of the process loses nothing but a crash of the machine might.
+	SyncNever
+)
+
+// ErrClosed is returned when appending to a closed log.
+var ErrClosed = errors.New("wal closed")
+
+// Log is an append only file of records. Every record is framed with its length and a CRC32C of its payload, so a
+// record that was only partly written before a crash is detected on replay.
+type Log struct {
+	mu     sync.Mutex
+	f      *os.File
+	policy SyncPolicy
+	dirty  bool
+}
+
+// Open opens or creates the log at path. Call Replay before appending to an existing log, it also positions the log
+// after the last good record.
+func Open(path string, policy SyncPolicy) (*Log, error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0o640)
+	if err != nil {
+		return nil, fmt.Errorf("error opening wal: %w", err)
+	}
+
+	if _, err := f.Seek(0, io.SeekEnd); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("error seeking wal: %w", err)
+	}
+
+	return &Log{f: f, policy: policy}, nil
+}
+
+// Replay calls fn with the payload of every record from the start of the log. A torn or corrupt record ends the
+// log, it and everything after it is truncated so new records are appended after the last good one. It returns
+// the number of bytes that were truncated.
+func (l *Log) Replay(fn func(payload []byte) error) (int64, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if _, err := l.f.Seek(0, io.SeekStart); err != nil {
+		return 0, fmt.Errorf("error seeking wal: %w", err)
+	}
+
+	var offset int64
+	header := make([]byte, headerSize)
+	for {
+		payload, err := readRecord(l.f, header)
+		if err != nil {
+			break
+		}
+		if err := fn(payload); err != nil {
+			return 0, err
+		}
+		offset += headerSize + int64(len(payload))
+	}
+
+	end, err := l.f.Seek(0, io.SeekEnd)
+	if err != nil {
+		return 0, fmt.Errorf("error seeking wal: %w", err)
+	}
+	if end > offset {
+		if err := l.f.Truncate(offset); err != nil {
+			return 0, fmt.Errorf("error truncating wal: %w", err)
+		}
+		if err := l.f.Sync(); err != nil {
+			return 0, fmt.Errorf("error syncing wal: %w", err)
+		}
+	}
+	if _, err := l.f.Seek(offset, io.SeekStart); err != nil {
+		return 0, fmt.Errorf("error seeking wal: %w", err)
+	}
+
+	return end - offset, nil
+}
+
+// readRecord reads the next record, any error means there is no complete and valid record left.
+func readRecord(r io.Reader, header []byte) ([]byte, error) {
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, err
+	}
+
+	size := binary.LittleEndian.Uint32(header[0:4])
+	sum := binary.LittleEndian.Uint32(header[4:8])
+	if size > MaxRecordSize {
+		return nil, errors.New("record too large")
+	}
+
+	payload := make([]byte, size)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return nil, err
+	}
+
+	if crc32.Checksum(payload, crcTable) != sum {
+		return nil, errors.New("checksum mismatch")
+	}
+
+	return payload, nil
+}
+
+// Append writes the record in a single write, and fsyncs it when the policy is SyncAlways.
+func (l *Log) Append(payload []byte) error {
+	if len(payload) > MaxRecordSize {
+		return fmt.Errorf("record of %d bytes is too large", len(payload))
+	}
+
+	buf := make([]byte, headerSize+len(payload))
+	binary.LittleEndian.PutUint32(buf[0:4], uint32(len(payload)))
+	binary.LittleEndian.PutUint32(buf[4:8], crc32.Checksum(payload, crcTable))
+	copy(buf[headerSize:], payload)
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.f == nil {
+		return ErrClosed
+	}
+
+	if _, err := l.f.Write(buf); err != nil {
+		return fmt.Errorf("error writing wal: %w", err)
+	}
+
+	if l.policy == SyncAlways {
+		if err := l.f.Sync(); err != nil {
+			return fmt.Errorf("error syncing wal: %w", err)
+		}
+		return nil
+	}
+	l.dirty = true
+
+	return nil
+}
+
+// Sync fsyncs the records appended since the last sync.
+func (l *Log) Sync() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.sync()
+}
+
+func (l *Log) sync() error {
+	if l.f == nil || !l.dirty {
+		return nil
+	}
+	if err := l.f.Sync(); err != nil {
+		return fmt.Errorf("error syncing wal: %w", err)
+	}
+	l.dirty = false
+	return nil
+}
+
+// Close syncs and closes the log.
+func (l *Log) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.f == nil {
+		return nil
+	}
+	err := l.sync()
+	if cerr := l.f.Close(); err == nil {
+		err = cerr
+	}
+	l.f = nil
+	return err
+}
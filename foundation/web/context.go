@@ -12,12 +12,21 @@ import (
 
 const ctxKey = "1"
 
+// Anonymous is the actor of requests that were not authenticated.
+const Anonymous = "anonymous"
+
 // Values represent state for each request.
 type Values struct {
 	TraceID    uuid.UUID
 	Log        *zerolog.Logger
 	Now        time.Time
 	StatusCode int
+	Actor      string
+}
+
+// SetValues sets the values of the request into the context.
+func SetValues(ctx echo.Context, v *Values) {
+	ctx.Set(ctxKey, v)
 }
 
 // GetValues returns the values from the context.
@@ -47,6 +56,25 @@ func GetTraceID(ctx echo.Context) uuid.UUID {
 	return v.TraceID
 }
 
+// GetActor returns the identity of the caller from the context.
+func GetActor(ctx echo.Context) string {
+	v, ok := ctx.Get(ctxKey).(*Values)
+	if !ok || v.Actor == "" {
+		return Anonymous
+	}
+	return v.Actor
+}
+
+// SetActor sets the identity of the caller back into the context.
+func SetActor(ctx echo.Context, actor string) error {
+	v, ok := ctx.Get(ctxKey).(*Values)
+	if !ok {
+		return errors.New("web actor value missing from context")
+	}
+	v.Actor = actor
+	return nil
+}
+
 func GetLogger(ctx echo.Context) (*zerolog.Logger, error) {
 	v, ok := ctx.Get(ctxKey).(*Values)
 	if !ok {
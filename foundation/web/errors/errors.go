@@ -1,7 +1,9 @@
 package errors
 
 import (
+	"database/sql"
 	"errors"
+	"time"
 )
 
 // ErrorResponse is the form used for API responses from failures in the API.
@@ -44,13 +46,31 @@ func GetRequestError(err error) *RequestError {
 	return re
 }
 
-// IsNoRowsError checks if the error passed in as a sql no row's error.
+// IsNoRowsError checks if sql.ErrNoRows is anywhere in the chain of the error.
 func IsNoRowsError(err error) bool {
-	if err == nil {
-		return false
+	return errors.Is(err, sql.ErrNoRows)
+}
+
+// Unavailable is implemented by the errors of a dependency that is down for a while, they are answered with a 503 and
+// a Retry-After header.
+type Unavailable interface {
+	error
+	RetryAfter() time.Duration
+}
+
+// IsUnavailable checks if an Unavailable error exists.
+func IsUnavailable(err error) bool {
+	var u Unavailable
+	return errors.As(err, &u)
+}
+
+// GetUnavailable returns the Unavailable error in the chain of the error.
+func GetUnavailable(err error) Unavailable {
+	var u Unavailable
+	if !errors.As(err, &u) {
+		return nil
 	}
-	err = errors.Unwrap(err)
-	return err.Error() == "sql: no rows in result set"
+	return u
 }
 
 // shutdownError is a type used to help with the graceful termination of the service.
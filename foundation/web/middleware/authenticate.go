@@ -0,0 +1,88 @@
+package middleware
+
+import (
+	"crypto/subtle"
+	"crypto/tls"
+	"errors"
+	"net/http"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+	"github.com/penthious/catchall/foundation/web"
+	webErr "github.com/penthious/catchall/foundation/web/errors"
+)
+
+// Authenticate identifies the caller and stores it as the actor of the request. A client certificate that was verified
+// during the TLS handshake is mapped from its subject's common name through certs, otherwise the API key of the request
+// is mapped to its key ID through keys. The key is read from the X-API-Key header or a bearer token. When neither keys
+// nor certs are configured every request is let through as anonymous, and the routes guarded by RequireActor refuse
+// them.
+func Authenticate(keys map[string]string, certs map[string]string) echo.MiddlewareFunc {
+	m := func(handler echo.HandlerFunc) echo.HandlerFunc {
+		h := func(ctx echo.Context) error {
+			if len(keys) == 0 && len(certs) == 0 {
+				return handler(ctx)
+			}
+
+			id, ok := lookupCert(certs, ctx.Request().TLS)
+			if !ok {
+				key := ctx.Request().Header.Get("X-API-Key")
+				if key == "" {
+					key = strings.TrimPrefix(ctx.Request().Header.Get(echo.HeaderAuthorization), "Bearer ")
+				}
+				id, ok = lookupKey(keys, key)
+			}
+			if !ok {
+				return webErr.NewRequestError(errors.New(http.StatusText(http.StatusUnauthorized)), http.StatusUnauthorized)
+			}
+
+			if err := web.SetActor(ctx, id); err != nil {
+				return webErr.NewShutdownError("web value missing from context")
+			}
+
+			return handler(ctx)
+		}
+		return h
+	}
+	return m
+}
+
+// lookupCert returns the identity of the subject of the verified client certificate of the connection. Certificates
+// that weren't verified against the client CAs are ignored.
+func lookupCert(certs map[string]string, state *tls.ConnectionState) (string, bool) {
+	if state == nil || len(state.VerifiedChains) == 0 || len(state.VerifiedChains[0]) == 0 {
+		return "", false
+	}
+	id, ok := certs[state.VerifiedChains[0][0].Subject.CommonName]
+	return id, ok
+}
+
+// lookupKey compares the key against every configured key in constant time, so the time taken doesn't leak how
+// much of a key was right.
+func lookupKey(keys map[string]string, key string) (string, bool) {
+	var id string
+	found := 0
+	for k, v := range keys {
+		if subtle.ConstantTimeCompare([]byte(k), []byte(key)) == 1 {
+			id = v
+			found = 1
+		}
+	}
+	return id, found == 1 && key != ""
+}
+
+// RequireActor refuses the requests of anonymous callers with a 403. Authenticate already refuses unauthenticated
+// requests when credentials are configured, so this guards the admin routes of a server that has none.
+func RequireActor() echo.MiddlewareFunc {
+	m := func(handler echo.HandlerFunc) echo.HandlerFunc {
+		h := func(ctx echo.Context) error {
+			if web.GetActor(ctx) == web.Anonymous {
+				err := errors.New("no credentials are configured, admin operations are disabled")
+				return webErr.NewRequestError(err, http.StatusForbidden)
+			}
+			return handler(ctx)
+		}
+		return h
+	}
+	return m
+}
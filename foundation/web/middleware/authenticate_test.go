@@ -0,0 +1,168 @@
+package middleware
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"io"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/penthious/catchall/foundation/web"
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+)
+
+// newApp returns an app authenticating with the keys and certs, whose /admin route requires an actor and /public
+// route doesn't. Both answer with the actor of the request.
+func newApp(keys, certs map[string]string) *web.App {
+	log := zerolog.Nop()
+	app := web.NewApp("test", make(chan os.Signal, 1), &log, Errors(), Authenticate(keys, certs))
+
+	actor := func(ctx echo.Context) error {
+		return ctx.String(http.StatusOK, web.GetActor(ctx))
+	}
+	app.Handle(http.MethodGet, "", "/public", actor)
+	app.Handle(http.MethodDelete, "", "/admin", actor, RequireActor())
+	return app
+}
+
+func serve(app http.Handler, method, path, key string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, path, nil)
+	if key != "" {
+		req.Header.Set("X-API-Key", key)
+	}
+	rec := httptest.NewRecorder()
+	app.ServeHTTP(rec, req)
+	return rec
+}
+
+func TestRequireActor(t *testing.T) {
+	t.Run("without credentials the admin routes are refused", func(t *testing.T) {
+		app := newApp(nil, nil)
+
+		rec := serve(app, http.MethodGet, "/public", "")
+		assert.Equal(t, http.StatusOK, rec.Code)
+		assert.Equal(t, web.Anonymous, rec.Body.String())
+
+		rec = serve(app, http.MethodDelete, "/admin", "")
+		assert.Equal(t, http.StatusForbidden, rec.Code)
+	})
+
+	t.Run("with credentials the admin routes take a key", func(t *testing.T) {
+		app := newApp(map[string]string{"secret": "ops"}, nil)
+
+		assert.Equal(t, http.StatusUnauthorized, serve(app, http.MethodDelete, "/admin", "").Code)
+		assert.Equal(t, http.StatusUnauthorized, serve(app, http.MethodDelete, "/admin", "wrong").Code)
+
+		rec := serve(app, http.MethodDelete, "/admin", "secret")
+		assert.Equal(t, http.StatusOK, rec.Code)
+		assert.Equal(t, "ops", rec.Body.String())
+	})
+}
+
+// issue creates a certificate for name signed by parent, or self-signed when parent is nil, and returns it along with
+// its key.
+func issue(t *testing.T, name string, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	if parent == nil {
+		tmpl.IsCA = true
+		tmpl.BasicConstraintsValid = true
+		tmpl.KeyUsage = x509.KeyUsageCertSign
+		parent, parentKey = tmpl, key
+	}
+
+	raw, err := x509.CreateCertificate(rand.Reader, tmpl, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert, key
+}
+
+func TestAuthenticateClientCert(t *testing.T) {
+	ca, caKey := issue(t, "ca", nil, nil)
+	clientCAs := x509.NewCertPool()
+	clientCAs.AddCert(ca)
+
+	srv := httptest.NewUnstartedServer(newApp(map[string]string{"secret": "ci"}, map[string]string{"ops.internal": "ops"}))
+	srv.TLS = &tls.Config{ClientCAs: clientCAs, ClientAuth: tls.VerifyClientCertIfGiven}
+	srv.StartTLS()
+	defer srv.Close()
+
+	// request deletes /admin over a new connection, presenting the certificate for name when it is set.
+	request := func(t *testing.T, name, key string) (int, string) {
+		t.Helper()
+		tr := srv.Client().Transport.(*http.Transport).Clone()
+		tr.DisableKeepAlives = true
+		if name != "" {
+			cert, certKey := issue(t, name, ca, caKey)
+			tr.TLSClientConfig.Certificates = []tls.Certificate{{Certificate: [][]byte{cert.Raw}, PrivateKey: certKey}}
+		}
+
+		req, err := http.NewRequest(http.MethodDelete, srv.URL+"/admin", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if key != "" {
+			req.Header.Set("X-API-Key", key)
+		}
+		resp, err := (&http.Client{Transport: tr}).Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+
+		body, err := io.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp.StatusCode, string(body)
+	}
+
+	tt := []struct {
+		name   string
+		cert   string
+		key    string
+		status int
+		actor  string
+	}{
+		{name: "the subject is mapped to its identity", cert: "ops.internal", status: http.StatusOK, actor: "ops"},
+		{name: "the certificate wins over the key", cert: "ops.internal", key: "secret", status: http.StatusOK, actor: "ops"},
+		{name: "an unknown subject is refused", cert: "dev.internal", status: http.StatusUnauthorized},
+		{name: "an unknown subject can use a key", cert: "dev.internal", key: "secret", status: http.StatusOK, actor: "ci"},
+		{name: "without a certificate the key is used", key: "secret", status: http.StatusOK, actor: "ci"},
+	}
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			status, body := request(t, tc.cert, tc.key)
+			assert.Equal(t, tc.status, status)
+			if tc.status == http.StatusOK {
+				assert.Equal(t, tc.actor, body)
+			}
+		})
+	}
+}
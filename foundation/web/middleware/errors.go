@@ -4,6 +4,8 @@ import (
 	"github.com/penthious/catchall/foundation/web"
 	webErr "github.com/penthious/catchall/foundation/web/errors"
 	"net/http"
+	"strconv"
+	"time"
 
 	"github.com/labstack/echo/v4"
 )
@@ -37,6 +39,14 @@ func Errors() echo.MiddlewareFunc {
 					}
 					status = reqErr.Status
 
+				case webErr.IsUnavailable(err):
+					u := webErr.GetUnavailable(err)
+					er = webErr.ErrorResponse{
+						Error: u.Error(),
+					}
+					status = http.StatusServiceUnavailable
+					ctx.Response().Header().Set("Retry-After", retryAfter(u.RetryAfter()))
+
 				default:
 					er = webErr.ErrorResponse{
 						Error: http.StatusText(http.StatusInternalServerError),
@@ -76,3 +86,12 @@ func Errors() echo.MiddlewareFunc {
 
 	return m
 }
+
+// retryAfter returns the duration in whole seconds, rounded up and at least one.
+func retryAfter(d time.Duration) string {
+	seconds := int64((d + time.Second - 1) / time.Second)
+	if seconds < 1 {
+		seconds = 1
+	}
+	return strconv.FormatInt(seconds, 10)
+}
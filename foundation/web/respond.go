@@ -20,6 +20,10 @@ func Respond(ctx echo.Context, statusCode int, data interface{}) error {
 		return ctx.NoContent(http.StatusCreated)
 	}
 
+	if statusCode == http.StatusAccepted && data == nil {
+		return ctx.NoContent(http.StatusAccepted)
+	}
+
 	if statusCode == http.StatusNotFound {
 		return ctx.NoContent(http.StatusNotFound)
 	}
@@ -0,0 +1,105 @@
+package web
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"os"
+	"sync/atomic"
+)
+
+// TLSConfig contains the files the server is served with over TLS.
+type TLSConfig struct {
+	CertFile string
+	KeyFile  string
+	// ClientCAFile is a PEM bundle of the CAs client certificates are verified against, leave empty to not ask for
+	// client certificates.
+	ClientCAFile string
+	// RequireClientCert refuses the connections without a client certificate, otherwise a client without one can
+	// still authenticate another way.
+	RequireClientCert bool
+}
+
+// Enabled reports whether a certificate is configured.
+func (c TLSConfig) Enabled() bool {
+	return c.CertFile != "" || c.KeyFile != ""
+}
+
+// certs is what a TLS handshake is made with, swapped as a whole on every reload.
+type certs struct {
+	cert      *tls.Certificate
+	clientCAs *x509.CertPool
+}
+
+// CertReloader serves TLS with the files of a TLSConfig, reading them again on Reload. Connections that were already
+// established keep going, only the handshakes after a reload use the new files.
+type CertReloader struct {
+	cfg     TLSConfig
+	current atomic.Pointer[certs]
+}
+
+// NewCertReloader reads the files of the config, which must have a certificate and key.
+func NewCertReloader(cfg TLSConfig) (*CertReloader, error) {
+	if cfg.CertFile == "" || cfg.KeyFile == "" {
+		return nil, errors.New("both a certificate and a key file are needed for TLS")
+	}
+
+	r := CertReloader{cfg: cfg}
+	if err := r.Reload(); err != nil {
+		return nil, err
+	}
+	return &r, nil
+}
+
+// Reload reads the files again. When any of them can't be read the files from before are kept.
+func (r *CertReloader) Reload() error {
+	cert, err := tls.LoadX509KeyPair(r.cfg.CertFile, r.cfg.KeyFile)
+	if err != nil {
+		return fmt.Errorf("loading certificate: %w", err)
+	}
+
+	c := certs{cert: &cert}
+	if r.cfg.ClientCAFile != "" {
+		pem, err := os.ReadFile(r.cfg.ClientCAFile)
+		if err != nil {
+			return fmt.Errorf("reading client CAs: %w", err)
+		}
+		c.clientCAs = x509.NewCertPool()
+		if !c.clientCAs.AppendCertsFromPEM(pem) {
+			return fmt.Errorf("no certificates found in %s", r.cfg.ClientCAFile)
+		}
+	}
+
+	r.current.Store(&c)
+	return nil
+}
+
+// Config returns the tls.Config to serve with, every handshake gets the files of the latest reload. h2 is offered
+// ahead of HTTP/1.1 so clients that support it negotiate it.
+func (r *CertReloader) Config() *tls.Config {
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		NextProtos: []string{"h2", "http/1.1"},
+		// http.Server only checks that there is a certificate, the handshakes use GetConfigForClient
+		GetCertificate: func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+			return r.current.Load().cert, nil
+		},
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			c := r.current.Load()
+			cfg := &tls.Config{
+				MinVersion:   tls.VersionTLS12,
+				NextProtos:   []string{"h2", "http/1.1"},
+				Certificates: []tls.Certificate{*c.cert},
+			}
+			if c.clientCAs != nil {
+				cfg.ClientCAs = c.clientCAs
+				cfg.ClientAuth = tls.VerifyClientCertIfGiven
+				if r.cfg.RequireClientCert {
+					cfg.ClientAuth = tls.RequireAndVerifyClientCert
+				}
+			}
+			return cfg, nil
+		},
+	}
+}
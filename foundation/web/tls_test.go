@@ -0,0 +1,214 @@
+package web
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// issue creates a certificate for name signed by parent, or self-signed when parent is nil, and returns it along with
+// its key.
+func issue(t *testing.T, name string, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		DNSNames:     []string{name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	if parent == nil {
+		tmpl.IsCA = true
+		tmpl.BasicConstraintsValid = true
+		tmpl.KeyUsage = x509.KeyUsageCertSign
+		parent, parentKey = tmpl, key
+	}
+
+	raw, err := x509.CreateCertificate(rand.Reader, tmpl, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert, key
+}
+
+func writePEM(t *testing.T, dir, name, kind string, der []byte) string {
+	t.Helper()
+	path := filepath.Join(dir, name)
+	if err := os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: kind, Bytes: der}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// writeKeyPair writes the certificate and key as PEM files into dir, replacing the files that are there.
+func writeKeyPair(t *testing.T, dir string, cert *x509.Certificate, key *ecdsa.PrivateKey) (string, string) {
+	t.Helper()
+	der, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return writePEM(t, dir, "cert.pem", "CERTIFICATE", cert.Raw), writePEM(t, dir, "key.pem", "EC PRIVATE KEY", der)
+}
+
+// serveTLS serves a handler answering with the common name of the verified client certificate, or nothing without
+// one, over TLS configured by the reloader.
+func serveTLS(t *testing.T, r *CertReloader) *httptest.Server {
+	t.Helper()
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if chains := req.TLS.VerifiedChains; len(chains) > 0 {
+			w.Write([]byte(chains[0][0].Subject.CommonName))
+		}
+	}))
+	srv.EnableHTTP2 = true
+	srv.TLS = r.Config()
+	srv.StartTLS()
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+// get requests the server over a new connection, trusting ca and presenting the client certificate when it is set. It
+// returns the body along with the response.
+func get(srv *httptest.Server, ca *x509.Certificate, client *tls.Certificate) (*http.Response, string, error) {
+	roots := x509.NewCertPool()
+	roots.AddCert(ca)
+	cfg := &tls.Config{RootCAs: roots, ServerName: "localhost"}
+	if client != nil {
+		// Presented whatever CAs the server asks for, the client would leave out a certificate of another CA otherwise.
+		cfg.GetClientCertificate = func(*tls.CertificateRequestInfo) (*tls.Certificate, error) { return client, nil }
+	}
+
+	c := http.Client{Transport: &http.Transport{TLSClientConfig: cfg, ForceAttemptHTTP2: true, DisableKeepAlives: true}}
+	resp, err := c.Get(srv.URL)
+	if err != nil {
+		return nil, "", err
+	}
+	defer resp.Body.Close()
+
+	var body [64]byte
+	n, _ := resp.Body.Read(body[:])
+	return resp, string(body[:n]), nil
+}
+
+func keyPair(cert *x509.Certificate, key *ecdsa.PrivateKey) *tls.Certificate {
+	return &tls.Certificate{Certificate: [][]byte{cert.Raw}, PrivateKey: key, Leaf: cert}
+}
+
+func TestCertReloader(t *testing.T) {
+	dir := t.TempDir()
+	ca, caKey := issue(t, "ca", nil, nil)
+	first, firstKey := issue(t, "localhost", ca, caKey)
+	certFile, keyFile := writeKeyPair(t, dir, first, firstKey)
+
+	r, err := NewCertReloader(TLSConfig{CertFile: certFile, KeyFile: keyFile})
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := serveTLS(t, r)
+
+	resp, _, err := get(srv, ca, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, 2, resp.ProtoMajor, "h2 is negotiated")
+	assert.Equal(t, first.SerialNumber, resp.TLS.PeerCertificates[0].SerialNumber)
+
+	t.Run("the new files are served after a reload", func(t *testing.T) {
+		second, secondKey := issue(t, "localhost", ca, caKey)
+		writeKeyPair(t, dir, second, secondKey)
+
+		resp, _, err := get(srv, ca, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, first.SerialNumber, resp.TLS.PeerCertificates[0].SerialNumber, "not before the reload")
+
+		if err := r.Reload(); err != nil {
+			t.Fatal(err)
+		}
+		resp, _, err = get(srv, ca, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, second.SerialNumber, resp.TLS.PeerCertificates[0].SerialNumber)
+	})
+
+	t.Run("broken files keep the previous ones", func(t *testing.T) {
+		if err := os.WriteFile(certFile, []byte("not a certificate"), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		assert.Error(t, r.Reload())
+
+		_, _, err := get(srv, ca, nil)
+		assert.NoError(t, err)
+	})
+}
+
+func TestCertReloaderClientCerts(t *testing.T) {
+	dir := t.TempDir()
+	ca, caKey := issue(t, "ca", nil, nil)
+	server, serverKey := issue(t, "localhost", ca, caKey)
+	certFile, keyFile := writeKeyPair(t, dir, server, serverKey)
+
+	clientCA, clientCAKey := issue(t, "client ca", nil, nil)
+	caFile := writePEM(t, dir, "client-ca.pem", "CERTIFICATE", clientCA.Raw)
+	client, clientKey := issue(t, "ops.internal", clientCA, clientCAKey)
+	otherCA, otherCAKey := issue(t, "other ca", nil, nil)
+	other, otherKey := issue(t, "ops.internal", otherCA, otherCAKey)
+	verified, unverified := keyPair(client, clientKey), keyPair(other, otherKey)
+
+	tt := []struct {
+		name    string
+		require bool
+		client  *tls.Certificate
+		subject string
+		refused bool
+	}{
+		{name: "a certificate from the client CAs is verified", client: verified, subject: "ops.internal"},
+		{name: "a certificate from another CA is refused", client: unverified, refused: true},
+		{name: "no certificate is let through", subject: ""},
+		{name: "no certificate is refused when required", require: true, refused: true},
+		{name: "a certificate is verified when required", require: true, client: verified, subject: "ops.internal"},
+	}
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg := TLSConfig{CertFile: certFile, KeyFile: keyFile, ClientCAFile: caFile, RequireClientCert: tc.require}
+			r, err := NewCertReloader(cfg)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			_, subject, err := get(serveTLS(t, r), ca, tc.client)
+			if tc.refused {
+				assert.Error(t, err)
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			assert.Equal(t, tc.subject, subject)
+		})
+	}
+}
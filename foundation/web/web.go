@@ -35,6 +35,11 @@ func NewApp(serviceName string, shutdown chan os.Signal, log *zerolog.Logger, mw
 	}
 }
 
+// Log returns the logger of the app.
+func (a *App) Log() *zerolog.Logger {
+	return a.log
+}
+
 // SignalShutdown is used to gracefully shut down the app when an integrity
 // issue is identified.
 func (a *App) SignalShutdown() {
@@ -62,7 +67,7 @@ func (a *App) Handle(method string, group string, path string, handler echo.Hand
 	// The function to execute for each request.
 	h := func(ctx echo.Context) error {
 
-		ctx.Set(ctxKey, &Values{Now: time.Now().UTC(), TraceID: uuid.New(), Log: a.log})
+		SetValues(ctx, &Values{Now: time.Now().UTC(), TraceID: uuid.New(), Log: a.log})
 
 		// Call the wrapped handler functions.
 		if err := handler(ctx); err != nil {